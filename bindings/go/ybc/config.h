@@ -77,6 +77,15 @@
  */
 #define C_WS_MAX_MOVABLE_ITEM_SIZE (64 * 1024)
 
+/*
+ * The number of times the map is swept for evicted items per storage wrap.
+ *
+ * Higher values reduce the delay between items' eviction and counting
+ * at the cost of higher CPU overhead on item allocations.
+ * See m_evictions_sweep() for details.
+ */
+#define C_EVICTIONS_SWEEPS_PER_WRAP 2
+
 /*
  * The probability of item defragmentation if it lays outside of hot data space.
  *
@@ -126,4 +135,12 @@
 
 #define C_CLUSTER_INITIAL_HASH_SEED 0xDEADBEEFDEADBEEF
 
+/*
+ * Hash seed mask for caches with enabled items' checksums.
+ *
+ * Items stored with and without checksums have distinct key digests, so caches
+ * opened with distinct checksums' settings never see each other's items.
+ */
+#define C_CHECKSUMS_HASH_SEED_MASK 0x5EED5EED5EED5EED
+
 #endif  /* YBC_CONFIG_H_INCLUDED */
@@ -0,0 +1,320 @@
+package ybc
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+)
+
+/*******************************************************************************
+ * EncryptedCache
+ ******************************************************************************/
+
+// Cache with contents encrypted at rest.
+//
+// The cache is held in anonymous memory, while its' contents are persisted
+// to Config.DataFile encrypted with AES-GCM. The file contains the whole
+// cache including keys, values and expiration times, so nothing stored
+// in the cache is written to disk in plaintext.
+//
+// The contents are persisted only on EncryptedCache.Sync()
+// and EncryptedCache.Close() calls. Config.SyncInterval is ignored, so items
+// stored after the last Sync() call are lost after the program crash.
+//
+// EncryptedCache provides all the Cache methods, so it may be passed
+// to memcache.Server.
+type EncryptedCache struct {
+	*Cache
+
+	file string
+	key  []byte
+	cg   cacheGuard
+
+	// Serializes writes to the file.
+	syncMutex sync.Mutex
+}
+
+// Encrypted files start with this header followed by a random salt
+// and a sequence of encrypted chunks containing the cache snapshot
+// written by Cache.SnapshotTo().
+//
+// Each chunk is encrypted with a key derived from the salt, so chunk numbers
+// may be used as nonces. The last chunk is authenticated as the last one,
+// so truncated files are detected.
+var encryptedFileHeader = []byte("ybc-encrypted-v1\n")
+
+const (
+	encryptedFileSaltSize  = 32
+	encryptedFileChunkSize = 64 * 1024
+)
+
+// Opens EncryptedCache with contents stored in cfg.DataFile.
+//
+// The key must be 16, 24 or 32 bytes long for AES-128, AES-192 or AES-256
+// encryption. Use the same key for opening the cache after application
+// restarts.
+//
+// cfg.IndexFile must be empty, since the index is rebuilt from the data file
+// on open. Read-only mode isn't supported.
+//
+// If force is true, then creates the cache if cfg.DataFile is missing instead
+// of returning ErrOpenFailed. Returns ErrDecryptFailed if cfg.DataFile
+// is encrypted with a distinct key or is corrupted.
+//
+// Do not open the same cache more than once at the same time!
+//
+// The returned cache must be closed with cache.Close() call!
+func (cfg *Config) OpenEncryptedCache(key []byte, force bool) (ec *EncryptedCache, err error) {
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		err = aes.KeySizeError(len(key))
+		return
+	}
+	if cfg.DataFile == "" || cfg.IndexFile != "" || cfg.ReadOnly {
+		err = ErrOpenFailed
+		return
+	}
+
+	ec = &EncryptedCache{
+		file: cfg.DataFile,
+		key:  append([]byte{}, key...),
+	}
+	ec.cg.SetDataFile(ec.file)
+	ec.cg.Acquire()
+	defer func() {
+		if err != nil {
+			ec.cg.Release()
+			ec = nil
+		}
+	}()
+
+	// Anonymous caches have no files to fix, so force is always set.
+	memCfg := *cfg
+	memCfg.DataFile = ""
+	if ec.Cache, err = memCfg.OpenCache(true); err != nil {
+		return
+	}
+	if err = ec.load(force); err != nil {
+		ec.Cache.Close()
+	}
+	return
+}
+
+// Writes the cache contents to the encrypted file.
+//
+// The file is replaced atomically, so it contains either old or new
+// contents if the program crashes during the call. Items added, updated
+// or removed during the call may be missing in the file.
+func (ec *EncryptedCache) Sync() error {
+	ec.syncMutex.Lock()
+	defer ec.syncMutex.Unlock()
+
+	tmpFile := ec.file + ".tmp"
+	f, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = ec.writeEncrypted(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile, ec.file)
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+	}
+	return err
+}
+
+// Writes the cache contents to the encrypted file and closes the cache.
+//
+// The cache is closed even if the contents cannot be written.
+//
+// Do not close the same cache more than once!
+func (ec *EncryptedCache) Close() error {
+	err := ec.Sync()
+	ec.Cache.Close()
+	ec.cg.Release()
+	return err
+}
+
+func (ec *EncryptedCache) writeEncrypted(w io.Writer) error {
+	var salt [encryptedFileSaltSize]byte
+	if _, err := io.ReadFull(rand.Reader, salt[:]); err != nil {
+		return err
+	}
+	aead, err := ec.newAEAD(salt[:])
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	bw.Write(encryptedFileHeader)
+	bw.Write(salt[:])
+	cw := &chunkWriter{
+		w:    bw,
+		aead: aead,
+		buf:  make([]byte, 0, encryptedFileChunkSize),
+	}
+	if err = ec.SnapshotTo(cw); err != nil {
+		return err
+	}
+	if err = cw.Close(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func (ec *EncryptedCache) load(force bool) error {
+	f, err := os.Open(ec.file)
+	if os.IsNotExist(err) && force {
+		return nil
+	}
+	if err != nil {
+		return ErrOpenFailed
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	header := make([]byte, len(encryptedFileHeader)+encryptedFileSaltSize)
+	if _, err = io.ReadFull(br, header); err != nil || !bytes.HasPrefix(header, encryptedFileHeader) {
+		return ErrDecryptFailed
+	}
+	aead, err := ec.newAEAD(header[len(encryptedFileHeader):])
+	if err != nil {
+		return err
+	}
+	cr := &chunkReader{
+		r:    br,
+		aead: aead,
+		buf:  make([]byte, encryptedFileChunkSize+aead.Overhead()),
+	}
+	if err = ec.RestoreFrom(cr); err != nil {
+		if cr.err != nil || err == ErrInvalidSnapshot {
+			return ErrDecryptFailed
+		}
+		return err
+	}
+	return nil
+}
+
+// Returns AES-GCM for chunks of the file with the given salt.
+func (ec *EncryptedCache) newAEAD(salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, ec.key)
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil)[:len(ec.key)])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypts chunks written to the encrypted file.
+type chunkWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	buf    []byte
+	sealed []byte
+	n      uint64
+}
+
+func (cw *chunkWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		if len(cw.buf) == cap(cw.buf) {
+			if err = cw.writeChunk(false); err != nil {
+				return
+			}
+		}
+		m := copy(cw.buf[len(cw.buf):cap(cw.buf)], p)
+		cw.buf = cw.buf[:len(cw.buf)+m]
+		p = p[m:]
+		n += m
+	}
+	return
+}
+
+// Writes the last chunk.
+func (cw *chunkWriter) Close() error {
+	return cw.writeChunk(true)
+}
+
+func (cw *chunkWriter) writeChunk(isLast bool) error {
+	cw.sealed = cw.aead.Seal(cw.sealed[:0], chunkNonce(cw.aead, cw.n), cw.buf, chunkAdditionalData(isLast))
+	cw.buf = cw.buf[:0]
+	cw.n++
+	_, err := cw.w.Write(cw.sealed)
+	return err
+}
+
+// Decrypts chunks read from the encrypted file.
+type chunkReader struct {
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	buf   []byte
+	plain []byte
+	n     uint64
+	done  bool
+
+	// Non-nil if the file cannot be decrypted.
+	err error
+}
+
+func (cr *chunkReader) Read(p []byte) (n int, err error) {
+	for len(cr.plain) == 0 {
+		if cr.err != nil {
+			return 0, cr.err
+		}
+		if cr.done {
+			return 0, io.EOF
+		}
+		cr.err = cr.readChunk()
+	}
+	n = copy(p, cr.plain)
+	cr.plain = cr.plain[n:]
+	return
+}
+
+func (cr *chunkReader) readChunk() error {
+	n, err := io.ReadFull(cr.r, cr.buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return ErrDecryptFailed
+	}
+	isLast := err == io.ErrUnexpectedEOF
+	if !isLast {
+		if _, err = cr.r.Peek(1); err == io.EOF {
+			isLast = true
+		}
+	}
+	cr.plain, err = cr.aead.Open(cr.buf[:0], chunkNonce(cr.aead, cr.n), cr.buf[:n], chunkAdditionalData(isLast))
+	if err != nil {
+		return ErrDecryptFailed
+	}
+	cr.n++
+	cr.done = isLast
+	return nil
+}
+
+func chunkNonce(aead cipher.AEAD, n uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], n)
+	return nonce
+}
+
+func chunkAdditionalData(isLast bool) []byte {
+	if isLast {
+		return []byte{1}
+	}
+	return []byte{0}
+}
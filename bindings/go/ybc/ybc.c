@@ -5,7 +5,7 @@
 #include <assert.h>  /* assert */
 #include <stddef.h>  /* size_t */
 #include <stdint.h>  /* uint*_t */
-#include <stdlib.h>  /* rand */
+#include <stdlib.h>  /* qsort, rand */
 #include <string.h>  /* memcpy, memcmp, memset */
 
 
@@ -87,16 +87,21 @@ static void m_file_remove_if_exists(const char *const filename)
  * If filename is NULL and force is set, then creates an anonymous file,
  * which will be automatically deleted after the file is closed.
  *
+ * If is_read_only is set, then the file is opened only for reading.
+ * Force mustn't be set in this case.
+ *
  * Returns non-zero on success, zero on failre.
  * Sets is_file_created to 1 if new file has been created (including
  * anonymous file).
  */
 static int m_file_open_or_create(struct p_file *const file,
     const char *const filename, const size_t expected_file_size,
-    const int force, int *const is_file_created)
+    const int force, const int is_read_only, int *const is_file_created)
 {
   size_t actual_file_size;
 
+  assert(!force || !is_read_only);
+
   *is_file_created = 0;
 
   if (filename == NULL) {
@@ -128,7 +133,7 @@ static int m_file_open_or_create(struct p_file *const file,
     *is_file_created = 1;
   }
   else {
-    p_file_open(file, filename);
+    p_file_open(file, filename, is_read_only);
   }
 
   p_file_get_size(file, &actual_file_size);
@@ -413,12 +418,13 @@ static void m_storage_fix_size(size_t *const size)
 
 static int m_storage_open(struct m_storage *const storage,
     struct p_file *const storage_file,
-    const char *const filename, const int force, int *const is_file_created)
+    const char *const filename, const int force, const int is_read_only,
+    int *const is_file_created)
 {
   void *ptr;
 
   if (!m_file_open_or_create(storage_file, filename, storage->size, force,
-      is_file_created)) {
+      is_read_only, is_file_created)) {
     return 0;
   }
 
@@ -428,7 +434,7 @@ static int m_storage_open(struct m_storage *const storage,
    * caching.
    */
 
-  p_memory_map(&ptr, storage_file, storage->size);
+  p_memory_map(&ptr, storage_file, storage->size, is_read_only);
   assert((uintptr_t)storage->size <= UINTPTR_MAX - (uintptr_t)ptr);
 
   storage->data = ptr;
@@ -632,6 +638,36 @@ static int m_storage_payload_check(const struct m_storage *const storage,
   return 1;
 }
 
+/*
+ * Returns the distance in bytes, which the next_cursor located
+ * at the base_cursor must pass in order to reach the given cursor.
+ *
+ * The cursor must point either to a valid payload or to the space allocated
+ * after the base_cursor.
+ */
+static size_t m_storage_get_distance(const struct m_storage *const storage,
+    const struct m_storage_cursor *const base_cursor,
+    const struct m_storage_cursor *const cursor)
+{
+  if (cursor->wrap_count == base_cursor->wrap_count - 1 ||
+      (cursor->wrap_count == base_cursor->wrap_count &&
+          cursor->offset >= base_cursor->offset)) {
+    return cursor->offset - base_cursor->offset;
+  }
+  return storage->size - base_cursor->offset + cursor->offset;
+}
+
+/*
+ * Returns non-zero if the given cursor a points to the location written
+ * before the location pointed by the cursor b.
+ */
+static int m_storage_cursor_less(const struct m_storage_cursor *const a,
+    const struct m_storage_cursor *const b)
+{
+  return a->wrap_count < b->wrap_count ||
+      (a->wrap_count == b->wrap_count && a->offset < b->offset);
+}
+
 static size_t m_storage_metadata_get_size(const size_t key_size) {
   /*
    * Payload metadata contains the following fields:
@@ -760,28 +796,6 @@ static void m_ws_fix_hot_data_size(size_t *const hot_data_size,
   }
 }
 
-/*
- * Defragments the given item, i.e. moves it into the front of storage's
- * free space.
- *
- * There is a race condition possible when another thread adds new item
- * with the given key before the defragmentation for this item is complete.
- * In this case new item will become overwritten by the old item after
- * the defragmentation is complete. But since this is a cache, not a persistent
- * storage, this should be OK - subsequent readers should notice old value
- * and overwrite it with new value.
- *
- * Since this operation can be quite costly, avoid performing it in hot paths.
- */
-static void m_ws_defragment(struct ybc *const cache,
-    const struct ybc_item *const item, const struct ybc_key *const key)
-{
-  struct ybc_value value;
-
-  ybc_item_get_value(item, &value);
-  (void)ybc_item_set(cache, key, &value);
-}
-
 /*
  * Checks whether the item pointed by the given payload should be defragmented.
  *
@@ -1286,15 +1300,15 @@ static size_t m_index_get_file_size(const size_t slots_count)
 static int m_index_open(struct m_index *const index,
     struct p_file *const index_file,
     const size_t map_slots_count, const size_t map_cache_slots_count,
-    const char *const filename, const int force, int *const is_file_created,
-    struct m_storage_cursor **const next_cursor)
+    const char *const filename, const int force, const int is_read_only,
+    int *const is_file_created, struct m_storage_cursor **const next_cursor)
 {
   void *ptr;
 
   const size_t file_size = m_index_get_file_size(map_slots_count);
 
   if (!m_file_open_or_create(index_file, filename, file_size, force,
-      is_file_created)) {
+      is_read_only, is_file_created)) {
     return 0;
   }
 
@@ -1317,7 +1331,7 @@ static int m_index_open(struct m_index *const index,
    */
   p_file_advise_random_access(index_file, file_size);
 
-  p_memory_map(&ptr, index_file, file_size);
+  p_memory_map(&ptr, index_file, file_size, is_read_only);
   assert((uintptr_t)file_size <= UINTPTR_MAX - (uintptr_t)ptr);
 
   /*
@@ -1760,6 +1774,10 @@ struct ybc_config
   size_t de_hashtable_size;
   uint64_t sync_interval;
   int has_overwrite_protection;
+  int has_checksums;
+  int is_read_only;
+  int has_huge_pages;
+  int is_locked_in_ram;
 };
 
 size_t ybc_config_get_size(void)
@@ -1778,6 +1796,10 @@ void ybc_config_init(struct ybc_config *const config)
   config->de_hashtable_size = C_CONFIG_DEFAULT_DE_HASHTABLE_SIZE;
   config->sync_interval = C_CONFIG_DEFAULT_SYNC_INTERVAL;
   config->has_overwrite_protection = 1;
+  config->has_checksums = 0;
+  config->is_read_only = 0;
+  config->has_huge_pages = 0;
+  config->is_locked_in_ram = 0;
 }
 
 void ybc_config_destroy(struct ybc_config *const config)
@@ -1843,6 +1865,26 @@ void ybc_config_disable_overwrite_protection(struct ybc_config *const config)
   config->has_overwrite_protection = 0;
 }
 
+void ybc_config_enable_checksums(struct ybc_config *const config)
+{
+  config->has_checksums = 1;
+}
+
+void ybc_config_enable_read_only(struct ybc_config *const config)
+{
+  config->is_read_only = 1;
+}
+
+void ybc_config_enable_huge_pages(struct ybc_config *const config)
+{
+  config->has_huge_pages = 1;
+}
+
+void ybc_config_enable_lock_in_ram(struct ybc_config *const config)
+{
+  config->is_locked_in_ram = 1;
+}
+
 
 /*******************************************************************************
  * Cache management API
@@ -1861,8 +1903,94 @@ struct ybc
   struct ybc_item acquired_items_tail;
   size_t hot_data_size;
   int has_overwrite_protection;
+  int has_checksums;
+  int is_read_only;
+
+  /*
+   * The number of live items evicted from the storage by new items
+   * since the cache has been opened. See m_evictions_sweep().
+   */
+  size_t evictions_count;
+
+  /*
+   * The index of the next map slot to be checked by m_evictions_sweep().
+   */
+  size_t evictions_sweep_index;
+
+  /*
+   * Items stored before this location aren't counted as evicted, since
+   * they may belong to the previous cache generation. See ybc_clear().
+   */
+  struct m_storage_cursor evictions_base_cursor;
 };
 
+/*
+ * Returns hash seed for the cache from the hash seed stored in the index.
+ */
+static uint64_t m_get_hash_seed(const struct ybc *const cache)
+{
+  const uint64_t hash_seed = *cache->index.hash_seed_ptr;
+
+  return cache->has_checksums ? (hash_seed ^ C_CHECKSUMS_HASH_SEED_MASK) :
+      hash_seed;
+}
+
+/*
+ * Counts live items overwritten in the storage by new items.
+ *
+ * Overwritten items remain in the map until their slots are reused, so they
+ * cannot be counted at allocation time without scanning the whole map.
+ * Instead the map is swept incrementally on each allocation. The number
+ * of checked slots is proportional to the allocated size, so the whole map
+ * is swept C_EVICTIONS_SWEEPS_PER_WRAP times per storage wrap. Slots
+ * of evicted items are cleared, so each item is counted only once.
+ *
+ * Evicted items, which expire before the sweep reaches them, aren't counted.
+ *
+ * Must be called under cache->lock, so next_cursor cannot be moved
+ * and the map cannot be updated during the sweep. The sweep runs
+ * in ybc_set_txn_begin() under the lock already held for the allocation,
+ * so it doesn't serialize commits.
+ */
+static void m_evictions_sweep(struct ybc *const cache,
+    const size_t allocated_size, const uint64_t current_time)
+{
+  const struct m_map *const map = &cache->index.map;
+  const struct m_storage *const storage = &cache->storage;
+
+  const double sweep_ratio = (double)allocated_size / storage->size *
+      C_EVICTIONS_SWEEPS_PER_WRAP;
+  size_t n = (size_t)(sweep_ratio * map->slots_count) + 1;
+  if (n > map->slots_count) {
+    n = map->slots_count;
+  }
+
+  size_t slot_index = cache->evictions_sweep_index;
+  while (n-- > 0) {
+    const struct m_key_digest key_digest = map->key_digests[slot_index];
+    const struct m_storage_payload payload = map->payloads[slot_index];
+
+    if (!m_key_digest_is_empty(&key_digest) &&
+        payload.expiration_time >= current_time &&
+        !m_storage_cursor_less(&payload.cursor,
+            &cache->evictions_base_cursor) &&
+        !m_storage_payload_check(storage, storage->next_cursor, &payload,
+            current_time)) {
+      /*
+       * The map is updated only under cache->lock, so the slot cannot be
+       * concurrently reused by another item.
+       */
+      m_key_digest_clear(&map->key_digests[slot_index]);
+      ++cache->evictions_count;
+    }
+
+    if (++slot_index == map->slots_count) {
+      slot_index = 0;
+    }
+  }
+  cache->evictions_sweep_index = slot_index;
+}
+
 static int m_open(struct ybc *const cache,
     const struct ybc_config *const config, const int force)
 {
@@ -1872,6 +2000,8 @@ static int m_open(struct ybc *const cache,
   p_memory_init();
 
   cache->has_overwrite_protection = config->has_overwrite_protection;
+  cache->has_checksums = config->has_checksums;
+  cache->is_read_only = config->is_read_only;
   cache->storage.size = config->data_file_size;
   m_storage_fix_size(&cache->storage.size);
 
@@ -1881,21 +2011,55 @@ static int m_open(struct ybc *const cache,
   size_t map_cache_slots_count = config->map_cache_slots_count;
   m_map_cache_fix_slots_count(&map_cache_slots_count, map_slots_count);
 
+  /*
+   * Files opened in read-only mode can be neither created nor resized.
+   */
+  const int is_read_only = cache->is_read_only;
+  const int force_open = force && !is_read_only;
+
   if (!m_index_open(&cache->index, &cache->index_file, map_slots_count,
-      map_cache_slots_count, config->index_file, force, &is_index_file_created,
-      &next_cursor)) {
+      map_cache_slots_count, config->index_file, force_open, is_read_only,
+      &is_index_file_created, &next_cursor)) {
     return 0;
   }
   if (next_cursor->offset > cache->storage.size) {
+    if (is_read_only) {
+      /* The index file is corrupted and it cannot be fixed. */
+      m_index_close(&cache->index, &cache->index_file);
+      return 0;
+    }
     next_cursor->offset = 0;
   }
 
   cache->storage.next_cursor = next_cursor;
-  cache->storage.hash_seed = *cache->index.hash_seed_ptr;
+  cache->storage.hash_seed = m_get_hash_seed(cache);
+
+  cache->evictions_count = 0;
+  cache->evictions_sweep_index = 0;
+  cache->evictions_base_cursor = *next_cursor;
 
   if (!m_storage_open(&cache->storage, &cache->storage_file, config->data_file,
-      force, &is_storage_file_created)) {
+      force_open, is_read_only, &is_storage_file_created)) {
+    m_index_close(&cache->index, &cache->index_file);
+    if (is_index_file_created) {
+      m_file_remove_if_exists(config->index_file);
+    }
+    return 0;
+  }
+
+  const size_t index_file_size = m_index_get_file_size(map_slots_count);
+  if (config->has_huge_pages) {
+    p_memory_advise_huge_pages(cache->index.map.key_digests, index_file_size);
+    p_memory_advise_huge_pages(cache->storage.data, cache->storage.size);
+  }
+  if (config->is_locked_in_ram &&
+      (!p_memory_lock(cache->index.map.key_digests, index_file_size) ||
+      !p_memory_lock(cache->storage.data, cache->storage.size))) {
+    m_storage_close(&cache->storage, &cache->storage_file);
     m_index_close(&cache->index, &cache->index_file);
+    if (is_storage_file_created) {
+      m_file_remove_if_exists(config->data_file);
+    }
     if (is_index_file_created) {
       m_file_remove_if_exists(config->index_file);
     }
@@ -1911,12 +2075,19 @@ static int m_open(struct ybc *const cache,
    */
   p_lock_init(&cache->lock);
 
-  m_sync_init(&cache->sc, config->sync_interval, *cache->storage.next_cursor, &cache->storage,
+  /*
+   * Read-only caches have nothing to sync.
+   */
+  const uint64_t sync_interval = is_read_only ? 0 : config->sync_interval;
+  m_sync_init(&cache->sc, sync_interval, *cache->storage.next_cursor, &cache->storage,
       &cache->acquired_items_head, &cache->lock,
       cache->has_overwrite_protection);
   m_de_init(&cache->de, config->de_hashtable_size);
 
-  cache->hot_data_size = config->hot_data_size;
+  /*
+   * Read-only caches cannot defragment items.
+   */
+  cache->hot_data_size = is_read_only ? 0 : config->hot_data_size;
   m_ws_fix_hot_data_size(&cache->hot_data_size, cache->storage.size);
 
   return 1;
@@ -1959,12 +2130,20 @@ void ybc_close(struct ybc *const cache)
 
 void ybc_clear(struct ybc *const cache)
 {
+  if (cache->is_read_only) {
+    return;
+  }
+
   /*
    * New hash seed automatically invalidates all the items stored in the cache.
    */
 
-  ++cache->storage.hash_seed;
-  *cache->index.hash_seed_ptr = cache->storage.hash_seed;
+  ++*cache->index.hash_seed_ptr;
+  cache->storage.hash_seed = m_get_hash_seed(cache);
+
+  p_lock_lock(&cache->lock);
+  cache->evictions_base_cursor = *cache->storage.next_cursor;
+  p_lock_unlock(&cache->lock);
 }
 
 void ybc_remove(const struct ybc_config *const config)
@@ -1984,6 +2163,14 @@ struct ybc_set_txn
   struct ybc_item item;
 };
 
+/*
+ * Returns the size of the checksum stored in the end of item's payload.
+ */
+static size_t m_item_get_checksum_size(const struct ybc_item *const item)
+{
+  return item->cache->has_checksums ? sizeof(uint64_t) : 0;
+}
+
 static size_t m_item_get_offset(const struct ybc_item *const item)
 {
   const size_t metadata_size = m_storage_metadata_get_size(item->key_size);
@@ -1996,8 +2183,9 @@ static size_t m_item_get_offset(const struct ybc_item *const item)
 static size_t m_item_get_size(const struct ybc_item *const item)
 {
   const size_t metadata_size = m_storage_metadata_get_size(item->key_size);
-  assert(item->payload.size >= metadata_size);
-  return item->payload.size - metadata_size;
+  const size_t checksum_size = m_item_get_checksum_size(item);
+  assert(item->payload.size >= metadata_size + checksum_size);
+  return item->payload.size - metadata_size - checksum_size;
 }
 
 static void *m_item_get_value_ptr(const struct ybc_item *const item)
@@ -2006,6 +2194,44 @@ static void *m_item_get_value_ptr(const struct ybc_item *const item)
   return m_storage_get_ptr(&item->cache->storage, offset);
 }
 
+static uint64_t m_item_get_checksum(const struct ybc_item *const item)
+{
+  return m_hash_get(0, m_item_get_value_ptr(item), m_item_get_size(item));
+}
+
+/*
+ * Stores the checksum for item's value if checksums are enabled.
+ *
+ * Must be called after the value is written.
+ */
+static void m_item_save_checksum(const struct ybc_item *const item)
+{
+  if (!item->cache->has_checksums) {
+    return;
+  }
+
+  const uint64_t checksum = m_item_get_checksum(item);
+  char *const ptr = m_item_get_value_ptr(item);
+  memcpy(ptr + m_item_get_size(item), &checksum, sizeof(checksum));
+}
+
+/*
+ * Verifies the checksum for item's value if checksums are enabled.
+ *
+ * Returns non-zero on successful check, zero on failure.
+ */
+static int m_item_checksum_check(const struct ybc_item *const item)
+{
+  if (!item->cache->has_checksums) {
+    return 1;
+  }
+
+  uint64_t checksum;
+  const char *const ptr = m_item_get_value_ptr(item);
+  memcpy(&checksum, ptr + m_item_get_size(item), sizeof(checksum));
+  return checksum == m_item_get_checksum(item);
+}
+
 static uint64_t m_item_get_ttl(const struct ybc_item *const item)
 {
   const uint64_t current_time = p_get_current_time();
@@ -2061,6 +2287,10 @@ int ybc_set_txn_begin(struct ybc *const cache, struct ybc_set_txn *const txn,
     const struct ybc_key *const key, const size_t value_size,
     const uint64_t ttl)
 {
+  if (cache->is_read_only) {
+    return 0;
+  }
+
   if (value_size > SIZE_MAX - key->size) {
     return 0;
   }
@@ -2072,8 +2302,11 @@ int ybc_set_txn_begin(struct ybc *const cache, struct ybc_set_txn *const txn,
   txn->item.is_set_txn = 1;
 
   const size_t metadata_size = m_storage_metadata_get_size(key->size);
-  assert(value_size <= SIZE_MAX - metadata_size);
-  txn->item.payload.size = metadata_size + value_size;
+  const size_t checksum_size = m_item_get_checksum_size(&txn->item);
+  if (value_size > SIZE_MAX - metadata_size - checksum_size) {
+    return 0;
+  }
+  txn->item.payload.size = metadata_size + value_size + checksum_size;
 
   const uint64_t current_time = p_get_current_time();
   txn->item.payload.expiration_time = (ttl > UINT64_MAX - current_time) ?
@@ -2082,6 +2315,9 @@ int ybc_set_txn_begin(struct ybc *const cache, struct ybc_set_txn *const txn,
   p_lock_lock(&cache->lock);
   int is_success = m_storage_allocate(&cache->storage,
       &cache->acquired_items_head, &txn->item, cache->has_overwrite_protection);
+  if (is_success) {
+    m_evictions_sweep(cache, txn->item.payload.size, current_time);
+  }
   p_lock_unlock(&cache->lock);
 
   if (!is_success) {
@@ -2098,12 +2334,13 @@ void ybc_set_txn_update_value_size(struct ybc_set_txn *const txn,
 {
   const size_t key_size = txn->item.key_size;
   const size_t metadata_size = m_storage_metadata_get_size(key_size);
+  const size_t checksum_size = m_item_get_checksum_size(&txn->item);
   struct m_storage_payload *const payload = &txn->item.payload;
 
-  assert(payload->size >= metadata_size);
-  assert(value_size <= payload->size - metadata_size);
+  assert(payload->size >= metadata_size + checksum_size);
+  assert(value_size <= payload->size - metadata_size - checksum_size);
   const size_t old_payload_size = payload->size;
-  payload->size = metadata_size + value_size;
+  payload->size = metadata_size + value_size + checksum_size;
 
   struct ybc *const cache = txn->item.cache;
 
@@ -2124,8 +2361,16 @@ void ybc_set_txn_commit(struct ybc_set_txn *const txn)
 {
   struct ybc *const cache = txn->item.cache;
 
+  m_item_save_checksum(&txn->item);
+
+  /*
+   * The map is updated under the cache lock, so ybc_set_txn_commit_if_*()
+   * calls remain atomic with respect to unconditional commits.
+   */
+  p_lock_lock(&cache->lock);
   m_map_cache_set(&cache->index.map, &cache->index.map_cache, &txn->key_digest,
       &txn->item.payload);
+  p_lock_unlock(&cache->lock);
 
   m_item_release(&txn->item);
 }
@@ -2135,10 +2380,11 @@ void ybc_set_txn_commit_item(struct ybc_set_txn *const txn,
 {
   struct ybc *const cache = txn->item.cache;
 
+  m_item_save_checksum(&txn->item);
+
+  p_lock_lock(&cache->lock);
   if (cache->has_overwrite_protection) {
-    p_lock_lock(&cache->lock);
     m_item_relocate(item, &txn->item);
-    p_lock_unlock(&cache->lock);
   } else {
     *item = txn->item;
   }
@@ -2146,6 +2392,110 @@ void ybc_set_txn_commit_item(struct ybc_set_txn *const txn,
 
   m_map_cache_set(&cache->index.map, &cache->index.map_cache, &txn->key_digest,
       &item->payload);
+  p_lock_unlock(&cache->lock);
+}
+
+/*
+ * Returns 1 if a valid item with the given key exists in the cache.
+ *
+ * Must be called under cache->lock, so next_cursor cannot be moved
+ * during the check.
+ */
+static int m_item_exists(struct ybc *const cache,
+    const struct ybc_key *const key,
+    const struct m_key_digest *const key_digest)
+{
+  struct m_storage_payload payload;
+
+  if (!m_map_cache_get(&cache->index.map, &cache->index.map_cache,
+      key_digest, &payload)) {
+    return 0;
+  }
+
+  const uint64_t current_time = p_get_current_time();
+  if (!m_storage_payload_check(&cache->storage, cache->storage.next_cursor,
+      &payload, current_time)) {
+    return 0;
+  }
+
+  return m_storage_metadata_check(&cache->storage, &payload, key);
+}
+
+int ybc_set_txn_commit_if_missing(struct ybc_set_txn *const txn)
+{
+  struct ybc *const cache = txn->item.cache;
+
+  m_item_save_checksum(&txn->item);
+
+  /*
+   * The key has been copied into item's metadata by ybc_set_txn_begin().
+   * The metadata starts with the digest.
+   */
+  const char *const metadata_ptr = m_storage_get_ptr(&cache->storage,
+      txn->item.payload.cursor.offset);
+  const struct ybc_key key = {
+    .ptr = metadata_ptr + sizeof(size_t),
+    .size = txn->item.key_size,
+  };
+
+  /*
+   * The check and the commit are performed under the cache lock, so only
+   * one of concurrent transactions for the same key may be commited.
+   */
+  p_lock_lock(&cache->lock);
+  const int exists = m_item_exists(cache, &key, &txn->key_digest);
+  if (!exists) {
+    m_map_cache_set(&cache->index.map, &cache->index.map_cache,
+        &txn->key_digest, &txn->item.payload);
+  }
+  p_lock_unlock(&cache->lock);
+
+  if (exists) {
+    ybc_set_txn_rollback(txn);
+    return 0;
+  }
+
+  m_item_release(&txn->item);
+  return 1;
+}
+
+int ybc_set_txn_commit_if_unchanged(struct ybc_set_txn *const txn,
+    const struct ybc_item *const item)
+{
+  struct ybc *const cache = txn->item.cache;
+  struct m_storage_payload payload;
+
+  assert(item->cache == cache);
+
+  m_item_save_checksum(&txn->item);
+
+  /*
+   * The check and the commit are performed under the cache lock, so only
+   * one of concurrent transactions based on the same item may be commited.
+   *
+   * The item is considered unchanged if the map still points to its' location
+   * in the storage. Expiration time isn't compared, so touched items remain
+   * unchanged.
+   */
+  p_lock_lock(&cache->lock);
+  const int is_unchanged = m_map_cache_get(&cache->index.map,
+      &cache->index.map_cache, &txn->key_digest, &payload) &&
+      payload.cursor.offset == item->payload.cursor.offset &&
+      payload.cursor.wrap_count == item->payload.cursor.wrap_count &&
+      payload.size == item->payload.size;
+  if (is_unchanged) {
+    m_map_cache_set(&cache->index.map, &cache->index.map_cache,
+        &txn->key_digest, &txn->item.payload);
+  }
+  p_lock_unlock(&cache->lock);
+
+  if (!is_unchanged) {
+    ybc_set_txn_rollback(txn);
+    return 0;
+  }
+
+  m_item_release(&txn->item);
+  return 1;
 }
 
 void ybc_set_txn_rollback(struct ybc_set_txn *const txn)
@@ -2164,6 +2514,32 @@ void ybc_set_txn_rollback(struct ybc_set_txn *const txn)
   m_item_release(&txn->item);
 }
 
+/*
+ * Defragments the given item, i.e. moves it into the front of storage's
+ * free space.
+ *
+ * The moved item is commited only if the item hasn't been changed
+ * by another thread, so concurrent updates for the item are never
+ * overwritten by its' old value.
+ *
+ * Since this operation can be quite costly, avoid performing it in hot paths.
+ */
+static void m_ws_defragment(struct ybc *const cache,
+    const struct ybc_item *const item, const struct ybc_key *const key)
+{
+  struct ybc_set_txn txn;
+  struct ybc_set_txn_value txn_value;
+  struct ybc_value value;
+
+  ybc_item_get_value(item, &value);
+  if (!ybc_set_txn_begin(cache, &txn, key, value.size, value.ttl)) {
+    return;
+  }
+  ybc_set_txn_get_value(&txn, &txn_value);
+  memcpy(txn_value.ptr, value.ptr, value.size);
+  (void)ybc_set_txn_commit_if_unchanged(&txn, item);
+}
+
 void ybc_set_txn_get_value(const struct ybc_set_txn *const txn,
     struct ybc_set_txn_value *const value)
 {
@@ -2214,7 +2590,8 @@ static int m_item_acquire(struct ybc *const cache, struct ybc_item *const item,
     p_lock_unlock(&cache->lock);
   }
 
-  if (!m_storage_metadata_check(&cache->storage, &item->payload, key)) {
+  if (!m_storage_metadata_check(&cache->storage, &item->payload, key) ||
+      !m_item_checksum_check(item)) {
     m_item_release(item);
     return 0;
   }
@@ -2271,9 +2648,86 @@ int ybc_item_remove(struct ybc *const cache, const struct ybc_key *const key)
 
   struct m_key_digest key_digest;
 
+  if (cache->is_read_only) {
+    return 0;
+  }
+
   m_key_digest_get(&key_digest, cache->storage.hash_seed, key);
-  return m_map_cache_remove(&cache->index.map, &cache->index.map_cache,
-      &key_digest);
+
+  p_lock_lock(&cache->lock);
+  const int is_removed = m_map_cache_remove(&cache->index.map,
+      &cache->index.map_cache, &key_digest);
+  p_lock_unlock(&cache->lock);
+
+  return is_removed;
+}
+
+int ybc_item_touch(struct ybc *const cache, const struct ybc_key *const key,
+    const uint64_t ttl)
+{
+  struct m_key_digest key_digest;
+  struct ybc_item item;
+
+  if (cache->is_read_only) {
+    return 0;
+  }
+
+  m_key_digest_get(&key_digest, cache->storage.hash_seed, key);
+
+  item.cache = cache;
+  item.key_size = key->size;
+  item.is_set_txn = 0;
+
+  /*
+   * Look up the item via map instead of m_item_acquire(), since the latter
+   * may defragment the item, i.e. move it to another location. The payload
+   * obtained before the move would point to the outdated location then.
+   */
+  if (!m_map_get(&cache->index.map, &key_digest, &item.payload)) {
+    return 0;
+  }
+
+  const struct m_storage_cursor next_cursor = *cache->storage.next_cursor;
+
+  const uint64_t current_time = p_get_current_time();
+  if (!m_storage_payload_check(&cache->storage, &next_cursor, &item.payload,
+      current_time)) {
+    return 0;
+  }
+  if (cache->has_overwrite_protection) {
+    p_lock_lock(&cache->lock);
+    m_item_register(&item, &cache->acquired_items_head);
+    p_lock_unlock(&cache->lock);
+  }
+
+  if (!m_storage_metadata_check(&cache->storage, &item.payload, key)) {
+    m_item_release(&item);
+    return 0;
+  }
+
+  /*
+   * Only the expiration time is updated, so the item's value stays
+   * at the same location in the storage.
+   *
+   * The item could be concurrently overwritten or removed after the lookup.
+   * The touch is ordered before such an update then, so the map is left
+   * intact.
+   */
+  struct m_storage_payload payload;
+  p_lock_lock(&cache->lock);
+  if (m_map_get(&cache->index.map, &key_digest, &payload) &&
+      payload.cursor.offset == item.payload.cursor.offset &&
+      payload.cursor.wrap_count == item.payload.cursor.wrap_count &&
+      payload.size == item.payload.size) {
+    payload.expiration_time = (ttl > UINT64_MAX - current_time) ?
+        UINT64_MAX : (ttl + current_time);
+    m_map_cache_set(&cache->index.map, &cache->index.map_cache, &key_digest,
+        &payload);
+  }
+  p_lock_unlock(&cache->lock);
+
+  m_item_release(&item);
+  return 1;
 }
 
 int ybc_item_get(struct ybc *const cache, struct ybc_item *const item,
@@ -2387,6 +2841,364 @@ void ybc_item_get_value(const struct ybc_item *const item,
   value->ttl = m_item_get_ttl(item);
 }
 
+void ybc_item_get_key(const struct ybc_item *const item,
+    struct ybc_key *const key)
+{
+  assert(item->payload.size >= m_storage_metadata_get_size(item->key_size));
+
+  const char *const ptr = m_storage_get_ptr(&item->cache->storage,
+      item->payload.cursor.offset);
+  key->ptr = ptr + sizeof(size_t);
+  key->size = item->key_size;
+}
+
+/*
+ * Restores item's key size from the metadata and verifies the key
+ * against the given key digest.
+ *
+ * Returns non-zero on success, zero if the metadata is invalid.
+ */
+static int m_item_load_key(struct ybc_item *const item,
+    const struct m_key_digest *const key_digest)
+{
+  const struct m_storage *const storage = &item->cache->storage;
+  const size_t payload_size = item->payload.size;
+
+  if (payload_size < m_storage_metadata_get_size(0)) {
+    return 0;
+  }
+
+  const char *const ptr = m_storage_get_ptr(storage,
+      item->payload.cursor.offset);
+  size_t digest;
+  memcpy(&digest, ptr, sizeof(digest));
+
+  /*
+   * See m_storage_metadata_get_digest() for details.
+   */
+  const size_t key_size = digest ^ (size_t)storage->hash_seed ^ payload_size;
+  if (key_size > payload_size - m_storage_metadata_get_size(0)) {
+    return 0;
+  }
+
+  const struct ybc_key key = {
+    .ptr = ptr + sizeof(digest),
+    .size = key_size,
+  };
+  struct m_key_digest actual_key_digest;
+  m_key_digest_get(&actual_key_digest, storage->hash_seed, &key);
+  if (!m_key_digest_equal(&actual_key_digest, key_digest)) {
+    return 0;
+  }
+
+  item->key_size = key_size;
+  return 1;
+}
+
+int ybc_item_next(struct ybc *const cache, struct ybc_item *const item,
+    size_t *const slot_index)
+{
+  const struct m_map *const map = &cache->index.map;
+
+  while (*slot_index < map->slots_count) {
+    const size_t i = (*slot_index)++;
+    const struct m_key_digest key_digest = map->key_digests[i];
+
+    if (m_key_digest_is_empty(&key_digest)) {
+      continue;
+    }
+
+    item->cache = cache;
+    item->key_size = 0;
+    item->is_set_txn = 0;
+    item->payload = map->payloads[i];
+
+    /*
+     * See m_item_acquire() for details regarding the racy copy
+     * of next_cursor.
+     */
+    const struct m_storage_cursor next_cursor = *cache->storage.next_cursor;
+
+    const uint64_t current_time = p_get_current_time();
+    if (!m_storage_payload_check(&cache->storage, &next_cursor, &item->payload,
+        current_time)) {
+      continue;
+    }
+    if (cache->has_overwrite_protection) {
+      p_lock_lock(&cache->lock);
+      m_item_register(item, &cache->acquired_items_head);
+      p_lock_unlock(&cache->lock);
+    }
+
+    if (!m_item_load_key(item, &key_digest) || !m_item_checksum_check(item)) {
+      m_item_release(item);
+      continue;
+    }
+
+    return 1;
+  }
+
+  return 0;
+}
+
+void ybc_get_stats(struct ybc *const cache, struct ybc_stats *const stats)
+{
+  const struct m_map *const map = &cache->index.map;
+  const struct m_storage_cursor next_cursor = *cache->storage.next_cursor;
+  const uint64_t current_time = p_get_current_time();
+  struct ybc_item item;
+  size_t i;
+
+  size_t min_distance = cache->storage.size;
+  size_t max_tail_offset = 0;
+
+  stats->items_count = 0;
+  stats->slots_count = map->slots_count;
+  stats->used_data_size = 0;
+  stats->data_size = cache->storage.size;
+  stats->storage_wraps_count = next_cursor.wrap_count;
+  stats->fragmented_data_size = 0;
+  stats->evictions_count = cache->evictions_count;
+
+  item.cache = cache;
+  item.is_set_txn = 0;
+
+  for (i = 0; i < map->slots_count; ++i) {
+    const struct m_key_digest key_digest = map->key_digests[i];
+
+    if (m_key_digest_is_empty(&key_digest)) {
+      continue;
+    }
+
+    /*
+     * Items aren't acquired, since they are only inspected here.
+     * Concurrently overwritten items may be miscounted. This is OK.
+     */
+    item.payload = map->payloads[i];
+    if (m_storage_payload_check(&cache->storage, &next_cursor, &item.payload,
+        current_time) && m_item_load_key(&item, &key_digest)) {
+      ++stats->items_count;
+      stats->used_data_size += item.payload.size;
+
+      const size_t distance = m_storage_get_distance(&cache->storage,
+          &next_cursor, &item.payload.cursor);
+      if (distance < min_distance) {
+        min_distance = distance;
+      }
+
+      const size_t end_offset = item.payload.cursor.offset + item.payload.size;
+      if (item.payload.cursor.wrap_count != next_cursor.wrap_count &&
+          end_offset > max_tail_offset) {
+        max_tail_offset = end_offset;
+      }
+    }
+  }
+
+  /*
+   * Live items are located between the oldest live item and next_cursor.
+   * The remaining space between them is occupied by deleted, expired
+   * and overwritten items. The space in the end of the storage, which
+   * has been skipped on the last storage wrap, isn't taken into account,
+   * since it cannot be reclaimed.
+   */
+  const size_t wrap_skipped_size = (max_tail_offset == 0) ? 0 :
+      (cache->storage.size - max_tail_offset);
+  const size_t live_data_span = cache->storage.size - min_distance;
+  if (live_data_span > stats->used_data_size + wrap_skipped_size) {
+    stats->fragmented_data_size = live_data_span - stats->used_data_size -
+        wrap_skipped_size;
+  }
+}
+
+size_t ybc_get_evictions_count(struct ybc *const cache)
+{
+  return cache->evictions_count;
+}
+
+/*
+ * A live item to be moved by ybc_compact().
+ */
+struct m_compaction_item
+{
+  /*
+   * The index of the item's slot in the map.
+   */
+  size_t slot_index;
+
+  /*
+   * The distance from next_cursor to the item at the compaction start.
+   */
+  size_t distance;
+};
+
+static int m_compaction_item_compare(const void *const a, const void *const b)
+{
+  const size_t a_distance = ((const struct m_compaction_item *)a)->distance;
+  const size_t b_distance = ((const struct m_compaction_item *)b)->distance;
+
+  return (a_distance > b_distance) - (a_distance < b_distance);
+}
+
+/*
+ * Returns 1 if the given slot points to a live item. Sets up item->payload
+ * for the item.
+ *
+ * Must be called under cache->lock, so next_cursor cannot be moved
+ * during the check.
+ */
+static int m_compaction_load_item(struct ybc *const cache,
+    struct ybc_item *const item, const size_t slot_index,
+    const uint64_t current_time)
+{
+  const struct m_map *const map = &cache->index.map;
+  const struct m_key_digest key_digest = map->key_digests[slot_index];
+
+  if (m_key_digest_is_empty(&key_digest)) {
+    return 0;
+  }
+
+  item->payload = map->payloads[slot_index];
+  return m_storage_payload_check(&cache->storage, cache->storage.next_cursor,
+      &item->payload, current_time) && m_item_load_key(item, &key_digest);
+}
+
+size_t ybc_compact(struct ybc *const cache, const size_t max_moved_size)
+{
+  struct m_storage *const storage = &cache->storage;
+  const struct m_map *const map = &cache->index.map;
+  struct ybc_item item;
+  struct ybc_stats stats;
+  size_t items_count = 0;
+  size_t i;
+
+  if (cache->is_read_only) {
+    return 0;
+  }
+
+  ybc_get_stats(cache, &stats);
+  if (stats.fragmented_data_size == 0) {
+    /* Avoid moving already packed items. */
+    return 0;
+  }
+
+  item.cache = cache;
+  item.is_set_txn = 0;
+
+  /*
+   * Allocations are blocked until the compaction is complete, since
+   * they would break the order of moved items in the storage.
+   */
+  p_lock_lock(&cache->lock);
+
+  const struct m_storage_cursor base_cursor = *storage->next_cursor;
+  const uint64_t current_time = p_get_current_time();
+
+  for (i = 0; i < map->slots_count; ++i) {
+    if (m_compaction_load_item(cache, &item, i, current_time)) {
+      ++items_count;
+    }
+  }
+  if (items_count == 0) {
+    p_lock_unlock(&cache->lock);
+    return 0;
+  }
+
+  struct m_compaction_item *const items =
+      p_malloc(items_count * sizeof(*items));
+  size_t n = 0;
+  for (i = 0; i < map->slots_count && n < items_count; ++i) {
+    if (m_compaction_load_item(cache, &item, i, current_time)) {
+      items[n].slot_index = i;
+      items[n].distance = m_storage_get_distance(storage, &base_cursor,
+          &item.payload.cursor);
+      ++n;
+    }
+  }
+
+  /*
+   * Move items starting from the oldest one to next_cursor. This packs
+   * live items into a contiguous area. Since the next_cursor never overtakes
+   * the item being moved, items, which are yet to be moved, cannot be
+   * overwritten.
+   */
+  qsort(items, n, sizeof(*items), m_compaction_item_compare);
+
+  size_t moved_size = 0;
+  size_t end_distance = 0;
+  for (i = 0; i < n && moved_size < max_moved_size; ++i) {
+    const size_t slot_index = items[i].slot_index;
+    const size_t distance = items[i].distance;
+    const struct m_key_digest key_digest = map->key_digests[slot_index];
+
+    /*
+     * The item could be overwritten while moving previous items.
+     */
+    if (!m_compaction_load_item(cache, &item, slot_index, current_time) ||
+        m_storage_get_distance(storage, &base_cursor,
+            &item.payload.cursor) != distance) {
+      continue;
+    }
+
+    const size_t size = item.payload.size;
+    char *const src = m_storage_get_ptr(storage, item.payload.cursor.offset);
+    const char first_byte = src[0];
+    struct ybc_item dst_item;
+
+    dst_item.payload = item.payload;
+    if (!m_storage_allocate(storage, &cache->acquired_items_head, &dst_item,
+        cache->has_overwrite_protection)) {
+      break;
+    }
+    if (cache->has_overwrite_protection) {
+      m_item_skiplist_del(&dst_item);
+    }
+    end_distance = distance + size;
+
+    const size_t dst_distance = m_storage_get_distance(storage, &base_cursor,
+        &dst_item.payload.cursor);
+    if (dst_distance > distance && dst_distance < end_distance) {
+      /*
+       * The allocation skipped acquired items and overwrote the item.
+       * The item is evicted from the cache in this case.
+       */
+      continue;
+    }
+    if (dst_distance == distance) {
+      /*
+       * The item is already in place. Restore its' first byte
+       * overwritten by m_storage_allocate().
+       */
+      src[0] = first_byte;
+    }
+    else {
+      char *const dst = m_storage_get_ptr(storage,
+          dst_item.payload.cursor.offset);
+      memmove(dst, src, size);
+      moved_size += size;
+    }
+
+    m_map_cache_set(&cache->index.map, &cache->index.map_cache,
+        &key_digest, &dst_item.payload);
+  }
+
+  const size_t next_distance = m_storage_get_distance(storage, &base_cursor,
+      storage->next_cursor);
+
+  p_lock_unlock(&cache->lock);
+
+  /*
+   * The space between next_cursor and the oldest item has been already free
+   * before the compaction.
+   */
+  const size_t free_size = items[0].distance;
+  p_free(items);
+
+  if (end_distance < next_distance + free_size) {
+    return 0;
+  }
+  return end_distance - next_distance - free_size;
+}
+
 
 /*******************************************************************************
  * Cache cluster API.
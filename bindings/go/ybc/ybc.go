@@ -22,12 +22,18 @@ package ybc
 import "C"
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash/fnv"
 	"io"
+	"math"
 	"reflect"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 )
@@ -35,11 +41,18 @@ import (
 var (
 	ErrNoSpace       = errors.New("ybc: not enough space in the cache")
 	ErrCacheMiss     = errors.New("ybc: the item is not found in the cache")
+	ErrItemExists    = errors.New("ybc: the item already exists in the cache")
+	ErrItemChanged   = errors.New("ybc: the item has been changed in the cache")
+	ErrNonNumeric    = errors.New("ybc: the value isn't a decimal number")
 	ErrOpenFailed    = errors.New("ybc: cannot open the cache")
 	ErrOutOfRange    = errors.New("ybc: out of range offset")
 	ErrPartialCommit = errors.New("ybc: partial commit")
 	ErrWouldBlock    = errors.New("ybc: the operation would block")
 
+	ErrInvalidSnapshot = errors.New("ybc: invalid snapshot")
+	ErrReadOnly        = errors.New("ybc: the cache is opened in read-only mode")
+	ErrDecryptFailed   = errors.New("ybc: cannot decrypt the cache file")
+
 	// Errors for internal use only
 	errPanic = errors.New("ybc: panic")
 )
@@ -81,6 +94,64 @@ type Cacher interface {
 	NewSetTxn(key []byte, valueSize int, ttl time.Duration) (txn *SetTxn, err error)
 }
 
+// Optional interfaces below extend Cacher. Cacher implementations may
+// implement any of them, so callers must check for them via type assertions:
+//
+//   if t, ok := cacher.(ybc.Toucher); ok {
+//     err = t.Touch(key, ttl)
+//   }
+
+// Cache and Cluster implement this optional interface
+type GrowingSetTxnCreator interface {
+	NewGrowingSetTxn(key []byte, initialSize int, ttl time.Duration) (txn *SetTxn, err error)
+}
+
+// Cache and Cluster implement this optional interface
+type Toucher interface {
+	Touch(key []byte, ttl time.Duration) error
+}
+
+// Cache and Cluster implement this optional interface
+type Adder interface {
+	Add(key []byte, value []byte, ttl time.Duration) error
+}
+
+// Cache and Cluster implement this optional interface
+type Incrementer interface {
+	Incr(key []byte, delta int64, initial uint64, ttl time.Duration) (value uint64, err error)
+}
+
+// Cache and Cluster implement this optional interface
+type ItemIterator interface {
+	ForEachItem(f func(key []byte, size int, ttl time.Duration) bool)
+}
+
+// Cache and Cluster implement this optional interface
+type StatsReporter interface {
+	Stats() CacheStats
+}
+
+// Cache and Cluster implement this optional interface
+type Compacter interface {
+	Compact(maxMovedBytes int) int
+}
+
+// Cache and Cluster implement this optional interface
+type Snapshotter interface {
+	SnapshotTo(w io.Writer) error
+	RestoreFrom(r io.Reader) error
+}
+
+// Cache and Cluster implement this optional interface
+type ItemLookuper interface {
+	LookupItem(key []byte) (item *Item, err error)
+}
+
+// Cache and Cluster implement this optional interface
+type EvictionsCounter interface {
+	Evictions() uint64
+}
+
 /*******************************************************************************
  * Config
  ******************************************************************************/
@@ -187,6 +258,48 @@ type Config struct {
 	//
 	// Leave this field empty (set to 0) if you are in doubt.
 	SyncInterval time.Duration
+
+	// Whether to store and verify checksums for items' values.
+	//
+	// Items with invalid checksums, e.g. due to data file corruption,
+	// are treated as missing instead of returning garbage. Checksums slow
+	// down access to large items, since the whole value is read on each
+	// access.
+	//
+	// Items stored with checksums are invisible to caches opened without
+	// checksums and vice versa, so use the same setting for all the opens
+	// of the same cache files.
+	EnableChecksums bool
+
+	// Whether to open existing IndexFile and DataFile only for reading.
+	//
+	// Multiple processes may open the same cache files in read-only mode
+	// at the same time. The files must be created beforehand by a cache
+	// opened with the same config without ReadOnly, which mustn't be opened
+	// while read-only caches are open. The force flag passed to OpenCache()
+	// and OpenSimpleCache() is ignored in read-only mode.
+	//
+	// Methods modifying the cache return ErrReadOnly in read-only mode,
+	// Cache.Delete() returns false, while Cache.Clear() and Cache.Compact()
+	// do nothing.
+	ReadOnly bool
+
+	// Whether to back the cache memory with huge pages.
+	//
+	// Huge pages reduce TLB pressure for big caches. This is just a hint
+	// to the OS, which may be ignored. For instance, Linux backs only
+	// caches without IndexFile and DataFile and cache files located
+	// on tmpfs with transparent huge pages.
+	EnableHugePages bool
+
+	// Whether to lock the cache memory in RAM, so it cannot be paged out
+	// by the OS under memory pressure.
+	//
+	// The whole IndexFile and DataFile are read into RAM when opening
+	// the cache, so this may take a lot of time for big caches. The cache
+	// opening fails with ErrOpenFailed if the memory cannot be locked,
+	// for instance, due to RLIMIT_MEMLOCK limit.
+	LockInRam bool
 }
 
 type configInternal struct {
@@ -262,8 +375,9 @@ func (cfg *Config) openCacheInternal(force, isSimpleCache bool) (cache *Cache, e
 	}()
 
 	cache = &Cache{
-		buf: make([]byte, cacheSize),
-		cg:  c.cg,
+		buf:      make([]byte, cacheSize),
+		cg:       c.cg,
+		readOnly: cfg.ReadOnly,
 	}
 	mForce := C.int(0)
 	if force {
@@ -305,13 +419,18 @@ func (cfg *Config) internal(isSimpleCache bool) *configInternal {
 		indexFileCStr := C.CString(cfg.IndexFile)
 		defer C.free(unsafe.Pointer(indexFileCStr))
 		C.ybc_config_set_index_file(ctx, indexFileCStr)
-		c.cg.SetIndexFile(cfg.IndexFile)
+		// Read-only caches may share files.
+		if !cfg.ReadOnly {
+			c.cg.SetIndexFile(cfg.IndexFile)
+		}
 	}
 	if cfg.DataFile != "" {
 		dataFileCStr := C.CString(cfg.DataFile)
 		defer C.free(unsafe.Pointer(dataFileCStr))
 		C.ybc_config_set_data_file(ctx, dataFileCStr)
-		c.cg.SetDataFile(cfg.DataFile)
+		if !cfg.ReadOnly {
+			c.cg.SetDataFile(cfg.DataFile)
+		}
 	}
 	C.ybc_config_set_hot_items_count(ctx, C.size_t(cfg.HotItemsCount))
 	C.ybc_config_set_hot_data_size(ctx, C.size_t(cfg.HotDataSize))
@@ -328,6 +447,18 @@ func (cfg *Config) internal(isSimpleCache bool) *configInternal {
 	if isSimpleCache {
 		C.ybc_config_disable_overwrite_protection(ctx)
 	}
+	if cfg.EnableChecksums {
+		C.ybc_config_enable_checksums(ctx)
+	}
+	if cfg.ReadOnly {
+		C.ybc_config_enable_read_only(ctx)
+	}
+	if cfg.EnableHugePages {
+		C.ybc_config_enable_huge_pages(ctx)
+	}
+	if cfg.LockInRam {
+		C.ybc_config_enable_lock_in_ram(ctx)
+	}
 
 	c.ctx = ctx
 	return c
@@ -365,6 +496,9 @@ func (sc *SimpleCache) Close() error {
 // Stores the given (key, value) pair with the given ttl in the cache.
 func (sc *SimpleCache) Set(key, value []byte, ttl time.Duration) error {
 	sc.cache.dg.CheckLive()
+	if sc.cache.readOnly {
+		return ErrReadOnly
+	}
 	var k C.struct_ybc_key
 	initKey(&k, key)
 	var v C.struct_ybc_value
@@ -454,9 +588,14 @@ func (sc *SimpleCache) Clear() {
 // Consider using SimpleCache for storing small objects (up to 1Kb).
 // It has better performance scalability on multi-CPU system.
 type Cache struct {
-	dg  debugGuard
-	cg  cacheGuard
-	buf []byte
+	// Accessed atomically, so must be 64-bit aligned.
+	hitsCount   uint64
+	missesCount uint64
+
+	dg       debugGuard
+	cg       cacheGuard
+	buf      []byte
+	readOnly bool
 }
 
 // Closes the cache.
@@ -476,6 +615,9 @@ func (cache *Cache) Close() error {
 // files - use Cache.NewSetTxn() instead.
 func (cache *Cache) Set(key []byte, value []byte, ttl time.Duration) error {
 	cache.dg.CheckLive()
+	if cache.readOnly {
+		return ErrReadOnly
+	}
 	var k C.struct_ybc_key
 	initKey(&k, key)
 	var v C.struct_ybc_value
@@ -486,6 +628,78 @@ func (cache *Cache) Set(key []byte, value []byte, ttl time.Duration) error {
 	return nil
 }
 
+// Stores the given value in the cache only if there is no value
+// for the given key.
+//
+// Returns ErrItemExists if the cache already contains a value for the key.
+// Concurrent Add() calls for the same missing key store only one value.
+func (cache *Cache) Add(key []byte, value []byte, ttl time.Duration) error {
+	txn, err := cache.NewSetTxn(key, len(value), ttl)
+	if err != nil {
+		return err
+	}
+	txn.Write(value)
+	return txn.CommitIfMissing()
+}
+
+// Atomically adds delta to the counter stored under the given key
+// and returns the new counter value.
+//
+// Counters are stored as decimal numbers, so they may be obtained via
+// Cache.Get(). The counter is created with initial value and the given ttl
+// if it is missing in the cache. Otherwise the counter retains its' ttl.
+// Negative delta cannot decrease the counter below zero.
+//
+// Returns ErrNonNumeric if the value for the key isn't a decimal number.
+func (cache *Cache) Incr(key []byte, delta int64, initial uint64, ttl time.Duration) (value uint64, err error) {
+	var buf [20]byte
+	for {
+		item, err := cache.GetItem(key)
+		if err == ErrCacheMiss {
+			err = cache.Add(key, strconv.AppendUint(buf[:0], initial, 10), ttl)
+			if err == ErrItemExists {
+				continue
+			}
+			return initial, err
+		}
+		if err != nil {
+			return 0, err
+		}
+		value, err = strconv.ParseUint(string(item.Peek()), 10, 64)
+		if err != nil {
+			item.Close()
+			return 0, ErrNonNumeric
+		}
+		value = addDelta(value, delta)
+		err = cache.setIfUnchanged(key, item, strconv.AppendUint(buf[:0], value, 10))
+		item.Close()
+		if err != ErrItemChanged {
+			return value, err
+		}
+	}
+}
+
+func addDelta(value uint64, delta int64) uint64 {
+	if delta >= 0 {
+		return value + uint64(delta)
+	}
+	if value < uint64(-delta) {
+		return 0
+	}
+	return value - uint64(-delta)
+}
+
+// Stores the given value under the given key only if the cache still
+// contains the given item under the key. The value inherits item's ttl.
+func (cache *Cache) setIfUnchanged(key []byte, item *Item, value []byte) error {
+	txn, err := cache.NewSetTxn(key, len(value), item.Ttl())
+	if err != nil {
+		return err
+	}
+	txn.Write(value)
+	return txn.CommitIfUnchanged(item)
+}
+
 // Returns value associated with the given key from the cache.
 //
 // Sets err to ErrCacheMiss on cache miss.
@@ -570,12 +784,38 @@ func (cache *Cache) Delete(key []byte) bool {
 	return C.go_item_remove(cache.ctx(), k.ptr, k.size) != C.int(0)
 }
 
+// Sets new ttl for the value associated with the given key.
+//
+// The value isn't copied, so this is much cheaper than Cache.Set() with
+// the same value for sliding expiration.
+//
+// Returns ErrCacheMiss if there is no such value in the cache.
+func (cache *Cache) Touch(key []byte, ttl time.Duration) error {
+	cache.dg.CheckLive()
+	if cache.readOnly {
+		return ErrReadOnly
+	}
+	var k C.struct_ybc_key
+	initKey(&k, key)
+	if ttl < 0 {
+		ttl = 0
+	}
+	if C.go_item_touch(cache.ctx(), k.ptr, k.size, C.uint64_t(ttl/time.Millisecond)) == 0 {
+		return ErrCacheMiss
+	}
+	return nil
+}
+
 // The same as Cache.Set(), but additionally returns item object associated
 // with just addded item.
 //
 // The returned item must be closed with item.Close() call!
 func (cache *Cache) SetItem(key []byte, value []byte, ttl time.Duration) (item *Item, err error) {
 	cache.dg.CheckLive()
+	if cache.readOnly {
+		err = ErrReadOnly
+		return
+	}
 	item = acquireItem()
 	var k C.struct_ybc_key
 	initKey(&k, key)
@@ -601,6 +841,23 @@ func (cache *Cache) SetItem(key []byte, value []byte, ttl time.Duration) (item *
 // Use this method instead of Cache.Get() for obtaining big values
 // from the cache such as video files.
 func (cache *Cache) GetItem(key []byte) (item *Item, err error) {
+	item, err = cache.LookupItem(key)
+	if err != nil {
+		atomic.AddUint64(&cache.missesCount, 1)
+		return
+	}
+	atomic.AddUint64(&cache.hitsCount, 1)
+	return
+}
+
+// The same as Cache.GetItem(), but the lookup isn't counted
+// in CacheStats.Hits and CacheStats.Misses.
+//
+// Use this method for auxiliary lookups, which don't serve cache reads,
+// e.g. for checking whether the item exists before updating it.
+//
+// The returned item must be closed with item.Close() call!
+func (cache *Cache) LookupItem(key []byte) (item *Item, err error) {
 	cache.dg.CheckLive()
 	item = acquireItem()
 	var k C.struct_ybc_key
@@ -661,10 +918,12 @@ func (cache *Cache) GetDeAsyncItem(key []byte, graceDuration time.Duration) (ite
 		err = ErrWouldBlock
 		return
 	case C.YBC_DE_NOTFOUND:
+		atomic.AddUint64(&cache.missesCount, 1)
 		releaseItem(item)
 		err = ErrCacheMiss
 		return
 	case C.YBC_DE_SUCCESS:
+		atomic.AddUint64(&cache.hitsCount, 1)
 		item.value = rv.value
 		item.dg.Init()
 		return
@@ -682,6 +941,10 @@ func (cache *Cache) GetDeAsyncItem(key []byte, graceDuration time.Duration) (ite
 func (cache *Cache) NewSetTxn(key []byte, valueSize int, ttl time.Duration) (txn *SetTxn, err error) {
 	cache.dg.CheckLive()
 	checkNonNegative(valueSize)
+	if cache.readOnly {
+		err = ErrReadOnly
+		return
+	}
 	if ttl < 0 {
 		ttl = 0
 	}
@@ -696,6 +959,31 @@ func (cache *Cache) NewSetTxn(key []byte, valueSize int, ttl time.Duration) (txn
 	return
 }
 
+// Starts new 'set transaction' for storing an item of unknown size
+// in the cache.
+//
+// The transaction grows on writes exceeding its' current size, so data
+// of unknown length such as proxied http responses may be streamed
+// into the cache. initialSize is the expected value size. The item
+// is stored with the actual written length on commit.
+//
+// Growing the transaction copies already written data, so initialSize
+// should be close to the actual size for big items.
+//
+// Returned txn must be finished with txn.Commit*() or txn.Rollback() calls.
+func (cache *Cache) NewGrowingSetTxn(key []byte, initialSize int, ttl time.Duration) (txn *SetTxn, err error) {
+	txn, err = cache.NewSetTxn(key, initialSize, ttl)
+	if err != nil {
+		return
+	}
+	txn.growth = &setTxnGrowth{
+		cache: cache,
+		key:   append([]byte(nil), key...),
+		ttl:   ttl,
+	}
+	return
+}
+
 func bufPtr(b []byte) (p unsafe.Pointer) {
 	if len(b) > 0 {
 		p = unsafe.Pointer(&b[0])
@@ -703,6 +991,134 @@ func bufPtr(b []byte) (p unsafe.Pointer) {
 	return p
 }
 
+// Calls f for every live item in the cache with item's key, value size
+// and ttl.
+//
+// The key is valid only until f returns. The iteration stops
+// if f returns false. Items' values aren't read during the iteration,
+// so it is cheap even for big items. Items added, updated or removed
+// during the iteration may be skipped.
+func (cache *Cache) ForEachItem(f func(key []byte, size int, ttl time.Duration) bool) {
+	cache.forEachItemValue(func(key, value []byte, ttl time.Duration) bool {
+		return f(key, len(value), ttl)
+	})
+}
+
+// The same as Cache.ForEachItem(), but passes items' values to f.
+//
+// The value is valid only until f returns.
+func (cache *Cache) forEachItemValue(f func(key, value []byte, ttl time.Duration) bool) {
+	cache.dg.CheckLive()
+	item := acquireItem()
+	var slotIndex C.size_t
+	for {
+		rv := C.go_item_next(cache.ctx(), item.ctx(), &slotIndex)
+		if rv.result == 0 {
+			break
+		}
+		key := newUnsafeSlice(unsafe.Pointer(rv.key.ptr), int(rv.key.size))
+		value := newUnsafeSlice(rv.value.ptr, int(rv.value.size))
+		ok := f(key, value, time.Duration(rv.value.ttl)*time.Millisecond)
+		C.ybc_item_release(item.ctx())
+		if !ok {
+			break
+		}
+	}
+	releaseItem(item)
+}
+
+// Cache statistics returned by Cache.Stats().
+type CacheStats struct {
+	// The number of live items in the cache.
+	ItemsCount uint64
+
+	// The maximum number of items the cache can store.
+	MaxItemsCount uint64
+
+	// The total size of live items in bytes including keys.
+	UsedBytes uint64
+
+	// The size of the storage in bytes.
+	DataFileSize uint64
+
+	// The number of times the storage has been wrapped around.
+	//
+	// Items are evicted from the storage in FIFO order, so each wrap
+	// means the whole storage contents has been evicted or re-written.
+	StorageWraps uint64
+
+	// The size of deleted, expired and overwritten items interleaved
+	// with live items in the storage.
+	//
+	// New items evict live items together with this space.
+	// It may be reclaimed via Cache.Compact().
+	FragmentedBytes uint64
+
+	// The number of items found and not found by Cache.Get*() calls
+	// since the cache has been opened.
+	Hits   uint64
+	Misses uint64
+
+	// The number of live items evicted from the storage by new items
+	// since the cache has been opened.
+	//
+	// Evicted items are counted with a delay of up to a half
+	// of the storage wrap. Items expiring during the delay aren't counted.
+	Evictions uint64
+}
+
+// Returns statistics for the cache.
+//
+// The method scans the whole cache index, so its' speed depends
+// on Config.MaxItemsCount. Avoid calling it frequently for big caches.
+func (cache *Cache) Stats() CacheStats {
+	cache.dg.CheckLive()
+	var mStats C.struct_ybc_stats
+	C.ybc_get_stats(cache.ctx(), &mStats)
+	return CacheStats{
+		ItemsCount:      uint64(mStats.items_count),
+		MaxItemsCount:   uint64(mStats.slots_count),
+		UsedBytes:       uint64(mStats.used_data_size),
+		DataFileSize:    uint64(mStats.data_size),
+		StorageWraps:    uint64(mStats.storage_wraps_count),
+		FragmentedBytes: uint64(mStats.fragmented_data_size),
+		Hits:            atomic.LoadUint64(&cache.hitsCount),
+		Misses:          atomic.LoadUint64(&cache.missesCount),
+		Evictions:       uint64(mStats.evictions_count),
+	}
+}
+
+// Returns the number of live items evicted from the storage by new items
+// since the cache has been opened.
+//
+// This is the same as CacheStats.Evictions, but the method doesn't scan
+// the cache index, so it is cheap.
+func (cache *Cache) Evictions() uint64 {
+	cache.dg.CheckLive()
+	return uint64(C.ybc_get_evictions_count(cache.ctx()))
+}
+
+// Compacts the cache storage by packing live items into a contiguous area,
+// so new items evict live items only after the reclaimed space is exhausted.
+//
+// Items are moved starting from the oldest one until the total size of moved
+// items reaches maxMovedBytes. This allows spreading the compaction over
+// multiple calls, e.g. from a background goroutine with a rate limit.
+// The whole cache is compacted if maxMovedBytes <= 0.
+//
+// Items cannot be added to the cache during the call, so large maxMovedBytes
+// values may block the cache for a long time.
+//
+// Returns the number of reclaimed bytes. See also CacheStats.FragmentedBytes.
+func (cache *Cache) Compact(maxMovedBytes int) int {
+	cache.dg.CheckLive()
+	maxSize := ^C.size_t(0)
+	if maxMovedBytes > 0 {
+		maxSize = C.size_t(maxMovedBytes)
+	}
+	return int(C.ybc_compact(cache.ctx(), maxSize))
+}
+
 // Instantly removes all the cache contents.
 //
 // This method is very fast - its' speed doesn't depend on the number of items
@@ -728,6 +1144,16 @@ type SetTxn struct {
 	buf            []byte
 	unsafeBufCache []byte
 	offset         int
+
+	// Non-nil for transactions started via Cache.NewGrowingSetTxn().
+	growth *setTxnGrowth
+}
+
+// Parameters for re-allocating growing 'set transaction'.
+type setTxnGrowth struct {
+	cache *Cache
+	key   []byte
+	ttl   time.Duration
 }
 
 // Commits the truncated transaction.
@@ -744,6 +1170,7 @@ func (txn *SetTxn) CommitTruncated() error {
 // The item appears atomically in the cache after the commit.
 func (txn *SetTxn) Commit() (err error) {
 	txn.dg.CheckLive()
+	txn.truncateIfGrowing()
 	buf := txn.unsafeBuf()
 	if txn.offset != len(buf) {
 		err = ErrPartialCommit
@@ -755,6 +1182,53 @@ func (txn *SetTxn) Commit() (err error) {
 	return
 }
 
+// Commits the transaction only if the cache doesn't contain an item
+// with the same key. Otherwise rolls back the transaction
+// and returns ErrItemExists.
+//
+// Only one of concurrent transactions for the same missing key is commited
+// via this method.
+func (txn *SetTxn) CommitIfMissing() (err error) {
+	txn.dg.CheckLive()
+	txn.truncateIfGrowing()
+	buf := txn.unsafeBuf()
+	if txn.offset != len(buf) {
+		err = ErrPartialCommit
+		txn.Rollback()
+		return
+	}
+	if C.ybc_set_txn_commit_if_missing(txn.ctx()) == 0 {
+		err = ErrItemExists
+	}
+	txn.finish()
+	return
+}
+
+// Commits the transaction only if the cache still contains the given item
+// under the transaction's key. Otherwise rolls back the transaction
+// and returns ErrItemChanged.
+//
+// The item must be obtained from the same cache under the same key.
+// The check and the commit are atomic with respect to other updates
+// for the key, so this may be used for implementing atomic read-modify-write
+// operations.
+func (txn *SetTxn) CommitIfUnchanged(item *Item) (err error) {
+	txn.dg.CheckLive()
+	item.dg.CheckLive()
+	txn.truncateIfGrowing()
+	buf := txn.unsafeBuf()
+	if txn.offset != len(buf) {
+		err = ErrPartialCommit
+		txn.Rollback()
+		return
+	}
+	if C.ybc_set_txn_commit_if_unchanged(txn.ctx(), item.ctx()) == 0 {
+		err = ErrItemChanged
+	}
+	txn.finish()
+	return
+}
+
 // Rolls back the transaction.
 func (txn *SetTxn) Rollback() {
 	txn.dg.CheckLive()
@@ -766,6 +1240,12 @@ func (txn *SetTxn) Rollback() {
 func (txn *SetTxn) Write(p []byte) (n int, err error) {
 	txn.dg.CheckLive()
 	buf := txn.unsafeBuf()
+	if txn.growth != nil && len(p) > len(buf)-txn.offset {
+		if err = txn.grow(len(p)); err != nil {
+			return
+		}
+		buf = txn.unsafeBuf()
+	}
 
 	n = copy(buf[txn.offset:], p)
 	txn.offset += n
@@ -777,8 +1257,13 @@ func (txn *SetTxn) Write(p []byte) (n int, err error) {
 }
 
 // io.ReaderFrom interface implementation
+//
+// Growing transactions read data until io.EOF.
 func (txn *SetTxn) ReadFrom(r io.Reader) (n int64, err error) {
 	txn.dg.CheckLive()
+	if txn.growth != nil {
+		return txn.readFromGrowing(r)
+	}
 	var nn int
 	buf := txn.unsafeBuf()
 	nn, err = io.ReadFull(r, buf[txn.offset:])
@@ -800,6 +1285,7 @@ func (txn *SetTxn) CommitItemTruncated() (item *Item, err error) {
 // The returned item must be closed with item.Close() call!
 func (txn *SetTxn) CommitItem() (item *Item, err error) {
 	txn.dg.CheckLive()
+	txn.truncateIfGrowing()
 	buf := txn.unsafeBuf()
 	if txn.offset != len(buf) {
 		err = ErrPartialCommit
@@ -813,6 +1299,61 @@ func (txn *SetTxn) CommitItem() (item *Item, err error) {
 	return
 }
 
+func (txn *SetTxn) readFromGrowing(r io.Reader) (n int64, err error) {
+	for {
+		buf := txn.unsafeBuf()
+		if txn.offset == len(buf) {
+			if err = txn.grow(1); err != nil {
+				return
+			}
+			buf = txn.unsafeBuf()
+		}
+		var nn int
+		nn, err = r.Read(buf[txn.offset:])
+		txn.offset += nn
+		n += int64(nn)
+		if err == io.EOF {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Re-allocates growing transaction, so it can hold at least n more bytes.
+//
+// The written data is copied to the new transaction, while the old one
+// is rolled back.
+func (txn *SetTxn) grow(n int) error {
+	buf := txn.unsafeBuf()
+	size := 2 * len(buf)
+	if size < txn.offset+n {
+		size = txn.offset + n
+	}
+	g := txn.growth
+	newTxn, err := g.cache.NewSetTxn(g.key, size, g.ttl)
+	if err != nil {
+		return err
+	}
+	copy(newTxn.unsafeBuf(), buf[:txn.offset])
+	C.ybc_set_txn_rollback(txn.ctx())
+
+	// Swap C transactions instead of copying them, since the cache
+	// may refer to them by pointers.
+	txn.buf, newTxn.buf = newTxn.buf, txn.buf
+	txn.unsafeBufCache = nil
+	newTxn.finish()
+	return nil
+}
+
+func (txn *SetTxn) truncateIfGrowing() {
+	if txn.growth != nil {
+		txn.truncateValue()
+	}
+}
+
 func (txn *SetTxn) truncateValue() {
 	txn.dg.CheckLive()
 	txn.unsafeBufCache = nil
@@ -823,6 +1364,7 @@ func (txn *SetTxn) finish() {
 	txn.dg.Close()
 	txn.unsafeBufCache = nil
 	txn.offset = 0
+	txn.growth = nil
 	releaseSetTxn(txn)
 }
 
@@ -1049,6 +1591,90 @@ func (cfg ClusterConfig) RemoveCluster() {
 	}
 }
 
+// Files for a part of the cache striped across multiple files.
+type StripeFile struct {
+	// Path to index file for the part.
+	//
+	// Leave this field empty if you want temporary cache.
+	IndexFile string
+
+	// Path to data file for the part.
+	//
+	// Leave this field empty if you want temporary cache.
+	DataFile string
+
+	// Data file size (in bytes).
+	//
+	// Leave this field empty (set to 0) for splitting the part
+	// of Config.DataFileSize not taken by other files evenly among files
+	// without DataFileSize.
+	DataFileSize SizeT
+}
+
+// Returns configuration for the cache described by cfg, which stores items
+// in the given files.
+//
+// Items are sharded by keys across the files proportionally to their
+// DataFileSize, so a single cache may exceed the capacity of a single
+// storage and spread I/O across storages if the files are located on distinct
+// devices. MaxItemsCount, HotItemsCount and HotDataSize are split
+// among the files proportionally to their DataFileSize, while the remaining
+// settings are shared by all the files. cfg.IndexFile and cfg.DataFile
+// are ignored.
+//
+// Open the returned configuration with ClusterConfig.OpenCluster().
+// Use the same files in the same order on subsequent opens, since
+// the sharding depends on them.
+func (cfg *Config) Stripe(files ...StripeFile) ClusterConfig {
+	filesCount := len(files)
+	remainingSize := cfg.DataFileSize
+	unsizedFilesCount := SizeT(0)
+	for _, f := range files {
+		if f.DataFileSize == 0 {
+			unsizedFilesCount++
+		} else if f.DataFileSize < remainingSize {
+			remainingSize -= f.DataFileSize
+		} else {
+			remainingSize = 0
+		}
+	}
+	dataFileSizes := make([]SizeT, filesCount)
+	totalSize := SizeT(0)
+	for i, f := range files {
+		dataFileSizes[i] = f.DataFileSize
+		if dataFileSizes[i] == 0 {
+			dataFileSizes[i] = remainingSize / unsizedFilesCount
+		}
+		totalSize += dataFileSizes[i]
+	}
+
+	// The sizes' product may overflow SizeT, so split via float64.
+	split := func(n, size SizeT) SizeT {
+		if totalSize == 0 {
+			return n / SizeT(filesCount)
+		}
+		return SizeT(float64(n) * float64(size) / float64(totalSize))
+	}
+
+	clusterCfg := make(ClusterConfig, filesCount)
+	for i, f := range files {
+		c := *cfg
+		c.IndexFile = f.IndexFile
+		c.DataFile = f.DataFile
+		c.DataFileSize = dataFileSizes[i]
+		c.MaxItemsCount = split(cfg.MaxItemsCount, c.DataFileSize)
+		if c.MaxItemsCount == 0 {
+			// Cluster routes items proportionally to MaxItemsCount,
+			// so each file must hold at least one item.
+			c.MaxItemsCount = 1
+		}
+		c.HotItemsCount = split(cfg.HotItemsCount, c.DataFileSize)
+		c.HotDataSize = split(cfg.HotDataSize, c.DataFileSize)
+		clusterCfg[i] = &c
+	}
+	return clusterCfg
+}
+
 /*******************************************************************************
  * Cluster
  ******************************************************************************/
@@ -1103,6 +1729,21 @@ func (cluster *Cluster) Delete(key []byte) bool {
 	return cluster.cache(key).Delete(key)
 }
 
+// See Cache.Touch()
+func (cluster *Cluster) Touch(key []byte, ttl time.Duration) error {
+	return cluster.cache(key).Touch(key, ttl)
+}
+
+// See Cache.Add()
+func (cluster *Cluster) Add(key []byte, value []byte, ttl time.Duration) error {
+	return cluster.cache(key).Add(key, value, ttl)
+}
+
+// See Cache.Incr()
+func (cluster *Cluster) Incr(key []byte, delta int64, initial uint64, ttl time.Duration) (value uint64, err error) {
+	return cluster.cache(key).Incr(key, delta, initial, ttl)
+}
+
 // See Cache.SetItem()
 func (cluster *Cluster) SetItem(key []byte, value []byte, ttl time.Duration) (item *Item, err error) {
 	return cluster.cache(key).SetItem(key, value, ttl)
@@ -1113,6 +1754,11 @@ func (cluster *Cluster) GetItem(key []byte) (item *Item, err error) {
 	return cluster.cache(key).GetItem(key)
 }
 
+// See Cache.LookupItem()
+func (cluster *Cluster) LookupItem(key []byte) (item *Item, err error) {
+	return cluster.cache(key).LookupItem(key)
+}
+
 // See Cache.GetDeItem()
 func (cluster *Cluster) GetDeItem(key []byte, graceDuration time.Duration) (item *Item, err error) {
 	return cluster.cache(key).GetDeItem(key, graceDuration)
@@ -1128,6 +1774,83 @@ func (cluster *Cluster) NewSetTxn(key []byte, valueSize int, ttl time.Duration)
 	return cluster.cache(key).NewSetTxn(key, valueSize, ttl)
 }
 
+// Returns statistics summed over all the caches in the cluster.
+//
+// See Cache.Stats().
+func (cluster *Cluster) Stats() CacheStats {
+	var stats CacheStats
+	for _, cache := range cluster.caches {
+		s := cache.Stats()
+		stats.ItemsCount += s.ItemsCount
+		stats.MaxItemsCount += s.MaxItemsCount
+		stats.UsedBytes += s.UsedBytes
+		stats.DataFileSize += s.DataFileSize
+		stats.StorageWraps += s.StorageWraps
+		stats.FragmentedBytes += s.FragmentedBytes
+		stats.Hits += s.Hits
+		stats.Misses += s.Misses
+		stats.Evictions += s.Evictions
+	}
+	return stats
+}
+
+// Returns the number of evicted items summed over all the caches
+// in the cluster.
+//
+// See Cache.Evictions().
+func (cluster *Cluster) Evictions() uint64 {
+	var n uint64
+	for _, cache := range cluster.caches {
+		n += cache.Evictions()
+	}
+	return n
+}
+
+// Compacts caches in the cluster one by one.
+//
+// maxMovedBytes limits the size of moved items per cache.
+//
+// See Cache.Compact().
+func (cluster *Cluster) Compact(maxMovedBytes int) int {
+	n := 0
+	for _, cache := range cluster.caches {
+		n += cache.Compact(maxMovedBytes)
+	}
+	return n
+}
+
+// See Cache.SnapshotTo()
+func (cluster *Cluster) SnapshotTo(w io.Writer) error {
+	return writeSnapshot(w, cluster.caches...)
+}
+
+// See Cache.RestoreFrom()
+//
+// The snapshot may be written by a cluster with distinct number of caches
+// or by a standalone cache.
+func (cluster *Cluster) RestoreFrom(r io.Reader) error {
+	return restoreSnapshot(cluster, r)
+}
+
+// See Cache.ForEachItem()
+func (cluster *Cluster) ForEachItem(f func(key []byte, size int, ttl time.Duration) bool) {
+	stopped := false
+	for _, cache := range cluster.caches {
+		cache.ForEachItem(func(key []byte, size int, ttl time.Duration) bool {
+			stopped = !f(key, size, ttl)
+			return !stopped
+		})
+		if stopped {
+			return
+		}
+	}
+}
+
+// See Cache.NewGrowingSetTxn()
+func (cluster *Cluster) NewGrowingSetTxn(key []byte, initialSize int, ttl time.Duration) (txn *SetTxn, err error) {
+	return cluster.cache(key).NewGrowingSetTxn(key, initialSize, ttl)
+}
+
 // See Cache.Clear()
 func (cluster *Cluster) Clear() {
 	for _, cache := range cluster.caches {
@@ -1149,6 +1872,139 @@ func (cluster *Cluster) cache(key []byte) *Cache {
 	return cluster.caches[i]
 }
 
+/*******************************************************************************
+ * Snapshots
+ ******************************************************************************/
+
+// Snapshots start with this header followed by items' records.
+//
+// Each record contains uvarint-encoded key size, key, uvarint-encoded
+// ttl in milliseconds, uvarint-encoded value size and value.
+var snapshotHeader = []byte("ybc-snapshot-v1\n")
+
+// Writes all the live items in the cache to w.
+//
+// The snapshot may be loaded via Cache.RestoreFrom()
+// or Config.OpenFromSnapshot(). Items added, updated or removed while
+// the snapshot is written may be missing in the snapshot. The remaining
+// ttl is saved for each item, so items continue expiring after the restore.
+//
+// This allows warm restarts for anonymous caches, which lose their
+// contents on close.
+func (cache *Cache) SnapshotTo(w io.Writer) error {
+	return writeSnapshot(w, cache)
+}
+
+func writeSnapshot(w io.Writer, caches ...*Cache) error {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(snapshotHeader); err != nil {
+		return err
+	}
+	for _, cache := range caches {
+		if err := cache.writeSnapshotItems(bw); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func (cache *Cache) writeSnapshotItems(bw *bufio.Writer) (err error) {
+	var buf [binary.MaxVarintLen64]byte
+	writeUvarint := func(n uint64) error {
+		_, err := bw.Write(buf[:binary.PutUvarint(buf[:], n)])
+		return err
+	}
+	cache.forEachItemValue(func(key, value []byte, ttl time.Duration) bool {
+		if ttl < time.Millisecond {
+			// The item is about to expire.
+			return true
+		}
+		err := writeUvarint(uint64(len(key)))
+		if err == nil {
+			_, err = bw.Write(key)
+		}
+		if err == nil {
+			err = writeUvarint(uint64(ttl / time.Millisecond))
+		}
+		if err == nil {
+			err = writeUvarint(uint64(len(value)))
+		}
+		if err == nil {
+			_, err = bw.Write(value)
+		}
+		return err == nil
+	})
+	return
+}
+
+// Loads items from the snapshot written by Cache.SnapshotTo().
+//
+// Loaded items overwrite items with the same keys in the cache.
+// Returns ErrInvalidSnapshot if r doesn't contain a valid snapshot.
+func (cache *Cache) RestoreFrom(r io.Reader) error {
+	return restoreSnapshot(cache, r)
+}
+
+// Opens a cache with the given config and loads items from the snapshot
+// written by Cache.SnapshotTo() into it.
+//
+// See Config.OpenCache() for details regarding force.
+func (config *Config) OpenFromSnapshot(r io.Reader, force bool) (cache *Cache, err error) {
+	cache, err = config.OpenCache(force)
+	if err != nil {
+		return
+	}
+	if err = cache.RestoreFrom(r); err != nil {
+		cache.Close()
+		cache = nil
+	}
+	return
+}
+
+func restoreSnapshot(cache Cacher, r io.Reader) error {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(snapshotHeader))
+	if _, err := io.ReadFull(br, header); err != nil || !bytes.Equal(header, snapshotHeader) {
+		return ErrInvalidSnapshot
+	}
+	var key []byte
+	for {
+		keySize, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil || keySize > math.MaxInt32 {
+			return ErrInvalidSnapshot
+		}
+		if uint64(cap(key)) < keySize {
+			key = make([]byte, keySize)
+		}
+		key = key[:keySize]
+		if _, err = io.ReadFull(br, key); err != nil {
+			return ErrInvalidSnapshot
+		}
+		ttl, err := binary.ReadUvarint(br)
+		if err != nil || ttl > uint64(MaxTtl/time.Millisecond) {
+			return ErrInvalidSnapshot
+		}
+		valueSize, err := binary.ReadUvarint(br)
+		if err != nil || valueSize > math.MaxInt32 {
+			return ErrInvalidSnapshot
+		}
+		txn, err := cache.NewSetTxn(key, int(valueSize), time.Duration(ttl)*time.Millisecond)
+		if err != nil {
+			return err
+		}
+		if _, err = txn.ReadFrom(br); err != nil {
+			txn.Rollback()
+			return ErrInvalidSnapshot
+		}
+		if err = txn.Commit(); err != nil {
+			return err
+		}
+	}
+}
+
 /*******************************************************************************
  * Aux functions
  ******************************************************************************/
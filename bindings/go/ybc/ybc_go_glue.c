@@ -28,6 +28,17 @@ static int go_item_remove(struct ybc *cache,
   return ybc_item_remove(cache, &key);
 }
 
+static int go_item_touch(struct ybc *cache,
+    const void *const key_ptr, const size_t key_size, const uint64_t ttl)
+{
+  const struct ybc_key key = {
+    .ptr = key_ptr,
+    .size = key_size,
+  };
+
+  return ybc_item_touch(cache, &key, ttl);
+}
+
 static int go_simple_set(struct ybc *cache,
     const void *const key_ptr, const size_t key_size,
     void *const value_ptr, const size_t value_size, const uint64_t value_ttl)
@@ -106,6 +117,26 @@ static struct go_ret_value go_get_item_and_value(struct ybc *const cache,
   return rv;
 }
 
+struct go_ret_key_value {
+  struct ybc_key key;
+  struct ybc_value value;
+  int result;
+};
+
+static struct go_ret_key_value go_item_next(struct ybc *const cache,
+    struct ybc_item *const item, size_t *const slot_index)
+{
+  struct go_ret_key_value rv;
+
+  rv.result = ybc_item_next(cache, item, slot_index);
+  if (rv.result != 0) {
+    ybc_item_get_key(item, &rv.key);
+    ybc_item_get_value(item, &rv.value);
+  }
+
+  return rv;
+}
+
 struct go_ret_de_value {
   struct ybc_value value;
   enum ybc_de_status status;
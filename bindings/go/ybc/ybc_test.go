@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"sync"
 	"testing"
 	"time"
 )
@@ -218,6 +221,26 @@ func TestSimpleCache_Clear(t *testing.T) {
  * Cache
  ******************************************************************************/
 
+// Cacher with all the optional interfaces implemented by Cache and Cluster.
+type fullCacher interface {
+	Cacher
+	GrowingSetTxnCreator
+	Toucher
+	Adder
+	Incrementer
+	ItemIterator
+	StatsReporter
+	Compacter
+	Snapshotter
+	ItemLookuper
+	EvictionsCounter
+}
+
+var (
+	_ fullCacher = &Cache{}
+	_ fullCacher = &Cluster{}
+)
+
 func newCache(t *testing.T) *Cache {
 	config := newConfig()
 	cache, err := config.OpenCache(true)
@@ -273,6 +296,701 @@ func TestCache_Clear(t *testing.T) {
 	simple_cacher_Clear(cache, t)
 }
 
+func cacher_Touch(cache fullCacher, t *testing.T) {
+	defer cache.Close()
+	key := []byte("test")
+	if err := cache.Touch(key, time.Hour); err != ErrCacheMiss {
+		t.Fatalf("unexpected error: [%v]. Expected ErrCacheMiss", err)
+	}
+
+	value := []byte("aaa")
+	if err := cache.Set(key, value, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Touch(key, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	item, err := cache.GetItem(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValue(t, value, item.Value())
+	if item.Ttl() <= time.Minute || item.Ttl() > time.Hour {
+		t.Fatalf("unexpected item's ttl=%s after touch. Expected %s", item.Ttl(), time.Hour)
+	}
+	item.Close()
+
+	if err := cache.Touch(key, 0); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if _, err := cache.Get(key); err != ErrCacheMiss {
+		t.Fatalf("unexpected error: [%v]. Expected ErrCacheMiss for the expired item", err)
+	}
+}
+
+func TestCache_Touch(t *testing.T) {
+	cache := newCache(t)
+	cacher_Touch(cache, t)
+}
+
+func cacher_Add(cache fullCacher, t *testing.T) {
+	defer cache.Close()
+	key := []byte("test")
+	value := []byte("aaa")
+	if err := cache.Add(key, value, MaxTtl); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Add(key, []byte("bbb"), MaxTtl); err != ErrItemExists {
+		t.Fatalf("unexpected error: [%v]. Expected ErrItemExists", err)
+	}
+	actualValue, err := cache.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValue(t, value, actualValue)
+
+	// Only one of concurrent adds for the same key must succeed.
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		var wg sync.WaitGroup
+		var lock sync.Mutex
+		addedCount := 0
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				err := cache.Add(key, []byte(fmt.Sprintf("value_%d", j)), MaxTtl)
+				if err == ErrItemExists {
+					return
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				lock.Lock()
+				addedCount++
+				lock.Unlock()
+			}(j)
+		}
+		wg.Wait()
+		if addedCount != 1 {
+			t.Fatalf("unexpected number of stored values for key=[%s]: %d. Expected 1", key, addedCount)
+		}
+	}
+}
+
+func TestCache_Add(t *testing.T) {
+	cache := newCache(t)
+	cacher_Add(cache, t)
+}
+
+func cacher_Incr(cache fullCacher, t *testing.T) {
+	defer cache.Close()
+	key := []byte("counter")
+	expectValue := func(value uint64, err error, expectedValue uint64) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != expectedValue {
+			t.Fatalf("unexpected counter value=%d. Expected %d", value, expectedValue)
+		}
+	}
+	value, err := cache.Incr(key, 5, 10, MaxTtl)
+	expectValue(value, err, 10)
+	value, err = cache.Incr(key, 5, 10, MaxTtl)
+	expectValue(value, err, 15)
+	value, err = cache.Incr(key, -20, 10, MaxTtl)
+	expectValue(value, err, 0)
+	actualValue, err := cache.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValue(t, []byte("0"), actualValue)
+
+	if err = cache.Set(key, []byte("foobar"), MaxTtl); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cache.Incr(key, 1, 0, MaxTtl); err != ErrNonNumeric {
+		t.Fatalf("unexpected error: [%v]. Expected ErrNonNumeric", err)
+	}
+
+	// Concurrent increments mustn't be lost, even if the counter
+	// is concurrently touched.
+	key = []byte("concurrent_counter")
+	if _, err = cache.Incr(key, 0, 0, MaxTtl); err != nil {
+		t.Fatal(err)
+	}
+	stopCh := make(chan struct{})
+	touchDoneCh := make(chan struct{})
+	go func() {
+		defer close(touchDoneCh)
+		for {
+			select {
+			case <-stopCh:
+				return
+			default:
+			}
+			if err := cache.Touch(key, MaxTtl); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if _, err := cache.Incr(key, 1, 1, MaxTtl); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(stopCh)
+	<-touchDoneCh
+	value, err = cache.Incr(key, 0, 0, MaxTtl)
+	expectValue(value, err, 4000)
+}
+
+func TestCache_Incr(t *testing.T) {
+	cache := newCache(t)
+	cacher_Incr(cache, t)
+}
+
+func cacher_ForEachItem(cache fullCacher, t *testing.T) {
+	defer cache.Close()
+	expectedSizes := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		value := []byte(fmt.Sprintf("value_%d", i*i))
+		if err := cache.Set([]byte(key), value, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		expectedSizes[key] = len(value)
+	}
+	if !cache.Delete([]byte("key_0")) {
+		t.Fatalf("cannot delete key_0")
+	}
+	delete(expectedSizes, "key_0")
+
+	cache.ForEachItem(func(key []byte, size int, ttl time.Duration) bool {
+		expectedSize, ok := expectedSizes[string(key)]
+		if !ok {
+			t.Fatalf("unexpected key=[%s]", key)
+		}
+		if size != expectedSize {
+			t.Fatalf("unexpected size=%d for key=[%s]. Expected %d", size, key, expectedSize)
+		}
+		if ttl <= 0 || ttl > time.Hour {
+			t.Fatalf("unexpected ttl=%s for key=[%s]", ttl, key)
+		}
+		delete(expectedSizes, string(key))
+		return true
+	})
+	if len(expectedSizes) > 0 {
+		t.Fatalf("%d items weren't visited", len(expectedSizes))
+	}
+
+	n := 0
+	cache.ForEachItem(func(key []byte, size int, ttl time.Duration) bool {
+		n++
+		return n < 10
+	})
+	if n != 10 {
+		t.Fatalf("unexpected number of visited items after the iteration stop: %d. Expected 10", n)
+	}
+}
+
+func TestCache_ForEachItem(t *testing.T) {
+	cache := newCache(t)
+	cacher_ForEachItem(cache, t)
+}
+
+func cacher_Stats(cache fullCacher, t *testing.T) {
+	defer cache.Close()
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		if err := cache.Set(key, []byte("value"), MaxTtl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cache.Set([]byte("expired"), []byte("value"), 0); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if _, err := cache.Get([]byte("key_0")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Get([]byte("missing")); err != ErrCacheMiss {
+		t.Fatalf("unexpected error: [%v]. Expected ErrCacheMiss", err)
+	}
+
+	stats := cache.Stats()
+	if stats.ItemsCount != 100 {
+		t.Fatalf("unexpected ItemsCount=%d. Expected 100", stats.ItemsCount)
+	}
+	if stats.UsedBytes < 100*uint64(len("key_0value")) || stats.UsedBytes > stats.DataFileSize {
+		t.Fatalf("unexpected UsedBytes=%d", stats.UsedBytes)
+	}
+	if stats.MaxItemsCount < stats.ItemsCount {
+		t.Fatalf("unexpected MaxItemsCount=%d", stats.MaxItemsCount)
+	}
+	if stats.Hits != 1 || stats.Misses != 1 {
+		t.Fatalf("unexpected Hits=%d, Misses=%d. Expected 1 and 1", stats.Hits, stats.Misses)
+	}
+	if stats.Evictions != 0 {
+		t.Fatalf("unexpected Evictions=%d. Expected 0", stats.Evictions)
+	}
+
+	// Auxiliary lookups mustn't be counted in hits and misses.
+	item, err := cache.LookupItem([]byte("key_1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	item.Close()
+	if _, err = cache.LookupItem([]byte("missing")); err != ErrCacheMiss {
+		t.Fatalf("unexpected error: [%v]. Expected ErrCacheMiss", err)
+	}
+	stats = cache.Stats()
+	if stats.Hits != 1 || stats.Misses != 1 {
+		t.Fatalf("unexpected Hits=%d, Misses=%d after lookups. Expected 1 and 1", stats.Hits, stats.Misses)
+	}
+
+	cache.Clear()
+	stats = cache.Stats()
+	if stats.ItemsCount != 0 {
+		t.Fatalf("unexpected ItemsCount=%d after Clear(). Expected 0", stats.ItemsCount)
+	}
+}
+
+func TestCache_Stats(t *testing.T) {
+	cache := newCache(t)
+	cacher_Stats(cache, t)
+}
+
+func cacher_Evictions(cache fullCacher, t *testing.T) {
+	defer cache.Close()
+	value := make([]byte, 1000)
+	itemsCount := 0
+	for cache.Stats().StorageWraps < 3 {
+		key := []byte(fmt.Sprintf("key_%d", itemsCount))
+		if err := cache.Set(key, value, MaxTtl); err != nil {
+			t.Fatal(err)
+		}
+		itemsCount++
+	}
+	stats := cache.Stats()
+	evictedCount := uint64(itemsCount) - stats.ItemsCount
+	if stats.Evictions == 0 || stats.Evictions > evictedCount {
+		t.Fatalf("unexpected Evictions=%d. Expected (0..%d]", stats.Evictions, evictedCount)
+	}
+	if n := cache.Evictions(); n != stats.Evictions {
+		t.Fatalf("unexpected Evictions()=%d. Expected %d", n, stats.Evictions)
+	}
+
+	// Items stored before Clear() mustn't be counted as evicted.
+	cache.Clear()
+	evictions := stats.Evictions
+	for i := 0; i < itemsCount/4; i++ {
+		key := []byte(fmt.Sprintf("new_key_%d", i))
+		if err := cache.Set(key, value, MaxTtl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := cache.Stats().Evictions; n != evictions {
+		t.Fatalf("unexpected Evictions=%d after Clear(). Expected %d", n, evictions)
+	}
+}
+
+func TestCache_Evictions(t *testing.T) {
+	cache := newCache(t)
+	cacher_Evictions(cache, t)
+}
+
+func cacher_Compact(cache fullCacher, t *testing.T) {
+	defer cache.Close()
+	for i := 0; i < 2000; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		value := bytes.Repeat([]byte{byte(i)}, 100+(i*37)%1000)
+		if err := cache.Set(key, value, MaxTtl); err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 1 {
+			cache.Delete([]byte(fmt.Sprintf("key_%d", i-1)))
+		}
+	}
+	expectedValues := make(map[string][]byte)
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		if value, err := cache.Get([]byte(key)); err == nil {
+			expectedValues[key] = value
+		}
+	}
+	stats := cache.Stats()
+	if stats.FragmentedBytes == 0 {
+		t.Fatalf("unexpected zero FragmentedBytes")
+	}
+
+	reclaimed := 0
+	for i := 0; i < 1000 && cache.Stats().FragmentedBytes > 0; i++ {
+		reclaimed += cache.Compact(10000)
+	}
+	if reclaimed == 0 {
+		t.Fatalf("nothing has been reclaimed")
+	}
+	if n := cache.Compact(0); n != 0 {
+		t.Fatalf("unexpected reclaimed bytes=%d for compacted cache. Expected 0", n)
+	}
+
+	stats = cache.Stats()
+	if stats.FragmentedBytes != 0 {
+		t.Fatalf("unexpected FragmentedBytes=%d after compaction. Expected 0", stats.FragmentedBytes)
+	}
+	if stats.ItemsCount != uint64(len(expectedValues)) {
+		t.Fatalf("unexpected ItemsCount=%d after compaction. Expected %d", stats.ItemsCount, len(expectedValues))
+	}
+	for key, expectedValue := range expectedValues {
+		value, err := cache.Get([]byte(key))
+		if err != nil {
+			t.Fatalf("cannot obtain item for key=[%s] after compaction: [%s]", key, err)
+		}
+		if !bytes.Equal(value, expectedValue) {
+			t.Fatalf("unexpected value for key=[%s] after compaction", key)
+		}
+	}
+}
+
+func TestCache_Compact(t *testing.T) {
+	cache := newCache(t)
+	cacher_Compact(cache, t)
+}
+
+func TestCache_CompactConcurrent(t *testing.T) {
+	cache := newCache(t)
+	defer cache.Close()
+
+	var wg sync.WaitGroup
+	stopCh := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stopCh:
+					return
+				default:
+				}
+				k := (i * (n + 1)) % 3000
+				key := []byte(fmt.Sprintf("key_%d", k))
+				expectedValue := bytes.Repeat([]byte{byte(k)}, 100+(k*37)%1000)
+				switch i % 3 {
+				case 0:
+					if err := cache.Set(key, expectedValue, MaxTtl); err != nil {
+						t.Error(err)
+						return
+					}
+				case 1:
+					cache.Delete(key)
+				default:
+					value, err := cache.Get(key)
+					if err == nil && !bytes.Equal(value, expectedValue) {
+						t.Errorf("unexpected value for key=[%s]", key)
+						return
+					}
+				}
+			}
+		}(i)
+	}
+	for i := 0; i < 100; i++ {
+		cache.Compact(10000)
+	}
+	close(stopCh)
+	wg.Wait()
+}
+
+func cacher_Snapshot(cache, restored fullCacher, t *testing.T) {
+	defer cache.Close()
+	defer restored.Close()
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		value := []byte(fmt.Sprintf("value_%d", i*i))
+		if err := cache.Set(key, value, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cache.Set([]byte("expired"), []byte("value"), 0); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	var buf bytes.Buffer
+	if err := cache.SnapshotTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.RestoreFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		expectedValue := []byte(fmt.Sprintf("value_%d", i*i))
+		item, err := restored.GetItem(key)
+		if err != nil {
+			t.Fatalf("cannot find restored item for key=[%s]: [%s]", key, err)
+		}
+		value := item.Value()
+		if !bytes.Equal(value, expectedValue) {
+			t.Fatalf("unexpected value=[%s] for key=[%s]. Expected [%s]", value, key, expectedValue)
+		}
+		if ttl := item.Ttl(); ttl <= 0 || ttl > time.Hour {
+			t.Fatalf("unexpected ttl=%s for key=[%s]", ttl, key)
+		}
+		item.Close()
+	}
+	if _, err := restored.Get([]byte("expired")); err != ErrCacheMiss {
+		t.Fatalf("unexpected error: [%v]. Expected ErrCacheMiss", err)
+	}
+
+	if err := restored.RestoreFrom(bytes.NewBufferString("foobar")); err != ErrInvalidSnapshot {
+		t.Fatalf("unexpected error: [%v]. Expected ErrInvalidSnapshot", err)
+	}
+	buf.Reset()
+	if err := cache.SnapshotTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	buf.Truncate(buf.Len() - 1)
+	if err := restored.RestoreFrom(&buf); err != ErrInvalidSnapshot {
+		t.Fatalf("unexpected error: [%v] for truncated snapshot. Expected ErrInvalidSnapshot", err)
+	}
+}
+
+func TestCache_Snapshot(t *testing.T) {
+	cache := newCache(t)
+	restored := newCache(t)
+	cacher_Snapshot(cache, restored, t)
+}
+
+func newChecksumCache(t *testing.T) *Cache {
+	config := newConfig()
+	config.EnableChecksums = true
+	cache, err := config.OpenCache(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache
+}
+
+func TestCache_Checksums(t *testing.T) {
+	simple_cacher_Set_Get_Remove(newChecksumCache(t), t)
+	cacher_Add(newChecksumCache(t), t)
+	cacher_Incr(newChecksumCache(t), t)
+	cacher_ForEachItem(newChecksumCache(t), t)
+	cacher_Compact(newChecksumCache(t), t)
+	cacher_NewSetTxn(newChecksumCache(t), t)
+
+	cache := newChecksumCache(t)
+	defer cache.Close()
+	key := []byte("key")
+	value := bytes.Repeat([]byte("value"), 1000)
+	txn, err := cache.NewGrowingSetTxn(key, 10, MaxTtl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = txn.Write(value); err != nil {
+		txn.Rollback()
+		t.Fatal(err)
+	}
+	if err = txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	actualValue, err := cache.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValue(t, value, actualValue)
+}
+
+func TestCache_Checksums_Corruption(t *testing.T) {
+	config := newConfig()
+	config.DataFile = "foobar.data.checksums"
+	config.IndexFile = "foobar.index.checksums"
+	config.EnableChecksums = true
+	defer config.RemoveCache()
+
+	key := []byte("key")
+	value := bytes.Repeat([]byte("0123456789"), 100)
+	cache, err := config.OpenCache(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cache.Set(key, value, MaxTtl); err != nil {
+		t.Fatal(err)
+	}
+	cache.Close()
+
+	// Items stored with checksums mustn't be visible without checksums.
+	config.EnableChecksums = false
+	cache, err = config.OpenCache(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cache.Get(key); err != ErrCacheMiss {
+		t.Fatalf("unexpected error: [%v]. Expected ErrCacheMiss", err)
+	}
+	cache.Close()
+
+	config.EnableChecksums = true
+	cache, err = config.OpenCache(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actualValue, err := cache.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValue(t, value, actualValue)
+	cache.Close()
+
+	data, err := ioutil.ReadFile(config.DataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := bytes.Index(data, value)
+	if n < 0 {
+		t.Fatalf("cannot find the value in the data file")
+	}
+	data[n+len(value)/2]++
+	if err = ioutil.WriteFile(config.DataFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err = config.OpenCache(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	if _, err = cache.Get(key); err != ErrCacheMiss {
+		t.Fatalf("unexpected error: [%v] for corrupted item. Expected ErrCacheMiss", err)
+	}
+}
+
+func TestCache_ReadOnly(t *testing.T) {
+	config := newConfig()
+	config.DataFile = "foobar.data.readonly"
+	config.IndexFile = "foobar.index.readonly"
+	defer config.RemoveCache()
+
+	// Read-only caches cannot create missing files.
+	config.ReadOnly = true
+	if _, err := config.OpenCache(true); err != ErrOpenFailed {
+		t.Fatalf("unexpected error: [%v]. Expected ErrOpenFailed", err)
+	}
+
+	config.ReadOnly = false
+	cache, err := config.OpenCache(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := []byte("key")
+	value := []byte("value")
+	if err = cache.Set(key, value, MaxTtl); err != nil {
+		t.Fatal(err)
+	}
+	cache.Close()
+
+	// Multiple read-only caches may share the same files.
+	config.ReadOnly = true
+	cache1, err := config.OpenCache(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache1.Close()
+	cache2, err := config.OpenCache(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache2.Close()
+
+	for _, cache := range []*Cache{cache1, cache2} {
+		actualValue, err := cache.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkValue(t, value, actualValue)
+
+		if err = cache.Set(key, value, MaxTtl); err != ErrReadOnly {
+			t.Fatalf("unexpected error: [%v]. Expected ErrReadOnly", err)
+		}
+		if _, err = cache.SetItem(key, value, MaxTtl); err != ErrReadOnly {
+			t.Fatalf("unexpected error: [%v]. Expected ErrReadOnly", err)
+		}
+		if _, err = cache.NewSetTxn(key, len(value), MaxTtl); err != ErrReadOnly {
+			t.Fatalf("unexpected error: [%v]. Expected ErrReadOnly", err)
+		}
+		if err = cache.Touch(key, MaxTtl); err != ErrReadOnly {
+			t.Fatalf("unexpected error: [%v]. Expected ErrReadOnly", err)
+		}
+		if cache.Delete(key) {
+			t.Fatalf("the item cannot be deleted from read-only cache")
+		}
+		cache.Clear()
+		if cache.Compact(0) != 0 {
+			t.Fatalf("read-only cache cannot be compacted")
+		}
+		if _, err = cache.Get(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCache_HugePagesLockInRam(t *testing.T) {
+	config := newConfig()
+	config.EnableHugePages = true
+	config.LockInRam = true
+
+	cache, err := config.OpenCache(true)
+	if err != nil {
+		// The memory cannot be locked due to RLIMIT_MEMLOCK limit.
+		t.Skipf("cannot open the cache: [%s]", err)
+	}
+	cacher_GetItem(cache, t)
+}
+
+func TestConfig_OpenFromSnapshot(t *testing.T) {
+	cache := newCache(t)
+	defer cache.Close()
+	if err := cache.Set([]byte("key"), []byte("value"), MaxTtl); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := cache.SnapshotTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	config := newConfig()
+	restored, err := config.OpenFromSnapshot(&buf, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	value, err := restored.Get([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "value" {
+		t.Fatalf("unexpected value=[%s]. Expected [value]", value)
+	}
+
+	if _, err = config.OpenFromSnapshot(bytes.NewBufferString("foobar"), true); err != ErrInvalidSnapshot {
+		t.Fatalf("unexpected error: [%v]. Expected ErrInvalidSnapshot", err)
+	}
+}
+
 func cacher_SetItem(cache Cacher, t *testing.T) {
 	defer cache.Close()
 	for i := 0; i < 1000; i++ {
@@ -630,6 +1348,59 @@ func TestSetTxn_ReadFrom(t *testing.T) {
 	checkValue(t, value, item.Value())
 }
 
+func TestSetTxn_Growing(t *testing.T) {
+	cache := newCache(t)
+	defer cache.Close()
+
+	key := []byte("key")
+	value := bytes.Repeat([]byte("value"), 1000)
+
+	txn, err := cache.NewGrowingSetTxn(key, 3, MaxTtl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(value); i += 7 {
+		end := i + 7
+		if end > len(value) {
+			end = len(value)
+		}
+		if _, err = txn.Write(value[i:end]); err != nil {
+			txn.Rollback()
+			t.Fatal(err)
+		}
+	}
+	if err = txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	actualValue, err := cache.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValue(t, value, actualValue)
+
+	// The item must be stored with the actual length if the initial size
+	// exceeds it.
+	txn, err = cache.NewGrowingSetTxn(key, len(value)*2, MaxTtl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := txn.ReadFrom(bytes.NewReader(value))
+	if err != nil {
+		txn.Rollback()
+		t.Fatal(err)
+	}
+	if n != int64(len(value)) {
+		txn.Rollback()
+		t.Fatalf("unexpected number of bytes written=%d. Expected %d", n, len(value))
+	}
+	item, err := txn.CommitItem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer item.Close()
+	checkValue(t, value, item.Value())
+}
+
 /*******************************************************************************
  * Item
  ******************************************************************************/
@@ -997,6 +1768,78 @@ func TestCluster_Ops(t *testing.T) {
 	}
 }
 
+func TestConfig_Stripe(t *testing.T) {
+	config := &Config{
+		MaxItemsCount: 3000,
+		DataFileSize:  3 * 1000 * 1000,
+		HotItemsCount: 300,
+	}
+	files := []StripeFile{
+		{
+			IndexFile: "cache.index.0",
+			DataFile:  "cache.data.0",
+		},
+		{
+			IndexFile:    "cache.index.1",
+			DataFile:     "cache.data.1",
+			DataFileSize: 2 * 1000 * 1000,
+		},
+	}
+	clusterConfig := config.Stripe(files...)
+	defer clusterConfig.RemoveCluster()
+
+	expectedSizes := []struct {
+		maxItemsCount, dataFileSize, hotItemsCount SizeT
+	}{
+		{1000, 1000 * 1000, 100},
+		{2000, 2 * 1000 * 1000, 200},
+	}
+	for i, c := range clusterConfig {
+		expected := expectedSizes[i]
+		if c.MaxItemsCount != expected.maxItemsCount || c.DataFileSize != expected.dataFileSize || c.HotItemsCount != expected.hotItemsCount {
+			t.Fatalf("unexpected sizes for file %d: MaxItemsCount=%d, DataFileSize=%d, HotItemsCount=%d. Expected %+v",
+				i, c.MaxItemsCount, c.DataFileSize, c.HotItemsCount, expected)
+		}
+		if c.IndexFile != files[i].IndexFile || c.DataFile != files[i].DataFile {
+			t.Fatalf("unexpected files for file %d: [%s], [%s]", i, c.IndexFile, c.DataFile)
+		}
+	}
+
+	cluster, err := clusterConfig.OpenCluster(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		value := []byte(fmt.Sprintf("value_%d", i))
+		if err = cluster.Set(key, value, MaxTtl); err != nil {
+			cluster.Close()
+			t.Fatal(err)
+		}
+	}
+	for i, cache := range cluster.caches {
+		if n := cache.Stats().ItemsCount; n < 200 || n > 800 {
+			cluster.Close()
+			t.Fatalf("unexpected number of items in file %d: %d", i, n)
+		}
+	}
+	cluster.Close()
+
+	cluster, err = config.Stripe(files...).OpenCluster(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Close()
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		value, err := cluster.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkValue(t, []byte(fmt.Sprintf("value_%d", i)), value)
+	}
+}
+
 func TestCluster_Set_Get_Remove(t *testing.T) {
 	cluster := newCluster(t)
 	simple_cacher_Set_Get_Remove(cluster, t)
@@ -1012,6 +1855,47 @@ func TestCluster_Clear(t *testing.T) {
 	simple_cacher_Clear(cluster, t)
 }
 
+func TestCluster_Touch(t *testing.T) {
+	cluster := newCluster(t)
+	cacher_Touch(cluster, t)
+}
+
+func TestCluster_Add(t *testing.T) {
+	cluster := newCluster(t)
+	cacher_Add(cluster, t)
+}
+
+func TestCluster_Incr(t *testing.T) {
+	cluster := newCluster(t)
+	cacher_Incr(cluster, t)
+}
+
+func TestCluster_ForEachItem(t *testing.T) {
+	cluster := newCluster(t)
+	cacher_ForEachItem(cluster, t)
+}
+
+func TestCluster_Stats(t *testing.T) {
+	cluster := newCluster(t)
+	cacher_Stats(cluster, t)
+}
+
+func TestCluster_Evictions(t *testing.T) {
+	cluster := newCluster(t)
+	cacher_Evictions(cluster, t)
+}
+
+func TestCluster_Compact(t *testing.T) {
+	cluster := newCluster(t)
+	cacher_Compact(cluster, t)
+}
+
+func TestCluster_Snapshot(t *testing.T) {
+	cluster := newCluster(t)
+	restored := newCluster(t)
+	cacher_Snapshot(cluster, restored, t)
+}
+
 func TestCluster_SetItem(t *testing.T) {
 	cluster := newCluster(t)
 	cacher_SetItem(cluster, t)
@@ -1031,3 +1915,138 @@ func TestCluster_NewSetTxn(t *testing.T) {
 	cluster := newCluster(t)
 	cacher_NewSetTxn(cluster, t)
 }
+
+/*******************************************************************************
+ * EncryptedCache
+ ******************************************************************************/
+
+var testEncryptionKey = []byte("0123456789abcdef0123456789abcdef")
+
+var _ Cacher = &EncryptedCache{}
+
+func newEncryptedCacheConfig() *Config {
+	return &Config{
+		MaxItemsCount: 1000 * 10,
+		DataFileSize:  1000 * 1000 * 10,
+		DataFile:      "cache.encrypted",
+	}
+}
+
+func newEncryptedCache(t *testing.T) *EncryptedCache {
+	ec, err := newEncryptedCacheConfig().OpenEncryptedCache(testEncryptionKey, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ec
+}
+
+func TestConfig_OpenEncryptedCache_InvalidConfig(t *testing.T) {
+	config := newEncryptedCacheConfig()
+	if _, err := config.OpenEncryptedCache([]byte("short key"), true); err == nil {
+		t.Fatalf("expected error for invalid key size")
+	}
+	config.DataFile = ""
+	if _, err := config.OpenEncryptedCache(testEncryptionKey, true); err != ErrOpenFailed {
+		t.Fatalf("unexpected error: [%v] for missing data file. Expected ErrOpenFailed", err)
+	}
+	config = newEncryptedCacheConfig()
+	config.IndexFile = "cache.index"
+	if _, err := config.OpenEncryptedCache(testEncryptionKey, true); err != ErrOpenFailed {
+		t.Fatalf("unexpected error: [%v] for index file. Expected ErrOpenFailed", err)
+	}
+	config = newEncryptedCacheConfig()
+	if _, err := config.OpenEncryptedCache(testEncryptionKey, false); err != ErrOpenFailed {
+		t.Fatalf("unexpected error: [%v] for missing file without force. Expected ErrOpenFailed", err)
+	}
+}
+
+func TestEncryptedCache_Set_Get_Remove(t *testing.T) {
+	defer os.Remove(newEncryptedCacheConfig().DataFile)
+	simple_cacher_Set_Get_Remove(newEncryptedCache(t), t)
+}
+
+func TestEncryptedCache_GetItem(t *testing.T) {
+	defer os.Remove(newEncryptedCacheConfig().DataFile)
+	cacher_GetItem(newEncryptedCache(t), t)
+}
+
+func TestEncryptedCache_NewSetTxn(t *testing.T) {
+	defer os.Remove(newEncryptedCacheConfig().DataFile)
+	cacher_NewSetTxn(newEncryptedCache(t), t)
+}
+
+func TestEncryptedCache_Persistence(t *testing.T) {
+	config := newEncryptedCacheConfig()
+	defer os.Remove(config.DataFile)
+
+	ec := newEncryptedCache(t)
+	bigValue := bytes.Repeat([]byte("big secret value "), 3*encryptedFileChunkSize/10)
+	if err := ec.Set([]byte("big secret key"), bigValue, MaxTtl); err != nil {
+		ec.Close()
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("secret key %d", i))
+		value := []byte(fmt.Sprintf("secret value %d", i))
+		if err := ec.Set(key, value, MaxTtl); err != nil {
+			ec.Close()
+			t.Fatal(err)
+		}
+	}
+	if err := ec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(config.DataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("secret")) {
+		t.Fatalf("plaintext is found in the encrypted file")
+	}
+	if _, err = os.Stat(config.DataFile + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("unexpected error: [%v] for the temporary file. Expected missing file", err)
+	}
+
+	ec, err = config.OpenEncryptedCache(testEncryptionKey, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := ec.Get([]byte("big secret key"))
+	if err != nil {
+		ec.Close()
+		t.Fatal(err)
+	}
+	checkValue(t, bigValue, value)
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("secret key %d", i))
+		value, err := ec.Get(key)
+		if err != nil {
+			ec.Close()
+			t.Fatal(err)
+		}
+		checkValue(t, []byte(fmt.Sprintf("secret value %d", i)), value)
+	}
+	if err = ec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = config.OpenEncryptedCache([]byte("fedcba9876543210"), false); err != ErrDecryptFailed {
+		t.Fatalf("unexpected error: [%v] for distinct key. Expected ErrDecryptFailed", err)
+	}
+
+	corruptions := map[string][]byte{
+		"truncated":      data[:len(data)-1],
+		"chunk-dropped":  data[:len(data)-(len(data)-len(encryptedFileHeader)-encryptedFileSaltSize)%(encryptedFileChunkSize+16)],
+		"tampered":       append(append([]byte{}, data[:len(data)/2]...), append([]byte{data[len(data)/2] + 1}, data[len(data)/2+1:]...)...),
+		"invalid-header": append([]byte("foobar"), data[6:]...),
+	}
+	for name, corrupted := range corruptions {
+		if err = ioutil.WriteFile(config.DataFile, corrupted, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = config.OpenEncryptedCache(testEncryptionKey, true); err != ErrDecryptFailed {
+			t.Fatalf("unexpected error: [%v] for %s file. Expected ErrDecryptFailed", err, name)
+		}
+	}
+}
@@ -3,9 +3,10 @@ package memcache
 import (
 	"bufio"
 	"bytes"
-	"github.com/valyala/ybc/bindings/go/ybc"
+	"fmt"
+	"github.com/kireevroi/ybc/bindings/go/ybc"
 	"io"
-	"log"
+	"math"
 	"strconv"
 	"time"
 )
@@ -19,6 +20,40 @@ const (
 
 	// see /proc/sys/net/core/wmem_default
 	defaultOSWriteBufferSize = 224 * 1024
+
+	defaultMaxLoggedLineLength = 64
+
+	defaultMaxKeySize = 250
+
+	defaultMaxLineSize = 1024 * 1024
+
+	defaultVersion = "1.4.0-ybc"
+
+	defaultStatsDInterval   = 10 * time.Second
+	defaultGraphiteInterval = 10 * time.Second
+
+	defaultHotKeysSampleRate = 0.01
+	defaultHotKeysWindow     = time.Minute
+
+	defaultFullnessSampleInterval = time.Second
+	defaultHighPressureThreshold  = 0.9
+	defaultHighPressureHysteresis = 0.05
+
+	defaultParkIdleDelay = time.Second
+
+	defaultMaxUDPRequests = 1024
+)
+
+const (
+	// The maximum time to wait for the client closing half-closed connection
+	// after 'quit' command. See QuitHalfClose.
+	quitDrainTimeout = 5 * time.Second
+)
+
+// Verbosity levels. See Server.Verbosity.
+const (
+	verbosityConns    = 1
+	verbosityCommands = 2
 )
 
 const (
@@ -29,24 +64,43 @@ const (
 
 var (
 	strAdd                 = []byte("add ")
+	strAppend              = []byte("append ")
+	strAuthFailureCrLf     = []byte("CLIENT_ERROR authentication failure\r\n")
+	strAuthenticated       = []byte("Authenticated")
+	strBadDataChunkCrLf    = []byte("CLIENT_ERROR bad data chunk\r\n")
 	strCas                 = []byte("cas ")
 	strCget                = []byte("cget ")
 	strCgetDe              = []byte("cgetde ")
+	strClientError         = []byte("CLIENT_ERROR ")
+	strClientErrorCrLf     = []byte("CLIENT_ERROR bad command line format\r\n")
+	strCmdRejectedCrLf     = []byte("CLIENT_ERROR command rejected\r\n")
 	strCrLf                = []byte("\r\n")
+	strDecr                = []byte("decr ")
 	strDelete              = []byte("delete ")
 	strDeleted             = []byte("DELETED")
 	strDeletedCrLf         = []byte("DELETED\r\n")
 	strEnd                 = []byte("END")
 	strEndCrLf             = []byte("END\r\n")
+	strErrorCrLf           = []byte("ERROR\r\n")
 	strExists              = []byte("EXISTS")
 	strExistsCrLf          = []byte("EXISTS\r\n")
 	strFlushAll            = []byte("flush_all")
 	strFlushAllCrLf        = []byte("flush_all\r\n")
 	strFlushAllWs          = []byte("flush_all ")
 	strFlushAllNoreplyCrLf = []byte("flush_all noreply\r\n")
+	strGat                 = []byte("gat ")
+	strGats                = []byte("gats ")
 	strGet                 = []byte("get ")
 	strGetDe               = []byte("getde ")
+	strGetNoKeys           = []byte("get")
 	strGets                = []byte("gets ")
+	strGetsNoKeys          = []byte("gets")
+	strHotKeys             = []byte("hotkeys")
+	strIncr                = []byte("incr ")
+	strInvalidDeltaCrLf    = []byte("CLIENT_ERROR invalid numeric delta argument\r\n")
+	strLineTooLongCrLf     = []byte("CLIENT_ERROR line too long\r\n")
+	strMultiPacketCrLf     = []byte("SERVER_ERROR multi-packet request not supported\r\n")
+	strNonNumericCrLf      = []byte("CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
 	strNoreply             = []byte("noreply")
 	strNotFound            = []byte("NOT_FOUND")
 	strNotFoundCrLf        = []byte("NOT_FOUND\r\n")
@@ -55,11 +109,30 @@ var (
 	strNotStored           = []byte("NOT_STORED")
 	strNotStoredCrLf       = []byte("NOT_STORED\r\n")
 	strOkCrLf              = []byte("OK\r\n")
+	strPrepend             = []byte("prepend ")
 	strQuit                = []byte("quit")
+	strRateLimitedCrLf     = []byte("SERVER_ERROR rate limit exceeded\r\n")
+	strReadOnlyCrLf        = []byte("SERVER_ERROR read only\r\n")
+	strReplace             = []byte("replace ")
+	strSaslPlain           = []byte("PLAIN")
+	strServerError         = []byte("SERVER_ERROR ")
+	strServerErrorCrLf     = []byte("SERVER_ERROR temporary failure\r\n")
+	strServerErrorOOMCrLf  = []byte("SERVER_ERROR out of memory storing object\r\n")
 	strSet                 = []byte("set ")
+	strStatWs              = []byte("STAT ")
+	strStats               = []byte("stats")
 	strStored              = []byte("STORED")
 	strStoredCrLf          = []byte("STORED\r\n")
+	strTooLargeCrLf        = []byte("SERVER_ERROR object too large for cache\r\n")
+	strTooManyConnsCrLf    = []byte("SERVER_ERROR too many connections\r\n")
+	strTouch               = []byte("touch ")
+	strTouched             = []byte("TOUCHED")
+	strTouchedCrLf         = []byte("TOUCHED\r\n")
+	strUnauthenticatedCrLf = []byte("CLIENT_ERROR unauthenticated\r\n")
 	strValue               = []byte("VALUE ")
+	strVerbosity           = []byte("verbosity ")
+	strVersion             = []byte("version")
+	strVersionWs           = []byte("VERSION ")
 	strWouldBlock          = []byte("WB")
 	strWouldBlockCrLf      = []byte("WB\r\n")
 	strWsNoreplyCrLf       = []byte(" noreply\r\n")
@@ -67,6 +140,7 @@ var (
 
 const (
 	casidSize              = 8
+	checksumSize           = 4
 	flagsSize              = 4
 	validateExpirationSize = 8
 	validateTtlSize        = 4
@@ -89,105 +163,133 @@ func validateKey(key []byte) bool {
 }
 
 func expectEof(line []byte, n int) bool {
-	if len(line) != n {
-		log.Printf("Unexpected length of line=[%s]: %d. Expected %d", line, len(line), n)
-		return false
-	}
-	return true
-}
-
-func matchByte(r *bufio.Reader, ch byte) bool {
-	c, err := r.ReadByte()
-	if err != nil {
-		log.Printf("Unexpected error when reading [%d]: [%s]", ch, err)
-		return false
-	}
-	if c != ch {
-		log.Printf("Unexpected byte read=[%d]. Expected [%d]", c, ch)
-		buf := make([]byte, 100)
-		if readLine(r, &buf) {
-			log.Printf("End of line: [%s]", buf)
-		}
-		return false
-	}
-	return true
-}
-
-func matchStr(r *bufio.Reader, s []byte) bool {
-	for _, c := range s {
-		if !matchByte(r, c) {
-			return false
-		}
-	}
-	return true
+	return len(line) == n
 }
 
-func matchCrLf(r *bufio.Reader) bool {
-	c, err := r.ReadByte()
-	if err != nil {
-		log.Printf("Unexpected error when reading \\r\\n: [%s]", err)
-		return false
-	}
-	switch c {
-	case '\n':
-		return true
-	case '\r':
-		return matchByte(r, '\n')
-	default:
-		return false
-	}
-}
-
-func readBytesUntil(r *bufio.Reader, endCh byte, lineBuf *[]byte) bool {
+// Reads bytes until endCh into lineBuf. The line may exceed the size
+// of the reader buffer.
+//
+// If maxSize is positive, bytes are accumulated in lineBuf only until
+// the line exceeds maxSize. The rest of the too long line is skipped
+// and tooLong is set to true.
+func readBytesUntil(r *bufio.Reader, endCh byte, lineBuf *[]byte, maxSize int) (tooLong, ok bool) {
 	line := *lineBuf
 	line = line[0:0]
 	for {
 		s, err := r.ReadSlice(endCh)
+		if !tooLong {
+			if maxSize > 0 && len(line)+len(s) > maxSize+1 {
+				tooLong = true
+			} else {
+				line = append(line, s...)
+			}
+		}
 		if err == nil {
-			line = append(line, s...)
 			break
 		}
 		if err == bufio.ErrBufferFull {
-			line = append(line, s...)
-			c, err := r.ReadByte()
-			if err != nil {
-				log.Printf("Error when reading next byte from buffer: [%s]", err)
-			}
-			line = append(line, c)
 			continue
 		}
-		if err == io.EOF && len(line) == 0 {
+		if err == io.EOF && len(line) == 0 && !tooLong {
 			*lineBuf = line
-			return true
+			ok = true
+			return
 		}
-		log.Printf("Error when reading bytes until endCh=[%d]: [%s]", endCh, err)
-		return false
+		return
+	}
+	ok = true
+	if tooLong {
+		*lineBuf = line[0:0]
+		return
 	}
 	*lineBuf = line[:len(line)-1]
-	return true
+	return
 }
 
 func readLine(r *bufio.Reader, lineBuf *[]byte) bool {
-	if !readBytesUntil(r, '\n', lineBuf) {
-		return false
+	_, ok := readLineWithTerminator(r, lineBuf)
+	return ok
+}
+
+// Reads the line terminated by either '\r\n' or '\n' into lineBuf.
+//
+// hasCr is set to true if the line is terminated by '\r\n'.
+func readLineWithTerminator(r *bufio.Reader, lineBuf *[]byte) (hasCr, ok bool) {
+	hasCr, _, ok = readLimitedLine(r, lineBuf, 0)
+	return
+}
+
+// Reads the line like readLineWithTerminator, but lines exceeding
+// maxSize bytes are skipped and reported via tooLong.
+//
+// The line size isn't limited if maxSize isn't positive.
+func readLimitedLine(r *bufio.Reader, lineBuf *[]byte, maxSize int) (hasCr, tooLong, ok bool) {
+	if tooLong, ok = readBytesUntil(r, '\n', lineBuf, maxSize); !ok || tooLong {
+		return
 	}
 	line := *lineBuf
 	if len(line) == 0 {
-		return true
+		return
 	}
 	lastN := len(line) - 1
 	if line[lastN] == '\r' {
 		line = line[:lastN]
+		hasCr = true
 	}
 	*lineBuf = line
-	return true
+	return
 }
 
-func nextToken(line []byte, n *int, entity string) []byte {
+// Replaces runs of spaces and tabs in the given line with a single space
+// and strips leading and trailing whitespace.
+//
+// The line is modified in place.
+func collapseWhitespace(line []byte) []byte {
+	n := 0
+	pendingSpace := false
+	for _, ch := range line {
+		if ch == ' ' || ch == '\t' {
+			pendingSpace = n > 0
+			continue
+		}
+		if pendingSpace {
+			line[n] = ' '
+			n++
+			pendingSpace = false
+		}
+		line[n] = ch
+		n++
+	}
+	return line[:n]
+}
+
+// Returns the first maxLength bytes of the given line suitable for logging.
+//
+// Non-printable bytes are hex-escaped, so binary garbage doesn't corrupt logs.
+func formatLoggedLine(line []byte, maxLength int) string {
+	truncated := false
+	if len(line) > maxLength {
+		line = line[:maxLength]
+		truncated = true
+	}
+	var buf bytes.Buffer
+	for _, c := range line {
+		if c >= 0x20 && c < 0x7f && c != '\\' {
+			buf.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&buf, "\\x%02x", c)
+	}
+	if truncated {
+		buf.WriteString("...")
+	}
+	return buf.String()
+}
+
+func nextToken(line []byte, n *int) []byte {
 	first := *n
 	first += 1
 	if first >= len(line) {
-		log.Printf("Cannot find entity=[%s] in line=[%s]: end of line", entity, line)
 		return nil
 	}
 	last := bytes.IndexByte(line[first:], ' ')
@@ -197,7 +299,6 @@ func nextToken(line []byte, n *int, entity string) []byte {
 		last += first
 	}
 	if first == last {
-		log.Printf("Cannot find entity=[%s] in line=[%s]: unexpected whitespace", entity, line)
 		return nil
 	}
 	*n = last
@@ -207,7 +308,10 @@ func nextToken(line []byte, n *int, entity string) []byte {
 func parseUint64(s []byte) (n uint64, ok bool) {
 	for _, c := range s {
 		if c < '0' || c > '9' {
-			log.Printf("Cannot convert s=[%s] to integer", s)
+			ok = false
+			return
+		}
+		if n > (math.MaxUint64-uint64(c-'0'))/10 {
 			ok = false
 			return
 		}
@@ -235,7 +339,6 @@ func parseInt(s []byte) (n int, ok bool) {
 		return
 	}
 	if n64 >= (uint64(1) << 31) {
-		log.Printf("Too big number for int=%d", n64)
 		ok = false
 		return
 	}
@@ -252,7 +355,6 @@ func parseUint32(s []byte) (n uint32, ok bool) {
 		return
 	}
 	if n64 >= (uint64(1) << 32) {
-		log.Printf("Too big number for uint32=%d", n64)
 		ok = false
 		return
 	}
@@ -260,24 +362,31 @@ func parseUint32(s []byte) (n uint32, ok bool) {
 	return
 }
 
-func parseExpiration(s []byte) (expiration time.Duration, ok bool) {
+func parseExpiration(s []byte, now time.Time) (expiration time.Duration, ok bool) {
 	t, ok := parseInt(s)
 	if !ok {
 		return
 	}
+	expiration = secondsToExpiration(t, now)
+	return
+}
+
+// Converts memcached expiration in seconds to the duration.
+//
+// 0 means 'no expiration', while values exceeding 30 days are treated
+// as unix timestamps, which are converted to the duration relative to now.
+func secondsToExpiration(t int, now time.Time) time.Duration {
 	if t == 0 {
-		expiration = maxExpiration
-	} else if t > maxExpirationSeconds {
-		expiration = time.Unix(int64(t), 0).Sub(time.Now())
-	} else {
-		expiration = time.Second * time.Duration(t)
+		return maxExpiration
 	}
-	ok = true
-	return
+	if t > maxExpirationSeconds {
+		return time.Unix(int64(t), 0).Sub(now)
+	}
+	return time.Second * time.Duration(t)
 }
 
 func parseFlagsToken(line []byte, n *int) (flags uint32, ok bool) {
-	flagsStr := nextToken(line, n, "flags")
+	flagsStr := nextToken(line, n)
 	if flagsStr == nil {
 		ok = false
 		return
@@ -287,7 +396,7 @@ func parseFlagsToken(line []byte, n *int) (flags uint32, ok bool) {
 }
 
 func parseSizeToken(line []byte, n *int) (size int, ok bool) {
-	sizeStr := nextToken(line, n, "size")
+	sizeStr := nextToken(line, n)
 	if sizeStr == nil {
 		ok = false
 		return
@@ -296,18 +405,18 @@ func parseSizeToken(line []byte, n *int) (size int, ok bool) {
 	return
 }
 
-func parseExpirationToken(line []byte, n *int) (expiration time.Duration, ok bool) {
-	expirationStr := nextToken(line, n, "expiration")
+func parseExpirationToken(line []byte, n *int, now time.Time) (expiration time.Duration, ok bool) {
+	expirationStr := nextToken(line, n)
 	if expirationStr == nil {
 		ok = false
 		return
 	}
-	expiration, ok = parseExpiration(expirationStr)
+	expiration, ok = parseExpiration(expirationStr, now)
 	return
 }
 
-func parseUint64Token(line []byte, n *int, tokenName string) (n64 uint64, ok bool) {
-	s := nextToken(line, n, tokenName)
+func parseUint64Token(line []byte, n *int) (n64 uint64, ok bool) {
+	s := nextToken(line, n)
 	if s == nil {
 		ok = false
 		return
@@ -316,8 +425,8 @@ func parseUint64Token(line []byte, n *int, tokenName string) (n64 uint64, ok boo
 	return
 }
 
-func parseUint32Token(line []byte, n *int, tokenName string) (n32 uint32, ok bool) {
-	s := nextToken(line, n, tokenName)
+func parseUint32Token(line []byte, n *int) (n32 uint32, ok bool) {
+	s := nextToken(line, n)
 	if s == nil {
 		ok = false
 		return
@@ -326,8 +435,8 @@ func parseUint32Token(line []byte, n *int, tokenName string) (n32 uint32, ok boo
 	return
 }
 
-func parseMillisecondsToken(line []byte, n *int, tokenName string) (duration time.Duration, ok bool) {
-	s := nextToken(line, n, tokenName)
+func parseMillisecondsToken(line []byte, n *int) (duration time.Duration, ok bool) {
+	s := nextToken(line, n)
 	if s == nil {
 		ok = false
 		return
@@ -341,11 +450,7 @@ func parseMillisecondsToken(line []byte, n *int, tokenName string) (duration tim
 }
 
 func writeByte(w *bufio.Writer, c byte) bool {
-	if err := w.WriteByte(c); err != nil {
-		log.Printf("Cannot write byte [%d] to output stream: [%s]", c, err)
-		return false
-	}
-	return true
+	return w.WriteByte(c) == nil
 }
 
 func writeWs(w *bufio.Writer) bool {
@@ -353,11 +458,14 @@ func writeWs(w *bufio.Writer) bool {
 }
 
 func writeStr(w *bufio.Writer, s []byte) bool {
-	if _, err := w.Write(s); err != nil {
-		log.Printf("Cannot write %d bytes to output stream: [%s]", len(s), err)
-		return false
-	}
-	return true
+	_, err := w.Write(s)
+	return err == nil
+}
+
+// Writes the given string without converting it to a byte slice.
+func writeString(w *bufio.Writer, s string) bool {
+	_, err := w.WriteString(s)
+	return err == nil
 }
 
 func writeUint64(w *bufio.Writer, n uint64, scratchBuf *[]byte) bool {
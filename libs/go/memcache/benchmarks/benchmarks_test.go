@@ -0,0 +1,160 @@
+package benchmarks
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kireevroi/ybc/bindings/go/ybc"
+	"github.com/kireevroi/ybc/libs/go/memcache"
+)
+
+// Synthetic workload executed by runWorkload().
+type workload struct {
+	// Requests sent once before the benchmark starts.
+	setupRequest  string
+	setupResponse string
+
+	// Requests sent on each benchmark iteration.
+	request  string
+	response string
+}
+
+// Runs the workload on the server over an in-memory connection.
+func runWorkload(w *workload, b *testing.B) {
+	config := ybc.Config{
+		MaxItemsCount: 100 * 1000,
+		DataFileSize:  64 * 1000 * 1000,
+	}
+	cache, err := config.OpenCache(true)
+	if err != nil {
+		b.Fatalf("Cannot open cache: [%s]", err)
+	}
+	defer cache.Close()
+
+	s := &memcache.Server{
+		Cache:      cache,
+		ListenAddr: "localhost:0",
+	}
+	if err := s.Start(); err != nil {
+		b.Fatalf("Cannot start the server: [%s]", err)
+	}
+	defer s.Stop()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go s.ServeConn(serverConn)
+
+	// Requests are written in a separate goroutine, since the server
+	// may block on writing responses to the unbuffered connection
+	// before reading the whole request.
+	requestsCh := make(chan []byte)
+	writerDone := make(chan error, 1)
+	go func() {
+		for request := range requestsCh {
+			if _, err := clientConn.Write(request); err != nil {
+				writerDone <- err
+				return
+			}
+		}
+		writerDone <- nil
+	}()
+	defer func() {
+		close(requestsCh)
+		<-writerDone
+	}()
+
+	exchange := func(request []byte, response []byte) {
+		requestsCh <- request
+		if _, err := io.ReadFull(clientConn, response); err != nil {
+			b.Fatalf("Cannot read the response: [%s]", err)
+		}
+	}
+	if w.setupRequest != "" {
+		response := make([]byte, len(w.setupResponse))
+		exchange([]byte(w.setupRequest), response)
+		if string(response) != w.setupResponse {
+			b.Fatalf("Unexpected setup response=[%s]. Expected [%s]", response, w.setupResponse)
+		}
+	}
+
+	request := []byte(w.request)
+	response := make([]byte, len(w.response))
+	b.SetBytes(int64(len(w.request) + len(w.response)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	startTime := time.Now()
+	for i := 0; i < b.N; i++ {
+		exchange(request, response)
+	}
+	b.ReportMetric(float64(b.N)/time.Since(startTime).Seconds(), "ops/s")
+	b.StopTimer()
+	if string(response) != w.response {
+		b.Fatalf("Unexpected response=[%s]. Expected [%s]", response, w.response)
+	}
+}
+
+func setRequest(key, value string) string {
+	return fmt.Sprintf("set %s 0 0 %d\r\n%s\r\n", key, len(value), value)
+}
+
+func getResponse(key, value string) string {
+	return fmt.Sprintf("VALUE %s 0 %d\r\n%s\r\nEND\r\n", key, len(value), value)
+}
+
+func BenchmarkGetHeavy(b *testing.B) {
+	value := strings.Repeat("x", 100)
+	runWorkload(&workload{
+		setupRequest:  setRequest("key", value),
+		setupResponse: "STORED\r\n",
+		request:       "get key\r\n",
+		response:      getResponse("key", value),
+	}, b)
+}
+
+func BenchmarkSetHeavy(b *testing.B) {
+	runWorkload(&workload{
+		request:  setRequest("key", strings.Repeat("x", 100)),
+		response: "STORED\r\n",
+	}, b)
+}
+
+func BenchmarkMixed(b *testing.B) {
+	value := strings.Repeat("x", 100)
+	runWorkload(&workload{
+		request:  setRequest("key", value) + "get key\r\nget missing\r\n",
+		response: "STORED\r\n" + getResponse("key", value) + "END\r\n",
+	}, b)
+}
+
+func BenchmarkPipelined(b *testing.B) {
+	const requestsCount = 16
+	value := strings.Repeat("x", 100)
+	var setup, setupResponse, request, response strings.Builder
+	for i := 0; i < requestsCount; i++ {
+		key := fmt.Sprintf("key%d", i)
+		setup.WriteString(setRequest(key, value))
+		setupResponse.WriteString("STORED\r\n")
+		request.WriteString("get " + key + "\r\n")
+		response.WriteString(getResponse(key, value))
+	}
+	runWorkload(&workload{
+		setupRequest:  setup.String(),
+		setupResponse: setupResponse.String(),
+		request:       request.String(),
+		response:      response.String(),
+	}, b)
+}
+
+func BenchmarkLargeValues(b *testing.B) {
+	value := strings.Repeat("x", 1024*1024)
+	runWorkload(&workload{
+		setupRequest:  setRequest("key", value),
+		setupResponse: "STORED\r\n",
+		request:       "get key\r\n",
+		response:      getResponse("key", value),
+	}, b)
+}
@@ -0,0 +1,9 @@
+// Benchmarks for the memcache server connection handler.
+//
+// Benchmarks drive memcache.Server over in-memory connections returned
+// by net.Pipe(), so they measure request parsing, cache access
+// and response writing without network overhead. Each benchmark
+// reports ops/s and allocations per operation:
+//
+//	go test -bench . -benchmem github.com/kireevroi/ybc/libs/go/memcache/benchmarks
+package benchmarks
@@ -2,8 +2,8 @@ package memcache
 
 import (
 	"encoding/binary"
-	"github.com/valyala/ybc/bindings/go/ybc"
-	"log"
+	"errors"
+	"github.com/kireevroi/ybc/bindings/go/ybc"
 	"time"
 )
 
@@ -52,6 +52,44 @@ type CachingClient struct {
 	//
 	// Currently ybc.Cache and ybc.Cluster may be passed here.
 	Cache ybc.Cacher
+
+	// What to do when validateTtl passed to *WithValidateTtl*() methods
+	// exceeds item's expiration.
+	// Optional parameter.
+	//
+	// By default such items are stored as is, i.e. locally cached items
+	// may be returned without revalidation after they expire on the server.
+	ValidateTtlMode ValidateTtlMode
+}
+
+var ErrValidateTtlExceedsExpiration = errors.New("memcache.CachingClient: validateTtl exceeds expiration")
+
+// Determines CachingClient behavior when validateTtl exceeds
+// item's expiration.
+type ValidateTtlMode int
+
+const (
+	// Store validateTtl as is.
+	ValidateTtlKeep = ValidateTtlMode(iota)
+
+	// Return ErrValidateTtlExceedsExpiration without storing the item.
+	ValidateTtlReject
+
+	// Clamp validateTtl to item's expiration.
+	ValidateTtlClamp
+)
+
+func (c *CachingClient) checkValidateTtl(item *Item, validateTtl time.Duration) (time.Duration, error) {
+	if item.Expiration <= 0 || validateTtl <= item.Expiration {
+		return validateTtl, nil
+	}
+	switch c.ValidateTtlMode {
+	case ValidateTtlReject:
+		return 0, ErrValidateTtlExceedsExpiration
+	case ValidateTtlClamp:
+		return item.Expiration, nil
+	}
+	return validateTtl, nil
 }
 
 const metadataSize = casidSize + flagsSize + validateTtlSize + validateExpirationSize
@@ -62,7 +100,7 @@ func writeItemMetadata(cache ybc.Cacher, key []byte, size int, casid uint64, fla
 	size += metadataSize
 	txn, err := cache.NewSetTxn(key, size, ybc.MaxTtl)
 	if err != nil {
-		log.Printf("Unexpected error in Cache.NewSetTxn(size=%d): [%s]", size, err)
+		logf(LogLevelError, "Unexpected error in Cache.NewSetTxn(size=%d): [%s]", size, err)
 		return nil
 	}
 
@@ -73,10 +111,10 @@ func writeItemMetadata(cache ybc.Cacher, key []byte, size int, casid uint64, fla
 	binary.LittleEndian.PutUint64(buf[casidSize+flagsSize+validateTtlSize:], validateExpiration64)
 	n, err := txn.Write(buf[:])
 	if err != nil {
-		log.Fatalf("Error in SetTxn.Write(): [%s]", err)
+		fatalf("Error in SetTxn.Write(): [%s]", err)
 	}
 	if n != len(buf) {
-		log.Fatalf("Unexpected result returned from SetTxn.Write(): %d. Expected %d", n, len(buf))
+		fatalf("Unexpected result returned from SetTxn.Write(): %d. Expected %d", n, len(buf))
 	}
 	return txn
 }
@@ -85,11 +123,11 @@ func readItemMetadata(it *ybc.Item) (casid uint64, flags uint32, validateExpirat
 	var buf [metadataSize]byte
 	n, err := it.Read(buf[:])
 	if err != nil {
-		log.Printf("Cannot read metadata for cached item: [%s]", err)
+		logf(LogLevelError, "Cannot read metadata for cached item: [%s]", err)
 		return
 	}
 	if n != len(buf) {
-		log.Printf("Unexpected result returned from ybc.Item.Read(): %d. Expected %d", n, len(buf))
+		logf(LogLevelError, "Unexpected result returned from ybc.Item.Read(): %d. Expected %d", n, len(buf))
 		return
 	}
 	casid = binary.LittleEndian.Uint64(buf[:])
@@ -103,7 +141,7 @@ func readItemMetadata(it *ybc.Item) (casid uint64, flags uint32, validateExpirat
 
 func cacheItem(cache ybc.Cacher, item *Item) error {
 	if len(item.Value) < validateTtlSize {
-		log.Printf("Cannot read validateTtl from too short item.Value. Its' size is %d bytes, while expected size should be greater than %d", len(item.Value), validateTtlSize-1)
+		logf(LogLevelWarning, "Cannot read validateTtl from too short item.Value. Its' size is %d bytes, while expected size should be greater than %d", len(item.Value), validateTtlSize-1)
 		return ErrCacheMiss
 	}
 	validateTtl := binary.LittleEndian.Uint32(item.Value)
@@ -117,10 +155,10 @@ func cacheItem(cache ybc.Cacher, item *Item) error {
 	size := len(item.Value)
 	n, err := txn.Write(item.Value)
 	if err != nil {
-		log.Fatalf("Unexpected error in SetTxn.Write(size=%d): [%s]", size, err)
+		fatalf("Unexpected error in SetTxn.Write(size=%d): [%s]", size, err)
 	}
 	if n != size {
-		log.Fatalf("Unexpected number of bytes written in SetTxn.Write(size=%d): %d", size, n)
+		fatalf("Unexpected number of bytes written in SetTxn.Write(size=%d): %d", size, n)
 	}
 	txn.Commit()
 	return nil
@@ -145,10 +183,10 @@ func setItemValue(it *ybc.Item, item *Item) error {
 	item.Value = make([]byte, size)
 	n, err := it.Read(item.Value)
 	if err != nil {
-		log.Fatalf("Unexpected error in Item.Read(size=%d): [%s]", size, err)
+		fatalf("Unexpected error in Item.Read(size=%d): [%s]", size, err)
 	}
 	if n != size {
-		log.Fatalf("Unexpected number of bytes read in Item.Read(size=%d): %d", size, n)
+		fatalf("Unexpected number of bytes read in Item.Read(size=%d): %d", size, n)
 	}
 	return nil
 }
@@ -165,10 +203,10 @@ func updateLocalItem(cache ybc.Cacher, it *ybc.Item, key []byte, casid uint64, f
 
 	n, err := txn.ReadFrom(it)
 	if err != nil {
-		log.Fatalf("Unexpected error in SetTxn.ReadFrom(size=%d): [%s]", size, err)
+		fatalf("Unexpected error in SetTxn.ReadFrom(size=%d): [%s]", size, err)
 	}
 	if n != int64(size) {
-		log.Fatalf("Unexpected number of bytes copied in SetTxn.ReadFrom(size=%d): %d", size, n)
+		fatalf("Unexpected number of bytes copied in SetTxn.ReadFrom(size=%d): %d", size, n)
 	}
 }
 
@@ -209,7 +247,7 @@ func (c *CachingClient) Get(item *Item) error {
 		return getAndCacheRemoteItem(c.Client, c.Cache, item)
 	}
 	if err != nil {
-		log.Fatalf("Unexpected error returned from Cache.GetItem() for key=[%s]: [%s]", item.Key, err)
+		fatalf("Unexpected error returned from Cache.GetItem() for key=[%s]: [%s]", item.Key, err)
 	}
 	// do not use defer it.Close() for performance reasons.
 
@@ -249,7 +287,7 @@ func (c *CachingClient) GetDe(item *Item, graceDuration time.Duration) error {
 		return getDeAndCacheRemoteItem(c.Client, c.Cache, item, graceDuration)
 	}
 	if err != nil {
-		log.Fatalf("Unexpected error returned from Cache.GetDeItem() for key=[%s]: [%s]", item.Key, err)
+		fatalf("Unexpected error returned from Cache.GetDeItem() for key=[%s]: [%s]", item.Key, err)
 	}
 	// do not use defer it.Close() for performance reasons.
 
@@ -291,6 +329,10 @@ func prependValidateTtl(value []byte, validateTtl time.Duration) []byte {
 // bandiwdth between the client and memcache servers is saved if the average
 // item size exceeds ~100 bytes.
 func (c *CachingClient) SetWithValidateTtl(item *Item, validateTtl time.Duration) error {
+	validateTtl, err := c.checkValidateTtl(item, validateTtl)
+	if err != nil {
+		return err
+	}
 	c.Cache.Delete(item.Key)
 	item.Value = prependValidateTtl(item.Value, validateTtl)
 	return c.Client.Set(item)
@@ -298,7 +340,14 @@ func (c *CachingClient) SetWithValidateTtl(item *Item, validateTtl time.Duration
 
 // The same as CachingClient.SetWithValidateTtl(), but doesn't wait
 // for completion of the operation.
+//
+// The item is silently dropped if validateTtl exceeds item's expiration
+// and ValidateTtlMode is set to ValidateTtlReject.
 func (c *CachingClient) SetWithValidateTtlNowait(item *Item, validateTtl time.Duration) {
+	validateTtl, err := c.checkValidateTtl(item, validateTtl)
+	if err != nil {
+		return
+	}
 	c.Cache.Delete(item.Key)
 	item.Value = prependValidateTtl(item.Value, validateTtl)
 	c.Client.SetNowait(item)
@@ -321,6 +370,10 @@ func (c *CachingClient) Set(item *Item) error {
 // bandwidth between the client and memcache servers is saved if the average
 // item size exceeds ~100 bytes.
 func (c *CachingClient) AddWithValidateTtl(item *Item, validateTtl time.Duration) error {
+	validateTtl, err := c.checkValidateTtl(item, validateTtl)
+	if err != nil {
+		return err
+	}
 	c.Cache.Delete(item.Key)
 	item.Value = prependValidateTtl(item.Value, validateTtl)
 	return c.Client.Add(item)
@@ -343,6 +396,10 @@ func (c *CachingClient) Add(item *Item) error {
 // bandwidth between the client and memcache servers is saved if the average
 // item size exceeds ~100 bytes.
 func (c *CachingClient) CasWithValidateTtl(item *Item, validateTtl time.Duration) error {
+	validateTtl, err := c.checkValidateTtl(item, validateTtl)
+	if err != nil {
+		return err
+	}
 	c.Cache.Delete(item.Key)
 	item.Value = prependValidateTtl(item.Value, validateTtl)
 	return c.Client.Cas(item)
@@ -2,7 +2,7 @@ package memcache
 
 import (
 	"bytes"
-	"github.com/valyala/ybc/bindings/go/ybc"
+	"github.com/kireevroi/ybc/bindings/go/ybc"
 	"testing"
 	"time"
 )
@@ -132,3 +132,62 @@ func TestCachingClient_SetGetDelete(t *testing.T) {
 		t.Fatalf("Unexpected error in CachingClient.Delete() on already deleted item: [%s]", err)
 	}
 }
+
+func checkValidateTtlMode(mode ValidateTtlMode, t *testing.T) {
+	c, s, cache := newCachingClientServerCache(t)
+	defer cache.Close()
+	defer s.Stop()
+	defer c.Cache.Close()
+	defer c.Client.(Cacher).Stop()
+
+	c.ValidateTtlMode = mode
+
+	key := []byte("key")
+	value := []byte("value")
+	expiration := time.Second
+	item := Item{
+		Key:        key,
+		Value:      value,
+		Expiration: expiration,
+	}
+	err := c.SetWithValidateTtl(&item, expiration*10)
+	if mode == ValidateTtlReject {
+		if err != ErrValidateTtlExceedsExpiration {
+			t.Fatalf("Unexpected error returned from CachingClient.SetWithValidateTtl(): [%s]. Expected ErrValidateTtlExceedsExpiration", err)
+		}
+		item.Value = nil
+		if err = c.Get(&item); err != ErrCacheMiss {
+			t.Fatalf("Unexpected error returned from CachingClient.Get() for rejected item: [%s]. Expected ErrCacheMiss", err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("Error in CachingClient.SetWithValidateTtl(): [%s]", err)
+	}
+
+	// Populate the local cache.
+	item.Value = nil
+	if err = c.Get(&item); err != nil {
+		t.Fatalf("Error in CachingClient.Get(): [%s]", err)
+	}
+	verifyItem(&item, value, 0, "clamp", t)
+
+	it, err := c.Cache.GetItem(key)
+	if err != nil {
+		t.Fatalf("Cannot find locally cached item: [%s]", err)
+	}
+	defer it.Close()
+	_, _, _, validateTtl, ok := readItemMetadata(it)
+	if !ok {
+		t.Fatalf("Cannot read metadata for locally cached item")
+	}
+	expectedValidateTtl := uint32(expiration / time.Millisecond)
+	if validateTtl != expectedValidateTtl {
+		t.Fatalf("Unexpected validateTtl=%d. Expected %d", validateTtl, expectedValidateTtl)
+	}
+}
+
+func TestCachingClient_ValidateTtlMode(t *testing.T) {
+	checkValidateTtlMode(ValidateTtlReject, t)
+	checkValidateTtlMode(ValidateTtlClamp, t)
+}
@@ -3,12 +3,13 @@ package memcache
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,11 +22,23 @@ var (
 	ErrNilValue             = errors.New("memcache.Client: nil value")
 	ErrNotModified          = errors.New("memcache.Client: item not modified")
 	ErrAlreadyExists        = errors.New("memcache.Client: the item already exists")
+	ErrNotStored            = errors.New("memcache.Client: the item isn't stored")
+	ErrNonNumeric           = errors.New("memcache.Client: the value isn't a decimal number")
+	ErrServerError          = errors.New("memcache.Client: the server returned an error")
+
+	// Alias for ErrCasidMismatch.
+	ErrCasConflict = ErrCasidMismatch
 )
 
 const (
 	defaultConnectionsCount        = 4
 	defaultMaxPendingRequestsCount = 1024
+
+	// The maximum number of operations sent in a single request
+	// by Client.Batch(). Bigger batches are split into multiple requests,
+	// so the server doesn't block on sending responses, which aren't read
+	// until the whole request is sent.
+	maxBatchRequestOpsCount = 1024
 )
 
 // Memcache client configuration. Can be passed to Client and DistributedClient.
@@ -69,6 +82,19 @@ type ClientConfig struct {
 	// The size in bytes of OS-supplied write buffer per TCP connection.
 	// Optional parameter.
 	OSWriteBufferSize int
+
+	// Logger for client messages.
+	// Optional parameter.
+	//
+	// By default DefaultLogger is used.
+	Logger Logger
+
+	// The prefix for the expvar variable with client counters.
+	// Counters are published under ExpvarPrefix + "client." + ServerAddr
+	// name, e.g. "memcache.client.localhost:11211" for "memcache." prefix,
+	// so they are exposed at /debug/vars.
+	// Optional parameter. Counters aren't published if the prefix is empty.
+	ExpvarPrefix string
 }
 
 // Fast memcache client.
@@ -109,6 +135,9 @@ type Client struct {
 
 	requests chan tasker
 	done     *sync.WaitGroup
+
+	requestsCount              uint64
+	communicationFailuresCount uint64
 }
 
 // Memcache item.
@@ -146,6 +175,12 @@ type tasker interface {
 	Wait() bool
 }
 
+// Tasker, which may be waited with a context.
+type ctxTasker interface {
+	tasker
+	WaitCtx(ctx context.Context) (ok bool, err error)
+}
+
 func requestsSender(w *bufio.Writer, requests <-chan tasker, responses chan<- tasker, c net.Conn, done *sync.WaitGroup) {
 	defer done.Done()
 	defer w.Flush()
@@ -166,6 +201,7 @@ func requestsSender(w *bufio.Writer, requests <-chan tasker, responses chan<- ta
 			break
 		}
 		if !t.WriteRequest(w, &scratchBuf) {
+			logf(LogLevelWarning, "Cannot send request to %s: [%s]", c.RemoteAddr(), w.Flush())
 			t.Done(false)
 			break
 		}
@@ -178,6 +214,7 @@ func responsesReceiver(r *bufio.Reader, responses <-chan tasker, c net.Conn, don
 	line := make([]byte, 0, 1024)
 	for t := range responses {
 		if !t.ReadResponse(r, &line) {
+			logf(LogLevelWarning, "Cannot read response from %s", c.RemoteAddr())
 			t.Done(false)
 			c.Close()
 			break
@@ -192,21 +229,21 @@ func responsesReceiver(r *bufio.Reader, responses <-chan tasker, c net.Conn, don
 func handleAddr(c *Client) {
 	tcpAddr, err := net.ResolveTCPAddr("tcp", c.ServerAddr)
 	if err != nil {
-		log.Printf("Cannot resolve ServerAddr=[%s]: [%s]", c.ServerAddr, err)
+		c.logf(LogLevelError, "Cannot resolve ServerAddr=[%s]: [%s]", c.ServerAddr, err)
 		return
 	}
 	conn, err := net.DialTCP("tcp", nil, tcpAddr)
 	if err != nil {
-		log.Printf("Cannot establish tcp connection to addr=[%s]: [%s]", tcpAddr, err)
+		c.logf(LogLevelError, "Cannot establish tcp connection to addr=[%s]: [%s]", tcpAddr, err)
 		return
 	}
 	defer conn.Close()
 
 	if err = conn.SetReadBuffer(c.OSReadBufferSize); err != nil {
-		log.Fatalf("Cannot set TCP read buffer size to %d: [%s]", c.OSReadBufferSize, err)
+		c.fatalf("Cannot set TCP read buffer size to %d: [%s]", c.OSReadBufferSize, err)
 	}
 	if err = conn.SetWriteBuffer(c.OSWriteBufferSize); err != nil {
-		log.Fatalf("Cannot set TCP write buffer size to %d: [%s]", c.OSWriteBufferSize, err)
+		c.fatalf("Cannot set TCP write buffer size to %d: [%s]", c.OSWriteBufferSize, err)
 	}
 
 	r := bufio.NewReaderSize(conn, c.ReadBufferSize)
@@ -293,6 +330,20 @@ func (c *Client) pushTask(t tasker) error {
 	return nil
 }
 
+// The same as Client.pushTask(), but returns ctx.Err() if ctx is done
+// before the task is pushed.
+func (c *Client) pushTaskCtx(ctx context.Context, t tasker) error {
+	if c.done == nil {
+		return ErrClientNotRunning
+	}
+	select {
+	case c.requests <- t:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (c *Client) do(t tasker) (err error) {
 	if c.requests == nil {
 		return ErrClientNotRunning
@@ -301,12 +352,88 @@ func (c *Client) do(t tasker) (err error) {
 	if err = c.pushTask(t); err != nil {
 		return
 	}
+	atomic.AddUint64(&c.requestsCount, 1)
 	if !t.Wait() {
+		atomic.AddUint64(&c.communicationFailuresCount, 1)
 		err = ErrCommunicationFailure
 	}
 	return
 }
 
+// The same as Client.do(), but returns ctx.Err() if ctx is done before
+// the task is completed.
+//
+// The task may be still processed after ctx.Err() is returned, so it mustn't
+// be reused and it mustn't refer to data modified by the caller.
+// See taskItem().
+func (c *Client) doCtx(ctx context.Context, t ctxTasker) error {
+	if ctx.Done() == nil {
+		// Fast path - the ctx cannot be cancelled.
+		return c.do(t)
+	}
+	if c.requests == nil {
+		return ErrClientNotRunning
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	t.Init()
+	if err := c.pushTaskCtx(ctx, t); err != nil {
+		return err
+	}
+	atomic.AddUint64(&c.requestsCount, 1)
+	ok, err := t.WaitCtx(ctx)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		atomic.AddUint64(&c.communicationFailuresCount, 1)
+		return ErrCommunicationFailure
+	}
+	return nil
+}
+
+// Returns the item for the task performed via Client.doCtx() with the given
+// ctx.
+//
+// The task may outlive the call if ctx is cancelled, so it works with a copy
+// of the item in this case. The caller must copy the item returned
+// by the successful task back to the original item.
+func taskItem(ctx context.Context, item *Item) *Item {
+	if ctx.Done() == nil {
+		return item
+	}
+	tmp := *item
+	return &tmp
+}
+
+// Sleeps for the given duration.
+//
+// Returns ctx.Err() if ctx is done before the duration elapses.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if ctx.Done() == nil {
+		time.Sleep(d)
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Returns client counters published via expvar package.
+func (c *Client) expvarCounters() map[string]interface{} {
+	return map[string]interface{}{
+		"requests":               atomic.LoadUint64(&c.requestsCount),
+		"communication_failures": atomic.LoadUint64(&c.communicationFailuresCount),
+		"pending_requests":       len(c.requests),
+	}
+}
+
 // Starts the given client.
 //
 // No longer needed clients must be stopped via Client.Stop() call.
@@ -315,6 +442,9 @@ func (c *Client) Start() {
 		panic("Did you call Client.Stop() before calling Client.Start()?")
 	}
 	c.init()
+	if c.ExpvarPrefix != "" {
+		publishExpvar(c.logger(), c.ExpvarPrefix+"client."+c.ServerAddr, func() interface{} { return c.expvarCounters() })
+	}
 	go c.run()
 }
 
@@ -364,23 +494,76 @@ func (t *taskSync) Wait() (ok bool) {
 	return
 }
 
+func (t *taskSync) WaitCtx(ctx context.Context) (ok bool, err error) {
+	select {
+	case ok = <-t.done:
+		releaseDoneChan(t.done)
+		return ok, nil
+	case <-ctx.Done():
+		// Do not release t.done, since the task is still pending
+		// and will write to it.
+		return false, ctx.Err()
+	}
+}
+
 type taskGetMulti struct {
 	items []Item
 	taskSync
 }
 
-func readValueHeader(line []byte) (key []byte, flags uint32, casid uint64, size int, ok bool) {
+func matchByte(r *bufio.Reader, ch byte) bool {
+	c, err := r.ReadByte()
+	if err != nil {
+		logf(LogLevelWarning, "Unexpected error when reading [%d]: [%s]", ch, err)
+		return false
+	}
+	if c != ch {
+		logf(LogLevelWarning, "Unexpected byte read=[%d]. Expected [%d]", c, ch)
+		buf := make([]byte, 100)
+		if readLine(r, &buf) {
+			logf(LogLevelWarning, "End of line: [%s]", buf)
+		}
+		return false
+	}
+	return true
+}
+
+func matchStr(r *bufio.Reader, s []byte) bool {
+	for _, c := range s {
+		if !matchByte(r, c) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchCrLf(r *bufio.Reader) bool {
+	c, err := r.ReadByte()
+	if err != nil {
+		logf(LogLevelWarning, "Unexpected error when reading \\r\\n: [%s]", err)
+		return false
+	}
+	switch c {
+	case '\n':
+		return true
+	case '\r':
+		return matchByte(r, '\n')
+	default:
+		return false
+	}
+}
+
+func parseValueHeader(line []byte) (key []byte, flags uint32, casid uint64, size int, ok bool) {
 	ok = false
 
 	if !bytes.HasPrefix(line, strValue) {
-		log.Printf("Unexpected line read=[%s]. It should start with [%s]", line, strValue)
 		return
 	}
 	line = line[len(strValue):]
 
 	n := -1
 
-	if key = nextToken(line, &n, "key"); key == nil {
+	if key = nextToken(line, &n); key == nil {
 		return
 	}
 	if flags, ok = parseFlagsToken(line, &n); !ok {
@@ -393,7 +576,7 @@ func readValueHeader(line []byte) (key []byte, flags uint32, casid uint64, size
 		return
 	}
 
-	if casid, ok = parseUint64Token(line, &n, "casid"); !ok {
+	if casid, ok = parseUint64Token(line, &n); !ok {
 		return
 	}
 	ok = expectEof(line, n)
@@ -404,7 +587,7 @@ func readValue(r *bufio.Reader, size int) (value []byte, ok bool) {
 	var err error
 	value, err = ioutil.ReadAll(io.LimitReader(r, int64(size)))
 	if err != nil {
-		log.Printf("Error when reading value with size=%d: [%s]", size, err)
+		logf(LogLevelWarning, "Error when reading value with size=%d: [%s]", size, err)
 		ok = false
 		return
 	}
@@ -414,7 +597,8 @@ func readValue(r *bufio.Reader, size int) (value []byte, ok bool) {
 
 func readKeyValue(r *bufio.Reader, line []byte) (key []byte, flags uint32, casid uint64, value []byte, ok bool) {
 	var size int
-	if key, flags, casid, size, ok = readValueHeader(line); !ok {
+	if key, flags, casid, size, ok = parseValueHeader(line); !ok {
+		logf(LogLevelWarning, "Unexpected line read=[%s]. It should be in the form [%skey flags size [casid]]", line, strValue)
 		return
 	}
 	value, ok = readValue(r, size)
@@ -425,7 +609,11 @@ func readItem(r *bufio.Reader, scratchBuf *[]byte, item *Item) (ok bool, eof boo
 	if ok = readLine(r, scratchBuf); !ok {
 		return
 	}
-	line := *scratchBuf
+	return readItemLine(r, *scratchBuf, item)
+}
+
+// The same as readItem(), but starts with the already read line.
+func readItemLine(r *bufio.Reader, line []byte, item *Item) (ok bool, eof bool, wouldBlock bool, notModified bool) {
 	if bytes.Equal(line, strEnd) {
 		ok = true
 		eof = true
@@ -443,6 +631,12 @@ func readItem(r *bufio.Reader, scratchBuf *[]byte, item *Item) (ok bool, eof boo
 		notModified = true
 		return
 	}
+	if bytes.Equal(line, strNotFound) {
+		// Explicit cache miss. See Server.ExplicitMiss.
+		ok = matchStr(r, strEndCrLf)
+		eof = true
+		return
+	}
 
 	item.Key, item.Flags, item.Casid, item.Value, ok = readKeyValue(r, line)
 	return
@@ -506,6 +700,13 @@ func (t *taskGetMulti) ReadResponse(r *bufio.Reader, scratchBuf *[]byte) bool {
 // Sets Item.Value, Item.Flags and Item.Casid for each returned item.
 // Doesn't modify Item.Value and Item.Flags for items missing on the server.
 func (c *Client) GetMulti(items []Item) error {
+	return c.GetMultiCtx(context.Background(), items)
+}
+
+// The same as Client.GetMulti(), but accepts ctx.
+//
+// See Client.GetCtx() for details.
+func (c *Client) GetMultiCtx(ctx context.Context, items []Item) error {
 	itemsCount := len(items)
 	if itemsCount == 0 {
 		return nil
@@ -517,7 +718,77 @@ func (c *Client) GetMulti(items []Item) error {
 	}
 	var t taskGetMulti
 	t.items = items
-	return c.do(&t)
+	if ctx.Done() != nil {
+		// See taskItem() for details.
+		t.items = append([]Item(nil), items...)
+	}
+	if err := c.doCtx(ctx, &t); err != nil {
+		return err
+	}
+	copy(items, t.items)
+	return nil
+}
+
+type taskGetMultiKeys struct {
+	keys  [][]byte
+	items map[string]Item
+	taskSync
+}
+
+func (t *taskGetMultiKeys) WriteRequest(w *bufio.Writer, scratchBuf *[]byte) bool {
+	if !writeStr(w, strGets) || !writeStr(w, t.keys[0]) {
+		return false
+	}
+	for _, key := range t.keys[1:] {
+		if !writeWs(w) || !writeStr(w, key) {
+			return false
+		}
+	}
+	return writeCrLf(w)
+}
+
+func (t *taskGetMultiKeys) ReadResponse(r *bufio.Reader, scratchBuf *[]byte) bool {
+	for {
+		var item Item
+		ok, eof, _, _ := readItem(r, scratchBuf, &item)
+		if !ok {
+			return false
+		}
+		if eof {
+			return true
+		}
+		t.items[string(item.Key)] = item
+	}
+}
+
+// Obtains items for the given keys in a single round trip.
+//
+// Returns found items keyed by their keys. Items missing on the server
+// are absent in the returned map.
+func (c *Client) GetMultiKeys(keys [][]byte) (map[string]Item, error) {
+	return c.GetMultiKeysCtx(context.Background(), keys)
+}
+
+// The same as Client.GetMultiKeys(), but accepts ctx.
+//
+// See Client.GetCtx() for details.
+func (c *Client) GetMultiKeysCtx(ctx context.Context, keys [][]byte) (map[string]Item, error) {
+	for _, key := range keys {
+		if !validateKey(key) {
+			return nil, ErrMalformedKey
+		}
+	}
+	items := make(map[string]Item, len(keys))
+	if len(keys) == 0 {
+		return items, nil
+	}
+	var t taskGetMultiKeys
+	t.keys = keys
+	t.items = items
+	if err := c.doCtx(ctx, &t); err != nil {
+		return nil, err
+	}
+	return items, nil
 }
 
 type taskGet struct {
@@ -531,8 +802,16 @@ func (t *taskGet) WriteRequest(w *bufio.Writer, scratchBuf *[]byte) bool {
 }
 
 func readSingleItem(r *bufio.Reader, scratchBuf *[]byte, item *Item) (ok bool, eof bool, wouldBlock, notModified bool) {
+	if ok = readLine(r, scratchBuf); !ok {
+		return
+	}
+	return readSingleItemLine(r, *scratchBuf, item)
+}
+
+// The same as readSingleItem(), but starts with the already read line.
+func readSingleItemLine(r *bufio.Reader, line []byte, item *Item) (ok bool, eof bool, wouldBlock, notModified bool) {
 	keyOriginal := item.Key
-	ok, eof, wouldBlock, notModified = readItem(r, scratchBuf, item)
+	ok, eof, wouldBlock, notModified = readItemLine(r, line, item)
 	if !ok || eof || wouldBlock || notModified {
 		return
 	}
@@ -540,7 +819,7 @@ func readSingleItem(r *bufio.Reader, scratchBuf *[]byte, item *Item) (ok bool, e
 		return
 	}
 	if ok = bytes.Equal(keyOriginal, item.Key); !ok {
-		log.Printf("Key mismatch! Expected [%s], but server returned [%s]", keyOriginal, item.Key)
+		logf(LogLevelWarning, "Key mismatch! Expected [%s], but server returned [%s]", keyOriginal, item.Key)
 		return
 	}
 	item.Key = keyOriginal
@@ -560,17 +839,29 @@ func (t *taskGet) ReadResponse(r *bufio.Reader, scratchBuf *[]byte) bool {
 //
 // Returns ErrCacheMiss on cache miss.
 func (c *Client) Get(item *Item) error {
+	return c.GetCtx(context.Background(), item)
+}
+
+// The same as Client.Get(), but accepts ctx, which may cancel the call
+// or bound it by a deadline.
+//
+// Returns ctx.Err() if ctx is done before the response is received.
+// The item isn't modified in this case. The request may be still sent
+// to the server after the call is cancelled, so do not modify slices pointed
+// by item.Key and item.Value after the cancelled call.
+func (c *Client) GetCtx(ctx context.Context, item *Item) error {
 	if !validateKey(item.Key) {
 		return ErrMalformedKey
 	}
 	var t taskGet
-	t.item = item
-	if err := c.do(&t); err != nil {
+	t.item = taskItem(ctx, item)
+	if err := c.doCtx(ctx, &t); err != nil {
 		return err
 	}
 	if !t.found {
 		return ErrCacheMiss
 	}
+	*item = *t.item
 	return nil
 }
 
@@ -613,12 +904,19 @@ func (t *taskCget) ReadResponse(r *bufio.Reader, scratchBuf *[]byte) bool {
 // with entity tags - see
 // http://www.w3.org/Protocols/rfc2616/rfc2616-sec3.html#sec3.11 .
 func (c *Client) Cget(item *Item) error {
+	return c.CgetCtx(context.Background(), item)
+}
+
+// The same as Client.Cget(), but accepts ctx.
+//
+// See Client.GetCtx() for details.
+func (c *Client) CgetCtx(ctx context.Context, item *Item) error {
 	if !validateKey(item.Key) {
 		return ErrMalformedKey
 	}
 	var t taskCget
-	t.item = item
-	if err := c.do(&t); err != nil {
+	t.item = taskItem(ctx, item)
+	if err := c.doCtx(ctx, &t); err != nil {
 		return err
 	}
 	if t.notModified {
@@ -627,6 +925,7 @@ func (c *Client) Cget(item *Item) error {
 	if !t.found {
 		return ErrCacheMiss
 	}
+	*item = *t.item
 	return nil
 }
 
@@ -656,18 +955,27 @@ func (t *taskCgetDe) ReadResponse(r *bufio.Reader, scratchBuf *[]byte) bool {
 
 // Combines functionality of Client.Cget() and Client.GetDe().
 func (c *Client) CgetDe(item *Item, graceDuration time.Duration) error {
+	return c.CgetDeCtx(context.Background(), item, graceDuration)
+}
+
+// The same as Client.CgetDe(), but accepts ctx.
+//
+// See Client.GetCtx() for details.
+func (c *Client) CgetDeCtx(ctx context.Context, item *Item, graceDuration time.Duration) error {
 	if !validateKey(item.Key) {
 		return ErrMalformedKey
 	}
-	var t taskCgetDe
 	for {
-		t.item = item
+		var t taskCgetDe
+		t.item = taskItem(ctx, item)
 		t.graceDuration = graceDuration
-		if err := c.do(&t); err != nil {
+		if err := c.doCtx(ctx, &t); err != nil {
 			return err
 		}
 		if t.wouldBlock {
-			time.Sleep(time.Millisecond * time.Duration(100))
+			if err := sleepCtx(ctx, time.Millisecond*time.Duration(100)); err != nil {
+				return err
+			}
 			continue
 		}
 		if t.notModified {
@@ -676,6 +984,7 @@ func (c *Client) CgetDe(item *Item, graceDuration time.Duration) error {
 		if !t.found {
 			return ErrCacheMiss
 		}
+		*item = *t.item
 		return nil
 	}
 }
@@ -717,23 +1026,33 @@ func (t *taskGetDe) ReadResponse(r *bufio.Reader, scratchBuf *[]byte) bool {
 // will create and store in the cache an item on cache miss during the given
 // graceDuration interval.
 func (c *Client) GetDe(item *Item, graceDuration time.Duration) error {
+	return c.GetDeCtx(context.Background(), item, graceDuration)
+}
+
+// The same as Client.GetDe(), but accepts ctx.
+//
+// See Client.GetCtx() for details.
+func (c *Client) GetDeCtx(ctx context.Context, item *Item, graceDuration time.Duration) error {
 	if !validateKey(item.Key) {
 		return ErrMalformedKey
 	}
-	var t taskGetDe
 	for {
-		t.item = item
+		var t taskGetDe
+		t.item = taskItem(ctx, item)
 		t.graceDuration = graceDuration
-		if err := c.do(&t); err != nil {
+		if err := c.doCtx(ctx, &t); err != nil {
 			return err
 		}
 		if t.wouldBlock {
-			time.Sleep(time.Millisecond * time.Duration(100))
+			if err := sleepCtx(ctx, time.Millisecond*time.Duration(100)); err != nil {
+				return err
+			}
 			continue
 		}
 		if !t.found {
 			return ErrCacheMiss
 		}
+		*item = *t.item
 		return nil
 	}
 }
@@ -783,6 +1102,13 @@ func (t *taskSet) ReadResponse(r *bufio.Reader, scratchBuf *[]byte) bool {
 
 // Stores the given item in the memcache server.
 func (c *Client) Set(item *Item) error {
+	return c.SetCtx(context.Background(), item)
+}
+
+// The same as Client.Set(), but accepts ctx.
+//
+// See Client.GetCtx() for details.
+func (c *Client) SetCtx(ctx context.Context, item *Item) error {
 	if !validateKey(item.Key) {
 		return ErrMalformedKey
 	}
@@ -790,8 +1116,8 @@ func (c *Client) Set(item *Item) error {
 		return ErrNilValue
 	}
 	var t taskSet
-	t.item = item
-	return c.do(&t)
+	t.item = taskItem(ctx, item)
+	return c.doCtx(ctx, &t)
 }
 
 type taskAdd struct {
@@ -817,7 +1143,7 @@ func (t *taskAdd) ReadResponse(r *bufio.Reader, scratchBuf *[]byte) bool {
 		t.notStored = true
 		return true
 	}
-	log.Printf("Unexpected response for add() command: [%s]", line)
+	logf(LogLevelWarning, "Unexpected response for add() command: [%s]", line)
 	return false
 }
 
@@ -827,6 +1153,13 @@ func (t *taskAdd) ReadResponse(r *bufio.Reader, scratchBuf *[]byte) bool {
 // Returns ErrAlreadyExists error if the server already holds data under
 // the item.Key.
 func (c *Client) Add(item *Item) error {
+	return c.AddCtx(context.Background(), item)
+}
+
+// The same as Client.Add(), but accepts ctx.
+//
+// See Client.GetCtx() for details.
+func (c *Client) AddCtx(ctx context.Context, item *Item) error {
 	if !validateKey(item.Key) {
 		return ErrMalformedKey
 	}
@@ -834,8 +1167,8 @@ func (c *Client) Add(item *Item) error {
 		return ErrNilValue
 	}
 	var t taskAdd
-	t.item = item
-	if err := c.do(&t); err != nil {
+	t.item = taskItem(ctx, item)
+	if err := c.doCtx(ctx, &t); err != nil {
 		return err
 	}
 	if t.notStored {
@@ -872,16 +1205,37 @@ func (t *taskCas) ReadResponse(r *bufio.Reader, scratchBuf *[]byte) bool {
 		t.casidMismatch = true
 		return true
 	}
-	log.Printf("Unexpected response for cas() command: [%s]", line)
+	logf(LogLevelWarning, "Unexpected response for cas() command: [%s]", line)
 	return false
 }
 
+// The same as Client.Get().
+//
+// Client.Get() always obtains item.Casid, so this method is provided
+// only for consistency with the memcache 'gets' command.
+func (c *Client) Gets(item *Item) error {
+	return c.GetCtx(context.Background(), item)
+}
+
+// The same as Client.GetCtx().
+func (c *Client) GetsCtx(ctx context.Context, item *Item) error {
+	return c.GetCtx(ctx, item)
+}
+
 // Stores the given item only if item.Casid matches casid for the given item
 // on the server.
 //
 // Returns ErrCacheMiss if the server has no item with such a key.
-// Returns ErrCasidMismatch if item on the server has other casid value.
+// Returns ErrCasidMismatch (aka ErrCasConflict) if item on the server
+// has other casid value.
 func (c *Client) Cas(item *Item) error {
+	return c.CasCtx(context.Background(), item)
+}
+
+// The same as Client.Cas(), but accepts ctx.
+//
+// See Client.GetCtx() for details.
+func (c *Client) CasCtx(ctx context.Context, item *Item) error {
 	if !validateKey(item.Key) {
 		return ErrMalformedKey
 	}
@@ -889,8 +1243,8 @@ func (c *Client) Cas(item *Item) error {
 		return ErrNilValue
 	}
 	var t taskCas
-	t.item = item
-	if err := c.do(&t); err != nil {
+	t.item = taskItem(ctx, item)
+	if err := c.doCtx(ctx, &t); err != nil {
 		return err
 	}
 	if t.notFound {
@@ -938,6 +1292,13 @@ func (c *Client) SetNowait(item *Item) {
 	c.do(&t)
 }
 
+// The same as Client.SetNowait().
+//
+// The set request is sent with noreply option.
+func (c *Client) SetNoreply(item *Item) {
+	c.SetNowait(item)
+}
+
 type taskDelete struct {
 	key         []byte
 	itemDeleted bool
@@ -971,7 +1332,7 @@ func (t *taskDelete) ReadResponse(r *bufio.Reader, scratchBuf *[]byte) bool {
 		t.itemDeleted = false
 		return true
 	}
-	log.Printf("Unexpected response for 'delete' request: [%s]", line)
+	logf(LogLevelWarning, "Unexpected response for 'delete' request: [%s]", line)
 	return false
 }
 
@@ -980,12 +1341,19 @@ func (t *taskDelete) ReadResponse(r *bufio.Reader, scratchBuf *[]byte) bool {
 // Returns ErrCacheMiss if there were no item with such key
 // on the server.
 func (c *Client) Delete(key []byte) error {
+	return c.DeleteCtx(context.Background(), key)
+}
+
+// The same as Client.Delete(), but accepts ctx.
+//
+// See Client.GetCtx() for details.
+func (c *Client) DeleteCtx(ctx context.Context, key []byte) error {
 	if !validateKey(key) {
 		return ErrMalformedKey
 	}
 	var t taskDelete
 	t.key = key
-	if err := c.do(&t); err != nil {
+	if err := c.doCtx(ctx, &t); err != nil {
 		return err
 	}
 	if !t.itemDeleted {
@@ -1016,6 +1384,515 @@ func (c *Client) DeleteNowait(key []byte) {
 	c.do(&t)
 }
 
+// The same as Client.DeleteNowait().
+//
+// The delete request is sent with noreply option.
+func (c *Client) DeleteNoreply(key []byte) {
+	c.DeleteNowait(key)
+}
+
+func writeAppendPrependRequest(w *bufio.Writer, item *Item, isPrepend, noreply bool, scratchBuf *[]byte) bool {
+	cmd := strAppend
+	if isPrepend {
+		cmd = strPrepend
+	}
+	return writeCommonSetParams(w, cmd, item, scratchBuf) &&
+		writeNoreplyAndValue(w, noreply, item.Value)
+}
+
+type taskAppendPrepend struct {
+	item      *Item
+	isPrepend bool
+	notStored bool
+	serverErr bool
+	taskSync
+}
+
+func (t *taskAppendPrepend) WriteRequest(w *bufio.Writer, scratchBuf *[]byte) bool {
+	return writeAppendPrependRequest(w, t.item, t.isPrepend, false, scratchBuf)
+}
+
+func (t *taskAppendPrepend) ReadResponse(r *bufio.Reader, scratchBuf *[]byte) bool {
+	if !readLine(r, scratchBuf) {
+		return false
+	}
+	line := *scratchBuf
+	if bytes.Equal(line, strStored) {
+		return true
+	}
+	if bytes.Equal(line, strNotStored) {
+		t.notStored = true
+		return true
+	}
+	if bytes.HasPrefix(line, strServerError) || bytes.HasPrefix(line, strClientError) {
+		t.serverErr = true
+		return true
+	}
+	logf(LogLevelWarning, "Unexpected response for append/prepend command: [%s]", line)
+	return false
+}
+
+func (c *Client) appendPrepend(ctx context.Context, item *Item, isPrepend bool) error {
+	if !validateKey(item.Key) {
+		return ErrMalformedKey
+	}
+	if item.Value == nil {
+		return ErrNilValue
+	}
+	var t taskAppendPrepend
+	t.item = taskItem(ctx, item)
+	t.isPrepend = isPrepend
+	if err := c.doCtx(ctx, &t); err != nil {
+		return err
+	}
+	if t.notStored {
+		return ErrCacheMiss
+	}
+	if t.serverErr {
+		return ErrServerError
+	}
+	return nil
+}
+
+// Appends item.Value to the value of the existing item with item.Key
+// on the server.
+//
+// item.Flags and item.Expiration are ignored, so the existing item
+// retains its flags and expiration.
+//
+// Returns ErrCacheMiss if the server has no item with such a key.
+func (c *Client) Append(item *Item) error {
+	return c.appendPrepend(context.Background(), item, false)
+}
+
+// The same as Client.Append(), but accepts ctx.
+//
+// See Client.GetCtx() for details.
+func (c *Client) AppendCtx(ctx context.Context, item *Item) error {
+	return c.appendPrepend(ctx, item, false)
+}
+
+// Prepends item.Value to the value of the existing item with item.Key
+// on the server.
+//
+// item.Flags and item.Expiration are ignored, so the existing item
+// retains its flags and expiration.
+//
+// Returns ErrCacheMiss if the server has no item with such a key.
+func (c *Client) Prepend(item *Item) error {
+	return c.appendPrepend(context.Background(), item, true)
+}
+
+// The same as Client.Prepend(), but accepts ctx.
+//
+// See Client.GetCtx() for details.
+func (c *Client) PrependCtx(ctx context.Context, item *Item) error {
+	return c.appendPrepend(ctx, item, true)
+}
+
+type taskAppendPrependNowait struct {
+	item      Item
+	isPrepend bool
+	taskNowait
+}
+
+func (t *taskAppendPrependNowait) WriteRequest(w *bufio.Writer, scratchBuf *[]byte) bool {
+	return writeAppendPrependRequest(w, &t.item, t.isPrepend, true, scratchBuf)
+}
+
+func (c *Client) appendPrependNowait(item *Item, isPrepend bool) {
+	if !validateKey(item.Key) || item.Value == nil {
+		return
+	}
+	var t taskAppendPrependNowait
+	t.item = *item
+	t.isPrepend = isPrepend
+	c.do(&t)
+}
+
+// The same as Client.Append(), but doesn't wait for operation completion.
+//
+// Do not modify slices pointed by item.Key and item.Value after passing
+// to this function - it actually becomes an owner of these slices.
+func (c *Client) AppendNowait(item *Item) {
+	c.appendPrependNowait(item, false)
+}
+
+// The same as Client.Prepend(), but doesn't wait for operation completion.
+//
+// Do not modify slices pointed by item.Key and item.Value after passing
+// to this function - it actually becomes an owner of these slices.
+func (c *Client) PrependNowait(item *Item) {
+	c.appendPrependNowait(item, true)
+}
+
+type taskTouch struct {
+	key        []byte
+	expiration time.Duration
+	touched    bool
+	serverErr  bool
+	taskSync
+}
+
+func (t *taskTouch) WriteRequest(w *bufio.Writer, scratchBuf *[]byte) bool {
+	return writeStr(w, strTouch) && writeStr(w, t.key) && writeWs(w) &&
+		writeExpiration(w, t.expiration, scratchBuf) && writeCrLf(w)
+}
+
+func (t *taskTouch) ReadResponse(r *bufio.Reader, scratchBuf *[]byte) bool {
+	if !readLine(r, scratchBuf) {
+		return false
+	}
+	line := *scratchBuf
+	if bytes.Equal(line, strTouched) {
+		t.touched = true
+		return true
+	}
+	if bytes.Equal(line, strNotFound) {
+		t.touched = false
+		return true
+	}
+	if bytes.HasPrefix(line, strServerError) || bytes.HasPrefix(line, strClientError) {
+		t.serverErr = true
+		return true
+	}
+	logf(LogLevelWarning, "Unexpected response for 'touch' request: [%s]", line)
+	return false
+}
+
+// Updates expiration time for the item with the given key on the server
+// without transferring the item's value.
+//
+// Returns ErrCacheMiss if there is no item with such key on the server.
+// Returns ErrServerError if the server fails touching the item.
+func (c *Client) Touch(key []byte, expiration time.Duration) error {
+	return c.TouchCtx(context.Background(), key, expiration)
+}
+
+// The same as Client.Touch(), but accepts ctx.
+//
+// See Client.GetCtx() for details.
+func (c *Client) TouchCtx(ctx context.Context, key []byte, expiration time.Duration) error {
+	if !validateKey(key) {
+		return ErrMalformedKey
+	}
+	var t taskTouch
+	t.key = key
+	t.expiration = expiration
+	if err := c.doCtx(ctx, &t); err != nil {
+		return err
+	}
+	if t.serverErr {
+		return ErrServerError
+	}
+	if !t.touched {
+		return ErrCacheMiss
+	}
+	return nil
+}
+
+type taskGat struct {
+	item       *Item
+	expiration time.Duration
+	found      bool
+	serverErr  bool
+	taskSync
+}
+
+func (t *taskGat) WriteRequest(w *bufio.Writer, scratchBuf *[]byte) bool {
+	return writeStr(w, strGats) && writeExpiration(w, t.expiration, scratchBuf) && writeWs(w) &&
+		writeStr(w, t.item.Key) && writeCrLf(w)
+}
+
+func (t *taskGat) ReadResponse(r *bufio.Reader, scratchBuf *[]byte) bool {
+	if !readLine(r, scratchBuf) {
+		return false
+	}
+	line := *scratchBuf
+	if bytes.HasPrefix(line, strServerError) || bytes.HasPrefix(line, strClientError) {
+		t.serverErr = true
+		return true
+	}
+	ok, eof, _, _ := readSingleItemLine(r, line, t.item)
+	if !ok {
+		return false
+	}
+	t.found = !eof
+	return true
+}
+
+// Obtains item.Value, item.Flags and item.Casid for the given item.Key
+// and updates expiration time for the item on the server.
+//
+// Returns ErrCacheMiss on cache miss.
+// Returns ErrServerError if the server fails updating the item.
+func (c *Client) Gat(item *Item, expiration time.Duration) error {
+	return c.GatCtx(context.Background(), item, expiration)
+}
+
+// The same as Client.Gat(), but accepts ctx.
+//
+// See Client.GetCtx() for details.
+func (c *Client) GatCtx(ctx context.Context, item *Item, expiration time.Duration) error {
+	if !validateKey(item.Key) {
+		return ErrMalformedKey
+	}
+	var t taskGat
+	t.item = taskItem(ctx, item)
+	t.expiration = expiration
+	if err := c.doCtx(ctx, &t); err != nil {
+		return err
+	}
+	if t.serverErr {
+		return ErrServerError
+	}
+	if !t.found {
+		return ErrCacheMiss
+	}
+	*item = *t.item
+	return nil
+}
+
+type taskIncrDecr struct {
+	key        []byte
+	delta      uint64
+	isIncr     bool
+	value      uint64
+	notFound   bool
+	nonNumeric bool
+	serverErr  bool
+	taskSync
+}
+
+func (t *taskIncrDecr) WriteRequest(w *bufio.Writer, scratchBuf *[]byte) bool {
+	cmd := strDecr
+	if t.isIncr {
+		cmd = strIncr
+	}
+	return writeStr(w, cmd) && writeStr(w, t.key) && writeWs(w) &&
+		writeUint64(w, t.delta, scratchBuf) && writeCrLf(w)
+}
+
+func (t *taskIncrDecr) ReadResponse(r *bufio.Reader, scratchBuf *[]byte) bool {
+	if !readLine(r, scratchBuf) {
+		return false
+	}
+	line := *scratchBuf
+	if bytes.Equal(line, strNotFound) {
+		t.notFound = true
+		return true
+	}
+	if bytes.Equal(line, strNonNumericCrLf[:len(strNonNumericCrLf)-len(strCrLf)]) {
+		t.nonNumeric = true
+		return true
+	}
+	if bytes.HasPrefix(line, strServerError) || bytes.HasPrefix(line, strClientError) {
+		t.serverErr = true
+		return true
+	}
+	var ok bool
+	if t.value, ok = parseUint64(line); !ok {
+		logf(LogLevelWarning, "Unexpected response for incr/decr command: [%s]", line)
+		return false
+	}
+	return true
+}
+
+func (c *Client) incrDecr(ctx context.Context, key []byte, delta uint64, isIncr bool) (uint64, error) {
+	if !validateKey(key) {
+		return 0, ErrMalformedKey
+	}
+	var t taskIncrDecr
+	t.key = key
+	t.delta = delta
+	t.isIncr = isIncr
+	if err := c.doCtx(ctx, &t); err != nil {
+		return 0, err
+	}
+	if t.notFound {
+		return 0, ErrCacheMiss
+	}
+	if t.nonNumeric {
+		return 0, ErrNonNumeric
+	}
+	if t.serverErr {
+		return 0, ErrServerError
+	}
+	return t.value, nil
+}
+
+// Atomically increments the counter stored under the given key by delta
+// and returns the new counter value.
+//
+// Counters are stored as decimal numbers. The counter wraps around
+// on 64-bit overflow.
+//
+// Returns ErrCacheMiss if there is no counter with such key on the server.
+// Returns ErrNonNumeric if the value for the key isn't a decimal number.
+func (c *Client) Incr(key []byte, delta uint64) (uint64, error) {
+	return c.incrDecr(context.Background(), key, delta, true)
+}
+
+// The same as Client.Incr(), but accepts ctx.
+//
+// See Client.GetCtx() for details.
+func (c *Client) IncrCtx(ctx context.Context, key []byte, delta uint64) (uint64, error) {
+	return c.incrDecr(ctx, key, delta, true)
+}
+
+// Atomically decrements the counter stored under the given key by delta
+// and returns the new counter value.
+//
+// The counter cannot be decremented below zero.
+//
+// Returns ErrCacheMiss if there is no counter with such key on the server.
+// Returns ErrNonNumeric if the value for the key isn't a decimal number.
+func (c *Client) Decr(key []byte, delta uint64) (uint64, error) {
+	return c.incrDecr(context.Background(), key, delta, false)
+}
+
+// The same as Client.Decr(), but accepts ctx.
+//
+// See Client.GetCtx() for details.
+func (c *Client) DecrCtx(ctx context.Context, key []byte, delta uint64) (uint64, error) {
+	return c.incrDecr(ctx, key, delta, false)
+}
+
+// Mutation performed via Client.Batch().
+type BatchOp struct {
+	// The item to store. Only Item.Key is used for deletions.
+	Item Item
+
+	// Whether to delete the item with the Item.Key instead of storing
+	// the item.
+	Delete bool
+
+	// The result of the operation set by Client.Batch():
+	//   * nil on success.
+	//   * ErrMalformedKey or ErrNilValue for invalid operations,
+	//     which aren't sent to the server.
+	//   * ErrCacheMiss if the deleted item is missing on the server.
+	//   * ErrNotStored or ErrServerError if the server rejected
+	//     the operation.
+	Err error
+}
+
+func validateBatchOp(op *BatchOp) error {
+	if !validateKey(op.Item.Key) {
+		return ErrMalformedKey
+	}
+	if !op.Delete && op.Item.Value == nil {
+		return ErrNilValue
+	}
+	return nil
+}
+
+type taskBatch struct {
+	ops []BatchOp
+	taskSync
+}
+
+func (t *taskBatch) WriteRequest(w *bufio.Writer, scratchBuf *[]byte) bool {
+	for i := range t.ops {
+		op := &t.ops[i]
+		if op.Err != nil {
+			continue
+		}
+		if op.Delete {
+			if !writeDeleteRequest(w, op.Item.Key, false) {
+				return false
+			}
+		} else if !writeSetRequest(w, &op.Item, false, scratchBuf) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *taskBatch) ReadResponse(r *bufio.Reader, scratchBuf *[]byte) bool {
+	for i := range t.ops {
+		op := &t.ops[i]
+		if op.Err != nil {
+			continue
+		}
+		if !readLine(r, scratchBuf) {
+			return false
+		}
+		line := *scratchBuf
+		switch {
+		case !op.Delete && bytes.Equal(line, strStored):
+		case !op.Delete && bytes.Equal(line, strNotStored):
+			op.Err = ErrNotStored
+		case op.Delete && bytes.Equal(line, strDeleted):
+		case op.Delete && bytes.Equal(line, strNotFound):
+			op.Err = ErrCacheMiss
+		case bytes.HasPrefix(line, strServerError) || bytes.HasPrefix(line, strClientError):
+			op.Err = ErrServerError
+		default:
+			logf(LogLevelWarning, "Unexpected response for batch operation: [%s]", line)
+			return false
+		}
+	}
+	return true
+}
+
+// Performs the given set and delete operations in a pipelined manner
+// and stores their results in BatchOp.Err.
+//
+// This is much faster than performing the operations one by one,
+// since the operations don't wait for each other's responses.
+// The operations may be performed in arbitrary order.
+//
+// Returns an error only if the batch cannot be performed, for instance,
+// due to communication failure. Results of operations aren't defined
+// in this case.
+func (c *Client) Batch(ops []BatchOp) error {
+	return c.BatchCtx(context.Background(), ops)
+}
+
+// The same as Client.Batch(), but accepts ctx.
+//
+// See Client.GetCtx() for details.
+func (c *Client) BatchCtx(ctx context.Context, ops []BatchOp) error {
+	for i := range ops {
+		op := &ops[i]
+		op.Err = validateBatchOp(op)
+	}
+	taskOps := ops
+	if ctx.Done() != nil {
+		// See taskItem() for details.
+		taskOps = append([]BatchOp(nil), ops...)
+	}
+
+	var err error
+	if len(taskOps) <= maxBatchRequestOpsCount {
+		err = c.doCtx(ctx, &taskBatch{ops: taskOps})
+	} else {
+		// Send requests concurrently, so they may be pipelined.
+		var wg sync.WaitGroup
+		var errOnce sync.Once
+		for n := 0; n < len(taskOps); n += maxBatchRequestOpsCount {
+			end := n + maxBatchRequestOpsCount
+			if end > len(taskOps) {
+				end = len(taskOps)
+			}
+			wg.Add(1)
+			go func(t *taskBatch) {
+				defer wg.Done()
+				if taskErr := c.doCtx(ctx, t); taskErr != nil {
+					errOnce.Do(func() { err = taskErr })
+				}
+			}(&taskBatch{ops: taskOps[n:end]})
+		}
+		wg.Wait()
+	}
+	if err != nil {
+		return err
+	}
+	copy(ops, taskOps)
+	return nil
+}
+
 type taskFlushAllDelayed struct {
 	expiration time.Duration
 	taskSync
@@ -1031,9 +1908,16 @@ func (t *taskFlushAllDelayed) ReadResponse(r *bufio.Reader, scratchBuf *[]byte)
 
 // Flushes all the items on the server after the given expiration delay.
 func (c *Client) FlushAllDelayed(expiration time.Duration) error {
+	return c.FlushAllDelayedCtx(context.Background(), expiration)
+}
+
+// The same as Client.FlushAllDelayed(), but accepts ctx.
+//
+// See Client.GetCtx() for details.
+func (c *Client) FlushAllDelayedCtx(ctx context.Context, expiration time.Duration) error {
 	var t taskFlushAllDelayed
 	t.expiration = expiration
-	return c.do(&t)
+	return c.doCtx(ctx, &t)
 }
 
 type taskFlushAll struct {
@@ -1050,8 +1934,15 @@ func (t *taskFlushAll) ReadResponse(r *bufio.Reader, scratchBuf *[]byte) bool {
 
 // Flushes all the items on the server.
 func (c *Client) FlushAll() error {
+	return c.FlushAllCtx(context.Background())
+}
+
+// The same as Client.FlushAll(), but accepts ctx.
+//
+// See Client.GetCtx() for details.
+func (c *Client) FlushAllCtx(ctx context.Context) error {
 	var t taskFlushAll
-	return c.do(&t)
+	return c.doCtx(ctx, &t)
 }
 
 type taskFlushAllDelayedNowait struct {
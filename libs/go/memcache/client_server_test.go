@@ -2,8 +2,9 @@ package memcache
 
 import (
 	"bytes"
+	"context"
 	"fmt"
-	"github.com/valyala/ybc/bindings/go/ybc"
+	"github.com/kireevroi/ybc/bindings/go/ybc"
 	"io"
 	"net"
 	"sync"
@@ -247,6 +248,98 @@ func TestClient_GetSet(t *testing.T) {
 	client_RunTest(cacher_GetSet, t)
 }
 
+func cacher_Ctx(c Cacher, t *testing.T) {
+	cc := c.(CacherCtx)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	key := []byte("key")
+	value := []byte("value")
+	item := Item{
+		Key:   key,
+		Value: value,
+	}
+	if err := cc.SetCtx(ctx, &item); err != nil {
+		t.Fatalf("error in client.SetCtx(): [%s]", err)
+	}
+	item.Value = nil
+	if err := cc.GetCtx(ctx, &item); err != nil {
+		t.Fatalf("error in client.GetCtx(): [%s]", err)
+	}
+	if !bytes.Equal(item.Value, value) {
+		t.Fatalf("invalid value=[%s] returned. Expected [%s]", item.Value, value)
+	}
+	if err := cc.GetMultiCtx(ctx, []Item{{Key: key}}); err != nil {
+		t.Fatalf("error in client.GetMultiCtx(): [%s]", err)
+	}
+	if err := cc.DeleteCtx(ctx, key); err != nil {
+		t.Fatalf("error in client.DeleteCtx(): [%s]", err)
+	}
+	if err := cc.GetCtx(ctx, &item); err != ErrCacheMiss {
+		t.Fatalf("unexpected err=[%v] for client.GetCtx(). Expected ErrCacheMiss", err)
+	}
+
+	cancel()
+	item.Value = nil
+	if err := cc.DeleteCtx(ctx, key); err != context.Canceled {
+		t.Fatalf("unexpected err=[%v] for client.DeleteCtx(). Expected context.Canceled", err)
+	}
+	if err := cc.GetCtx(ctx, &item); err != context.Canceled {
+		t.Fatalf("unexpected err=[%v] for client.GetCtx(). Expected context.Canceled", err)
+	}
+	if err := cc.FlushAllCtx(ctx); err != context.Canceled {
+		t.Fatalf("unexpected err=[%v] for client.FlushAllCtx(). Expected context.Canceled", err)
+	}
+	if item.Value != nil {
+		t.Fatalf("the item mustn't be modified by cancelled calls")
+	}
+}
+
+func TestClient_Ctx(t *testing.T) {
+	client_RunTest(cacher_Ctx, t)
+}
+
+func TestClient_CtxDeadline(t *testing.T) {
+	// The server accepts connections, but never responds.
+	ln, err := net.Listen("tcp", testAddr)
+	if err != nil {
+		t.Fatalf("cannot listen %s: [%s]", testAddr, err)
+	}
+	defer ln.Close()
+	conns := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			conns <- conn
+		}
+	}()
+
+	c := &Client{
+		ServerAddr: testAddr,
+		ClientConfig: ClientConfig{
+			ConnectionsCount: 1,
+		},
+	}
+	c.Start()
+	defer c.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	item := Item{
+		Key: []byte("key"),
+	}
+	if err := c.GetCtx(ctx, &item); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected err=[%v] for client.GetCtx(). Expected context.DeadlineExceeded", err)
+	}
+	if item.Value != nil {
+		t.Fatalf("the item mustn't be modified by the timed out call")
+	}
+
+	// Unblock the pending request.
+	conn := <-conns
+	conn.Close()
+}
+
 func cacher_Add(c Cacher, t *testing.T) {
 	key := []byte("keybb")
 	value := []byte("value_addd")
@@ -306,6 +399,16 @@ func cacher_Cas(c Cacher, t *testing.T) {
 	if item.Flags != flags {
 		t.Fatalf("Unexpected item.Flags=%d. Expected %d", item.Flags, flags)
 	}
+	if g, ok := c.(interface{ Gets(item *Item) error }); ok {
+		casid := item.Casid
+		item.Casid = 0
+		if err := g.Gets(&item); err != nil {
+			t.Fatalf("error in Gets(): [%s]", err)
+		}
+		if item.Casid != casid {
+			t.Fatalf("Unexpected item.Casid=%d returned from Gets(). Expected %d", item.Casid, casid)
+		}
+	}
 
 	newValue := []byte("new_value")
 	newFlags := uint32(98111)
@@ -317,6 +420,9 @@ func cacher_Cas(c Cacher, t *testing.T) {
 	if err := c.Cas(&item); err != ErrCasidMismatch {
 		t.Fatalf("unexpected error returned from Cacher.Cas(): [%s]. Expected ErrCasidMismatch", err)
 	}
+	if err := c.Cas(&item); err != ErrCasConflict {
+		t.Fatalf("unexpected error returned from Cacher.Cas(): [%s]. Expected ErrCasConflict", err)
+	}
 
 	item.Value = nil
 	item.Flags = 0
@@ -540,6 +646,78 @@ func TestClient_GetMulti(t *testing.T) {
 	client_RunTest(cacher_GetMulti, t)
 }
 
+func cacher_GetMultiKeys(c Cacher, t *testing.T) {
+	cc := c.(interface {
+		GetMultiKeys(keys [][]byte) (map[string]Item, error)
+	})
+
+	itemsCount := 100
+	var keys [][]byte
+	for i := 0; i < itemsCount; i++ {
+		item := Item{
+			Key:   []byte(fmt.Sprintf("key_%d", i)),
+			Value: []byte(fmt.Sprintf("value_%d", i)),
+			Flags: uint32(i),
+		}
+		if err := c.Set(&item); err != nil {
+			t.Fatalf("error in client.Set(): [%s]", err)
+		}
+		keys = append(keys, item.Key)
+	}
+	keys = append(keys, []byte("missing_key"))
+
+	items, err := cc.GetMultiKeys(keys)
+	if err != nil {
+		t.Fatalf("error in client.GetMultiKeys(): [%s]", err)
+	}
+	if len(items) != itemsCount {
+		t.Fatalf("unexpected number of items returned: %d. Expected %d", len(items), itemsCount)
+	}
+	for i := 0; i < itemsCount; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		item, ok := items[key]
+		if !ok {
+			t.Fatalf("cannot find item for key=[%s]", key)
+		}
+		value := fmt.Sprintf("value_%d", i)
+		if string(item.Value) != value {
+			t.Fatalf("unexpected value=[%s] for key=[%s]. Expected [%s]", item.Value, key, value)
+		}
+		if item.Flags != uint32(i) {
+			t.Fatalf("unexpected flags=%d for key=[%s]. Expected %d", item.Flags, key, i)
+		}
+	}
+
+	// GetMulti() must fill values for items passed without values.
+	getItems := make([]Item, len(keys))
+	for i, key := range keys {
+		getItems[i].Key = key
+	}
+	if err = c.GetMulti(getItems); err != nil {
+		t.Fatalf("error in client.GetMulti(): [%s]", err)
+	}
+	for i := 0; i < itemsCount; i++ {
+		value := fmt.Sprintf("value_%d", i)
+		if string(getItems[i].Value) != value {
+			t.Fatalf("unexpected value=[%s] for key=[%s]. Expected [%s]", getItems[i].Value, getItems[i].Key, value)
+		}
+	}
+	if getItems[itemsCount].Value != nil {
+		t.Fatalf("unexpected value=[%s] for missing key", getItems[itemsCount].Value)
+	}
+
+	if items, err = cc.GetMultiKeys(nil); err != nil {
+		t.Fatalf("error in client.GetMultiKeys(): [%s]", err)
+	}
+	if len(items) != 0 {
+		t.Fatalf("unexpected items returned for empty keys: %v", items)
+	}
+}
+
+func TestClient_GetMultiKeys(t *testing.T) {
+	client_RunTest(cacher_GetMultiKeys, t)
+}
+
 func cacher_SetNowait(c Cacher, t *testing.T) {
 	itemsCount := 100
 	items := make([]Item, itemsCount)
@@ -582,6 +760,308 @@ func TestClient_Delete(t *testing.T) {
 	client_RunTest(cacher_Delete, t)
 }
 
+func cacher_Batch(c Cacher, t *testing.T) {
+	cc := c.(interface {
+		Batch(ops []BatchOp) error
+	})
+
+	// The number of operations exceeds maxBatchRequestOpsCount.
+	itemsCount := 3000
+	ops := make([]BatchOp, itemsCount+2)
+	for i := 0; i < itemsCount; i++ {
+		op := &ops[i]
+		op.Item.Key = []byte(fmt.Sprintf("batch_key_%d", i))
+		op.Item.Value = []byte(fmt.Sprintf("value_%d", i))
+	}
+	ops[itemsCount].Item.Key = []byte("malformed key")
+	ops[itemsCount].Item.Value = []byte("value")
+	ops[itemsCount+1].Item.Key = []byte("nil_value")
+	if err := cc.Batch(ops); err != nil {
+		t.Fatalf("error in client.Batch(): [%s]", err)
+	}
+	for i := 0; i < itemsCount; i++ {
+		if ops[i].Err != nil {
+			t.Fatalf("unexpected error for key=[%s]: [%s]", ops[i].Item.Key, ops[i].Err)
+		}
+		item := Item{
+			Key: ops[i].Item.Key,
+		}
+		if err := c.Get(&item); err != nil {
+			t.Fatalf("cannot obtain value for key=[%s]: [%s]", item.Key, err)
+		}
+		if !bytes.Equal(item.Value, ops[i].Item.Value) {
+			t.Fatalf("invalid value=[%s] returned. Expected [%s]", item.Value, ops[i].Item.Value)
+		}
+	}
+	if ops[itemsCount].Err != ErrMalformedKey {
+		t.Fatalf("unexpected error=[%v] for malformed key. Expected ErrMalformedKey", ops[itemsCount].Err)
+	}
+	if ops[itemsCount+1].Err != ErrNilValue {
+		t.Fatalf("unexpected error=[%v] for nil value. Expected ErrNilValue", ops[itemsCount+1].Err)
+	}
+
+	// Delete even items and missing items.
+	ops = ops[:0]
+	for i := 0; i < itemsCount; i += 2 {
+		ops = append(ops, BatchOp{
+			Item: Item{
+				Key: []byte(fmt.Sprintf("batch_key_%d", i)),
+			},
+			Delete: true,
+		})
+		ops = append(ops, BatchOp{
+			Item: Item{
+				Key: []byte(fmt.Sprintf("missing_batch_key_%d", i)),
+			},
+			Delete: true,
+		})
+	}
+	if err := cc.Batch(ops); err != nil {
+		t.Fatalf("error in client.Batch(): [%s]", err)
+	}
+	for i := 0; i < len(ops); i += 2 {
+		if ops[i].Err != nil {
+			t.Fatalf("unexpected error when deleting key=[%s]: [%s]", ops[i].Item.Key, ops[i].Err)
+		}
+		if ops[i+1].Err != ErrCacheMiss {
+			t.Fatalf("unexpected error=[%v] when deleting missing key=[%s]. Expected ErrCacheMiss", ops[i+1].Err, ops[i+1].Item.Key)
+		}
+	}
+	for i := 0; i < itemsCount; i++ {
+		item := Item{
+			Key: []byte(fmt.Sprintf("batch_key_%d", i)),
+		}
+		err := c.Get(&item)
+		if i%2 == 0 && err != ErrCacheMiss {
+			t.Fatalf("unexpected error=[%v] for deleted key=[%s]. Expected ErrCacheMiss", err, item.Key)
+		}
+		if i%2 != 0 && err != nil {
+			t.Fatalf("cannot obtain value for key=[%s]: [%s]", item.Key, err)
+		}
+	}
+}
+
+func TestClient_Batch(t *testing.T) {
+	client_RunTest(cacher_Batch, t)
+}
+
+func cacher_TouchGat(c Cacher, t *testing.T) {
+	cc := c.(interface {
+		Touch(key []byte, expiration time.Duration) error
+		Gat(item *Item, expiration time.Duration) error
+	})
+
+	item := Item{
+		Key:   []byte("touch_key"),
+		Value: []byte("value"),
+		Flags: 42,
+	}
+	if err := cc.Touch(item.Key, time.Hour); err != ErrCacheMiss {
+		t.Fatalf("unexpected error=[%v] when touching missing item. Expected ErrCacheMiss", err)
+	}
+	if err := cc.Gat(&item, time.Hour); err != ErrCacheMiss {
+		t.Fatalf("unexpected error=[%v] when obtaining missing item. Expected ErrCacheMiss", err)
+	}
+	if err := cc.Touch([]byte("malformed key"), time.Hour); err != ErrMalformedKey {
+		t.Fatalf("unexpected error=[%v] for malformed key. Expected ErrMalformedKey", err)
+	}
+
+	item.Expiration = time.Second
+	if err := c.Set(&item); err != nil {
+		t.Fatalf("error in client.Set(): [%s]", err)
+	}
+	if err := cc.Touch(item.Key, time.Hour); err != nil {
+		t.Fatalf("error in client.Touch(): [%s]", err)
+	}
+	item.Value = nil
+	item.Flags = 0
+	if err := cc.Gat(&item, time.Hour); err != nil {
+		t.Fatalf("error in client.Gat(): [%s]", err)
+	}
+	if string(item.Value) != "value" {
+		t.Fatalf("unexpected value=[%s]. Expected [value]", item.Value)
+	}
+	if item.Flags != 42 {
+		t.Fatalf("unexpected flags=%d. Expected 42", item.Flags)
+	}
+}
+
+func TestClient_TouchGat(t *testing.T) {
+	client_RunTest(cacher_TouchGat, t)
+}
+
+func TestClient_TouchGatServerError(t *testing.T) {
+	c, s, cache := newClientServerCache(t)
+	defer cache.Close()
+	defer s.Stop()
+	c.Start()
+	defer c.Stop()
+
+	item := Item{
+		Key:   []byte("key"),
+		Value: []byte("value"),
+	}
+	if err := c.Set(&item); err != nil {
+		t.Fatalf("error in client.Set(): [%s]", err)
+	}
+
+	// Read-only server rejects touch and gat commands with SERVER_ERROR.
+	s.SetReadOnly(true)
+	if err := c.Touch(item.Key, time.Hour); err != ErrServerError {
+		t.Fatalf("unexpected error=[%v] in client.Touch(). Expected ErrServerError", err)
+	}
+	if err := c.Gat(&item, time.Hour); err != ErrServerError {
+		t.Fatalf("unexpected error=[%v] in client.Gat(). Expected ErrServerError", err)
+	}
+
+	// The connection must remain usable after errors.
+	item.Value = nil
+	if err := c.Get(&item); err != nil {
+		t.Fatalf("error in client.Get(): [%s]", err)
+	}
+	if string(item.Value) != "value" {
+		t.Fatalf("unexpected value=[%s]. Expected [value]", item.Value)
+	}
+}
+
+func cacher_AppendPrepend(c Cacher, t *testing.T) {
+	cc := c.(interface {
+		Append(item *Item) error
+		Prepend(item *Item) error
+		AppendNowait(item *Item)
+		PrependNowait(item *Item)
+	})
+
+	item := Item{
+		Key:   []byte("append_key"),
+		Value: []byte("bar"),
+	}
+	if err := cc.Append(&item); err != ErrCacheMiss {
+		t.Fatalf("unexpected error=[%v] when appending to missing item. Expected ErrCacheMiss", err)
+	}
+	if err := cc.Prepend(&item); err != ErrCacheMiss {
+		t.Fatalf("unexpected error=[%v] when prepending to missing item. Expected ErrCacheMiss", err)
+	}
+	if err := cc.Append(&Item{Key: item.Key}); err != ErrNilValue {
+		t.Fatalf("unexpected error=[%v] for nil value. Expected ErrNilValue", err)
+	}
+
+	item.Flags = 123
+	if err := c.Set(&item); err != nil {
+		t.Fatalf("error in client.Set(): [%s]", err)
+	}
+	if err := cc.Append(&Item{Key: item.Key, Value: []byte("baz")}); err != nil {
+		t.Fatalf("error in client.Append(): [%s]", err)
+	}
+	if err := cc.Prepend(&Item{Key: item.Key, Value: []byte("foo")}); err != nil {
+		t.Fatalf("error in client.Prepend(): [%s]", err)
+	}
+	item.Value = nil
+	item.Flags = 0
+	if err := c.Get(&item); err != nil {
+		t.Fatalf("error in client.Get(): [%s]", err)
+	}
+	if string(item.Value) != "foobarbaz" {
+		t.Fatalf("unexpected value=[%s]. Expected [foobarbaz]", item.Value)
+	}
+	if item.Flags != 123 {
+		t.Fatalf("unexpected flags=%d. Expected 123", item.Flags)
+	}
+
+	itemsCount := 100
+	items := make([]Item, itemsCount)
+	for i := 0; i < itemsCount; i++ {
+		item := &items[i]
+		item.Key = []byte(fmt.Sprintf("append_nowait_key_%d", i))
+		item.Value = []byte("value")
+		if err := c.Set(item); err != nil {
+			t.Fatalf("error in client.Set(): [%s]", err)
+		}
+	}
+	for i := 0; i < itemsCount; i++ {
+		item := &items[i]
+		cc.AppendNowait(&Item{Key: item.Key, Value: []byte("_suffix")})
+		cc.PrependNowait(&Item{Key: item.Key, Value: []byte("prefix_")})
+		item.Value = []byte("prefix_value_suffix")
+	}
+
+	checkItems(c, items, t)
+}
+
+func TestClient_AppendPrepend(t *testing.T) {
+	client_RunTest(cacher_AppendPrepend, t)
+}
+
+func cacher_IncrDecr(c Cacher, t *testing.T) {
+	cc := c.(interface {
+		Incr(key []byte, delta uint64) (uint64, error)
+		Decr(key []byte, delta uint64) (uint64, error)
+	})
+
+	key := []byte("counter")
+	if _, err := cc.Incr(key, 1); err != ErrCacheMiss {
+		t.Fatalf("unexpected error=[%v] when incrementing missing counter. Expected ErrCacheMiss", err)
+	}
+	if _, err := cc.Decr(key, 1); err != ErrCacheMiss {
+		t.Fatalf("unexpected error=[%v] when decrementing missing counter. Expected ErrCacheMiss", err)
+	}
+	if _, err := cc.Incr([]byte("malformed key"), 1); err != ErrMalformedKey {
+		t.Fatalf("unexpected error=[%v] for malformed key. Expected ErrMalformedKey", err)
+	}
+
+	item := Item{
+		Key:   key,
+		Value: []byte("10"),
+	}
+	if err := c.Set(&item); err != nil {
+		t.Fatalf("error in client.Set(): [%s]", err)
+	}
+	for i := uint64(1); i <= 10; i++ {
+		n, err := cc.Incr(key, 5)
+		if err != nil {
+			t.Fatalf("error in client.Incr(): [%s]", err)
+		}
+		if n != 10+5*i {
+			t.Fatalf("unexpected counter value=%d. Expected %d", n, 10+5*i)
+		}
+	}
+	n, err := cc.Decr(key, 20)
+	if err != nil {
+		t.Fatalf("error in client.Decr(): [%s]", err)
+	}
+	if n != 40 {
+		t.Fatalf("unexpected counter value=%d. Expected 40", n)
+	}
+	if n, err = cc.Decr(key, 100); err != nil {
+		t.Fatalf("error in client.Decr(): [%s]", err)
+	}
+	if n != 0 {
+		t.Fatalf("unexpected counter value=%d. Expected 0", n)
+	}
+	item.Value = nil
+	if err = c.Get(&item); err != nil {
+		t.Fatalf("cannot obtain counter value: [%s]", err)
+	}
+	if string(item.Value) != "0" {
+		t.Fatalf("unexpected counter value=[%s]. Expected [0]", item.Value)
+	}
+
+	item.Value = []byte("foobar")
+	if err = c.Set(&item); err != nil {
+		t.Fatalf("error in client.Set(): [%s]", err)
+	}
+	if _, err = cc.Incr(key, 1); err != ErrNonNumeric {
+		t.Fatalf("unexpected error=[%v] when incrementing non-numeric value. Expected ErrNonNumeric", err)
+	}
+	if _, err = cc.Decr(key, 1); err != ErrNonNumeric {
+		t.Fatalf("unexpected error=[%v] when decrementing non-numeric value. Expected ErrNonNumeric", err)
+	}
+}
+
+func TestClient_IncrDecr(t *testing.T) {
+	client_RunTest(cacher_IncrDecr, t)
+}
+
 func cacher_DeleteNowait(c Cacher, t *testing.T) {
 	itemsCount := 100
 	var item Item
@@ -608,6 +1088,42 @@ func TestClient_DeleteNowait(t *testing.T) {
 	client_RunTest(cacher_DeleteNowait, t)
 }
 
+type noreplyCacher interface {
+	SetNoreply(item *Item)
+	DeleteNoreply(key []byte)
+}
+
+func cacher_Noreply(c Cacher, t *testing.T) {
+	nc, ok := c.(noreplyCacher)
+	if !ok {
+		t.Fatalf("%T must implement SetNoreply() and DeleteNoreply()", c)
+	}
+	itemsCount := 100
+	items := make([]Item, itemsCount)
+	for i := 0; i < itemsCount; i++ {
+		item := &items[i]
+		item.Key = []byte(fmt.Sprintf("key_%d", i))
+		item.Value = []byte(fmt.Sprintf("value_%d", i))
+		nc.SetNoreply(item)
+	}
+	checkItems(c, items, t)
+
+	for i := 0; i < itemsCount; i++ {
+		nc.DeleteNoreply(items[i].Key)
+	}
+	var item Item
+	for i := 0; i < itemsCount; i++ {
+		item.Key = items[i].Key
+		if err := c.Get(&item); err != ErrCacheMiss {
+			t.Fatalf("error when obtaining deleted item for key=[%s]: [%s]", item.Key, err)
+		}
+	}
+}
+
+func TestClient_Noreply(t *testing.T) {
+	client_RunTest(cacher_Noreply, t)
+}
+
 func cacher_FlushAll(c Cacher, t *testing.T) {
 	itemsCount := 100
 	var item Item
@@ -989,6 +1505,11 @@ func TestDistributedClient_GetSet(t *testing.T) {
 	distributedClientStatic_RunTest(cacher_GetSet, t)
 }
 
+func TestDistributedClient_Ctx(t *testing.T) {
+	distributedClient_RunTest(cacher_Ctx, t)
+	distributedClientStatic_RunTest(cacher_Ctx, t)
+}
+
 func TestDistributedClient_Add(t *testing.T) {
 	distributedClient_RunTest(cacher_Add, t)
 	distributedClientStatic_RunTest(cacher_Add, t)
@@ -1019,6 +1540,31 @@ func TestDistributedClient_GetMulti_EmptyItems(t *testing.T) {
 	distributedClientStatic_RunTest(cacher_GetMulti_EmptyItems, t)
 }
 
+func TestDistributedClient_GetMultiKeys(t *testing.T) {
+	distributedClient_RunTest(cacher_GetMultiKeys, t)
+	distributedClientStatic_RunTest(cacher_GetMultiKeys, t)
+}
+
+func TestDistributedClient_Batch(t *testing.T) {
+	distributedClient_RunTest(cacher_Batch, t)
+	distributedClientStatic_RunTest(cacher_Batch, t)
+}
+
+func TestDistributedClient_TouchGat(t *testing.T) {
+	distributedClient_RunTest(cacher_TouchGat, t)
+	distributedClientStatic_RunTest(cacher_TouchGat, t)
+}
+
+func TestDistributedClient_AppendPrepend(t *testing.T) {
+	distributedClient_RunTest(cacher_AppendPrepend, t)
+	distributedClientStatic_RunTest(cacher_AppendPrepend, t)
+}
+
+func TestDistributedClient_IncrDecr(t *testing.T) {
+	distributedClient_RunTest(cacher_IncrDecr, t)
+	distributedClientStatic_RunTest(cacher_IncrDecr, t)
+}
+
 func TestDistributedClient_GetMulti(t *testing.T) {
 	distributedClient_RunTest(cacher_GetMulti, t)
 	distributedClientStatic_RunTest(cacher_GetMulti, t)
@@ -1039,6 +1585,11 @@ func TestDistributedClient_DeleteNowait(t *testing.T) {
 	distributedClientStatic_RunTest(cacher_DeleteNowait, t)
 }
 
+func TestDistributedClient_Noreply(t *testing.T) {
+	distributedClient_RunTest(cacher_Noreply, t)
+	distributedClientStatic_RunTest(cacher_Noreply, t)
+}
+
 func TestDistributedClient_FlushAll(t *testing.T) {
 	distributedClient_RunTest(cacher_FlushAll, t)
 	distributedClientStatic_RunTest(cacher_FlushAll, t)
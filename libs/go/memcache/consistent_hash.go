@@ -2,8 +2,8 @@ package memcache
 
 import (
 	"encoding/binary"
+	"fmt"
 	"hash/fnv"
-	"log"
 )
 
 type chItem struct {
@@ -27,7 +27,7 @@ func (h *consistentHash) bucketIdx(key []byte, i int) (keyUint uint32, idx int)
 	fnvH := fnv.New32()
 	fnvH.Write(key)
 	if err := binary.Write(fnvH, binary.LittleEndian, uint32(i)); err != nil {
-		log.Panicf("binary.Write() failed: [%s]", err)
+		panic(fmt.Sprintf("binary.Write() failed: [%s]", err))
 	}
 	keyUint = fnvH.Sum32()
 	idx = int(keyUint % uint32(h.BucketsCount))
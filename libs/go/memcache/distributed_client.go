@@ -1,6 +1,7 @@
 package memcache
 
 import (
+	"context"
 	"errors"
 	"sync"
 	"time"
@@ -241,7 +242,10 @@ func (c *DistributedClient) client(key []byte) (client *Client, err error) {
 	return
 }
 
-func (c *DistributedClient) itemsPerClient(items []Item) (m [][]Item, clients []*Client, err error) {
+// Returns indexes of keys per client for the given keysCount keys.
+//
+// The i-th key is obtained via getKey(i).
+func (c *DistributedClient) keyIdxsPerClient(keysCount int, getKey func(i int) []byte) (m [][]int, clients []*Client, err error) {
 	c.lock()
 	// do not use defer c.unlock() for performance reasons.
 
@@ -251,10 +255,10 @@ func (c *DistributedClient) itemsPerClient(items []Item) (m [][]Item, clients []
 		return
 	}
 
-	m = make([][]Item, clientsCount)
-	for _, item := range items {
-		clientIdx := c.clientIdx(item.Key)
-		m[clientIdx] = append(m[clientIdx], item)
+	m = make([][]int, clientsCount)
+	for i := 0; i < keysCount; i++ {
+		clientIdx := c.clientIdx(getKey(i))
+		m[clientIdx] = append(m[clientIdx], i)
 	}
 	if c.isDynamic {
 		clients = make([]*Client, clientsCount)
@@ -273,24 +277,90 @@ func handleRaceCondition(err *error) {
 }
 
 // See Client.GetMulti().
-func (c *DistributedClient) GetMulti(items []Item) (err error) {
-	itemsPerClient, clients, err := c.itemsPerClient(items)
+func (c *DistributedClient) GetMulti(items []Item) error {
+	return c.GetMultiCtx(context.Background(), items)
+}
+
+// See Client.GetMultiCtx().
+func (c *DistributedClient) GetMultiCtx(ctx context.Context, items []Item) (err error) {
+	idxsPerClient, clients, err := c.keyIdxsPerClient(len(items), func(i int) []byte { return items[i].Key })
 	if err != nil {
 		return
 	}
 	if c.isDynamic {
 		defer handleRaceCondition(&err)
 	}
-	for clientIdx, clientItems := range itemsPerClient {
-		if err = clients[clientIdx].GetMulti(clientItems); err != nil {
+	var clientItems []Item
+	for clientIdx, idxs := range idxsPerClient {
+		clientItems = clientItems[:0]
+		for _, i := range idxs {
+			clientItems = append(clientItems, items[i])
+		}
+		if err = clients[clientIdx].GetMultiCtx(ctx, clientItems); err != nil {
 			return
 		}
+		for j, i := range idxs {
+			items[i] = clientItems[j]
+		}
+	}
+	return
+}
+
+// See Client.GetMultiKeys().
+func (c *DistributedClient) GetMultiKeys(keys [][]byte) (map[string]Item, error) {
+	return c.GetMultiKeysCtx(context.Background(), keys)
+}
+
+// See Client.GetMultiKeysCtx().
+//
+// Requests to distinct servers are performed concurrently.
+func (c *DistributedClient) GetMultiKeysCtx(ctx context.Context, keys [][]byte) (items map[string]Item, err error) {
+	idxsPerClient, clients, err := c.keyIdxsPerClient(len(keys), func(i int) []byte { return keys[i] })
+	if err != nil {
+		return
+	}
+
+	var wg sync.WaitGroup
+	results := make([]map[string]Item, len(clients))
+	errs := make([]error, len(clients))
+	for clientIdx, idxs := range idxsPerClient {
+		if len(idxs) == 0 {
+			continue
+		}
+		clientKeys := make([][]byte, len(idxs))
+		for j, i := range idxs {
+			clientKeys[j] = keys[i]
+		}
+		wg.Add(1)
+		go func(clientIdx int, clientKeys [][]byte) {
+			defer wg.Done()
+			if c.isDynamic {
+				defer handleRaceCondition(&errs[clientIdx])
+			}
+			results[clientIdx], errs[clientIdx] = clients[clientIdx].GetMultiKeysCtx(ctx, clientKeys)
+		}(clientIdx, clientKeys)
+	}
+	wg.Wait()
+
+	items = make(map[string]Item, len(keys))
+	for clientIdx, result := range results {
+		if errs[clientIdx] != nil {
+			return nil, errs[clientIdx]
+		}
+		for key, item := range result {
+			items[key] = item
+		}
 	}
 	return
 }
 
 // See Client.Get().
-func (c *DistributedClient) Get(item *Item) (err error) {
+func (c *DistributedClient) Get(item *Item) error {
+	return c.GetCtx(context.Background(), item)
+}
+
+// See Client.GetCtx().
+func (c *DistributedClient) GetCtx(ctx context.Context, item *Item) (err error) {
 	client, err := c.client(item.Key)
 	if err != nil {
 		return
@@ -298,11 +368,16 @@ func (c *DistributedClient) Get(item *Item) (err error) {
 	if c.isDynamic {
 		defer handleRaceCondition(&err)
 	}
-	return client.Get(item)
+	return client.GetCtx(ctx, item)
 }
 
 // See Client.Cget().
-func (c *DistributedClient) Cget(item *Item) (err error) {
+func (c *DistributedClient) Cget(item *Item) error {
+	return c.CgetCtx(context.Background(), item)
+}
+
+// See Client.CgetCtx().
+func (c *DistributedClient) CgetCtx(ctx context.Context, item *Item) (err error) {
 	client, err := c.client(item.Key)
 	if err != nil {
 		return
@@ -310,11 +385,16 @@ func (c *DistributedClient) Cget(item *Item) (err error) {
 	if c.isDynamic {
 		defer handleRaceCondition(&err)
 	}
-	return client.Cget(item)
+	return client.CgetCtx(ctx, item)
 }
 
 // See Client.GetDe().
-func (c *DistributedClient) GetDe(item *Item, graceDuration time.Duration) (err error) {
+func (c *DistributedClient) GetDe(item *Item, graceDuration time.Duration) error {
+	return c.GetDeCtx(context.Background(), item, graceDuration)
+}
+
+// See Client.GetDeCtx().
+func (c *DistributedClient) GetDeCtx(ctx context.Context, item *Item, graceDuration time.Duration) (err error) {
 	client, err := c.client(item.Key)
 	if err != nil {
 		return
@@ -322,11 +402,16 @@ func (c *DistributedClient) GetDe(item *Item, graceDuration time.Duration) (err
 	if c.isDynamic {
 		defer handleRaceCondition(&err)
 	}
-	return client.GetDe(item, graceDuration)
+	return client.GetDeCtx(ctx, item, graceDuration)
 }
 
 // See Client.CgetDe()
-func (c *DistributedClient) CgetDe(item *Item, graceDuration time.Duration) (err error) {
+func (c *DistributedClient) CgetDe(item *Item, graceDuration time.Duration) error {
+	return c.CgetDeCtx(context.Background(), item, graceDuration)
+}
+
+// See Client.CgetDeCtx().
+func (c *DistributedClient) CgetDeCtx(ctx context.Context, item *Item, graceDuration time.Duration) (err error) {
 	client, err := c.client(item.Key)
 	if err != nil {
 		return
@@ -334,11 +419,16 @@ func (c *DistributedClient) CgetDe(item *Item, graceDuration time.Duration) (err
 	if c.isDynamic {
 		defer handleRaceCondition(&err)
 	}
-	return client.CgetDe(item, graceDuration)
+	return client.CgetDeCtx(ctx, item, graceDuration)
 }
 
 // See Client.Set().
-func (c *DistributedClient) Set(item *Item) (err error) {
+func (c *DistributedClient) Set(item *Item) error {
+	return c.SetCtx(context.Background(), item)
+}
+
+// See Client.SetCtx().
+func (c *DistributedClient) SetCtx(ctx context.Context, item *Item) (err error) {
 	client, err := c.client(item.Key)
 	if err != nil {
 		return
@@ -346,11 +436,16 @@ func (c *DistributedClient) Set(item *Item) (err error) {
 	if c.isDynamic {
 		defer handleRaceCondition(&err)
 	}
-	return client.Set(item)
+	return client.SetCtx(ctx, item)
 }
 
 // See Client.Add().
-func (c *DistributedClient) Add(item *Item) (err error) {
+func (c *DistributedClient) Add(item *Item) error {
+	return c.AddCtx(context.Background(), item)
+}
+
+// See Client.AddCtx().
+func (c *DistributedClient) AddCtx(ctx context.Context, item *Item) (err error) {
 	client, err := c.client(item.Key)
 	if err != nil {
 		return
@@ -358,11 +453,26 @@ func (c *DistributedClient) Add(item *Item) (err error) {
 	if c.isDynamic {
 		defer handleRaceCondition(&err)
 	}
-	return client.Add(item)
+	return client.AddCtx(ctx, item)
+}
+
+// See Client.Gets().
+func (c *DistributedClient) Gets(item *Item) error {
+	return c.GetCtx(context.Background(), item)
+}
+
+// See Client.GetsCtx().
+func (c *DistributedClient) GetsCtx(ctx context.Context, item *Item) error {
+	return c.GetCtx(ctx, item)
 }
 
 // See Client.Cas()
-func (c *DistributedClient) Cas(item *Item) (err error) {
+func (c *DistributedClient) Cas(item *Item) error {
+	return c.CasCtx(context.Background(), item)
+}
+
+// See Client.CasCtx().
+func (c *DistributedClient) CasCtx(ctx context.Context, item *Item) (err error) {
 	client, err := c.client(item.Key)
 	if err != nil {
 		return
@@ -370,7 +480,181 @@ func (c *DistributedClient) Cas(item *Item) (err error) {
 	if c.isDynamic {
 		defer handleRaceCondition(&err)
 	}
-	return client.Cas(item)
+	return client.CasCtx(ctx, item)
+}
+
+// See Client.Append().
+func (c *DistributedClient) Append(item *Item) error {
+	return c.AppendCtx(context.Background(), item)
+}
+
+// See Client.AppendCtx().
+func (c *DistributedClient) AppendCtx(ctx context.Context, item *Item) (err error) {
+	client, err := c.client(item.Key)
+	if err != nil {
+		return
+	}
+	if c.isDynamic {
+		defer handleRaceCondition(&err)
+	}
+	return client.AppendCtx(ctx, item)
+}
+
+// See Client.Prepend().
+func (c *DistributedClient) Prepend(item *Item) error {
+	return c.PrependCtx(context.Background(), item)
+}
+
+// See Client.PrependCtx().
+func (c *DistributedClient) PrependCtx(ctx context.Context, item *Item) (err error) {
+	client, err := c.client(item.Key)
+	if err != nil {
+		return
+	}
+	if c.isDynamic {
+		defer handleRaceCondition(&err)
+	}
+	return client.PrependCtx(ctx, item)
+}
+
+// See Client.AppendNowait().
+func (c *DistributedClient) AppendNowait(item *Item) {
+	client, err := c.client(item.Key)
+	if err != nil {
+		return
+	}
+	if c.isDynamic {
+		defer handleRaceCondition(&err)
+	}
+	client.AppendNowait(item)
+}
+
+// See Client.PrependNowait().
+func (c *DistributedClient) PrependNowait(item *Item) {
+	client, err := c.client(item.Key)
+	if err != nil {
+		return
+	}
+	if c.isDynamic {
+		defer handleRaceCondition(&err)
+	}
+	client.PrependNowait(item)
+}
+
+// See Client.Touch().
+func (c *DistributedClient) Touch(key []byte, expiration time.Duration) error {
+	return c.TouchCtx(context.Background(), key, expiration)
+}
+
+// See Client.TouchCtx().
+func (c *DistributedClient) TouchCtx(ctx context.Context, key []byte, expiration time.Duration) (err error) {
+	client, err := c.client(key)
+	if err != nil {
+		return
+	}
+	if c.isDynamic {
+		defer handleRaceCondition(&err)
+	}
+	return client.TouchCtx(ctx, key, expiration)
+}
+
+// See Client.Gat().
+func (c *DistributedClient) Gat(item *Item, expiration time.Duration) error {
+	return c.GatCtx(context.Background(), item, expiration)
+}
+
+// See Client.GatCtx().
+func (c *DistributedClient) GatCtx(ctx context.Context, item *Item, expiration time.Duration) (err error) {
+	client, err := c.client(item.Key)
+	if err != nil {
+		return
+	}
+	if c.isDynamic {
+		defer handleRaceCondition(&err)
+	}
+	return client.GatCtx(ctx, item, expiration)
+}
+
+// See Client.Incr().
+func (c *DistributedClient) Incr(key []byte, delta uint64) (uint64, error) {
+	return c.IncrCtx(context.Background(), key, delta)
+}
+
+// See Client.IncrCtx().
+func (c *DistributedClient) IncrCtx(ctx context.Context, key []byte, delta uint64) (value uint64, err error) {
+	client, err := c.client(key)
+	if err != nil {
+		return
+	}
+	if c.isDynamic {
+		defer handleRaceCondition(&err)
+	}
+	return client.IncrCtx(ctx, key, delta)
+}
+
+// See Client.Decr().
+func (c *DistributedClient) Decr(key []byte, delta uint64) (uint64, error) {
+	return c.DecrCtx(context.Background(), key, delta)
+}
+
+// See Client.DecrCtx().
+func (c *DistributedClient) DecrCtx(ctx context.Context, key []byte, delta uint64) (value uint64, err error) {
+	client, err := c.client(key)
+	if err != nil {
+		return
+	}
+	if c.isDynamic {
+		defer handleRaceCondition(&err)
+	}
+	return client.DecrCtx(ctx, key, delta)
+}
+
+// See Client.Batch().
+func (c *DistributedClient) Batch(ops []BatchOp) error {
+	return c.BatchCtx(context.Background(), ops)
+}
+
+// See Client.BatchCtx().
+//
+// Operations for distinct servers are performed concurrently.
+func (c *DistributedClient) BatchCtx(ctx context.Context, ops []BatchOp) (err error) {
+	idxsPerClient, clients, err := c.keyIdxsPerClient(len(ops), func(i int) []byte { return ops[i].Item.Key })
+	if err != nil {
+		return
+	}
+
+	var wg sync.WaitGroup
+	opsPerClient := make([][]BatchOp, len(clients))
+	errs := make([]error, len(clients))
+	for clientIdx, idxs := range idxsPerClient {
+		if len(idxs) == 0 {
+			continue
+		}
+		clientOps := make([]BatchOp, len(idxs))
+		for j, i := range idxs {
+			clientOps[j] = ops[i]
+		}
+		opsPerClient[clientIdx] = clientOps
+		wg.Add(1)
+		go func(clientIdx int) {
+			defer wg.Done()
+			if c.isDynamic {
+				defer handleRaceCondition(&errs[clientIdx])
+			}
+			errs[clientIdx] = clients[clientIdx].BatchCtx(ctx, opsPerClient[clientIdx])
+		}(clientIdx)
+	}
+	wg.Wait()
+
+	for clientIdx, idxs := range idxsPerClient {
+		if errs[clientIdx] != nil {
+			return errs[clientIdx]
+		}
+		for j, i := range idxs {
+			ops[i].Err = opsPerClient[clientIdx][j].Err
+		}
+	}
+	return
 }
 
 // See Client.SetNowait().
@@ -385,8 +669,18 @@ func (c *DistributedClient) SetNowait(item *Item) {
 	client.SetNowait(item)
 }
 
+// See Client.SetNoreply().
+func (c *DistributedClient) SetNoreply(item *Item) {
+	c.SetNowait(item)
+}
+
 // See Client.Delete().
-func (c *DistributedClient) Delete(key []byte) (err error) {
+func (c *DistributedClient) Delete(key []byte) error {
+	return c.DeleteCtx(context.Background(), key)
+}
+
+// See Client.DeleteCtx().
+func (c *DistributedClient) DeleteCtx(ctx context.Context, key []byte) (err error) {
 	client, err := c.client(key)
 	if err != nil {
 		return
@@ -394,7 +688,7 @@ func (c *DistributedClient) Delete(key []byte) (err error) {
 	if c.isDynamic {
 		defer handleRaceCondition(&err)
 	}
-	return client.Delete(key)
+	return client.DeleteCtx(ctx, key)
 }
 
 // See Client.DeleteNowait().
@@ -409,6 +703,11 @@ func (c *DistributedClient) DeleteNowait(key []byte) {
 	client.DeleteNowait(key)
 }
 
+// See Client.DeleteNoreply().
+func (c *DistributedClient) DeleteNoreply(key []byte) {
+	c.DeleteNowait(key)
+}
+
 func (c *DistributedClient) allClients() (clients []*Client, err error) {
 	c.lock()
 	// do not use defer c.unlock() for performance reasons.
@@ -429,7 +728,12 @@ func (c *DistributedClient) allClients() (clients []*Client, err error) {
 }
 
 // See Client.FlushAllDelayed().
-func (c *DistributedClient) FlushAllDelayed(expiration time.Duration) (err error) {
+func (c *DistributedClient) FlushAllDelayed(expiration time.Duration) error {
+	return c.FlushAllDelayedCtx(context.Background(), expiration)
+}
+
+// See Client.FlushAllDelayedCtx().
+func (c *DistributedClient) FlushAllDelayedCtx(ctx context.Context, expiration time.Duration) (err error) {
 	clients, err := c.allClients()
 	if err != nil {
 		return
@@ -438,7 +742,7 @@ func (c *DistributedClient) FlushAllDelayed(expiration time.Duration) (err error
 		defer handleRaceCondition(&err)
 	}
 	for _, client := range clients {
-		if err = client.FlushAllDelayed(expiration); err != nil {
+		if err = client.FlushAllDelayedCtx(ctx, expiration); err != nil {
 			return
 		}
 	}
@@ -446,7 +750,12 @@ func (c *DistributedClient) FlushAllDelayed(expiration time.Duration) (err error
 }
 
 // See Client.FlushAll().
-func (c *DistributedClient) FlushAll() (err error) {
+func (c *DistributedClient) FlushAll() error {
+	return c.FlushAllCtx(context.Background())
+}
+
+// See Client.FlushAllCtx().
+func (c *DistributedClient) FlushAllCtx(ctx context.Context) (err error) {
 	clients, err := c.allClients()
 	if err != nil {
 		return
@@ -455,7 +764,7 @@ func (c *DistributedClient) FlushAll() (err error) {
 		defer handleRaceCondition(&err)
 	}
 	for _, client := range clients {
-		if err = client.FlushAll(); err != nil {
+		if err = client.FlushAllCtx(ctx); err != nil {
 			return
 		}
 	}
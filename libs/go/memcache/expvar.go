@@ -0,0 +1,42 @@
+package memcache
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+)
+
+// Publishing server and client counters via expvar package.
+//
+// See Server.ExpvarPrefix and ClientConfig.ExpvarPrefix.
+
+// Variables published via publishExpvar() keyed by name.
+//
+// expvar package doesn't support unpublishing variables, so restarted
+// servers and clients replace the function behind the already published
+// variable.
+var (
+	expvarsLock sync.Mutex
+	expvars     = make(map[string]*atomic.Value)
+)
+
+// Publishes the variable with the given name, which is evaluated via f.
+func publishExpvar(logger Logger, name string, f func() interface{}) {
+	expvarsLock.Lock()
+	defer expvarsLock.Unlock()
+
+	if v, ok := expvars[name]; ok {
+		v.Store(f)
+		return
+	}
+	if expvar.Get(name) != nil {
+		logger.Logf(LogLevelError, "Cannot publish expvar=[%s], since it is already published by other code", name)
+		return
+	}
+	v := &atomic.Value{}
+	v.Store(f)
+	expvars[name] = v
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return v.Load().(func() interface{})()
+	}))
+}
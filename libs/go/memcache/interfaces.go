@@ -1,6 +1,7 @@
 package memcache
 
 import (
+	"context"
 	"time"
 )
 
@@ -35,6 +36,21 @@ type Ccacher interface {
 	CgetDe(item *Item, graceDuration time.Duration) error
 }
 
+// Client and DistributedClient implement this interface.
+type CacherCtx interface {
+	GetCtx(ctx context.Context, item *Item) error
+	GetMultiCtx(ctx context.Context, items []Item) error
+	GetDeCtx(ctx context.Context, item *Item, graceDuration time.Duration) error
+	CgetCtx(ctx context.Context, item *Item) error
+	CgetDeCtx(ctx context.Context, item *Item, graceDuration time.Duration) error
+	SetCtx(ctx context.Context, item *Item) error
+	AddCtx(ctx context.Context, item *Item) error
+	CasCtx(ctx context.Context, item *Item) error
+	DeleteCtx(ctx context.Context, key []byte) error
+	FlushAllCtx(ctx context.Context) error
+	FlushAllDelayedCtx(ctx context.Context, expiration time.Duration) error
+}
+
 // Client and DistributedClient implement this interface.
 type Cacher interface {
 	Ccacher
@@ -0,0 +1,132 @@
+package memcache
+
+import (
+	"log"
+	"os"
+)
+
+// Severity of logged messages.
+type LogLevel int
+
+const (
+	// Per-request details. Enabled via verbosity levels on the server.
+	LogLevelDebug = LogLevel(iota)
+
+	// Connection-level events such as accepted and closed connections.
+	LogLevelInfo
+
+	// Unexpected but recoverable conditions such as malformed requests
+	// or network errors. These may be noisy under misbehaving clients.
+	LogLevelWarning
+
+	// Failures requiring attention such as cache errors.
+	LogLevelError
+
+	// Unrecoverable errors. The process exits after logging them.
+	LogLevelFatal
+)
+
+var logLevelNames = [...]string{
+	LogLevelDebug:   "DEBUG",
+	LogLevelInfo:    "INFO",
+	LogLevelWarning: "WARNING",
+	LogLevelError:   "ERROR",
+	LogLevelFatal:   "FATAL",
+}
+
+func (level LogLevel) String() string {
+	if level < 0 || int(level) >= len(logLevelNames) {
+		return "UNKNOWN"
+	}
+	return logLevelNames[level]
+}
+
+// Destination for messages logged by Server and Client.
+//
+// Implementations may be called concurrently from multiple goroutines.
+type Logger interface {
+	// Logs the message with the given level.
+	//
+	// Arguments are handled in the manner of fmt.Printf.
+	Logf(level LogLevel, format string, args ...interface{})
+}
+
+// Logger for Server and Client instances without explicitly set Logger
+// and for low-level client protocol messages, which aren't bound
+// to a particular Client.
+//
+// By default messages are written to the standard logger from log package.
+var DefaultLogger Logger = NewStdLogger(nil, LogLevelDebug)
+
+// Returns Logger writing messages with at least the given level
+// to the given log.Logger.
+//
+// Messages are written to the standard logger if l is nil.
+func NewStdLogger(l *log.Logger, minLevel LogLevel) Logger {
+	return &stdLogger{
+		l:        l,
+		minLevel: minLevel,
+	}
+}
+
+type stdLogger struct {
+	l        *log.Logger
+	minLevel LogLevel
+}
+
+func (sl *stdLogger) Logf(level LogLevel, format string, args ...interface{}) {
+	if level < sl.minLevel {
+		return
+	}
+	if sl.l == nil {
+		log.Printf(format, args...)
+	} else {
+		sl.l.Printf(format, args...)
+	}
+}
+
+// Logs the message via DefaultLogger.
+//
+// Server code must log via Server.logf() instead, so messages are passed
+// to Server.Logger.
+func logf(level LogLevel, format string, args ...interface{}) {
+	DefaultLogger.Logf(level, format, args...)
+}
+
+// Logs the message via DefaultLogger and exits the process.
+func fatalf(format string, args ...interface{}) {
+	logFatalf(DefaultLogger, format, args...)
+}
+
+func logFatalf(logger Logger, format string, args ...interface{}) {
+	logger.Logf(LogLevelFatal, format, args...)
+	os.Exit(1)
+}
+
+// Returns Server.Logger or DefaultLogger if it isn't set.
+func (s *Server) logger() Logger {
+	if s.Logger == nil {
+		return DefaultLogger
+	}
+	return s.Logger
+}
+
+func (s *Server) logf(level LogLevel, format string, args ...interface{}) {
+	s.logger().Logf(level, format, args...)
+}
+
+// Returns ClientConfig.Logger or DefaultLogger if it isn't set.
+func (c *ClientConfig) logger() Logger {
+	if c.Logger == nil {
+		return DefaultLogger
+	}
+	return c.Logger
+}
+
+func (c *ClientConfig) logf(level LogLevel, format string, args ...interface{}) {
+	c.logger().Logf(level, format, args...)
+}
+
+func (c *ClientConfig) fatalf(format string, args ...interface{}) {
+	logFatalf(c.logger(), format, args...)
+}
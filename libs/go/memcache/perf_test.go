@@ -2,8 +2,11 @@ package memcache
 
 import (
 	"fmt"
-	"github.com/valyala/ybc/bindings/go/ybc"
+	"github.com/kireevroi/ybc/bindings/go/ybc"
+	"io"
 	"math/rand"
+	"net"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -154,6 +157,66 @@ func getMulti(batchSize int, b *testing.B) {
 	}
 }
 
+func getMultiSlowCache(multigetConcurrency int, b *testing.B) {
+	config := ybc.Config{
+		MaxItemsCount: 1000 * 1000,
+		DataFileSize:  10 * 1000 * 1000,
+	}
+	cache, err := config.OpenCache(true)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer cache.Close()
+
+	s := &Server{
+		Cache: &slowCacher{
+			Cacher: cache,
+			delay:  100 * time.Microsecond,
+		},
+		ListenAddr:          testAddr,
+		MultigetConcurrency: multigetConcurrency,
+	}
+	s.Start()
+	defer s.Stop()
+
+	c := &Client{
+		ServerAddr: testAddr,
+	}
+	c.Start()
+	defer c.Stop()
+
+	var items []Item
+	for i := 0; i < 32; i++ {
+		item := Item{
+			Key:   []byte(fmt.Sprintf("key_%d", i)),
+			Value: []byte("value"),
+		}
+		if err := c.Set(&item); err != nil {
+			b.Fatalf("Error in client.Set(): [%s]", err)
+		}
+		items = append(items, item)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i += len(items) {
+		if err := c.GetMulti(items); err != nil {
+			b.Fatalf("Error in client.GetMulti(): [%s]", err)
+		}
+	}
+}
+
+func BenchmarkServer_GetMultiSlowCache_Sequential(b *testing.B) {
+	getMultiSlowCache(0, b)
+}
+
+func BenchmarkServer_GetMultiSlowCache_4Workers(b *testing.B) {
+	getMultiSlowCache(4, b)
+}
+
+func BenchmarkServer_GetMultiSlowCache_16Workers(b *testing.B) {
+	getMultiSlowCache(16, b)
+}
+
 func BenchmarkClientServer_GetMulti_1Items(b *testing.B) {
 	getMulti(1, b)
 }
@@ -804,3 +867,113 @@ func BenchmarkCachingClientServer_ConcurrentGetSet_64Workers(b *testing.B) {
 func BenchmarkCachingClientServer_ConcurrentGetSet_128Workers(b *testing.B) {
 	concurrentGetSetForCachingClient(128, b)
 }
+
+func BenchmarkServer_ConnTurnover(b *testing.B) {
+	config := ybc.Config{
+		MaxItemsCount: 1000 * 1000,
+		DataFileSize:  10 * 1000 * 1000,
+	}
+	cache, err := config.OpenCache(true)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer cache.Close()
+
+	s := &Server{
+		Cache:      cache,
+		ListenAddr: testAddr,
+	}
+	s.Start()
+	defer s.Stop()
+
+	request := []byte("get key\r\n")
+	response := make([]byte, len("END\r\n"))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn, err := net.Dial("tcp", testAddr)
+		if err != nil {
+			b.Fatalf("Cannot dial the server: [%s]", err)
+		}
+		if _, err = conn.Write(request); err != nil {
+			b.Fatalf("Cannot send the request: [%s]", err)
+		}
+		if _, err = io.ReadFull(conn, response); err != nil {
+			b.Fatalf("Cannot read the response: [%s]", err)
+		}
+		conn.Close()
+	}
+}
+
+// Sends the given requests over a single connection and expects
+// the given responses. Allocations include server-side allocations.
+func benchServerRequests(request, response string, b *testing.B) {
+	config := ybc.Config{
+		MaxItemsCount: 1000 * 1000,
+		DataFileSize:  10 * 1000 * 1000,
+	}
+	cache, err := config.OpenCache(true)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer cache.Close()
+
+	s := &Server{
+		Cache:      cache,
+		ListenAddr: testAddr,
+	}
+	s.Start()
+	defer s.Stop()
+
+	conn, err := net.Dial("tcp", testAddr)
+	if err != nil {
+		b.Fatalf("Cannot dial the server: [%s]", err)
+	}
+	defer conn.Close()
+
+	requestBuf := []byte(request)
+	responseBuf := make([]byte, len(response))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err = conn.Write(requestBuf); err != nil {
+			b.Fatalf("Cannot send the request: [%s]", err)
+		}
+		if _, err = io.ReadFull(conn, responseBuf); err != nil {
+			b.Fatalf("Cannot read the response: [%s]", err)
+		}
+	}
+	b.StopTimer()
+	if string(responseBuf) != response {
+		b.Fatalf("Unexpected response=[%s]. Expected [%s]", responseBuf, response)
+	}
+}
+
+func BenchmarkServer_SetGetRequests(b *testing.B) {
+	benchServerRequests("set key 123 0 5\r\nvalue\r\nget key\r\n",
+		"STORED\r\nVALUE key 123 5\r\nvalue\r\nEND\r\n", b)
+}
+
+func BenchmarkServer_LargeMultigetRequests(b *testing.B) {
+	value := strings.Repeat("x", 32*1024)
+	var request, response strings.Builder
+	for i := 0; i < 4; i++ {
+		fmt.Fprintf(&request, "set key%d 0 0 %d noreply\r\n%s\r\n", i, len(value), value)
+		fmt.Fprintf(&response, "VALUE key%d 0 %d\r\n%s\r\n", i, len(value), value)
+	}
+	request.WriteString("get key0 key1 key2 key3\r\n")
+	response.WriteString("END\r\n")
+	benchServerRequests(request.String(), response.String(), b)
+}
+
+func BenchmarkServer_LargeGetRequests(b *testing.B) {
+	value := strings.Repeat("x", 1024*1024)
+	request := fmt.Sprintf("set key 0 0 %d noreply\r\n%s\r\nget key\r\n", len(value), value)
+	response := fmt.Sprintf("VALUE key 0 %d\r\n%s\r\nEND\r\n", len(value), value)
+	benchServerRequests(request, response, b)
+}
+
+func BenchmarkServer_IncrDeleteRequests(b *testing.B) {
+	benchServerRequests("set counter 0 0 1\r\n0\r\nincr counter 12345\r\ndelete counter\r\ndelete counter\r\n",
+		"STORED\r\n12345\r\nDELETED\r\nNOT_FOUND\r\n", b)
+}
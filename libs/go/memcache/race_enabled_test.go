@@ -0,0 +1,7 @@
+//go:build race
+
+package memcache
+
+// The race detector allocates memory on its own, so allocation tests
+// are skipped under it.
+const raceEnabled = true
@@ -3,19 +3,26 @@ package memcache
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
-	"github.com/valyala/ybc/bindings/go/ybc"
-	"log"
+	"errors"
+	"fmt"
+	"github.com/kireevroi/ybc/bindings/go/ybc"
+	"hash/crc32"
+	"hash/maphash"
+	"io"
+	"io/ioutil"
+	"math"
 	"net"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
-var (
-	casidCounter uint64
-	casidLock    sync.Mutex
-)
+var casidCounter uint64
 
 func init() {
 	casidCounter = uint64(time.Now().UnixNano())
@@ -25,35 +32,48 @@ func getCasid() uint64 {
 	return atomic.AddUint64(&casidCounter, 1)
 }
 
-func writeItem(w *bufio.Writer, item *ybc.Item, size int) bool {
+func writeItem(w *bufio.Writer, s *Server, item *ybc.Item, size int) bool {
 	n, err := item.WriteTo(w)
 	if err != nil {
-		log.Printf("Error when writing payload with size=[%d] to output stream: [%s]", size, err)
+		s.logf(LogLevelWarning, "Error when writing payload with size=[%d] to output stream: [%s]", size, err)
 		return false
 	}
 	if n != int64(size) {
-		log.Printf("Invalid length of payload=[%d] written to output stream. Expected [%d]", n, size)
+		s.logf(LogLevelWarning, "Invalid length of payload=[%d] written to output stream. Expected [%d]", n, size)
 		return false
 	}
 	return writeCrLf(w)
 }
 
-func writeGetResponse(w *bufio.Writer, key []byte, item *ybc.Item, shouldWriteCasid bool, scratchBuf *[]byte) bool {
-	var casid uint64
+// Reads casid and flags from the item, so the item is positioned
+// at the beginning of the payload.
+func readGetItemMetadata(s *Server, item *ybc.Item, hasChecksum bool) (casid uint64, flags uint32, ok bool) {
 	var buf [casidSize + flagsSize]byte
 	n, err := item.Read(buf[:])
 	if err != nil {
-		log.Printf("error when reading item metadata: [%s]", err)
-		return false
+		s.logf(LogLevelError, "error when reading item metadata: [%s]", err)
+		return
 	}
 	if n != len(buf) {
-		log.Printf("Unexpected result returned from ybc.Item.Read(): %d. Expected %d", n, len(buf))
-		return false
+		s.logf(LogLevelError, "Unexpected result returned from ybc.Item.Read(): %d. Expected %d", n, len(buf))
+		return
 	}
-	if shouldWriteCasid {
-		casid = binary.LittleEndian.Uint64(buf[:])
+	casid = binary.LittleEndian.Uint64(buf[:])
+	flags = binary.LittleEndian.Uint32(buf[casidSize:])
+	if hasChecksum {
+		if _, err := item.Seek(checksumSize, 1); err != nil {
+			s.logf(LogLevelError, "Cannot skip checksum in the item: [%s]", err)
+			return
+		}
+	}
+	return casid, flags, true
+}
+
+func writeGetResponse(w *bufio.Writer, s *Server, key []byte, item *ybc.Item, shouldWriteCasid, hasChecksum bool, scratchBuf *[]byte) bool {
+	casid, flags, ok := readGetItemMetadata(s, item, hasChecksum)
+	if !ok {
+		return false
 	}
-	flags := binary.LittleEndian.Uint32(buf[casidSize:])
 
 	size := item.Available()
 	if !writeStr(w, strValue) || !writeStr(w, key) || !writeWs(w) ||
@@ -68,33 +88,368 @@ func writeGetResponse(w *bufio.Writer, key []byte, item *ybc.Item, shouldWriteCa
 		}
 	}
 
-	return writeStr(w, strCrLf) && writeItem(w, item, size)
+	return writeStr(w, strCrLf) && writeItem(w, s, item, size)
+}
+
+// Verifies the checksum stored in the given item against item's payload.
+//
+// Corrupted items are deleted from the cache. See deleteCorruptedItem().
+func verifyItemChecksum(s *Server, key []byte, item *ybc.Item) bool {
+	buf := item.Peek()
+	if len(buf) >= casidSize+flagsSize+checksumSize {
+		checksum := binary.LittleEndian.Uint32(buf[casidSize+flagsSize:])
+		if crc32.ChecksumIEEE(buf[casidSize+flagsSize+checksumSize:]) == checksum {
+			return true
+		}
+	}
+	s.logf(LogLevelError, "Checksum mismatch for the item with key=[%s]. Deleting the item from the cache", key)
+	atomic.AddUint64(&s.checksumMismatchesCount, 1)
+	deleteCorruptedItem(s, key, item)
+	return false
+}
+
+// Deletes the given corrupted item obtained for the given key.
+//
+// The item is overwritten by an empty value, which expires immediately
+// and is treated as a tombstone until then. The value isn't stored
+// if the item has been concurrently modified, so fresh values stored
+// after the item has been obtained aren't deleted.
+func deleteCorruptedItem(s *Server, key []byte, item *ybc.Item) {
+	txn, err := s.Cache.NewSetTxn(key, 0, 0)
+	if err != nil {
+		s.logf(LogLevelError, "Cannot delete the corrupted item with key=[%s]: [%s]", key, err)
+		return
+	}
+	if err = txn.CommitIfUnchanged(item); err != nil && err != ybc.ErrItemChanged {
+		s.logf(LogLevelError, "Unexpected error returned from SetTxn.CommitIfUnchanged(): [%s]", err)
+	}
+}
+
+// Returns true if the given error returned from Server.Cache may disappear
+// when retrying the operation.
+func isTransientCacheError(err error) bool {
+	if err == ybc.ErrWouldBlock {
+		return true
+	}
+	e, ok := err.(interface {
+		Temporary() bool
+	})
+	return ok && e.Temporary()
+}
+
+// Obtains the item for the given key without counting the lookup
+// in cache hits and misses if Server.Cache supports this.
+// See ybc.ItemLookuper.
+//
+// Use it for lookups, which don't serve get requests.
+func lookupItemInCache(s *Server, key []byte) (*ybc.Item, error) {
+	if l, ok := s.Cache.(ybc.ItemLookuper); ok {
+		return l.LookupItem(key)
+	}
+	return s.Cache.GetItem(key)
+}
+
+// Calls Server.Cache.GetItem() (or lookupItemInCache() if isGet is false)
+// up to Server.CacheOpRetries additional times while it returns transient
+// errors.
+func getItemWithRetries(s *Server, key []byte, isGet bool) (item *ybc.Item, err error) {
+	for i := 0; ; i++ {
+		if isGet {
+			item, err = s.Cache.GetItem(key)
+		} else {
+			item, err = lookupItemInCache(s, key)
+		}
+		if err == nil || i >= s.CacheOpRetries || !isTransientCacheError(err) {
+			return
+		}
+		time.Sleep(s.CacheOpRetryDelay)
+	}
+}
+
+// Calls Server.Cache.NewSetTxn() up to Server.CacheOpRetries additional times
+// while it returns transient errors.
+func newSetTxnWithRetries(s *Server, key []byte, size int, expiration time.Duration) (txn *ybc.SetTxn, err error) {
+	for i := 0; ; i++ {
+		txn, err = s.Cache.NewSetTxn(key, size, expiration)
+		if err == nil || i >= s.CacheOpRetries || !isTransientCacheError(err) {
+			return
+		}
+		time.Sleep(s.CacheOpRetryDelay)
+	}
+}
+
+// Returns the item for the given key from the cache.
+//
+// Returns nil item on cache miss. The returned item must be closed after use.
+func getCachedItem(s *Server, key []byte) (item *ybc.Item, ok bool) {
+	trackHotKey(s, key)
+	return fetchCachedItem(s, key, true)
+}
+
+// The same as getCachedItem(), but the lookup isn't counted in cache hits
+// and misses. Use it for lookups, which don't serve get requests.
+func lookupCachedItem(s *Server, key []byte) (item *ybc.Item, ok bool) {
+	trackHotKey(s, key)
+	return fetchCachedItem(s, key, false)
 }
 
-func getItemAndWriteResponse(w *bufio.Writer, cache ybc.Cacher, key []byte, shouldWriteCasid bool, scratchBuf *[]byte) bool {
-	item, err := cache.GetItem(key)
+// The same as getCachedItem() (or lookupCachedItem() if isGet is false),
+// but the key isn't counted in hot keys.
+func fetchCachedItem(s *Server, key []byte, isGet bool) (item *ybc.Item, ok bool) {
+	item, err := getItemWithRetries(s, key, isGet)
 	if err != nil {
 		if err == ybc.ErrCacheMiss {
-			return true
+			return nil, true
+		}
+		if isTransientCacheError(err) {
+			s.logf(LogLevelError, "Cannot obtain item for key=[%s] after %d retries: [%s]", key, s.CacheOpRetries, err)
+		} else {
+			s.logf(LogLevelError, "Unexpected error returned by cache.GetItem(key=[%s]): [%s]", key, err)
 		}
-		log.Fatalf("Unexpected error returned by cache.GetItem(key=[%s]): [%s]", key, err)
+		return nil, false
+	}
+	if isTombstone(item) || (s.VerifyChecksums && !verifyItemChecksum(s, key, item)) {
+		item.Close()
+		return nil, true
+	}
+	return item, true
+}
+
+func getItemAndWriteResponse(c *serverConn, s *Server, key []byte, shouldWriteCasid bool, scratchBuf *[]byte) (found, ok bool) {
+	item, ok := getCachedItem(s, key)
+	if ok {
+		s.countGetResult(item != nil)
+	}
+	if item == nil {
+		return
 	}
 	// do not use defer item.Close() for performance reasons
 
-	ok := writeGetResponse(w, key, item, shouldWriteCasid, scratchBuf)
+	found = true
+	if shouldWriteDirect(c, s, item.Available()) {
+		ok = writeGetResponseDirect(c, s, key, item, shouldWriteCasid)
+	} else {
+		ok = writeGetResponse(c.Writer, s, key, item, shouldWriteCasid, s.VerifyChecksums, scratchBuf)
+	}
 	item.Close()
-	return ok
+	return
+}
+
+// Obtains items for the given keys from the cache using up to
+// Server.MultigetConcurrency goroutines.
+//
+// items[i] is set to nil on cache miss for keys[i].
+// Returns false if items for some keys couldn't be obtained.
+func getCachedItemsConcurrently(s *Server, keys [][]byte, items []*ybc.Item) bool {
+	workersCount := s.MultigetConcurrency
+	if workersCount > len(keys) {
+		workersCount = len(keys)
+	}
+	nextKey := int64(-1)
+	failuresCount := int64(0)
+	var wg sync.WaitGroup
+	wg.Add(workersCount)
+	for i := 0; i < workersCount; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				n := int(atomic.AddInt64(&nextKey, 1))
+				if n >= len(keys) {
+					return
+				}
+				item, ok := getCachedItem(s, keys[n])
+				if !ok {
+					atomic.AddInt64(&failuresCount, 1)
+				}
+				items[n] = item
+			}
+		}()
+	}
+	wg.Wait()
+	return failuresCount == 0
+}
+
+// Obtains items for the given keys from the cache one by one.
+//
+// items[i] is set to nil on cache miss for keys[i].
+// Returns false if items for some keys couldn't be obtained.
+func getCachedItems(s *Server, keys [][]byte, items []*ybc.Item) bool {
+	for i, key := range keys {
+		item, ok := getCachedItem(s, key)
+		if !ok {
+			return false
+		}
+		items[i] = item
+	}
+	return true
+}
+
+// Obtains items for c.keys before writing the response, so large responses
+// may be written via writeItemsVectored().
+func getItemsAndWriteResponse(c *serverConn, s *Server, shouldWriteCasid bool, scratchBuf *[]byte) bool {
+	keys := c.keys
+	if cap(c.items) < len(keys) {
+		c.items = make([]*ybc.Item, len(keys))
+	}
+	items := c.items[:len(keys)]
+	var ok bool
+	if s.MultigetConcurrency > 1 {
+		ok = getCachedItemsConcurrently(s, keys, items)
+	} else {
+		ok = getCachedItems(s, keys, items)
+	}
+	if ok {
+		for _, item := range items {
+			s.countGetResult(item != nil)
+		}
+		if shouldWriteVectored(c, s, items) {
+			ok = writeItemsVectored(c, s, keys, items, shouldWriteCasid)
+			closeItems(items)
+			return ok
+		}
+	}
+	for i, item := range items {
+		if item == nil {
+			continue
+		}
+		if ok {
+			ok = writeGetResponse(c.Writer, s, keys[i], item, shouldWriteCasid, s.VerifyChecksums, scratchBuf)
+		}
+		item.Close()
+		items[i] = nil
+	}
+	if !ok {
+		return writeServerError(c.Writer, s)
+	}
+	return writeEndCrLf(c.Writer)
+}
+
+// Closes non-nil items and resets them to nil.
+func closeItems(items []*ybc.Item) {
+	for i, item := range items {
+		if item != nil {
+			item.Close()
+			items[i] = nil
+		}
+	}
 }
 
-func writeGetResponseWithEof(w *bufio.Writer, key []byte, item *ybc.Item, scratchBuf *[]byte) bool {
-	return writeGetResponse(w, key, item, true, scratchBuf) && writeStr(w, strEndCrLf)
+func writeGetResponseWithEof(w *bufio.Writer, s *Server, key []byte, item *ybc.Item, hasChecksum bool, scratchBuf *[]byte) bool {
+	return writeGetResponse(w, s, key, item, true, hasChecksum, scratchBuf) && writeStr(w, strEndCrLf)
 }
 
 func writeEndCrLf(w *bufio.Writer) bool {
 	return writeStr(w, strEndCrLf)
 }
 
-func processGetCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte, scratchBuf *[]byte, shouldWriteCasid bool) bool {
+// Writes SERVER_ERROR response after a failed cache operation.
+//
+// The connection is closed anyway if the operation failed due to a broken
+// connection, since bufio.Writer keeps returning the write error.
+func writeServerError(w *bufio.Writer, s *Server) bool {
+	return writeErrorStr(w, s, strServerErrorCrLf)
+}
+
+// Logs the invalid command line and writes CLIENT_ERROR response.
+//
+// line contains command arguments without the command name.
+func writeClientError(w *bufio.Writer, s *Server, line []byte) bool {
+	s.logf(LogLevelWarning, "Invalid command arguments=[%s]", formatLoggedLine(line, s.MaxLoggedLineLength))
+	return writeErrorStr(w, s, strClientErrorCrLf)
+}
+
+// Writes the given CLIENT_ERROR or SERVER_ERROR response
+// and counts it in the corresponding stat.
+func writeErrorStr(w *bufio.Writer, s *Server, response []byte) bool {
+	countErrorResponse(s, response)
+	return writeStr(w, response)
+}
+
+// Counts the given CLIENT_ERROR or SERVER_ERROR response.
+func countErrorResponse(s *Server, response []byte) {
+	if bytes.HasPrefix(response, strClientError) {
+		atomic.AddUint64(&s.clientErrorsCount, 1)
+	} else if bytes.HasPrefix(response, strServerError) {
+		atomic.AddUint64(&s.serverErrorsCount, 1)
+	}
+}
+
+func containsKey(keys [][]byte, key []byte) bool {
+	for _, k := range keys {
+		if bytes.Equal(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// The maximum number of distinct keys, which are searched linearly
+// for duplicates. Larger requests are deduplicated via c.keysTable.
+const maxLinearDedupeKeys = 16
+
+// The seed for hashing keys in c.keysTable. It is random, so clients
+// cannot craft keys with colliding hashes.
+var keysTableSeed = maphash.MakeSeed()
+
+// Returns true if the key is already in c.keys.
+//
+// Otherwise the key is remembered in c.keysTable for requests with many keys,
+// so it must be appended to c.keys then.
+func isDuplicateKey(c *serverConn, key []byte) bool {
+	keysCount := len(c.keys)
+	if keysCount < maxLinearDedupeKeys {
+		return containsKey(c.keys, key)
+	}
+	if 2*(keysCount+1) > len(c.keysTable) {
+		// Keep the table at most half full, so probe sequences remain short.
+		rebuildKeysTable(c)
+	}
+	slot := keysTableSlot(c, key)
+	if *slot != 0 {
+		return true
+	}
+	*slot = uint32(keysCount + 1)
+	return false
+}
+
+// Rebuilds c.keysTable for c.keys with enough free slots for new keys.
+//
+// The table's memory is reused between requests.
+func rebuildKeysTable(c *serverConn) {
+	size := 4 * maxLinearDedupeKeys
+	for size < 4*len(c.keys) {
+		size *= 2
+	}
+	if cap(c.keysTable) < size {
+		c.keysTable = make([]uint32, size)
+	} else {
+		c.keysTable = c.keysTable[:size]
+		clear(c.keysTable)
+	}
+	for i, key := range c.keys {
+		*keysTableSlot(c, key) = uint32(i + 1)
+	}
+}
+
+// Returns the slot in c.keysTable for the given key.
+//
+// The slot contains either the index of the key in c.keys plus one
+// or zero if the key is missing in the table.
+func keysTableSlot(c *serverConn, key []byte) *uint32 {
+	table := c.keysTable
+	mask := uint64(len(table) - 1)
+	for i := maphash.Bytes(keysTableSeed, key) & mask; ; i = (i + 1) & mask {
+		n := table[i]
+		if n == 0 || bytes.Equal(c.keys[n-1], key) {
+			return &table[i]
+		}
+	}
+}
+
+// Puts keys from the given line into c.keys.
+func parseGetKeys(c *serverConn, s *Server, line []byte) {
+	c.keys = c.keys[:0]
+	c.keysTable = c.keysTable[:0]
 	last := -1
 	lineSize := len(line)
 	for last < lineSize {
@@ -109,61 +464,127 @@ func processGetCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte, scratchBu
 			continue
 		}
 		key := line[first:last]
-		if !getItemAndWriteResponse(c.Writer, cache, key, shouldWriteCasid, scratchBuf) {
+		if s.DedupeMultigetKeys && isDuplicateKey(c, key) {
+			continue
+		}
+		c.keys = append(c.keys, key)
+	}
+}
+
+// Returns true if the given key is no longer than Server.MaxKeySize
+// and contains no whitespace and control characters, which would break
+// the protocol.
+func isValidServerKey(s *Server, key []byte) bool {
+	if len(key) > s.MaxKeySize {
+		s.logf(LogLevelWarning, "Too long key=[%s]: %d bytes. Server.MaxKeySize=%d", formatLoggedLine(key, s.MaxLoggedLineLength), len(key), s.MaxKeySize)
+		return false
+	}
+	for _, ch := range key {
+		if ch <= ' ' || ch == 0x7f {
+			s.logf(LogLevelWarning, "Invalid character=[%d] in key=[%s]", ch, formatLoggedLine(key, s.MaxLoggedLineLength))
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true if all the keys in c.keys are valid.
+// See isValidServerKey().
+func areValidServerKeys(c *serverConn, s *Server) bool {
+	for _, key := range c.keys {
+		if !isValidServerKey(s, key) {
+			return false
+		}
+	}
+	return true
+}
+
+func processGetCmd(c *serverConn, s *Server, line []byte, scratchBuf *[]byte, shouldWriteCasid bool) bool {
+	parseGetKeys(c, s, line)
+	keysCount := len(c.keys)
+	if keysCount == 0 && s.RejectEmptyGet {
+		return writeStr(c.Writer, strErrorCrLf)
+	}
+	if !areValidServerKeys(c, s) {
+		return writeClientError(c.Writer, s, line)
+	}
+	if keysCount > 1 && (s.MultigetConcurrency > 1 || c.cw != nil) {
+		return getItemsAndWriteResponse(c, s, shouldWriteCasid, scratchBuf)
+	}
+
+	found := false
+	for _, key := range c.keys {
+		var ok bool
+		if found, ok = getItemAndWriteResponse(c, s, key, shouldWriteCasid, scratchBuf); !ok {
+			return writeServerError(c.Writer, s)
+		}
+	}
+	if s.ExplicitMiss && keysCount == 1 && !found {
+		if !writeStr(c.Writer, strNotFoundCrLf) {
 			return false
 		}
 	}
 	return writeEndCrLf(c.Writer)
 }
 
-func processGetDeCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte, scratchBuf *[]byte) bool {
+func processGetDeCmd(c *bufio.ReadWriter, s *Server, line []byte, scratchBuf *[]byte) bool {
 	n := -1
 
-	key := nextToken(line, &n, "key")
+	key := nextToken(line, &n)
 	if key == nil {
-		return false
+		return writeClientError(c.Writer, s, line)
 	}
-	graceDuration, ok := parseMillisecondsToken(line, &n, "graceDuration")
+	graceDuration, ok := parseMillisecondsToken(line, &n)
 	if !ok {
-		return false
+		return writeClientError(c.Writer, s, line)
 	}
-	if !expectEof(line, n) {
-		return false
+	if !expectEof(line, n) || !isValidServerKey(s, key) {
+		return writeClientError(c.Writer, s, line)
 	}
 
-	item, err := cache.GetDeAsyncItem(key, graceDuration)
+	trackHotKey(s, key)
+	item, err := s.Cache.GetDeAsyncItem(key, graceDuration)
 	if err != nil {
 		if err == ybc.ErrWouldBlock {
 			return writeStr(c.Writer, strWouldBlockCrLf)
 		}
 		if err == ybc.ErrCacheMiss {
+			if !s.recomputes.tryStart(key, graceDuration, s.MaxConcurrentRecomputes) {
+				return writeStr(c.Writer, strWouldBlockCrLf)
+			}
 			return writeEndCrLf(c.Writer)
 		}
-		log.Fatalf("Unexpected error returned by Cache.GetDeAsyncItem(): [%s]", err)
+		s.logf(LogLevelError, "Unexpected error returned by Cache.GetDeAsyncItem(): [%s]", err)
+		return writeServerError(c.Writer, s)
 	}
 	// do not use defer item.Close() for performance reasons
 
-	ok = writeGetResponseWithEof(c.Writer, key, item, scratchBuf)
+	if isTombstone(item) || (s.VerifyChecksums && !verifyItemChecksum(s, key, item)) {
+		item.Close()
+		return writeEndCrLf(c.Writer)
+	}
+	ok = writeGetResponseWithEof(c.Writer, s, key, item, s.VerifyChecksums, scratchBuf)
 	item.Close()
 	return ok
 }
 
-func checkAndUpdateCasid(item *ybc.Item, casid *uint64) (isModified, ok bool) {
+func checkAndUpdateCasid(s *Server, item *ybc.Item, casid *uint64) (isModified, ok bool) {
 	casidOld := *casid
 	var buf [casidSize]byte
 	n, err := item.Read(buf[:])
 	if err != nil {
-		log.Printf("Cannod read casid from item: [%s]", err)
+		s.logf(LogLevelError, "Cannod read casid from item: [%s]", err)
 		return
 	}
 	if n != len(buf) {
-		log.Printf("Unexpected result returned from ybc.Item.Read(): %d. Expected %d", n, len(buf))
+		s.logf(LogLevelError, "Unexpected result returned from ybc.Item.Read(): %d. Expected %d", n, len(buf))
 		return
 	}
 	*casid = binary.LittleEndian.Uint64(buf[:])
 
 	if _, err := item.Seek(-casidSize, 1); err != nil {
-		log.Fatalf("Unexpected error returned from ybc.Item.Seek(%d, 1): [%s]", -casidSize, err)
+		s.logf(LogLevelError, "Unexpected error returned from ybc.Item.Seek(%d, 1): [%s]", -casidSize, err)
+		return
 	}
 
 	isModified = (casidOld != *casid)
@@ -171,125 +592,147 @@ func checkAndUpdateCasid(item *ybc.Item, casid *uint64) (isModified, ok bool) {
 	return
 }
 
-func processCgetCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte, scratchBuf *[]byte) bool {
+func processCgetCmd(c *bufio.ReadWriter, s *Server, line []byte, scratchBuf *[]byte) bool {
 	n := -1
 
-	key := nextToken(line, &n, "key")
+	key := nextToken(line, &n)
 	if key == nil {
-		return false
+		return writeClientError(c.Writer, s, line)
 	}
-	casid, ok := parseUint64Token(line, &n, "casid")
+	casid, ok := parseUint64Token(line, &n)
 	if !ok {
-		return false
+		return writeClientError(c.Writer, s, line)
 	}
-	if !expectEof(line, n) {
-		return false
+	if !expectEof(line, n) || !isValidServerKey(s, key) {
+		return writeClientError(c.Writer, s, line)
 	}
 
-	item, err := cache.GetItem(key)
-	if err == ybc.ErrCacheMiss {
-		return writeStr(c.Writer, strEndCrLf)
+	item, ok := getCachedItem(s, key)
+	if !ok {
+		return writeServerError(c.Writer, s)
 	}
-	if err != nil {
-		log.Fatalf("Unexpected error returned: [%s]", err)
+	if item == nil {
+		return writeStr(c.Writer, strEndCrLf)
 	}
 	// do not use defer item.Close() for performance reasons
 
-	isModified, ok := checkAndUpdateCasid(item, &casid)
+	isModified, ok := checkAndUpdateCasid(s, item, &casid)
 	if !ok {
 		item.Close()
-		return false
+		return writeServerError(c.Writer, s)
 	}
 	if !isModified {
 		item.Close()
 		return writeStr(c.Writer, strNotModifiedCrLf)
 	}
 
-	ok = writeGetResponseWithEof(c.Writer, key, item, scratchBuf)
+	ok = writeGetResponseWithEof(c.Writer, s, key, item, s.VerifyChecksums, scratchBuf)
 	item.Close()
 	return ok
 }
 
-func processCgetDeCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte, scratchBuf *[]byte) bool {
+func processCgetDeCmd(c *bufio.ReadWriter, s *Server, line []byte, scratchBuf *[]byte) bool {
 	n := -1
 
-	key := nextToken(line, &n, "key")
+	key := nextToken(line, &n)
 	if key == nil {
-		return false
+		return writeClientError(c.Writer, s, line)
 	}
-	casid, ok := parseUint64Token(line, &n, "casid")
+	casid, ok := parseUint64Token(line, &n)
 	if !ok {
-		return false
+		return writeClientError(c.Writer, s, line)
 	}
-	graceDuration, ok := parseMillisecondsToken(line, &n, "graceDuration")
+	graceDuration, ok := parseMillisecondsToken(line, &n)
 	if !ok {
-		return false
+		return writeClientError(c.Writer, s, line)
 	}
-	if !expectEof(line, n) {
-		return false
+	if !expectEof(line, n) || !isValidServerKey(s, key) {
+		return writeClientError(c.Writer, s, line)
 	}
 
-	item, err := cache.GetDeAsyncItem(key, graceDuration)
+	trackHotKey(s, key)
+	item, err := s.Cache.GetDeAsyncItem(key, graceDuration)
 	if err == ybc.ErrWouldBlock {
 		return writeStr(c.Writer, strWouldBlockCrLf)
 	}
 	if err == ybc.ErrCacheMiss {
+		if !s.recomputes.tryStart(key, graceDuration, s.MaxConcurrentRecomputes) {
+			return writeStr(c.Writer, strWouldBlockCrLf)
+		}
 		return writeStr(c.Writer, strEndCrLf)
 	}
 	if err != nil {
-		log.Fatalf("Unexpected error returned: [%s]", err)
+		s.logf(LogLevelError, "Unexpected error returned by Cache.GetDeAsyncItem(): [%s]", err)
+		return writeServerError(c.Writer, s)
 	}
 	// do not use defer item.Close() for performance reasons
 
-	isModified, ok := checkAndUpdateCasid(item, &casid)
+	if isTombstone(item) || (s.VerifyChecksums && !verifyItemChecksum(s, key, item)) {
+		item.Close()
+		return writeStr(c.Writer, strEndCrLf)
+	}
+
+	isModified, ok := checkAndUpdateCasid(s, item, &casid)
 	if !ok {
 		item.Close()
-		return false
+		return writeServerError(c.Writer, s)
 	}
 	if !isModified {
 		item.Close()
 		return writeStr(c.Writer, strNotModifiedCrLf)
 	}
 
-	ok = writeGetResponseWithEof(c.Writer, key, item, scratchBuf)
+	ok = writeGetResponseWithEof(c.Writer, s, key, item, s.VerifyChecksums, scratchBuf)
 	item.Close()
 	return ok
 }
 
 func expectNoreply(line []byte, n *int) bool {
-	noreplyStr := nextToken(line, n, "noreply")
+	noreplyStr := nextToken(line, n)
 	if noreplyStr == nil {
 		return false
 	}
-	if !bytes.Equal(noreplyStr, strNoreply) {
-		log.Printf("Unexpected noreply in line=[%s]: [%s]. Expected [%s]", line, noreplyStr, strNoreply)
-		return false
-	}
-	return true
+	return bytes.Equal(noreplyStr, strNoreply)
 }
 
-func parseSetCmd(line []byte, shouldParseCasid bool) (key []byte, flags uint32, expiration time.Duration, size int, casid uint64, noreply bool, ok bool) {
+// Parses the command line for set, add, cas, replace, append and prepend
+// commands.
+//
+// size is set to -1 if it cannot be parsed, so the payload cannot be skipped.
+func parseSetCmd(line []byte, shouldParseCasid bool, now time.Time) (key []byte, flags uint32, expiration time.Duration, size int, casid uint64, noreply bool, validFlags bool, ok bool) {
 	n := -1
 
 	ok = false
-	if key = nextToken(line, &n, "key"); key == nil {
+	size = -1
+	if key = nextToken(line, &n); key == nil {
 		return
 	}
-	if flags, ok = parseFlagsToken(line, &n); !ok {
+	flagsStr := nextToken(line, &n)
+	if flagsStr == nil {
 		return
 	}
-	if expiration, ok = parseExpirationToken(line, &n); !ok {
+	if expiration, ok = parseExpirationToken(line, &n, now); !ok {
 		return
 	}
 	if size, ok = parseSizeToken(line, &n); !ok {
+		size = -1
+		return
+	}
+	if size < 0 {
+		size = -1
+		ok = false
 		return
 	}
 	if shouldParseCasid {
-		if casid, ok = parseUint64Token(line, &n, "casid"); !ok {
+		if casid, ok = parseUint64Token(line, &n); !ok {
 			return
 		}
 	}
 
+	// Flags are validated after the size is parsed, so the payload
+	// can be skipped if flags are invalid.
+	flags, validFlags = parseUint32(flagsStr)
+
 	noreply = false
 	if n == len(line) {
 		ok = true
@@ -308,212 +751,644 @@ func parseSetCmd(line []byte, shouldParseCasid bool) (key []byte, flags uint32,
 	return
 }
 
-func readValueToTxn(r *bufio.Reader, txn *ybc.SetTxn, size int) bool {
-	n, err := txn.ReadFrom(r)
+// Reads '\r\n' or '\n' following the payload.
+//
+// validChunk is set to false if the payload is followed by other bytes.
+// The rest of the line is skipped then, so it isn't processed
+// as a command line.
+func readPayloadTerminator(r *bufio.Reader, s *Server) (validChunk, ok bool) {
+	c, err := r.ReadByte()
 	if err != nil {
-		log.Printf("Error when reading payload with size=[%d]: [%s]", size, err)
+		s.logf(LogLevelWarning, "Unexpected error when reading \\r\\n after the payload: [%s]", err)
+		return
+	}
+	if c == '\r' {
+		if c, err = r.ReadByte(); err != nil {
+			s.logf(LogLevelWarning, "Unexpected error when reading \\n after the payload: [%s]", err)
+			return
+		}
+	}
+	ok = true
+	validChunk = (c == '\n')
+	if !validChunk {
+		s.logf(LogLevelWarning, "Unexpected byte=[%d] after the payload. Expected \\r\\n", c)
+		var buf []byte
+		ok = readLine(r, &buf)
+	}
+	return
+}
+
+func discardValue(r *bufio.Reader, s *Server, size int) bool {
+	if _, err := io.CopyN(ioutil.Discard, r, int64(size)); err != nil {
+		s.logf(LogLevelWarning, "Error when skipping payload with size=[%d]: [%s]", size, err)
 		return false
 	}
-	if n != int64(size) {
-		log.Printf("Unexpected payload size=[%d]. Expected [%d]", n, size)
+	_, ok := readPayloadTerminator(r, s)
+	return ok
+}
+
+// Skips the payload with the given size and writes CLIENT_ERROR response.
+//
+// The payload isn't skipped if its size is unknown, i.e. negative.
+// The payload is processed as the next command line then.
+func discardValueAndWriteClientError(c *bufio.ReadWriter, s *Server, line []byte, size int) bool {
+	if size >= 0 && !discardValue(c.Reader, s, size) {
 		return false
 	}
-	return matchCrLf(r)
+	return writeClientError(c.Writer, s, line)
 }
 
-func writeSetResponse(w *bufio.Writer, noreply bool) bool {
-	if noreply {
-		return true
+// Commands with payloads, which must be skipped when the command
+// is rejected.
+var storageCmdPrefixes = [][]byte{strSet, strAdd, strReplace, strAppend, strPrepend, strCas}
+
+// Skips the payload of the rejected text protocol command
+// and writes the given response.
+func rejectCmd(c *serverConn, s *Server, line []byte, response []byte) bool {
+	for _, prefix := range storageCmdPrefixes {
+		if !bytes.HasPrefix(line, prefix) {
+			continue
+		}
+		_, _, _, size, _, _, _, _ := parseSetCmd(line[len(prefix):], bytes.Equal(prefix, strCas), s.Clock())
+		if size >= 0 && !discardValue(c.Reader, s, size) {
+			return false
+		}
+		break
 	}
-	return writeStr(w, strStoredCrLf)
+	return writeErrorStr(c.Writer, s, response)
 }
 
-func startSetTxn(cache ybc.Cacher, key []byte, flags uint32, expiration time.Duration, size int) *ybc.SetTxn {
-	casid := getCasid()
-	size += casidSize + flagsSize
-	txn, err := cache.NewSetTxn(key, size, expiration)
-	if err != nil {
-		log.Printf("Error in Cache.NewSetTxn() for key=[%s], size=[%d], expiration=[%s]: [%s]", key, size, expiration, err)
-		return nil
+// Returns true if the given payload size exceeds Server.MaxValueSize.
+func isTooLargeValue(s *Server, size int) bool {
+	if s.MaxValueSize <= 0 || size <= s.MaxValueSize {
+		return false
 	}
+	s.logf(LogLevelWarning, "Too large payload size=%d. Server.MaxValueSize=%d", size, s.MaxValueSize)
+	return true
+}
 
-	var buf [casidSize + flagsSize]byte
-	binary.LittleEndian.PutUint64(buf[:casidSize], casid)
-	binary.LittleEndian.PutUint32(buf[casidSize:], flags)
-	n, err := txn.Write(buf[:])
-	if err != nil {
-		log.Fatalf("Error in SetTxn.Write(): [%s]", err)
+// Skips the payload with the given size and writes SERVER_ERROR response
+// for payloads exceeding Server.MaxValueSize.
+func discardValueAndWriteTooLarge(c *bufio.ReadWriter, s *Server, size int) bool {
+	return discardValue(c.Reader, s, size) && writeErrorStr(c.Writer, s, strTooLargeCrLf)
+}
+
+// Skips the payload with the given size and writes SERVER_ERROR response
+// for items, which cannot be stored.
+func discardValueAndWriteServerError(c *bufio.ReadWriter, s *Server, size int) bool {
+	return discardValue(c.Reader, s, size) && writeErrorStr(c.Writer, s, strServerErrorOOMCrLf)
+}
+
+// Skips the payload with the given size and writes NOT_STORED response.
+func discardValueAndWriteNotStored(c *bufio.ReadWriter, s *Server, size int, noreply bool) bool {
+	if !discardValue(c.Reader, s, size) {
+		return false
 	}
-	if n != len(buf) {
-		log.Fatalf("Unexpected result returned from SetTxn.Write(): %d. Expected %d", n, len(buf))
+	if noreply {
+		return true
 	}
-	return txn
+	return writeStr(c.Writer, strNotStoredCrLf)
 }
 
-func readValueToTxnAndWriteResponse(c *bufio.ReadWriter, txn *ybc.SetTxn, size int, noreply bool) bool {
-	if txn == nil {
+func readValueWithChecksumToTxn(r *bufio.Reader, s *Server, txn *ybc.SetTxn, size int) bool {
+	// The checksum must precede the payload in the item, so the payload
+	// is buffered before writing it to txn.
+	valueBuf := acquireByteBuf()
+	defer releaseByteBuf(valueBuf)
+	value := append((*valueBuf)[:0], make([]byte, size)...)
+	*valueBuf = value
+	if _, err := io.ReadFull(r, value); err != nil {
+		s.logf(LogLevelWarning, "Error when reading payload with size=[%d]: [%s]", size, err)
 		return false
 	}
-	if !readValueToTxn(c.Reader, txn, size) {
-		txn.Rollback()
+	var buf [checksumSize]byte
+	binary.LittleEndian.PutUint32(buf[:], crc32.ChecksumIEEE(value))
+	if _, err := txn.Write(buf[:]); err != nil {
+		s.logf(LogLevelError, "Error in SetTxn.Write(): [%s]", err)
 		return false
 	}
-	if err := txn.Commit(); err != nil {
-		log.Fatalf("Unexpected error returned from SetTxn.Commit(): [%s]", err)
+	if _, err := txn.Write(value); err != nil {
+		s.logf(LogLevelError, "Error in SetTxn.Write(): [%s]", err)
+		return false
 	}
-	return writeSetResponse(c.Writer, noreply)
+	return true
 }
 
-func processSetCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte, scratchBuf *[]byte) bool {
-	key, flags, expiration, size, _, noreply, ok := parseSetCmd(line, false)
-	if !ok {
+// Reads the payload with the given size to txn.
+func readRawValueToTxn(r *bufio.Reader, s *Server, txn *ybc.SetTxn, size int, withChecksum bool) bool {
+	if withChecksum {
+		return readValueWithChecksumToTxn(r, s, txn, size)
+	}
+	n, err := txn.ReadFrom(r)
+	if err != nil {
+		s.logf(LogLevelWarning, "Error when reading payload with size=[%d]: [%s]", size, err)
 		return false
 	}
-
-	txn := startSetTxn(cache, key, flags, expiration, size)
-	return readValueToTxnAndWriteResponse(c, txn, size, noreply)
+	if n != int64(size) {
+		s.logf(LogLevelWarning, "Unexpected payload size=[%d]. Expected [%d]", n, size)
+		return false
+	}
+	return true
+}
+
+// Reads the payload with the given size followed by '\r\n' to txn.
+//
+// validChunk is set to false if the payload isn't followed by '\r\n'.
+func readValueToTxn(r *bufio.Reader, s *Server, txn *ybc.SetTxn, size int, withChecksum bool) (validChunk, ok bool) {
+	if !readRawValueToTxn(r, s, txn, size, withChecksum) {
+		return
+	}
+	return readPayloadTerminator(r, s)
+}
+
+func writeSetResponse(w *bufio.Writer, noreply bool) bool {
+	if noreply {
+		return true
+	}
+	return writeStr(w, strStoredCrLf)
 }
 
-func getCasidForCachedItem(cache ybc.Cacher, key []byte) (casid uint64, cacheMiss, ok bool) {
-	item, err := cache.GetItem(key)
+// Starts set transaction for the given item.
+//
+// The returned transaction must be finished with either commitSetTxn()
+// or rollbackSetTxn().
+func startSetTxn(s *Server, key []byte, flags uint32, expiration time.Duration, size int) *ybc.SetTxn {
+	trackHotKey(s, key)
+	return startSetTxnWithCasid(s, key, flags, expiration, size, getCasid())
+}
+
+// Starts set transaction for the given item with the given casid.
+//
+// The returned transaction must be finished with either commitSetTxn()
+// or rollbackSetTxn().
+func startSetTxnWithCasid(s *Server, key []byte, flags uint32, expiration time.Duration, size int, casid uint64) *ybc.SetTxn {
+	openTxnsCount := atomic.AddInt64(&s.openTxnsCount, 1)
+	if s.MaxOpenTxns > 0 && openTxnsCount > int64(s.MaxOpenTxns) {
+		atomic.AddInt64(&s.openTxnsCount, -1)
+		s.logf(LogLevelWarning, "Cannot start set transaction for key=[%s]: too many open transactions. Server.MaxOpenTxns=%d", key, s.MaxOpenTxns)
+		return nil
+	}
+
+	size += casidSize + flagsSize
+	if s.VerifyChecksums {
+		size += checksumSize
+	}
+	txn, err := newSetTxnWithRetries(s, key, size, expiration)
 	if err != nil {
-		if err == ybc.ErrCacheMiss {
-			cacheMiss = true
-			return
-		}
-		log.Fatalf("Unexpected error returned from Cache.GetItem() for key=[%s]: [%s]", key, err)
+		atomic.AddInt64(&s.openTxnsCount, -1)
+		s.logf(LogLevelError, "Error in Cache.NewSetTxn() for key=[%s], size=[%d], expiration=[%s]: [%s]", key, size, expiration, err)
+		return nil
 	}
-	// do not use defer item.Close() for performance reasons
 
-	var buf [casidSize]byte
-	n, err := item.Read(buf[:])
-	item.Close()
+	var buf [casidSize + flagsSize]byte
+	binary.LittleEndian.PutUint64(buf[:casidSize], casid)
+	binary.LittleEndian.PutUint32(buf[casidSize:], flags)
+	n, err := txn.Write(buf[:])
 	if err != nil {
-		log.Printf("Error when reading casid for the item: [%s]", err)
-		return
+		s.logf(LogLevelError, "Error in SetTxn.Write(): [%s]", err)
+		rollbackSetTxn(s, txn)
+		return nil
 	}
 	if n != len(buf) {
-		log.Printf("Unexpected result returned from ybc.Item.Read(): %d. Expected %d", n, len(buf))
+		s.logf(LogLevelError, "Unexpected result returned from SetTxn.Write(): %d. Expected %d", n, len(buf))
+		rollbackSetTxn(s, txn)
+		return nil
+	}
+	return txn
+}
+
+// Commits the given set transaction.
+//
+// Returns false if the item cannot be stored in the cache.
+func commitSetTxn(s *Server, txn *ybc.SetTxn) bool {
+	err := txn.Commit()
+	atomic.AddInt64(&s.openTxnsCount, -1)
+	if err != nil {
+		s.logf(LogLevelError, "Unexpected error returned from SetTxn.Commit(): [%s]", err)
+		return false
+	}
+	return true
+}
+
+// Commits txn only if the cache doesn't contain an item for the same key.
+func commitSetTxnIfMissing(s *Server, txn *ybc.SetTxn) (stored, ok bool) {
+	err := txn.CommitIfMissing()
+	atomic.AddInt64(&s.openTxnsCount, -1)
+	if err == ybc.ErrItemExists {
+		return false, true
+	}
+	if err != nil {
+		s.logf(LogLevelError, "Unexpected error returned from SetTxn.CommitIfMissing(): [%s]", err)
+		return false, false
+	}
+	return true, true
+}
+
+// Commits txn only if the cache still contains the given item for the same key.
+func commitSetTxnIfUnchanged(s *Server, txn *ybc.SetTxn, item *ybc.Item) (stored, ok bool) {
+	err := txn.CommitIfUnchanged(item)
+	atomic.AddInt64(&s.openTxnsCount, -1)
+	if err == ybc.ErrItemChanged {
+		return false, true
+	}
+	if err != nil {
+		s.logf(LogLevelError, "Unexpected error returned from SetTxn.CommitIfUnchanged(): [%s]", err)
+		return false, false
+	}
+	return true, true
+}
+
+// Must be called after the item for the given key is stored in the cache
+// by set, add or cas command.
+func onItemStored(s *Server, key []byte, size int, expiration time.Duration) {
+	s.recomputes.finish(key)
+	s.sampleItemAge(key)
+	publishMutation(s, MutationSet, key, size, expiration)
+}
+
+func rollbackSetTxn(s *Server, txn *ybc.SetTxn) {
+	txn.Rollback()
+	atomic.AddInt64(&s.openTxnsCount, -1)
+}
+
+// Reads the payload with the given size from the client connection to txn.
+//
+// The payload must be read in Server.PayloadReadTimeout if it is set.
+func readPayloadToTxn(c *serverConn, s *Server, txn *ybc.SetTxn, size int) (validChunk, ok bool) {
+	if !startPayloadRead(c, s) {
 		return
 	}
-	casid = binary.LittleEndian.Uint64(buf[:])
-	ok = true
+	if validChunk, ok = readValueToTxn(c.Reader, s, txn, size, s.VerifyChecksums); !ok {
+		return
+	}
+	ok = finishPayloadRead(c, s)
 	return
 }
 
-func cachedItemExists(cache ybc.Cacher, key []byte) bool {
-	item, err := cache.GetItem(key)
-	if err == ybc.ErrCacheMiss {
+// Reads the payload with the given size from the client connection to txn.
+//
+// txn is rolled back if the payload cannot be read or if it isn't followed
+// by '\r\n'. 'CLIENT_ERROR bad data chunk' is written in the latter case.
+func readPayloadToTxnOrRollback(c *serverConn, s *Server, txn *ybc.SetTxn, size int) (validChunk, ok bool) {
+	validChunk, ok = readPayloadToTxn(c, s, txn, size)
+	if ok && validChunk {
+		return
+	}
+	rollbackSetTxn(s, txn)
+	if ok {
+		ok = writeErrorStr(c.Writer, s, strBadDataChunkCrLf)
+	}
+	return
+}
+
+// Reads the payload with the given size from the client connection
+// and appends it to dst.
+//
+// The payload must be read in Server.PayloadReadTimeout if it is set.
+// validChunk is set to false if the payload isn't followed by '\r\n'.
+func readPayload(c *serverConn, s *Server, dst []byte, size int) (value []byte, validChunk, ok bool) {
+	value = dst
+	if !startPayloadRead(c, s) {
+		return
+	}
+	n := len(value)
+	value = append(value, make([]byte, size)...)
+	if _, err := io.ReadFull(c.Reader, value[n:]); err != nil {
+		s.logf(LogLevelWarning, "Error when reading payload with size=[%d]: [%s]", size, err)
+		return
+	}
+	if validChunk, ok = readPayloadTerminator(c.Reader, s); !ok {
+		return
+	}
+	ok = finishPayloadRead(c, s)
+	return
+}
+
+func startPayloadRead(c *serverConn, s *Server) bool {
+	if s.PayloadReadTimeout <= 0 {
+		return true
+	}
+	if err := c.conn.SetReadDeadline(time.Now().Add(s.PayloadReadTimeout)); err != nil {
+		s.logf(LogLevelWarning, "Cannot set read deadline on the connection: [%s]", err)
 		return false
 	}
-	if err != nil {
-		log.Fatalf("Unexpected error returned from Cacher.GetItem(): [%s]", err)
+	return true
+}
+
+func finishPayloadRead(c *serverConn, s *Server) bool {
+	if s.PayloadReadTimeout <= 0 {
+		return true
+	}
+	// Restore the deadline for the whole request.
+	if err := c.conn.SetReadDeadline(c.readDeadline); err != nil {
+		s.logf(LogLevelWarning, "Cannot reset read deadline on the connection: [%s]", err)
+		return false
 	}
-	item.Close()
 	return true
 }
 
-func processAddCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte, scratchBuf *[]byte) bool {
-	key, flags, expiration, size, _, noreply, ok := parseSetCmd(line, false)
+func processSetCmd(c *serverConn, s *Server, line []byte, scratchBuf *[]byte) bool {
+	key, flags, expiration, size, _, noreply, validFlags, ok := parseSetCmd(line, false, s.Clock())
 	if !ok {
-		return false
+		return discardValueAndWriteClientError(c.ReadWriter, s, line, size)
+	}
+	if !validFlags || !isValidServerKey(s, key) {
+		return discardValueAndWriteClientError(c.ReadWriter, s, line, size)
 	}
+	if isTooLargeValue(s, size) {
+		return discardValueAndWriteTooLarge(c.ReadWriter, s, size)
+	}
+	if expiration <= 0 && s.RejectExpiredSets {
+		return discardValueAndWriteNotStored(c.ReadWriter, s, size, noreply)
+	}
+	if s.TombstoneRejectsSets && s.DeleteTombstoneWindow > 0 && tombstoneExists(s, key) {
+		return discardValueAndWriteNotStored(c.ReadWriter, s, size, noreply)
+	}
+
+	// Check for the existing item before starting the transaction,
+	// since the transaction may overwrite the item.
+	itemExists := s.TrackSetCreates && cachedItemExists(s, key)
 
-	txn := startSetTxn(cache, key, flags, expiration, size)
+	txn := startSetTxn(s, key, flags, expiration, size)
 	if txn == nil {
-		return false
+		return discardValueAndWriteServerError(c.ReadWriter, s, size)
 	}
-	if !readValueToTxn(c.Reader, txn, size) {
-		txn.Rollback()
-		return false
+	if validChunk, ok := readPayloadToTxnOrRollback(c, s, txn, size); !ok || !validChunk {
+		return ok
+	}
+	if !commitSetTxn(s, txn) {
+		return writeServerError(c.Writer, s)
+	}
+	trackSetCreate(s, itemExists)
+	onItemStored(s, key, size, expiration)
+	return writeSetResponse(c.Writer, noreply)
+}
+
+// Counts the stored set command in new_items or updated_items stats
+// depending on whether the item existed before the command.
+// See Server.TrackSetCreates.
+func trackSetCreate(s *Server, itemExists bool) {
+	if !s.TrackSetCreates {
+		return
+	}
+	if itemExists {
+		atomic.AddUint64(&s.updatedItemsCount, 1)
+	} else {
+		atomic.AddUint64(&s.newItemsCount, 1)
 	}
+}
 
-	casidLock.Lock()
-	// do not use defer casid.Unlock() for performance reasons
+func getCasidForCachedItem(s *Server, key []byte) (casid uint64, cacheMiss, ok bool) {
+	item, casid, ok := lookupItemWithCasid(s, key)
+	if item == nil {
+		cacheMiss = ok
+		return
+	}
+	item.Close()
+	return
+}
 
-	if cachedItemExists(cache, key) {
-		casidLock.Unlock()
-		txn.Rollback()
-		if noreply {
-			return true
+// Returns the item for the given key and its casid.
+//
+// Returns nil item on cache miss and for deleted items. The returned item
+// must be closed after use.
+func lookupItemWithCasid(s *Server, key []byte) (item *ybc.Item, casid uint64, ok bool) {
+	item, err := lookupItemInCache(s, key)
+	if err != nil {
+		if err == ybc.ErrCacheMiss {
+			return nil, 0, true
 		}
-		return writeStr(c.Writer, strNotStoredCrLf)
+		s.logf(LogLevelError, "Unexpected error returned from Cache.GetItem() for key=[%s]: [%s]", key, err)
+		return nil, 0, false
 	}
-	if err := txn.Commit(); err != nil {
-		log.Fatalf("Unexpected error in SetTxn.Commit(): [%s]", err)
+	if isTombstone(item) {
+		item.Close()
+		return nil, 0, true
 	}
-	casidLock.Unlock()
-	return writeSetResponse(c.Writer, noreply)
+	casid = binary.LittleEndian.Uint64(item.Peek())
+	return item, casid, true
 }
 
-func processCasCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte, scratchBuf *[]byte) bool {
-	key, flags, expiration, size, casid, noreply, ok := parseSetCmd(line, true)
-	if !ok {
+// The value stored instead of deleted items if Server.DeleteTombstoneWindow
+// is set.
+//
+// Tombstones are distinguished from items by size, since items always
+// contain casid and flags.
+var tombstoneValue = make([]byte, casidSize)
+
+func isTombstone(item *ybc.Item) bool {
+	return item.Size() < casidSize+flagsSize
+}
+
+// Returns true if the item for the given key is deleted during
+// Server.DeleteTombstoneWindow.
+//
+// Cache errors are logged and treated as missing tombstones.
+func tombstoneExists(s *Server, key []byte) bool {
+	item, err := lookupItemInCache(s, key)
+	if err == ybc.ErrCacheMiss {
+		return false
+	}
+	if err != nil {
+		s.logf(LogLevelError, "Unexpected error returned from Cacher.GetItem(): [%s]", err)
 		return false
 	}
+	exists := isTombstone(item)
+	item.Close()
+	return exists
+}
 
-	txn := startSetTxn(cache, key, flags, expiration, size)
-	if txn == nil {
+// Returns true if the item for the given key exists in the cache.
+//
+// Cache errors are logged and treated as missing items.
+func cachedItemExists(s *Server, key []byte) bool {
+	item, err := lookupItemInCache(s, key)
+	if err == ybc.ErrCacheMiss {
 		return false
 	}
-	if !readValueToTxn(c.Reader, txn, size) {
-		txn.Rollback()
+	if err != nil {
+		s.logf(LogLevelError, "Unexpected error returned from Cacher.GetItem(): [%s]", err)
 		return false
 	}
+	exists := !isTombstone(item)
+	item.Close()
+	return exists
+}
+
+func processAddCmd(c *serverConn, s *Server, line []byte, scratchBuf *[]byte) bool {
+	return processConditionalSetCmd(c, s, line, false)
+}
 
-	casidLock.Lock()
-	// do not use defer casidLock.Unlock() for performance reasons
+func processReplaceCmd(c *serverConn, s *Server, line []byte, scratchBuf *[]byte) bool {
+	return processConditionalSetCmd(c, s, line, true)
+}
 
-	casidOrig, cacheMiss, ok := getCasidForCachedItem(cache, key)
+// Stores the item only if it is missing in the cache (add command)
+// or only if it is present in the cache (replace command).
+func processConditionalSetCmd(c *serverConn, s *Server, line []byte, mustExist bool) bool {
+	key, flags, expiration, size, _, noreply, validFlags, ok := parseSetCmd(line, false, s.Clock())
 	if !ok {
-		casidLock.Unlock()
-		txn.Rollback()
-		return false
+		return discardValueAndWriteClientError(c.ReadWriter, s, line, size)
 	}
-	if cacheMiss {
-		casidLock.Unlock()
-		txn.Rollback()
+	if !validFlags || !isValidServerKey(s, key) {
+		return discardValueAndWriteClientError(c.ReadWriter, s, line, size)
+	}
+	if isTooLargeValue(s, size) {
+		return discardValueAndWriteTooLarge(c.ReadWriter, s, size)
+	}
+	if expiration <= 0 && s.RejectExpiredSets {
+		return discardValueAndWriteNotStored(c.ReadWriter, s, size, noreply)
+	}
+	if s.TombstoneRejectsSets && s.DeleteTombstoneWindow > 0 && tombstoneExists(s, key) {
+		return discardValueAndWriteNotStored(c.ReadWriter, s, size, noreply)
+	}
+
+	txn := startSetTxn(s, key, flags, expiration, size)
+	if txn == nil {
+		return discardValueAndWriteServerError(c.ReadWriter, s, size)
+	}
+	if validChunk, ok := readPayloadToTxnOrRollback(c, s, txn, size); !ok || !validChunk {
+		return ok
+	}
+
+	stored, ok := commitConditionalSetTxn(s, key, txn, mustExist)
+	if !ok {
+		return writeServerError(c.Writer, s)
+	}
+	if !stored {
 		if noreply {
 			return true
 		}
-		return writeStr(c.Writer, strNotFoundCrLf)
+		return writeStr(c.Writer, strNotStoredCrLf)
 	}
-	if casidOrig != casid {
-		casidLock.Unlock()
-		txn.Rollback()
+	onItemStored(s, key, size, expiration)
+	return writeSetResponse(c.Writer, noreply)
+}
+
+// Commits txn only if the item for the given key is missing in the cache
+// (add command) or only if it is present in the cache (replace command).
+//
+// txn is rolled back if it isn't commited.
+func commitConditionalSetTxn(s *Server, key []byte, txn *ybc.SetTxn, mustExist bool) (stored, ok bool) {
+	item, err := lookupItemInCache(s, key)
+	if err == ybc.ErrCacheMiss {
+		if mustExist {
+			rollbackSetTxn(s, txn)
+			return false, true
+		}
+		// The cache checks for the missing item and commits txn atomically.
+		return commitSetTxnIfMissing(s, txn)
+	}
+	if err != nil {
+		s.logf(LogLevelError, "Unexpected error returned from Cacher.GetItem(): [%s]", err)
+		rollbackSetTxn(s, txn)
+		return false, false
+	}
+	// do not use defer item.Close() for performance reasons
+
+	// Tombstones are treated as missing items.
+	if isTombstone(item) == mustExist {
+		item.Close()
+		rollbackSetTxn(s, txn)
+		return false, true
+	}
+
+	// The item (or the tombstone) is overwritten only if it hasn't been
+	// concurrently modified after the lookup. Otherwise the command
+	// is ordered before the modification, which overwrites the stored value.
+	// So the command succeeds in both cases.
+	_, ok = commitSetTxnIfUnchanged(s, txn, item)
+	item.Close()
+	return ok, ok
+}
+
+func processCasCmd(c *serverConn, s *Server, line []byte, scratchBuf *[]byte) bool {
+	key, flags, expiration, size, casid, noreply, validFlags, ok := parseSetCmd(line, true, s.Clock())
+	if !ok {
+		return discardValueAndWriteClientError(c.ReadWriter, s, line, size)
+	}
+	if !validFlags || !isValidServerKey(s, key) {
+		return discardValueAndWriteClientError(c.ReadWriter, s, line, size)
+	}
+	if isTooLargeValue(s, size) {
+		return discardValueAndWriteTooLarge(c.ReadWriter, s, size)
+	}
+	if expiration <= 0 && s.RejectExpiredSets {
+		return discardValueAndWriteNotStored(c.ReadWriter, s, size, noreply)
+	}
+	if s.TombstoneRejectsSets && s.DeleteTombstoneWindow > 0 && tombstoneExists(s, key) {
+		return discardValueAndWriteNotStored(c.ReadWriter, s, size, noreply)
+	}
+
+	txn := startSetTxn(s, key, flags, expiration, size)
+	if txn == nil {
+		return discardValueAndWriteServerError(c.ReadWriter, s, size)
+	}
+	if validChunk, ok := readPayloadToTxnOrRollback(c, s, txn, size); !ok || !validChunk {
+		return ok
+	}
+
+	stored, cacheMiss, ok := commitCasTxn(s, key, txn, casid)
+	if !ok {
+		return writeServerError(c.Writer, s)
+	}
+	if !stored {
 		if noreply {
 			return true
 		}
+		if cacheMiss {
+			return writeStr(c.Writer, strNotFoundCrLf)
+		}
 		return writeStr(c.Writer, strExistsCrLf)
 	}
-	if err := txn.Commit(); err != nil {
-		log.Fatalf("Unexpected error in SetTxn.Commit(): [%s]", err)
-	}
-	casidLock.Unlock()
+	onItemStored(s, key, size, expiration)
 	return writeSetResponse(c.Writer, noreply)
 }
 
-func processDeleteCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte, scratchBuf *[]byte) bool {
+// Commits txn only if the item for the given key has the given casid.
+//
+// txn is rolled back if it isn't commited.
+func commitCasTxn(s *Server, key []byte, txn *ybc.SetTxn, casid uint64) (stored, cacheMiss, ok bool) {
+	item, casidOrig, ok := lookupItemWithCasid(s, key)
+	if !ok || item == nil {
+		rollbackSetTxn(s, txn)
+		return false, ok, ok
+	}
+	// do not use defer item.Close() for performance reasons
+
+	if casidOrig != casid {
+		item.Close()
+		rollbackSetTxn(s, txn)
+		return false, false, true
+	}
+	// The item is overwritten only if it hasn't been modified
+	// since its casid has been read.
+	stored, ok = commitSetTxnIfUnchanged(s, txn, item)
+	item.Close()
+	return stored, false, ok
+}
+
+func processDeleteCmd(c *bufio.ReadWriter, s *Server, line []byte, scratchBuf *[]byte) bool {
 	n := -1
 
-	key := nextToken(line, &n, "key")
+	key := nextToken(line, &n)
 	if key == nil {
-		return false
+		return writeClientError(c.Writer, s, line)
 	}
 
 	noreply := false
 	if n < len(line) {
-		s := nextToken(line, &n, "noreply_or_exptime")
-		if s == nil {
-			return false
+		token := nextToken(line, &n)
+		if token == nil {
+			return writeClientError(c.Writer, s, line)
 		}
-		if !bytes.Equal(s, strNoreply) {
-			if _, ok := parseUint32(s); !ok {
-				return false
+		if !bytes.Equal(token, strNoreply) {
+			if _, ok := parseUint32(token); !ok {
+				return writeClientError(c.Writer, s, line)
 			}
 			if n < len(line) {
 				if !expectNoreply(line, &n) {
-					return false
+					return writeClientError(c.Writer, s, line)
 				}
 				noreply = true
 			}
@@ -521,146 +1396,1307 @@ func processDeleteCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte, scratc
 			noreply = true
 		}
 	}
-	if !expectEof(line, n) {
-		return false
+	if !expectEof(line, n) || !isValidServerKey(s, key) {
+		return writeClientError(c.Writer, s, line)
 	}
 
-	ok := cache.Delete(key)
+	deleted, ok := deleteItem(s, key)
+	if !ok {
+		return writeErrorStr(c.Writer, s, strServerErrorOOMCrLf)
+	}
 	if noreply {
 		return true
 	}
 
 	response := strDeletedCrLf
-	if !ok {
+	if !deleted {
 		response = strNotFoundCrLf
 	}
 	return writeStr(c.Writer, response)
 }
 
-func parseFlushAllCmd(line []byte) (expiration time.Duration, noreply bool, ok bool) {
-	if len(line) == 0 {
-		noreply = false
-		ok = true
-		return
+// Deletes the item for the given key from the cache.
+//
+// The item is replaced by a tombstone if Server.DeleteTombstoneWindow is set.
+// ok is set to false if the tombstone cannot be stored.
+func deleteItem(s *Server, key []byte) (deleted, ok bool) {
+	if s.DeleteTombstoneWindow <= 0 {
+		deleted = s.Cache.Delete(key)
+	} else {
+		if !cachedItemExists(s, key) {
+			return false, true
+		}
+		if err := s.Cache.Set(key, tombstoneValue, s.DeleteTombstoneWindow); err != nil {
+			s.logf(LogLevelError, "Cannot store tombstone for key=[%s]: [%s]", key, err)
+			return false, false
+		}
+		deleted = true
 	}
-
-	ok = false
-	noreply = false
-	if line[0] != ' ' {
-		log.Printf("Unexpected character at the beginning of line=[%s]. Expected whitespace", line)
-		return
+	if deleted {
+		publishMutation(s, MutationDelete, key, 0, 0)
 	}
+	return deleted, true
+}
 
-	n := 0
-
-	s := nextToken(line, &n, "expiration_or_noreply")
-	if s == nil {
-		return
-	}
-	if bytes.Equal(s, strNoreply) {
-		noreply = true
-		ok = expectEof(line, n)
-		return
-	}
+func parseIncrDecrCmd(line []byte) (key []byte, delta uint64, noreply, validDelta, ok bool) {
+	n := -1
 
-	if expiration, ok = parseExpiration(s); !ok {
+	ok = false
+	key = nextToken(line, &n)
+	if key == nil {
 		return
 	}
-	if n == len(line) {
-		ok = true
+	deltaStr := nextToken(line, &n)
+	if deltaStr == nil {
 		return
 	}
+	delta, validDelta = parseUint64(deltaStr)
 
-	if ok = expectNoreply(line, &n); !ok {
-		return
+	noreply = false
+	if n < len(line) {
+		if !expectNoreply(line, &n) {
+			return
+		}
+		noreply = true
 	}
-	noreply = true
 	ok = expectEof(line, n)
 	return
 }
 
-func processFlushAllCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte, flushAllTimer **time.Timer) bool {
-	expiration, noreply, ok := parseFlushAllCmd(line)
+// Returns flags and payload for the given item.
+//
+// The returned payload is valid only until the item is closed.
+func itemFlagsAndPayload(s *Server, item *ybc.Item) (flags uint32, payload []byte, ok bool) {
+	buf := item.Peek()
+	headerSize := casidSize + flagsSize
+	if s.VerifyChecksums {
+		headerSize += checksumSize
+	}
+	if len(buf) < headerSize {
+		s.logf(LogLevelError, "Too short item size=%d. Expected at least %d bytes", len(buf), headerSize)
+		return
+	}
+	flags = binary.LittleEndian.Uint32(buf[casidSize:])
+	payload = buf[headerSize:]
+	ok = true
+	return
+}
+
+// Parses the payload of the given item as a decimal 64-bit unsigned number.
+func parseItemNumber(s *Server, item *ybc.Item) (flags uint32, number uint64, ok bool) {
+	flags, payload, ok := itemFlagsAndPayload(s, item)
+	if !ok || len(payload) == 0 {
+		ok = false
+		return
+	}
+	number, ok = parseUint64(payload)
+	return
+}
+
+// Stores the given value under the given key with the given flags, ttl
+// and casid only if the cache still contains the given item for the key.
+//
+// stored is set to false if the item has been concurrently modified.
+func storeItemValueIfUnchanged(s *Server, key []byte, item *ybc.Item, flags uint32, ttl time.Duration, value []byte, casid uint64) (stored, ok bool) {
+	txn := startSetTxnWithValue(s, key, flags, ttl, value, casid)
+	if txn == nil {
+		return false, false
+	}
+	stored, ok = commitSetTxnIfUnchanged(s, txn, item)
+	if stored {
+		onItemStored(s, key, len(value), ttl)
+	}
+	return stored, ok
+}
+
+// Stores the given value under the given key with the given flags, ttl
+// and casid only if the cache doesn't contain an item for the key.
+//
+// stored is set to false if the item has been concurrently created.
+func storeItemValueIfMissing(s *Server, key []byte, flags uint32, ttl time.Duration, value []byte, casid uint64) (stored, ok bool) {
+	txn := startSetTxnWithValue(s, key, flags, ttl, value, casid)
+	if txn == nil {
+		return false, false
+	}
+	stored, ok = commitSetTxnIfMissing(s, txn)
+	if stored {
+		onItemStored(s, key, len(value), ttl)
+	}
+	return stored, ok
+}
+
+// Starts set transaction for the given item and writes the given value to it.
+//
+// The returned transaction must be finished with commitSetTxn*()
+// or rollbackSetTxn().
+func startSetTxnWithValue(s *Server, key []byte, flags uint32, ttl time.Duration, value []byte, casid uint64) *ybc.SetTxn {
+	txn := startSetTxnWithCasid(s, key, flags, ttl, len(value), casid)
+	if txn == nil {
+		return nil
+	}
+	if s.VerifyChecksums {
+		var buf [checksumSize]byte
+		binary.LittleEndian.PutUint32(buf[:], crc32.ChecksumIEEE(value))
+		if _, err := txn.Write(buf[:]); err != nil {
+			s.logf(LogLevelError, "Error in SetTxn.Write(): [%s]", err)
+			rollbackSetTxn(s, txn)
+			return nil
+		}
+	}
+	if _, err := txn.Write(value); err != nil {
+		s.logf(LogLevelError, "Error in SetTxn.Write(): [%s]", err)
+		rollbackSetTxn(s, txn)
+		return nil
+	}
+	return txn
+}
+
+// Processes incr and decr commands with memcached semantics:
+// incr wraps around on 64-bit overflow, while decr stops at 0.
+//
+// The new value is stored only if the item hasn't been modified
+// since it has been read. Otherwise the command is retried, so concurrent
+// updates for the key are never lost.
+func processIncrDecrCmd(c *bufio.ReadWriter, s *Server, line []byte, scratchBuf *[]byte, isIncr bool) bool {
+	key, delta, noreply, validDelta, ok := parseIncrDecrCmd(line)
+	if !ok || !isValidServerKey(s, key) {
+		return writeClientError(c.Writer, s, line)
+	}
+	if !validDelta {
+		return writeErrorStr(c.Writer, s, strInvalidDeltaCrLf)
+	}
+
+	var number uint64
+	for {
+		item, ok := lookupCachedItem(s, key)
+		if !ok {
+			return writeServerError(c.Writer, s)
+		}
+		if item == nil {
+			if noreply {
+				return true
+			}
+			return writeStr(c.Writer, strNotFoundCrLf)
+		}
+		flags, n, isNumber := parseItemNumber(s, item)
+		if !isNumber {
+			item.Close()
+			if noreply {
+				return true
+			}
+			return writeErrorStr(c.Writer, s, strNonNumericCrLf)
+		}
+
+		number = applyDelta(n, delta, isIncr)
+		*scratchBuf = strconv.AppendUint((*scratchBuf)[:0], number, 10)
+		stored, ok := storeItemValueIfUnchanged(s, key, item, flags, item.Ttl(), *scratchBuf, getCasid())
+		item.Close()
+		if !ok {
+			return writeErrorStr(c.Writer, s, strServerErrorOOMCrLf)
+		}
+		if stored {
+			break
+		}
+		// The item has been modified after it has been read, so retry
+		// with the new value.
+	}
+	if noreply {
+		return true
+	}
+	return writeUint64(c.Writer, number, scratchBuf) && writeCrLf(c.Writer)
+}
+
+// Returns the number incremented or decremented by delta.
+//
+// Incremented numbers wrap around 64 bits, while decremented numbers
+// cannot go below zero.
+func applyDelta(number, delta uint64, isIncr bool) uint64 {
+	if isIncr {
+		return number + delta
+	}
+	if number > delta {
+		return number - delta
+	}
+	return 0
+}
+
+// Processes append and prepend commands.
+//
+// Flags and expiration passed in the command are ignored, so the item
+// retains its flags and ttl.
+//
+// The new value is stored only if the item hasn't been modified
+// since it has been read. Otherwise the command is retried, so concurrent
+// updates for the key are never lost.
+func processAppendPrependCmd(c *serverConn, s *Server, line []byte, scratchBuf *[]byte, isPrepend bool) bool {
+	key, _, _, size, _, noreply, validFlags, ok := parseSetCmd(line, false, s.Clock())
 	if !ok {
+		return discardValueAndWriteClientError(c.ReadWriter, s, line, size)
+	}
+	if !validFlags || !isValidServerKey(s, key) {
+		return discardValueAndWriteClientError(c.ReadWriter, s, line, size)
+	}
+	if isTooLargeValue(s, size) {
+		return discardValueAndWriteTooLarge(c.ReadWriter, s, size)
+	}
+
+	buf, validChunk, ok := readPayload(c, s, (*scratchBuf)[:0], size)
+	*scratchBuf = buf
+	if !ok || !validChunk {
+		return ok && writeErrorStr(c.Writer, s, strBadDataChunkCrLf)
+	}
+
+	for {
+		item, ok := lookupCachedItem(s, key)
+		if !ok {
+			return writeServerError(c.Writer, s)
+		}
+		if item == nil {
+			if noreply {
+				return true
+			}
+			return writeStr(c.Writer, strNotStoredCrLf)
+		}
+		flags, payload, ok := itemFlagsAndPayload(s, item)
+		if !ok {
+			item.Close()
+			return writeServerError(c.Writer, s)
+		}
+		if isTooLargeValue(s, size+len(payload)) {
+			item.Close()
+			return writeErrorStr(c.Writer, s, strTooLargeCrLf)
+		}
+		var value []byte
+		buf, value = joinItemPayload(buf, size, payload, isPrepend)
+		*scratchBuf = buf
+
+		stored, ok := storeItemValueIfUnchanged(s, key, item, flags, item.Ttl(), value, getCasid())
+		item.Close()
+		if !ok {
+			return writeErrorStr(c.Writer, s, strServerErrorOOMCrLf)
+		}
+		if stored {
+			break
+		}
+		// The item has been modified after it has been read, so retry
+		// with the new value.
+	}
+	return writeSetResponse(c.Writer, noreply)
+}
+
+// Joins the item's payload with the chunk stored at buf[:chunkSize]
+// for append and prepend commands.
+//
+// The joined value is appended to buf, so the chunk remains intact
+// for retries.
+func joinItemPayload(buf []byte, chunkSize int, payload []byte, isPrepend bool) (newBuf, value []byte) {
+	buf = buf[:chunkSize]
+	if isPrepend {
+		buf = append(buf, buf[:chunkSize]...)
+		buf = append(buf, payload...)
+	} else {
+		buf = append(buf, payload...)
+		buf = append(buf, buf[:chunkSize]...)
+	}
+	return buf, buf[chunkSize:]
+}
+
+func parseTouchCmd(line []byte, now time.Time) (key []byte, expiration time.Duration, noreply, ok bool) {
+	n := -1
+
+	ok = false
+	key = nextToken(line, &n)
+	if key == nil {
+		return
+	}
+	if expiration, ok = parseExpirationToken(line, &n, now); !ok {
+		return
+	}
+
+	noreply = false
+	if n < len(line) {
+		if ok = expectNoreply(line, &n); !ok {
+			return
+		}
+		noreply = true
+	}
+	ok = expectEof(line, n)
+	return
+}
+
+// Sets new expiration for the given item obtained for the given key.
+//
+// The item's value isn't copied if Server.Cache implements ybc.Toucher.
+// Otherwise the item is copied with the new expiration only if it hasn't
+// been concurrently modified, so concurrent updates aren't overwritten
+// by the old value. Casid and flags are retained in both cases.
+func touchItem(s *Server, key []byte, item *ybc.Item, expiration time.Duration) bool {
+	if t, ok := s.Cache.(ybc.Toucher); ok {
+		if err := t.Touch(key, expiration); err != nil {
+			s.logf(LogLevelError, "Cannot set new expiration=[%s] for the item with key=[%s]: [%s]", expiration, key, err)
+			return false
+		}
+	} else if !copyItemWithExpiration(s, key, item, expiration) {
 		return false
 	}
-	(*flushAllTimer).Stop()
+	if atomic.LoadInt32(&s.mutationSubs.count) > 0 {
+		_, payload, _ := itemFlagsAndPayload(s, item)
+		publishMutation(s, MutationSet, key, len(payload), expiration)
+	}
+	return true
+}
+
+// Copies the given item obtained for the given key with the new expiration.
+//
+// The copy isn't stored if the item has been concurrently modified.
+// The touch is ordered before the modification in this case, so true
+// is returned.
+func copyItemWithExpiration(s *Server, key []byte, item *ybc.Item, expiration time.Duration) bool {
+	buf := item.Peek()
+	txn, err := newSetTxnWithRetries(s, key, len(buf), expiration)
+	if err != nil {
+		s.logf(LogLevelError, "Cannot store the item with key=[%s] and new expiration=[%s]: [%s]", key, expiration, err)
+		return false
+	}
+	if _, err = txn.Write(buf); err != nil {
+		s.logf(LogLevelError, "Error in SetTxn.Write(): [%s]", err)
+		txn.Rollback()
+		return false
+	}
+	if err = txn.CommitIfUnchanged(item); err != nil && err != ybc.ErrItemChanged {
+		s.logf(LogLevelError, "Unexpected error returned from SetTxn.CommitIfUnchanged(): [%s]", err)
+		return false
+	}
+	return true
+}
+
+func processTouchCmd(c *bufio.ReadWriter, s *Server, line []byte, scratchBuf *[]byte) bool {
+	key, expiration, noreply, ok := parseTouchCmd(line, s.Clock())
+	if !ok || !isValidServerKey(s, key) {
+		return writeClientError(c.Writer, s, line)
+	}
+
+	item, ok := lookupCachedItem(s, key)
+	if !ok {
+		return writeServerError(c.Writer, s)
+	}
+	if item == nil {
+		if noreply {
+			return true
+		}
+		return writeStr(c.Writer, strNotFoundCrLf)
+	}
+	ok = touchItem(s, key, item, expiration)
+	item.Close()
+	if !ok {
+		return writeErrorStr(c.Writer, s, strServerErrorOOMCrLf)
+	}
+	if noreply {
+		return true
+	}
+	return writeStr(c.Writer, strTouchedCrLf)
+}
+
+func getAndTouchItemAndWriteResponse(w *bufio.Writer, s *Server, key []byte, expiration time.Duration, shouldWriteCasid bool, scratchBuf *[]byte) bool {
+	item, ok := getCachedItem(s, key)
+	if ok {
+		s.countGetResult(item != nil)
+	}
+	if item == nil {
+		return ok
+	}
+	ok = touchItem(s, key, item, expiration)
+	ok = ok && writeGetResponse(w, s, key, item, shouldWriteCasid, s.VerifyChecksums, scratchBuf)
+	item.Close()
+	return ok
+}
+
+// Processes gat and gats commands, which return items for the given keys
+// and set new expiration for them.
+//
+// Items are obtained sequentially regardless of Server.MultigetConcurrency.
+func processGatCmd(c *serverConn, s *Server, line []byte, scratchBuf *[]byte, shouldWriteCasid bool) bool {
+	n := -1
+	expiration, ok := parseExpirationToken(line, &n, s.Clock())
+	if !ok {
+		return writeClientError(c.Writer, s, line)
+	}
+	parseGetKeys(c, s, line[n:])
+	if len(c.keys) == 0 && s.RejectEmptyGet {
+		return writeStr(c.Writer, strErrorCrLf)
+	}
+	if !areValidServerKeys(c, s) {
+		return writeClientError(c.Writer, s, line)
+	}
+	for _, key := range c.keys {
+		if !getAndTouchItemAndWriteResponse(c.Writer, s, key, expiration, shouldWriteCasid, scratchBuf) {
+			return writeServerError(c.Writer, s)
+		}
+	}
+	return writeEndCrLf(c.Writer)
+}
+
+func parseFlushAllCmd(line []byte, now time.Time) (expiration time.Duration, noreply bool, ok bool) {
+	if len(line) == 0 {
+		noreply = false
+		ok = true
+		return
+	}
+
+	ok = false
+	noreply = false
+	if line[0] != ' ' {
+		return
+	}
+
+	n := 0
+
+	s := nextToken(line, &n)
+	if s == nil {
+		return
+	}
+	if bytes.Equal(s, strNoreply) {
+		noreply = true
+		ok = expectEof(line, n)
+		return
+	}
+
+	if expiration, ok = parseExpiration(s, now); !ok {
+		return
+	}
+	if n == len(line) {
+		ok = true
+		return
+	}
+
+	if ok = expectNoreply(line, &n); !ok {
+		return
+	}
+	noreply = true
+	ok = expectEof(line, n)
+	return
+}
+
+func processFlushAllCmd(c *bufio.ReadWriter, s *Server, line []byte) bool {
+	expiration, noreply, ok := parseFlushAllCmd(line, s.Clock())
+	if !ok {
+		return writeClientError(c.Writer, s, line)
+	}
+	flushAll(s, expiration)
+	if noreply {
+		return true
+	}
+	return writeStr(c.Writer, strOkCrLf)
+}
+
+// Clears the cache after the given delay.
+//
+// The cache is cleared immediately if the delay isn't positive.
+// The delayed clear is shared by all the connections, so it isn't canceled
+// when the connection issued it is closed. Subsequent flushAll calls
+// from any connection replace the pending delayed clear.
+func flushAll(s *Server, expiration time.Duration) {
+	publishMutation(s, MutationFlush, nil, 0, expiration)
+
+	s.flushAllLock.Lock()
+	defer s.flushAllLock.Unlock()
+
+	if s.flushAllTimer != nil {
+		s.flushAllTimer.Stop()
+		s.flushAllTimer = nil
+	}
 	if expiration <= 0 {
-		cache.Clear()
+		s.Cache.Clear()
 	} else {
-		*flushAllTimer = time.AfterFunc(expiration, cacheClearFunc(cache))
+		s.flushAllTimer = time.AfterFunc(expiration, cacheClearFunc(s.Cache))
+	}
+}
+
+// Cancels the pending delayed clear started by flushAll.
+func stopFlushAll(s *Server) {
+	s.flushAllLock.Lock()
+	if s.flushAllTimer != nil {
+		s.flushAllTimer.Stop()
+		s.flushAllTimer = nil
+	}
+	s.flushAllLock.Unlock()
+}
+
+func parseVerbosityCmd(line []byte) (level uint32, noreply, ok bool) {
+	n := -1
+
+	if level, ok = parseUint32Token(line, &n); !ok {
+		return
 	}
+
+	noreply = false
+	if n < len(line) {
+		if ok = expectNoreply(line, &n); !ok {
+			return
+		}
+		noreply = true
+	}
+	ok = expectEof(line, n)
+	return
+}
+
+func processVerbosityCmd(c *bufio.ReadWriter, s *Server, line []byte) bool {
+	level, noreply, ok := parseVerbosityCmd(line)
+	if !ok {
+		return writeClientError(c.Writer, s, line)
+	}
+	s.SetVerbosity(int(level))
 	if noreply {
 		return true
 	}
 	return writeStr(c.Writer, strOkCrLf)
 }
 
-func processRequest(c *bufio.ReadWriter, cache ybc.Cacher, scratchBuf *[]byte, flushAllTimer **time.Timer) bool {
-	if !readLine(c.Reader, scratchBuf) {
+func processVersionCmd(c *bufio.ReadWriter, s *Server) bool {
+	return writeStr(c.Writer, strVersionWs) && writeString(c.Writer, s.Version) && writeCrLf(c.Writer)
+}
+
+func processQuitCmd(c *serverConn, s *Server) bool {
+	c.quit = true
+	switch s.QuitMode {
+	case QuitCloseImmediately:
+		// The connection is closed by closeConn().
+		c.dropResponses = true
+	case QuitHalfClose:
+		cw, ok := c.conn.(closeWriter)
+		if !ok {
+			break
+		}
+		if err := c.Flush(); err != nil {
+			s.logf(LogLevelWarning, "Cannot flush responses before closing the connection: [%s]", err)
+			break
+		}
+		if err := cw.CloseWrite(); err != nil {
+			s.logf(LogLevelWarning, "Cannot half-close the connection: [%s]", err)
+			break
+		}
+		// Drain incoming data until the client closes the connection,
+		// so the full close doesn't reset the connection with responses
+		// still unread by the client.
+		c.conn.SetReadDeadline(time.Now().Add(quitDrainTimeout))
+		io.Copy(ioutil.Discard, c.conn)
+	}
+	return false
+}
+
+// Applies Server.CaseInsensitiveCommands and Server.CommandAliases
+// to the command name in the given line.
+func canonicalizeCommand(c *serverConn, s *Server, line []byte) []byte {
+	n := bytes.IndexByte(line, ' ')
+	if n == -1 {
+		n = len(line)
+	}
+	cmd := line[:n]
+	if s.CaseInsensitiveCommands {
+		for i, ch := range cmd {
+			if ch >= 'A' && ch <= 'Z' {
+				cmd[i] = ch + ('a' - 'A')
+			}
+		}
+	}
+	canonicalCmd, ok := s.CommandAliases[string(cmd)]
+	if !ok {
+		return line
+	}
+	buf := append(c.aliasBuf[:0], canonicalCmd...)
+	buf = append(buf, line[n:]...)
+	c.aliasBuf = buf
+	return buf
+}
+
+func processRequest(c *serverConn, s *Server, scratchBuf *[]byte) bool {
+	// readLineWithTerminator() returns an empty line on EOF, so check for EOF
+	// beforehand in order to distinguish it from empty command lines.
+	if _, err := c.Reader.Peek(1); err != nil {
 		return false
 	}
-	line := *scratchBuf
-	if len(line) == 0 {
+	// The line is read into a distinct buffer, since command handlers
+	// use scratchBuf while processing the line.
+	hasCr, tooLong, ok := readLimitedLine(c.Reader, &c.lineBuf, s.MaxLineSize)
+	if !ok {
 		return false
 	}
-	if bytes.HasPrefix(line, strGet) {
-		return processGetCmd(c, cache, line[len(strGet):], scratchBuf, false)
+	if tooLong {
+		s.logf(LogLevelWarning, "Too long command line. Server.MaxLineSize=%d", s.MaxLineSize)
+		return writeErrorStr(c.Writer, s, strLineTooLongCrLf)
+	}
+	line := c.lineBuf
+	if len(line) == 0 {
+		return writeStr(c.Writer, strErrorCrLf)
+	}
+	if !hasCr && s.StrictLineEndings {
+		s.logf(LogLevelWarning, "Command line=[%s] isn't terminated by CRLF", formatLoggedLine(line, s.MaxLoggedLineLength))
+		return writeStr(c.Writer, strErrorCrLf)
+	}
+	if s.LenientTokenizer {
+		if line = collapseWhitespace(line); len(line) == 0 {
+			return writeStr(c.Writer, strErrorCrLf)
+		}
+	}
+	if s.CaseInsensitiveCommands || len(s.CommandAliases) > 0 {
+		line = canonicalizeCommand(c, s, line)
+	}
+	if atomic.LoadInt32(&s.verbosity) >= verbosityCommands {
+		s.logf(LogLevelDebug, "Command from %s: [%s]", c.conn.RemoteAddr(), formatLoggedLine(line, s.MaxLoggedLineLength))
+	}
+	if c.accessLogEntry != nil {
+		fillTextAccessLogEntry(c.accessLogEntry, s, line)
 	}
-	if bytes.HasPrefix(line, strGets) {
-		return processGetCmd(c, cache, line[len(strGets):], scratchBuf, true)
+	if c.rateLimited {
+		return rejectRateLimitedCmd(c, s, line)
+	}
+	if s.Authenticator != nil && !c.authenticated {
+		return processUnauthenticatedCmd(c, s, line, scratchBuf)
+	}
+	if s.OnCommand != nil {
+		if accepted, ok := acceptTextCmd(c, s, line); !accepted {
+			return ok
+		}
+	}
+	if s.IsReadOnly() && isMutatingCmd(line) {
+		return rejectReadOnlyCmd(c, s, line)
+	}
+	if bytes.HasPrefix(line, strGet) || bytes.Equal(line, strGetNoKeys) {
+		countCmd(c, s, cmdGet)
+		return processGetCmd(c, s, line[len(strGetNoKeys):], scratchBuf, false)
+	}
+	if bytes.HasPrefix(line, strGets) || bytes.Equal(line, strGetsNoKeys) {
+		countCmd(c, s, cmdGets)
+		return processGetCmd(c, s, line[len(strGetsNoKeys):], scratchBuf, true)
 	}
 	if bytes.HasPrefix(line, strGetDe) {
-		return processGetDeCmd(c, cache, line[len(strGetDe):], scratchBuf)
+		countCmd(c, s, cmdGetDe)
+		return processGetDeCmd(c.ReadWriter, s, line[len(strGetDe):], scratchBuf)
 	}
 	if bytes.HasPrefix(line, strCget) {
-		return processCgetCmd(c, cache, line[len(strCget):], scratchBuf)
+		countCmd(c, s, cmdCget)
+		return processCgetCmd(c.ReadWriter, s, line[len(strCget):], scratchBuf)
 	}
 	if bytes.HasPrefix(line, strCgetDe) {
-		return processCgetDeCmd(c, cache, line[len(strCgetDe):], scratchBuf)
+		countCmd(c, s, cmdCgetDe)
+		return processCgetDeCmd(c.ReadWriter, s, line[len(strCgetDe):], scratchBuf)
 	}
 	if bytes.HasPrefix(line, strSet) {
-		return processSetCmd(c, cache, line[len(strSet):], scratchBuf)
+		countCmd(c, s, cmdSet)
+		return processSetCmd(c, s, line[len(strSet):], scratchBuf)
 	}
 	if bytes.HasPrefix(line, strCas) {
-		return processCasCmd(c, cache, line[len(strCas):], scratchBuf)
+		countCmd(c, s, cmdCas)
+		return processCasCmd(c, s, line[len(strCas):], scratchBuf)
 	}
 	if bytes.HasPrefix(line, strAdd) {
-		return processAddCmd(c, cache, line[len(strAdd):], scratchBuf)
+		countCmd(c, s, cmdAdd)
+		return processAddCmd(c, s, line[len(strAdd):], scratchBuf)
+	}
+	if bytes.HasPrefix(line, strReplace) {
+		countCmd(c, s, cmdReplace)
+		return processReplaceCmd(c, s, line[len(strReplace):], scratchBuf)
 	}
 	if bytes.HasPrefix(line, strDelete) {
-		return processDeleteCmd(c, cache, line[len(strDelete):], scratchBuf)
+		countCmd(c, s, cmdDelete)
+		return processDeleteCmd(c.ReadWriter, s, line[len(strDelete):], scratchBuf)
+	}
+	if bytes.HasPrefix(line, strAppend) {
+		countCmd(c, s, cmdAppend)
+		return processAppendPrependCmd(c, s, line[len(strAppend):], scratchBuf, false)
+	}
+	if bytes.HasPrefix(line, strPrepend) {
+		countCmd(c, s, cmdPrepend)
+		return processAppendPrependCmd(c, s, line[len(strPrepend):], scratchBuf, true)
+	}
+	if bytes.HasPrefix(line, strIncr) {
+		countCmd(c, s, cmdIncr)
+		return processIncrDecrCmd(c.ReadWriter, s, line[len(strIncr):], scratchBuf, true)
+	}
+	if bytes.HasPrefix(line, strDecr) {
+		countCmd(c, s, cmdDecr)
+		return processIncrDecrCmd(c.ReadWriter, s, line[len(strDecr):], scratchBuf, false)
+	}
+	if bytes.HasPrefix(line, strGat) {
+		countCmd(c, s, cmdGat)
+		return processGatCmd(c, s, line[len(strGat):], scratchBuf, false)
+	}
+	if bytes.HasPrefix(line, strGats) {
+		countCmd(c, s, cmdGats)
+		return processGatCmd(c, s, line[len(strGats):], scratchBuf, true)
+	}
+	if bytes.HasPrefix(line, strTouch) {
+		countCmd(c, s, cmdTouch)
+		return processTouchCmd(c.ReadWriter, s, line[len(strTouch):], scratchBuf)
 	}
 	if bytes.HasPrefix(line, strFlushAll) {
-		return processFlushAllCmd(c, cache, line[len(strFlushAll):], flushAllTimer)
+		countCmd(c, s, cmdFlushAll)
+		return processFlushAllCmd(c.ReadWriter, s, line[len(strFlushAll):])
+	}
+	if bytes.HasPrefix(line, strStats) {
+		return processStatsCmd(c.ReadWriter, s, line[len(strStats):], scratchBuf)
+	}
+	if bytes.HasPrefix(line, strVerbosity) {
+		return processVerbosityCmd(c.ReadWriter, s, line[len(strVerbosity):])
+	}
+	if bytes.Equal(line, strVersion) {
+		return processVersionCmd(c.ReadWriter, s)
 	}
 	if bytes.HasPrefix(line, strQuit) {
+		return processQuitCmd(c, s)
+	}
+	s.logf(LogLevelWarning, "Unrecognized command=[%s]", formatLoggedLine(line, s.MaxLoggedLineLength))
+	return writeStr(c.Writer, strErrorCrLf)
+}
+
+// Server-side state of a client connection.
+type serverConn struct {
+	*bufio.ReadWriter
+	conn    net.Conn
+	lineBuf []byte
+	// Buffers acquired via acquireConnBuffers().
+	lineBufPtr *[]byte
+	scratchBuf *[]byte
+	// Byte counters wrapping conn. See Server.Stats().
+	// Both are nil for UDP requests.
+	cr *countingReader
+	cw *countingWriter
+	// Buffers reused by writeItemsVectored().
+	vecBufs       net.Buffers
+	vecPending    net.Buffers
+	vecHeaders    []byte
+	vecHeaderEnds []int
+	// The buffer for command lines with aliased commands.
+	// See Server.CommandAliases.
+	aliasBuf []byte
+
+	// Keys of the current get request.
+	keys [][]byte
+	// Open-addressing hash table with indexes of distinct keys in keys
+	// for the current get request with many keys. See isDuplicateKey().
+	keysTable []uint32
+	// Items for the current get request.
+	// See Server.MultigetConcurrency.
+	items []*ybc.Item
+
+	// Whether the client passed authentication.
+	// See Server.Authenticator.
+	authenticated bool
+
+	// The connection state used for graceful shutdown.
+	// See waitForRequest().
+	state int32
+
+	// The read deadline for the current request.
+	// See Server.ReadTimeout.
+	readDeadline time.Time
+
+	// Request rate limiters for the connection and the client ip.
+	// See Server.MaxRequestRate and Server.MaxRequestRatePerIP.
+	rateLimiter   *rateLimiter
+	ipRateLimiter *ipRateLimiter
+
+	// Whether the current request exceeds the rate limits.
+	// See Server.RejectRateLimitedRequests.
+	rateLimited bool
+
+	// The access log entry for the current request if it is sampled.
+	// See Server.AccessLog.
+	accessLogEntry *AccessLogEntry
+
+	// The context returned by Server.OnConnect.
+	ctx context.Context
+
+	// Whether the client sent 'quit' command.
+	quit bool
+
+	// Whether pending responses must be dropped when closing
+	// the connection. See QuitCloseImmediately.
+	dropResponses bool
+
+	// The reason for closing the connection passed to Server.OnDisconnect.
+	closeErr error
+
+	// The type of the last processed command or -1 if the command
+	// isn't counted. See Server.TrackLatencies.
+	cmd int
+
+	// Processes requests in the protocol detected on the connection.
+	processFunc func(c *serverConn, s *Server, scratchBuf *[]byte) bool
+
+	// The connection start time and the number of processed commands.
+	// See Server.OnConnClose.
+	startTime     time.Time
+	commandsCount int
+
+	// Whether the connection passed openConn().
+	opened bool
+
+	// Whether the connection close must be logged.
+	logClose bool
+
+	// Whether the connection is registered via acquireIPConn().
+	// See Server.MaxConnsPerIP.
+	ipConnAcquired bool
+
+	// Notified when the connection is closed.
+	done *sync.WaitGroup
+
+	// The file descriptor of the connection or -1 if the connection
+	// cannot be parked. See Server.ParkIdleConns.
+	fd int
+
+	// The time since the parked connection is idle.
+	// See Server.IdleTimeout.
+	parkTime time.Time
+
+	// The number of responses written since the last flush and the time
+	// until they may be delayed. See Server.MaxUnflushedResponses
+	// and Server.FlushDelay.
+	unflushedCount int
+	flushDeadline  time.Time
+}
+
+// serverConn states.
+const (
+	connBusy = int32(iota)
+	connIdle
+	connClosing
+	connParked
+)
+
+// Waits until the next request arrives on the connection.
+//
+// The connection is parked if it stays idle for Server.ParkIdleDelay.
+// See Server.ParkIdleConns.
+//
+// Returns false if the connection must be closed, i.e. on read errors,
+// after Server.IdleTimeout or when the server is stopping. parked is set
+// to true if the connection has been parked, so it mustn't be accessed
+// by the caller anymore.
+func waitForRequest(c *serverConn, s *Server) (ok, parked bool) {
+	if c.Reader.Buffered() > 0 {
+		if atomic.LoadInt32(&s.stopping) != 0 {
+			return false, false
+		}
+		return setRequestDeadlines(c, s), false
+	}
+	idleStartTime := time.Now()
+	var idleDeadline time.Time
+	if s.IdleTimeout > 0 {
+		idleDeadline = idleStartTime.Add(s.IdleTimeout)
+	}
+	canPark := c.fd >= 0
+	var err error
+	for {
+		deadline := idleDeadline
+		var parkDeadline time.Time
+		if canPark {
+			parkDeadline = time.Now().Add(s.ParkIdleDelay)
+			if deadline.IsZero() || parkDeadline.Before(deadline) {
+				deadline = parkDeadline
+			} else {
+				parkDeadline = time.Time{}
+			}
+		}
+
+		// The idle deadline must be set before switching to connIdle state,
+		// so it doesn't override the deadline set by closeIdleConns().
+		if !deadline.IsZero() || s.ReadTimeout > 0 {
+			if err := c.conn.SetReadDeadline(deadline); err != nil {
+				s.logf(LogLevelWarning, "Cannot set idle deadline on the connection: [%s]", err)
+				return false, false
+			}
+		}
+		atomic.StoreInt32(&c.state, connIdle)
+		if atomic.LoadInt32(&s.stopping) != 0 {
+			return false, false
+		}
+		_, err = c.Reader.Peek(1)
+
+		// The connection may be switched to connClosing by closeIdleConns()
+		// while waiting for the request. The request is dropped in this case.
+		if !atomic.CompareAndSwapInt32(&c.state, connIdle, connBusy) {
+			return false, false
+		}
+		if err == nil || parkDeadline.IsZero() || !isTimeoutError(err) {
+			break
+		}
+
+		// The connection stayed idle for Server.ParkIdleDelay.
+		c.cr.err = nil
+		c.parkTime = idleStartTime
+		if parkConn(c, s) {
+			return false, true
+		}
+		canPark = false
+	}
+	if err != nil {
+		if err != io.EOF {
+			c.closeErr = err
+		}
+		if isTimeoutError(err) {
+			atomic.AddUint64(&s.idleKicksCount, 1)
+			if atomic.LoadInt32(&s.verbosity) >= verbosityConns {
+				s.logf(LogLevelInfo, "Closing idle connection from %s after Server.IdleTimeout=%s", c.conn.RemoteAddr(), s.IdleTimeout)
+			}
+		}
+		return false, false
+	}
+	return setRequestDeadlines(c, s), false
+}
+
+func isTimeoutError(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// Limits the duration of reading the next request and writing
+// the response to it according to Server.ReadTimeout
+// and Server.WriteTimeout.
+func setRequestDeadlines(c *serverConn, s *Server) bool {
+	if s.IdleTimeout > 0 || s.ReadTimeout > 0 || c.fd >= 0 {
+		// Reset the idle or park deadline if ReadTimeout isn't set.
+		c.readDeadline = time.Time{}
+		if s.ReadTimeout > 0 {
+			c.readDeadline = time.Now().Add(s.ReadTimeout)
+		}
+		if err := c.conn.SetReadDeadline(c.readDeadline); err != nil {
+			s.logf(LogLevelWarning, "Cannot set read deadline on the connection: [%s]", err)
+			return false
+		}
+	}
+	if s.WriteTimeout > 0 {
+		if err := c.conn.SetWriteDeadline(time.Now().Add(s.WriteTimeout)); err != nil {
+			s.logf(LogLevelWarning, "Cannot set write deadline on the connection: [%s]", err)
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true if buffered responses must be flushed before processing
+// buffered requests according to Server.MaxUnflushedResponses
+// and Server.MaxUnflushedBytes.
+func shouldFlushResponses(c *serverConn, s *Server) bool {
+	return (s.MaxUnflushedResponses > 0 && c.unflushedCount >= s.MaxUnflushedResponses) ||
+		(s.MaxUnflushedBytes > 0 && c.Writer.Buffered() >= s.MaxUnflushedBytes)
+}
+
+// Waits for the next request until c.flushDeadline, so responses
+// to requests arriving in the meantime are flushed together.
+// See Server.FlushDelay.
+//
+// Read errors are left to waitForRequest().
+func waitForNextRequest(c *serverConn, s *Server) {
+	if !time.Now().Before(c.flushDeadline) {
+		return
+	}
+	if err := c.conn.SetReadDeadline(c.flushDeadline); err != nil {
+		return
+	}
+	c.Reader.Peek(1)
+	// Reset the deadline, since waitForRequest() doesn't reset it
+	// if neither Server.IdleTimeout nor Server.ReadTimeout is set.
+	c.conn.SetReadDeadline(time.Time{})
+}
+
+func registerConn(s *Server, c *serverConn) {
+	s.connsLock.Lock()
+	if s.conns == nil {
+		s.conns = make(map[*serverConn]struct{})
+	}
+	s.conns[c] = struct{}{}
+	s.connsLock.Unlock()
+}
+
+func unregisterConn(s *Server, c *serverConn) {
+	s.connsLock.Lock()
+	delete(s.conns, c)
+	s.connsLock.Unlock()
+}
+
+// Interrupts reads on connections waiting for requests,
+// so they are closed.
+func closeIdleConns(s *Server) {
+	s.connsLock.Lock()
+	for c := range s.conns {
+		if atomic.CompareAndSwapInt32(&c.state, connIdle, connClosing) {
+			c.conn.SetReadDeadline(time.Now())
+		} else if atomic.LoadInt32(&c.state) == connParked {
+			// closeConn() acquires connsLock, so the connection
+			// is closed in a separate goroutine.
+			go closeParkedConn(c, s, nil)
+		}
+	}
+	s.connsLock.Unlock()
+}
+
+func closeAllConns(s *Server) {
+	s.connsLock.Lock()
+	for c := range s.conns {
+		c.conn.Close()
+	}
+	s.connsLock.Unlock()
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Serves the connection accepted by the accept loop.
+//
+// The connection must be already counted in Server.currConnsCount.
+func handleConn(conn net.Conn, s *Server, done *sync.WaitGroup) {
+	c := &serverConn{
+		conn: conn,
+		done: done,
+		fd:   -1,
+		// The connection is registered by the accept loop.
+		ipConnAcquired: s.MaxConnsPerIP > 0,
+	}
+	serveNewConn(c, s)
+}
+
+func serveNewConn(c *serverConn, s *Server) {
+	conn := c.conn
+	atomic.AddUint64(&s.totalConnsCount, 1)
+	if atomic.LoadInt32(&s.verbosity) >= verbosityConns {
+		s.logf(LogLevelInfo, "Accepted connection from %s", conn.RemoteAddr())
+		c.logClose = true
+	}
+	if !openConn(c, s) {
+		closeConn(c, s)
+		return
+	}
+	serveConn(c, s)
+}
+
+// Performs TLS handshake, calls Server.OnConnect and prepares
+// the connection for serving requests.
+//
+// Returns false if the connection must be closed.
+func openConn(c *serverConn, s *Server) bool {
+	conn := c.conn
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		// Perform the handshake explicitly, so handshake errors are logged
+		// instead of being reported as ordinary read errors.
+		if err := tlsConn.Handshake(); err != nil {
+			s.logf(LogLevelWarning, "TLS handshake with %s failed: [%s]", conn.RemoteAddr(), err)
+			return false
+		}
+		if s.AuthorizeClientCert != nil && !authorizeClientCert(s, tlsConn) {
+			return false
+		}
+	}
+	ctx, ok := connectHook(s, conn)
+	if !ok {
 		return false
 	}
-	log.Printf("Unrecognized command=[%s]", line)
-	return false
+	c.ctx = ctx
+	c.cr = &countingReader{r: conn, n: &s.bytesReadCount}
+	c.cw = &countingWriter{w: conn, n: &s.bytesWrittenCount}
+	acquireConnBuffers(c, s, c.cr, c.cw)
+	registerConn(s, c)
+	c.opened = true
+	if s.MaxRequestRate > 0 {
+		c.rateLimiter = newRateLimiter(s.MaxRequestRate, s.MaxRequestBurst)
+	}
+	if s.MaxRequestRatePerIP > 0 {
+		c.ipRateLimiter = acquireIPRateLimiter(s, connIP(conn))
+	}
+	if s.poller != nil {
+		c.fd = connFd(conn)
+	}
+	c.startTime = time.Now()
+	return true
 }
 
-func handleConn(conn net.Conn, cache ybc.Cacher, readBufferSize, writeBufferSize int, done *sync.WaitGroup) {
-	defer conn.Close()
-	defer done.Done()
-	r := bufio.NewReaderSize(conn, readBufferSize)
-	w := bufio.NewWriterSize(conn, writeBufferSize)
-	c := bufio.NewReadWriter(r, w)
-	defer w.Flush()
+// Serves requests on the opened connection until it is closed
+// or parked. See Server.ParkIdleConns.
+func serveConn(c *serverConn, s *Server) {
+	ok, parked := waitForRequest(c, s)
+	if parked {
+		return
+	}
+	if c.processFunc == nil {
+		c.processFunc = processRequest
+		if ok && isBinaryConn(c.Reader) {
+			c.processFunc = processBinaryRequest
+		}
+	}
+
+	for ok {
+		if c.rateLimiter != nil || c.ipRateLimiter != nil {
+			c.rateLimited = !limitRequestRate(c, s)
+		}
+		if (s.AccessLog != nil || s.Tracer != nil) && shouldLogAccess(s) {
+			startAccessLogEntry(c, c.cw, true)
+		} else if s.SlowRequestThreshold > 0 {
+			startAccessLogEntry(c, c.cw, false)
+		}
+		if s.TrackLatencies {
+			c.cmd = -1
+			requestStartTime := time.Now()
+			ok = c.processFunc(c, s, c.scratchBuf)
+			recordLatency(c, s, time.Since(requestStartTime))
+		} else {
+			ok = c.processFunc(c, s, c.scratchBuf)
+		}
+		if c.accessLogEntry != nil {
+			finishAccessLogEntry(c, s, c.cw)
+		}
+		if !ok {
+			if !c.quit && c.closeErr == nil {
+				c.closeErr = ErrConnAborted
+				logConnIOError(c, s)
+			}
+			break
+		}
+		c.commandsCount++
+		if c.unflushedCount == 0 {
+			c.flushDeadline = time.Time{}
+			if s.FlushDelay > 0 {
+				c.flushDeadline = time.Now().Add(s.FlushDelay)
+			}
+		}
+		c.unflushedCount++
+		if c.Reader.Buffered() == 0 && !c.flushDeadline.IsZero() {
+			waitForNextRequest(c, s)
+		}
+		if c.Reader.Buffered() == 0 || shouldFlushResponses(c, s) {
+			c.unflushedCount = 0
+			if err := c.Writer.Flush(); err != nil {
+				// The client most likely closed the connection,
+				// so this isn't a server error.
+				atomic.AddUint64(&s.clientDisconnectsCount, 1)
+				c.closeErr = err
+				break
+			}
+		}
+		if ok, parked = waitForRequest(c, s); parked {
+			return
+		}
+	}
+	closeConn(c, s)
+}
+
+// Logs the I/O error, which aborted request processing on the connection.
+//
+// Errors are logged here instead of low-level read and write helpers,
+// which are shared with Client.
+func logConnIOError(c *serverConn, s *Server) {
+	err := c.cr.err
+	if err == nil {
+		err = c.cw.err
+	}
+	if err != nil {
+		s.logf(LogLevelWarning, "I/O error on the connection from %s: [%s]", c.conn.RemoteAddr(), err)
+	}
+}
+
+// Closes the connection and releases resources held by it.
+func closeConn(c *serverConn, s *Server) {
+	// Buffers are released while the connection is parked.
+	if c.opened && c.ReadWriter != nil && !c.dropResponses {
+		c.Flush()
+	}
+
+	// Close the connection before calling hooks, so they observe
+	// the closed connection.
+	c.conn.Close()
+
+	if c.opened {
+		if s.OnConnClose != nil {
+			s.OnConnClose(&ConnStats{
+				RemoteAddr:    c.conn.RemoteAddr(),
+				Duration:      time.Since(c.startTime),
+				CommandsCount: c.commandsCount,
+				BytesRead:     c.cr.bytesCount,
+				BytesWritten:  c.cw.bytesCount,
+			})
+		}
+		if s.OnDisconnect != nil {
+			s.OnDisconnect(c.conn, c.closeErr)
+		}
+		if c.ipRateLimiter != nil {
+			releaseIPRateLimiter(s, connIP(c.conn))
+		}
+		unregisterConn(s, c)
+		if c.ReadWriter != nil {
+			releaseConnBuffers(c, s)
+		}
+	}
+	if c.logClose {
+		logConnClose(s, c.conn)
+	}
+	if c.ipConnAcquired {
+		releaseIPConn(s, connIP(c.conn))
+	}
+	atomic.AddInt64(&s.currConnsCount, -1)
+	c.done.Done()
+}
+
+// Returns true if Server.AuthorizeClientCert authorizes the client
+// of the given connection with completed handshake.
+func authorizeClientCert(s *Server, conn *tls.Conn) bool {
+	var cert *x509.Certificate
+	if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		cert = certs[0]
+	}
+	if !s.AuthorizeClientCert(conn.RemoteAddr(), cert) {
+		if cert != nil {
+			s.logf(LogLevelWarning, "Client %s with certificate subject=[%s] isn't authorized", conn.RemoteAddr(), cert.Subject)
+		} else {
+			s.logf(LogLevelWarning, "Client %s without certificate isn't authorized", conn.RemoteAddr())
+		}
+		return false
+	}
+	return true
+}
+
+func logConnClose(s *Server, conn net.Conn) {
+	if atomic.LoadInt32(&s.verbosity) >= verbosityConns {
+		s.logf(LogLevelInfo, "Closed connection from %s", conn.RemoteAddr())
+	}
+}
+
+// Connection closing sequence used by the server on 'quit' command.
+type QuitMode int
+
+const (
+	// Flushes pending responses and then closes the connection.
+	QuitCloseAfterFlush = QuitMode(iota)
+
+	// Closes the connection immediately. Pending responses are dropped.
+	QuitCloseImmediately
+
+	// Flushes pending responses, closes the write side of the connection
+	// and waits until the client closes the connection before the full
+	// close. This lets clients pipelining requests before 'quit' reading
+	// all the pending responses.
+	//
+	// Falls back to QuitCloseAfterFlush for connections without
+	// CloseWrite() support.
+	QuitHalfClose
+)
 
-	flushAllTimer := time.NewTimer(0)
-	defer flushAllTimer.Stop()
+// Statistics for a client connection passed to Server.OnConnClose.
+type ConnStats struct {
+	// The address of the client.
+	RemoteAddr net.Addr
 
-	scratchBuf := make([]byte, 0, 1024)
-	for {
-		if !processRequest(c, cache, &scratchBuf, &flushAllTimer) {
-			break
-		}
-		if r.Buffered() == 0 {
-			w.Flush()
-		}
-	}
+	// The duration of the connection.
+	Duration time.Duration
+
+	// The number of commands processed over the connection.
+	CommandsCount int
+
+	// The number of bytes read from the connection.
+	BytesRead uint64
+
+	// The number of bytes written to the connection.
+	BytesWritten uint64
 }
 
 // Memcache server.
@@ -685,17 +2721,75 @@ type Server struct {
 	// The cache must be initialized before passing it here.
 	//
 	// Currently ybc.Cache and ybc.Cluster may be passed here.
+	// See OpenShardedCache() for reducing lock contention inside
+	// the cache under high load.
 	Cache ybc.Cacher
 
 	// TCP address to listen to. Must be in the form addr:port.
 	// Required parameter.
 	ListenAddr string
 
+	// UDP address to listen to for memcached UDP protocol requests.
+	// Must be in the form addr:port.
+	// Optional parameter. UDP requests aren't served if the address is empty.
+	//
+	// Requests must fit a single datagram. Responses are split
+	// into datagrams of up to 1400 bytes.
+	UDPListenAddr string
+
+	// The maximum number of UDP requests processed concurrently.
+	// Request datagrams received while the limit is reached are dropped
+	// like datagrams lost in the network.
+	// Optional parameter. The default value is 1024.
+	MaxUDPRequests int
+
+	// TLS configuration for client connections accepted on ListenAddr.
+	// Optional parameter. Connections are unencrypted if it isn't set.
+	//
+	// The configuration must contain at least one certificate
+	// or set GetCertificate. UDP requests are always unencrypted.
+	TLSConfig *tls.Config
+
+	// Whether to require and verify client certificates on TLS connections
+	// (mutual TLS). Client certificates are verified against
+	// TLSConfig.ClientCAs, or against system roots if ClientCAs isn't set.
+	// Optional parameter. Requires TLSConfig.
+	//
+	// By default TLSConfig.ClientAuth is used as is.
+	RequireClientCerts bool
+
+	// The callback, which decides whether the client with the given
+	// certificate may use the server. It is called after successful
+	// TLS handshake with the leaf client certificate, or with nil
+	// if the client didn't present a certificate. The connection is closed
+	// if the callback returns false.
+	// Optional parameter. All the clients passed TLS handshake
+	// are authorized by default.
+	AuthorizeClientCert func(remoteAddr net.Addr, cert *x509.Certificate) bool
+
+	// The callback, which checks client credentials. If set, clients
+	// must authenticate before issuing other commands.
+	// Optional parameter. Clients aren't authenticated by default.
+	//
+	// Binary protocol clients authenticate via SASL PLAIN mechanism.
+	// Text protocol clients authenticate like in the original memcached
+	// by sending 'set' command with '<username> <password>' payload.
+	// Other commands from unauthenticated clients are rejected.
+	// UDP requests are always rejected, since they cannot be authenticated.
+	Authenticator func(username, password string) bool
+
 	// The size of buffer used for reading requests from clients
 	// per each connection.
 	// Optional parameter.
 	ReadBufferSize int
 
+	// The maximum size in bytes of command lines. Command lines may exceed
+	// ReadBufferSize, e.g. multi-key get requests from aggregating proxies.
+	// Longer lines are skipped and responded with
+	// 'CLIENT_ERROR line too long'.
+	// Optional parameter. Default is 1MB.
+	MaxLineSize int
+
 	// The size of buffer used for writing responses to clients
 	// per each connection.
 	// Optional parameter.
@@ -709,12 +2803,644 @@ type Server struct {
 	// Optional parameter.
 	OSWriteBufferSize int
 
+	// Whether to enable Nagle's algorithm on client connections.
+	// Optional parameter.
+	//
+	// By default TCP_NODELAY is set on client connections, so small
+	// responses are sent without delay.
+	DisableTCPNoDelay bool
+
+	// The maximum number of responses buffered before flushing them
+	// to the client.
+	// Optional parameter.
+	//
+	// By default responses are flushed only when the server runs out
+	// of buffered requests from the client or the write buffer is full.
+	// Pipelining clients may receive responses earlier with small values.
+	MaxUnflushedResponses int
+
+	// The maximum size in bytes of responses buffered before flushing them
+	// to the client.
+	// Optional parameter.
+	//
+	// By default buffered responses are limited only by WriteBufferSize.
+	// See also Server.MaxUnflushedResponses and Server.FlushDelay.
+	MaxUnflushedBytes int
+
+	// The maximum duration buffered responses may wait for the next
+	// request from the client before being flushed. Responses
+	// to requests arriving within the delay are flushed together,
+	// so throughput-oriented deployments may trade latency for fewer
+	// syscalls and packets.
+	// Optional parameter.
+	//
+	// By default responses are flushed as soon as the server runs out
+	// of buffered requests from the client.
+	FlushDelay time.Duration
+
+	// Whether to store CRC32 checksum of the payload with each item
+	// and to verify it on each get.
+	// Optional parameter.
+	//
+	// Items with checksum mismatch are treated as corrupted. Such items
+	// are deleted from the cache and are skipped in responses.
+	//
+	// Enabling checksums adds 4 bytes per item and requires additional CPU
+	// time for each get and set. Items stored with checksums enabled cannot
+	// be read with checksums disabled and vice versa, so do not toggle
+	// this option for persistent caches.
+	VerifyChecksums bool
+
+	// Connection closing sequence used on 'quit' command.
+	// Optional parameter. QuitCloseAfterFlush is used by default.
+	QuitMode QuitMode
+
+	// Time window for averaging per-command rates reported
+	// by 'stats' command.
+	// Optional parameter. Command rates aren't tracked if the window is 0.
+	//
+	// Rates are calculated as exponentially weighted moving averages
+	// of command counters sampled in background.
+	CommandRateWindow time.Duration
+
+	// The number of the most requested keys reported by Server.HotKeys()
+	// and 'stats hotkeys' command.
+	// Optional parameter. Hot keys aren't tracked if the count is 0.
+	//
+	// Keys of sampled get and set requests are counted in a count-min
+	// sketch, so memory usage doesn't depend on the number of distinct keys.
+	HotKeysCount int
+
+	// The fraction of get and set requests sampled for hot keys tracking.
+	// Optional parameter. Default is 0.01.
+	HotKeysSampleRate float64
+
+	// Time window for measuring hot keys request rates.
+	// Optional parameter. Default is 1 minute.
+	HotKeysWindow time.Duration
+
+	// Whether to return each distinct key at most once in responses
+	// for multiget requests such as 'get k1 k2 k1'.
+	// Optional parameter.
+	//
+	// By default duplicate keys are returned for each occurrence
+	// in the request like the original memcached does.
+	DedupeMultigetKeys bool
+
+	// Whether to write 'NOT_FOUND' line before 'END' on cache miss
+	// for get and gets requests containing a single key.
+	// Optional parameter.
+	//
+	// By default cache misses are signalled only by the absence of 'VALUE'
+	// lines in the response like the original memcached does.
+	// Multiget requests are always served this way.
+	ExplicitMiss bool
+
+	// The maximum duration for reading payload of set, add and cas commands
+	// after the command line has been read.
+	// Connections failing to send the payload in time are closed.
+	// Optional parameter.
+	//
+	// By default the payload read duration isn't limited.
+	PayloadReadTimeout time.Duration
+
+	// The maximum duration a client connection may wait between requests.
+	// Idle connections are closed after the timeout, so they don't pin
+	// buffers and goroutines forever. Closed connections are counted
+	// in idle_kicks stat.
+	// Optional parameter.
+	//
+	// By default idle connections are kept open until clients close them.
+	IdleTimeout time.Duration
+
+	// Whether to park idle connections without dedicated goroutines
+	// and read/write buffers. Parked connections are watched via epoll
+	// and are resumed in new goroutines when requests arrive. This saves
+	// memory when serving a lot of mostly idle connections at the cost
+	// of higher latency for requests arriving on idle connections.
+	// TLS connections aren't parked. The number of parked connections
+	// is reported in parked_connections stat.
+	// Optional parameter.
+	//
+	// Supported only on Linux.
+	ParkIdleConns bool
+
+	// The duration a connection must stay idle before it is parked.
+	// See Server.ParkIdleConns.
+	// Optional parameter.
+	//
+	// By default connections are parked after a second of inactivity.
+	ParkIdleDelay time.Duration
+
+	// The maximum duration for reading a request after its first byte
+	// has been received. Connections failing to send the request in time
+	// are closed.
+	// Optional parameter.
+	//
+	// By default the request read duration isn't limited. PayloadReadTimeout
+	// additionally limits reading payloads if set.
+	ReadTimeout time.Duration
+
+	// The maximum duration for writing the response to a request.
+	// Connections of clients, which don't read responses in time,
+	// are closed.
+	// Optional parameter.
+	//
+	// By default the response write duration isn't limited.
+	WriteTimeout time.Duration
+
+	// The maximum number of simultaneously open set transactions.
+	// Set, add and cas commands exceeding the limit are rejected
+	// with 'SERVER_ERROR out of memory storing object'.
+	// Optional parameter.
+	//
+	// By default the number of open set transactions isn't limited.
+	MaxOpenTxns int
+
+	// Whether to respond with 'ERROR' to get, gets, gat and gats requests
+	// without keys.
+	// Optional parameter.
+	//
+	// By default such requests are responded with 'END'.
+	RejectEmptyGet bool
+
+	// The maximum number of goroutines, which may concurrently fetch items
+	// from the cache for a single multiget request.
+	// Responses are written in the order of requested keys.
+	// Optional parameter.
+	//
+	// By default items are fetched sequentially.
+	// Concurrent fetching may reduce multiget latency for slow caches
+	// such as Server.Cache performing disk reads.
+	MultigetConcurrency int
+
+	// The maximum number of bytes to log from unrecognized command lines.
+	// Non-printable bytes are logged in hex-escaped form.
+	// Optional parameter.
+	MaxLoggedLineLength int
+
+	// The maximum number of retries for cache operations failed
+	// with transient errors. Errors are considered transient if they
+	// have Temporary() method returning true.
+	// Optional parameter.
+	//
+	// By default cache operations aren't retried.
+	CacheOpRetries int
+
+	// The delay between retries of failed cache operations.
+	// See CacheOpRetries.
+	// Optional parameter.
+	CacheOpRetryDelay time.Duration
+
+	// Whether to count set commands creating new items and set commands
+	// overwriting existing items. The counts are reported in 'stats'
+	// as new_items and updated_items.
+	// Optional parameter.
+	//
+	// This requires an additional cache lookup per set command,
+	// so it is disabled by default.
+	TrackSetCreates bool
+
+	// Whether to track per-command latency histograms. Latency
+	// percentiles are reported in 'stats' as <cmd>_latency_p50_us,
+	// <cmd>_latency_p95_us and <cmd>_latency_p99_us and
+	// in Server.Stats(). The latency includes reading the payload
+	// of storage commands.
+	// Optional parameter.
+	TrackLatencies bool
+
+	// Whether to reject command lines terminated by bare '\n'
+	// instead of '\r\n'. Such lines are responded with 'ERROR' and
+	// the server proceeds to the next line.
+	// Optional parameter.
+	//
+	// By default bare '\n' is accepted as a line terminator.
+	StrictLineEndings bool
+
+	// Callback, which is called after each client connection is closed.
+	// The callback may be called concurrently from multiple goroutines.
+	// Optional parameter.
+	OnConnClose func(stats *ConnStats)
+
+	// Callback, which is called for each accepted client connection before
+	// reading requests from it. The returned context is passed
+	// to OnCommand calls for the connection, so it may carry per-connection
+	// data such as the tenant. The connection is closed if the callback
+	// returns an error. The callback may be called concurrently
+	// from multiple goroutines.
+	// Optional parameter.
+	OnConnect func(ctx context.Context, conn net.Conn) (context.Context, error)
+
+	// Callback, which is called after the client connection accepted
+	// by OnConnect is closed. err is nil if the connection is closed
+	// by the client, via 'quit' command or on server stop.
+	// ErrConnAborted is passed if the connection is closed because
+	// of a malformed request. The callback may be called concurrently
+	// from multiple goroutines.
+	// Optional parameter.
+	OnDisconnect func(conn net.Conn, err error)
+
+	// Callback, which is called before processing each command with
+	// the context returned by OnConnect, the command name and the first key
+	// in the command. The key is empty for commands without keys.
+	// Binary protocol commands are named like in AccessLogEntry.Command.
+	// The command is rejected with 'CLIENT_ERROR command rejected'
+	// or with 'Auth failure' binary status if the callback returns an error.
+	// The callback is called after the client is authenticated
+	// if Authenticator is set. The callback may be called concurrently
+	// from multiple goroutines.
+	// Optional parameter.
+	OnCommand func(ctx context.Context, cmd, key string) error
+
+	// Callback, which is called after each request over TCP connections
+	// is processed. Use AccessLogEntry.String() for writing the entry
+	// to an io.Writer. The callback may be called concurrently
+	// from multiple goroutines.
+	// Optional parameter.
+	//
+	// Logged requests are processed without pipelining, since the server
+	// flushes responses around them. Use AccessLogSampleRate for limiting
+	// the overhead under high load.
+	AccessLog func(entry *AccessLogEntry)
+
+	// The fraction of requests passed to AccessLog and Tracer
+	// in the range (0..1].
+	// Optional parameter.
+	//
+	// By default all the requests are logged.
+	AccessLogSampleRate float64
+
+	// Tracer for commands processed over TCP connections. Traced commands
+	// are processed without pipelining like commands passed to AccessLog.
+	// Optional parameter.
+	Tracer Tracer
+
+	// The processing time above which requests over TCP connections
+	// are considered slow. Slow requests are passed to OnSlowRequest.
+	// Optional parameter.
+	//
+	// By default slow requests aren't tracked.
+	SlowRequestThreshold time.Duration
+
+	// Callback, which is called for requests processed for longer than
+	// SlowRequestThreshold. AccessLogEntry.Result is set only for requests
+	// sampled for AccessLog or Tracer. The callback may be called
+	// concurrently from multiple goroutines.
+	// Optional parameter.
+	//
+	// By default slow requests are logged with LogLevelWarning.
+	OnSlowRequest func(entry *AccessLogEntry)
+
+	// Whether to respond with 'NOT_STORED' to set, add and cas commands
+	// with expiration in the past instead of storing already expired items.
+	// Optional parameter.
+	//
+	// By default such items are stored and expire immediately
+	// like the original memcached does.
+	RejectExpiredSets bool
+
+	// Whether to run Server.SelfTest() in Server.Start().
+	// Optional parameter.
+	//
+	// The self-test catches broken cache configurations before serving
+	// clients at the cost of a small startup delay. flush_all isn't
+	// exercised by the self-test. See Server.SelfTest() for details.
+	RunSelfTest bool
+
+	// Maps alternative command names to canonical command names,
+	// e.g. {"gete": "getde"}.
+	// Optional parameter.
+	//
+	// Alternative names must be lowercase if CaseInsensitiveCommands is set.
+	CommandAliases map[string]string
+
+	// Whether to match command names regardless of case.
+	// Optional parameter.
+	//
+	// By default command names are case-sensitive.
+	CaseInsensitiveCommands bool
+
+	// Whether to tolerate extra whitespace in command lines.
+	// Runs of spaces and tabs between tokens are treated as a single
+	// separator, while leading and trailing whitespace is ignored.
+	// Optional parameter.
+	//
+	// By default tokens must be separated by a single space, and command
+	// lines with extra whitespace are responded with errors.
+	LenientTokenizer bool
+
+	// Whether to report an estimated age of the oldest item in the cache
+	// as oldest_item_age in 'stats'.
+	// Optional parameter.
+	//
+	// The estimation is approximate, since ybc doesn't track item creation
+	// times. The server remembers creation times for a sample of items stored
+	// via set, add and cas commands and reports the age of the oldest sampled
+	// item still present in the cache. So the real oldest item may be older.
+	TrackOldestItemAge bool
+
+	// Whether to report storage-level stats obtained via Cache.Stats()
+	// in 'stats' as curr_items, bytes, limit_maxbytes, cache_hits,
+	// cache_misses, storage_wraps and fragmented_bytes
+	// and in Server.Stats().
+	// Optional parameter.
+	//
+	// Cache.Stats() scans the whole cache index, so the stats may be slow
+	// for caches with big number of items.
+	//
+	// Server.Cache must implement ybc.StatsReporter if set.
+	ReportCacheStats bool
+
+	// The maximum number of keys, which may be recomputed simultaneously
+	// by clients after cache misses returned from getde and cgetde commands.
+	// getde and cgetde return 'WB' instead of cache miss to clients
+	// exceeding the limit, so they wait for other recomputations instead
+	// of hitting the origin. The number of keys being recomputed
+	// is reported as getde_in_flight in 'stats'.
+	// Optional parameter.
+	//
+	// The recomputation is considered finished after the item is stored
+	// via set, add or cas command or after the grace duration passed
+	// to getde expires. By default the number of recomputations
+	// isn't limited.
+	MaxConcurrentRecomputes int
+
+	// UDP address of StatsD server for pushing server metrics to.
+	// Counters are pushed as deltas since the previous push, gauges
+	// are pushed as current values.
+	// Optional parameter. Metrics aren't pushed if the address is empty.
+	StatsDAddr string
+
+	// The interval for pushing metrics to StatsDAddr.
+	// Optional parameter. Default is 10 seconds.
+	StatsDInterval time.Duration
+
+	// The prefix for metric names pushed to StatsDAddr, e.g. "ybc.".
+	// Optional parameter.
+	StatsDPrefix string
+
+	// TCP address of Graphite server for pushing server metrics to
+	// via plaintext protocol. Counters are pushed as cumulative values.
+	// Optional parameter. Metrics aren't pushed if the address is empty.
+	GraphiteAddr string
+
+	// The interval for pushing metrics to GraphiteAddr.
+	// Optional parameter. Default is 10 seconds.
+	GraphiteInterval time.Duration
+
+	// The prefix for metric names pushed to GraphiteAddr, e.g. "ybc.".
+	// Optional parameter.
+	GraphitePrefix string
+
+	// The prefix for the expvar variable with server stats.
+	// Server.Stats() is published under ExpvarPrefix + "server" name,
+	// e.g. "memcache.server" for "memcache." prefix, so it is exposed
+	// at /debug/vars.
+	// Optional parameter. Stats aren't published if the prefix is empty.
+	ExpvarPrefix string
+
+	// The duration for keeping tombstones for deleted items.
+	// Optional parameter.
+	//
+	// If set, delete command replaces the item with a tombstone instead of
+	// removing it. Tombstones are returned as cache misses. They let
+	// the server reject stale values for recently deleted keys, see
+	// TombstoneRejectsSets. By default items are removed immediately.
+	DeleteTombstoneWindow time.Duration
+
+	// Whether to respond with 'NOT_STORED' to set, add and cas commands
+	// for keys deleted during the last DeleteTombstoneWindow.
+	// Optional parameter.
+	//
+	// By default such commands overwrite tombstones.
+	TombstoneRejectsSets bool
+
+	// The maximum rate of accepting new connections per second.
+	// Connections exceeding the rate wait in the listen backlog
+	// until they can be accepted.
+	// Optional parameter. The rate isn't limited by default.
+	MaxAcceptRate float64
+
+	// The maximum number of connections, which may be accepted at once
+	// regardless of MaxAcceptRate after an idle period.
+	// Optional parameter. Default is 1.
+	MaxAcceptBurst int
+
+	// The maximum number of concurrent client connections.
+	// New connections exceeding the limit are responded with
+	// 'SERVER_ERROR too many connections' and closed immediately.
+	// Optional parameter. The number of connections isn't limited by default.
+	MaxConns int
+
+	// The maximum number of concurrent client connections per client IP.
+	// New connections exceeding the limit are rejected like connections
+	// exceeding MaxConns.
+	// Optional parameter. The number of connections isn't limited by default.
+	MaxConnsPerIP int
+
+	// The maximum rate of requests per second per client connection.
+	// Requests exceeding the rate are delayed unless
+	// RejectRateLimitedRequests is set.
+	// Optional parameter. The rate isn't limited by default.
+	MaxRequestRate float64
+
+	// The maximum number of requests per client connection, which may be
+	// processed at once regardless of MaxRequestRate after an idle period.
+	// Optional parameter. Default is 1.
+	MaxRequestBurst int
+
+	// The maximum rate of requests per second over all the connections
+	// from the same client IP.
+	// Optional parameter. The rate isn't limited by default.
+	MaxRequestRatePerIP float64
+
+	// The maximum number of requests from the same client IP, which may be
+	// processed at once regardless of MaxRequestRatePerIP.
+	// Optional parameter. Default is 1.
+	MaxRequestBurstPerIP int
+
+	// Whether to reject requests exceeding MaxRequestRate
+	// or MaxRequestRatePerIP with 'SERVER_ERROR rate limit exceeded'
+	// instead of delaying them.
+	// Optional parameter.
+	//
+	// Limited requests are counted in rate_limited_requests stat.
+	RejectRateLimitedRequests bool
+
+	// Networks in CIDR notation, e.g. "10.0.0.0/8", clients from which
+	// may connect to the server. Connections and UDP requests from other
+	// clients are closed and dropped.
+	// Optional parameter. Clients from all the networks are allowed
+	// by default.
+	AllowedNetworks []string
+
+	// Networks in CIDR notation, clients from which may not connect
+	// to the server. DeniedNetworks take precedence over AllowedNetworks.
+	// Optional parameter.
+	DeniedNetworks []string
+
+	// Returns the current fullness of Server.Cache in the range [0..1].
+	// Ybc bindings don't report cache fullness, so it must be provided
+	// by the caller.
+	// Optional parameter. Required for OnHighPressure.
+	CacheFullness func() float64
+
+	// The interval for sampling CacheFullness.
+	// Optional parameter. Default is 1 second.
+	FullnessSampleInterval time.Duration
+
+	// Fullness thresholds in ascending order, which trigger OnHighPressure
+	// when crossed upwards.
+	// Optional parameter. Default is a single threshold at 0.9.
+	HighPressureThresholds []float64
+
+	// Sampled fullness must drop below the crossed threshold by this value
+	// before OnHighPressure may fire again for the threshold.
+	// This prevents flapping around the threshold.
+	// Optional parameter. Default is 0.05.
+	HighPressureHysteresis float64
+
+	// The callback, which is called with the sampled fullness each time
+	// it crosses one of HighPressureThresholds upwards. May be used
+	// for triggering external scaling or load shedding.
+	// Optional parameter. Fullness isn't sampled if the callback isn't set.
+	OnHighPressure func(fraction float64)
+
+	// The maximum key size in bytes. Commands with longer keys are rejected
+	// with 'CLIENT_ERROR bad command line format'.
+	// Optional parameter. Default is 250 like in the original memcached.
+	MaxKeySize int
+
+	// The maximum payload size in bytes for set, add, replace, cas, append
+	// and prepend commands. Larger payloads are skipped and the commands
+	// are responded with 'SERVER_ERROR object too large for cache'.
+	// Optional parameter.
+	//
+	// By default the payload size isn't limited.
+	MaxValueSize int
+
+	// The version string returned by version command.
+	// Clients often use version command for connection health checks,
+	// while some of them parse the version, so it should start
+	// with memcached-compatible version number.
+	// Optional parameter. Default is "1.4.0-ybc".
+	Version string
+
+	// The clock used for converting absolute unix-timestamp expirations
+	// (values exceeding 30 days) into item TTLs.
+	// Optional parameter. Default is time.Now.
+	//
+	// May be overridden when the server host clock is skewed relative
+	// to clients' clocks.
+	//
+	// The clock also times command rate samples and sampled item ages.
+	// See Server.CommandRateWindow and Server.TrackOldestItemAge.
+	Clock func() time.Time
+
+	// The initial verbosity level of the server log.
+	// Level 0 logs errors only. Level 1 additionally logs opened and closed
+	// client connections. Level 2 and higher additionally logs each command
+	// line received from clients.
+	// Optional parameter.
+	//
+	// The level may be changed on a running server via 'verbosity' command
+	// or via Server.SetVerbosity() call.
+	Verbosity int
+
+	// Logger for server messages. Connection events are logged
+	// with LogLevelInfo and command lines with LogLevelDebug according
+	// to the verbosity level.
+	// Optional parameter.
+	//
+	// By default DefaultLogger is used.
+	Logger Logger
+
+	// Whether the server starts in read-only mode. Commands modifying
+	// the cache such as set, delete, incr, touch and flush_all are rejected
+	// with 'SERVER_ERROR read only' in this mode.
+	// Optional parameter.
+	//
+	// The mode may be changed on a running server via Server.SetReadOnly()
+	// call or via the admin HTTP endpoint. See Server.AdminAddr.
+	ReadOnly bool
+
+	// TCP address for the admin HTTP listener.
+	// Optional parameter. The admin listener is disabled if empty.
+	//
+	// The listener serves:
+	//   - /debug/pprof/ with net/http/pprof handlers.
+	//   - /stats with Server.Stats() in JSON.
+	//   - /healthz returning 200 OK until the server is stopping.
+	//   - /verbosity returning the current verbosity level.
+	//     POST /verbosity?level=N changes the level.
+	//   - /readonly returning 1 in read-only mode and 0 otherwise.
+	//     POST /readonly?enabled=1 or ?enabled=0 changes the mode.
+	//
+	// Requests aren't authenticated, so the address must be reachable
+	// by trusted clients only.
+	AdminAddr string
+
 	listenSocket *net.TCPListener
+	adminSocket  net.Listener
+	poller       *connPoller
+	tlsConfig    *tls.Config
+	udpSocket    *net.UDPConn
 	done         sync.WaitGroup
+	stopCh       chan struct{}
+	stopping     int32
+	connsLock    sync.Mutex
+	conns        map[*serverConn]struct{}
 	err          error
+
+	// Protects serving, so Server.ServeConn() doesn't race
+	// with Server.Start() and Server.Stop().
+	servingLock sync.Mutex
+	serving     bool
+
+	checksumMismatchesCount uint64
+	openTxnsCount           int64
+	newItemsCount           uint64
+	updatedItemsCount       uint64
+	clientDisconnectsCount  uint64
+	getHitsCount            uint64
+	getMissesCount          uint64
+	bytesReadCount          uint64
+	bytesWrittenCount       uint64
+	currConnsCount          int64
+	totalConnsCount         uint64
+	rejectedConnsCount      uint64
+	deniedConnsCount        uint64
+	idleKicksCount          uint64
+	rateLimitedCount        uint64
+	droppedMutationsCount   uint64
+	droppedUDPRequestsCount uint64
+	clientErrorsCount       uint64
+	serverErrorsCount       uint64
+	mutationSubs            mutationSubscribers
+	ipRateLimitersLock      sync.Mutex
+	ipRateLimiters          map[string]*ipRateLimiter
+	allowedNetworks         []*net.IPNet
+	deniedNetworks          []*net.IPNet
+	ipConnsLock             sync.Mutex
+	ipConns                 map[string]int
+	readerPool              sync.Pool
+	writerPool              sync.Pool
+	verbosity               int32
+	readOnly                int32
+	versionBytes            []byte
+	startTime               time.Time
+	itemAgeSampler          itemAgeSampler
+	recomputes              recomputesTracker
+	hotKeys                 hotKeysTracker
+	flushAllLock            sync.Mutex
+	flushAllTimer           *time.Timer
+	pressureLevel           int
+	cmdCounters             [cmdsCount]uint64
+	latencies               *[cmdsCount]latencyHistogram
+	cmdRates                [cmdsCount]uint64
 }
 
-func (s *Server) init() {
+func (s *Server) init() error {
 	if s.ReadBufferSize == 0 {
 		s.ReadBufferSize = defaultReadBufferSize
 	}
@@ -727,54 +3453,376 @@ func (s *Server) init() {
 	if s.OSWriteBufferSize == 0 {
 		s.OSWriteBufferSize = defaultOSWriteBufferSize
 	}
+	if s.MaxLoggedLineLength == 0 {
+		s.MaxLoggedLineLength = defaultMaxLoggedLineLength
+	}
+	if s.MaxKeySize == 0 {
+		s.MaxKeySize = defaultMaxKeySize
+	}
+	if s.MaxLineSize == 0 {
+		s.MaxLineSize = defaultMaxLineSize
+	}
+	if s.Version == "" {
+		s.Version = defaultVersion
+	}
+	s.versionBytes = []byte(s.Version)
+	if s.TrackLatencies && s.latencies == nil {
+		s.latencies = &[cmdsCount]latencyHistogram{}
+	}
+	if s.HotKeysSampleRate <= 0 {
+		s.HotKeysSampleRate = defaultHotKeysSampleRate
+	}
+	if s.HotKeysWindow <= 0 {
+		s.HotKeysWindow = defaultHotKeysWindow
+	}
+	if s.AccessLogSampleRate <= 0 {
+		s.AccessLogSampleRate = 1
+	}
+	if s.Clock == nil {
+		s.Clock = time.Now
+	}
+	s.verbosity = int32(s.Verbosity)
+	s.SetReadOnly(s.ReadOnly)
+	if s.FullnessSampleInterval == 0 {
+		s.FullnessSampleInterval = defaultFullnessSampleInterval
+	}
+	if s.HighPressureThresholds == nil {
+		s.HighPressureThresholds = []float64{defaultHighPressureThreshold}
+	}
+	if s.HighPressureHysteresis == 0 {
+		s.HighPressureHysteresis = defaultHighPressureHysteresis
+	}
+	if s.ParkIdleDelay <= 0 {
+		s.ParkIdleDelay = defaultParkIdleDelay
+	}
+	if s.MaxUDPRequests <= 0 {
+		s.MaxUDPRequests = defaultMaxUDPRequests
+	}
+	var err error
+	if s.allowedNetworks, err = parseNetworks(s.AllowedNetworks, "AllowedNetworks"); err != nil {
+		return err
+	}
+	if s.deniedNetworks, err = parseNetworks(s.DeniedNetworks, "DeniedNetworks"); err != nil {
+		return err
+	}
+	if _, ok := s.Cache.(ybc.StatsReporter); s.ReportCacheStats && !ok {
+		return errors.New("memcache.Server: ReportCacheStats requires Server.Cache implementing ybc.StatsReporter")
+	}
+	s.tlsConfig = s.TLSConfig
+	if s.RequireClientCerts {
+		if s.TLSConfig == nil {
+			return errors.New("memcache.Server: RequireClientCerts requires TLSConfig")
+		}
+		// Clone the config, so the caller's config isn't modified.
+		s.tlsConfig = s.TLSConfig.Clone()
+		s.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	// The self-test runs after the defaults are applied, so it checks
+	// the configuration the server serves with. It runs before opening
+	// sockets, so nothing must be closed if it fails.
+	if s.RunSelfTest {
+		if err := s.SelfTest(); err != nil {
+			return err
+		}
+	}
 
 	listenAddr, err := net.ResolveTCPAddr("tcp", s.ListenAddr)
 	if err != nil {
-		log.Fatalf("Cannot resolve listenAddr=[%s]: [%s]", s.ListenAddr, err)
+		return fmt.Errorf("memcache.Server: cannot resolve ListenAddr=[%s]: %w", s.ListenAddr, err)
 	}
-	s.listenSocket, err = net.ListenTCP("tcp", listenAddr)
+	listenSocket, err := net.ListenTCP("tcp", listenAddr)
 	if err != nil {
-		log.Fatalf("Cannot listen for ListenAddr=[%s]: [%s]", listenAddr, err)
+		return fmt.Errorf("memcache.Server: cannot listen for ListenAddr=[%s]: %w", listenAddr, err)
+	}
+	if s.UDPListenAddr != "" {
+		if s.udpSocket, err = listenUDP(s); err != nil {
+			listenSocket.Close()
+			return err
+		}
+	}
+	if s.AdminAddr != "" {
+		if s.adminSocket, err = net.Listen("tcp", s.AdminAddr); err != nil {
+			listenSocket.Close()
+			if s.udpSocket != nil {
+				s.udpSocket.Close()
+				s.udpSocket = nil
+			}
+			return fmt.Errorf("memcache.Server: cannot listen for AdminAddr=[%s]: %w", s.AdminAddr, err)
+		}
+	}
+	if s.ParkIdleConns {
+		if s.poller, err = newConnPoller(); err != nil {
+			listenSocket.Close()
+			if s.udpSocket != nil {
+				s.udpSocket.Close()
+				s.udpSocket = nil
+			}
+			if s.adminSocket != nil {
+				s.adminSocket.Close()
+				s.adminSocket = nil
+			}
+			return fmt.Errorf("memcache.Server: cannot create connection poller: %w", err)
+		}
 	}
+	s.listenSocket = listenSocket
+	if s.ExpvarPrefix != "" {
+		publishExpvar(s.logger(), s.ExpvarPrefix+"server", func() interface{} { return s.Stats() })
+	}
+	s.stopCh = make(chan struct{})
+	s.startTime = time.Now()
 	s.done.Add(1)
+	return nil
+}
+
+func listenUDP(s *Server) (*net.UDPConn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", s.UDPListenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("memcache.Server: cannot resolve UDPListenAddr=[%s]: %w", s.UDPListenAddr, err)
+	}
+	udpSocket, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("memcache.Server: cannot listen for UDPListenAddr=[%s]: %w", udpAddr, err)
+	}
+	if err = udpSocket.SetReadBuffer(s.OSReadBufferSize); err != nil {
+		udpSocket.Close()
+		return nil, fmt.Errorf("memcache.Server: cannot set UDP read buffer size to %d: %w", s.OSReadBufferSize, err)
+	}
+	return udpSocket, nil
+}
+
+// Token bucket limiting the rate of events.
+// See Server.MaxAcceptRate and Server.MaxRequestRate.
+type rateLimiter struct {
+	rate       float64
+	burst      float64
+	tokens     float64
+	lastUpdate time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst <= 0 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:       rate,
+		burst:      float64(burst),
+		tokens:     float64(burst),
+		lastUpdate: time.Now(),
+	}
+}
+
+func (l *rateLimiter) refill() time.Time {
+	now := time.Now()
+	l.tokens += now.Sub(l.lastUpdate).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.lastUpdate = now
+	return now
+}
+
+// Takes a token from the bucket. Sleeps until the token becomes available
+// if the bucket is empty.
+func (l *rateLimiter) wait() {
+	time.Sleep(l.reserve())
+}
+
+// Takes a token from the bucket and returns the delay until the token
+// becomes available.
+func (l *rateLimiter) reserve() time.Duration {
+	now := l.refill()
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+	delay := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	l.tokens = 0
+	l.lastUpdate = now.Add(delay)
+	return delay
+}
+
+// Takes a token from the bucket if it is available.
+func (l *rateLimiter) tryTake() bool {
+	l.refill()
+	if l.tokens >= 1 {
+		l.tokens--
+		return true
+	}
+	return false
 }
 
 func (s *Server) run() {
 	defer s.done.Done()
 
+	// Stop background goroutines after the listener is closed.
+	defer close(s.stopCh)
+	if s.CommandRateWindow > 0 {
+		s.done.Add(1)
+		go s.updateCommandRates()
+	}
+	if s.HotKeysCount > 0 {
+		s.done.Add(1)
+		go s.rotateHotKeys()
+	}
+	if s.StatsDAddr != "" {
+		s.done.Add(1)
+		go s.pushStatsD()
+	}
+	if s.GraphiteAddr != "" {
+		s.done.Add(1)
+		go s.pushGraphite()
+	}
+	if s.OnHighPressure != nil && s.CacheFullness != nil {
+		s.done.Add(1)
+		go s.sampleFullness()
+	}
+	if s.udpSocket != nil {
+		s.done.Add(1)
+		go s.serveUDP()
+	}
+	if s.adminSocket != nil {
+		s.done.Add(1)
+		go s.serveAdmin()
+	}
+	if s.poller != nil {
+		s.done.Add(1)
+		go s.pollParkedConns()
+	}
+
+	var limiter *rateLimiter
+	if s.MaxAcceptRate > 0 {
+		limiter = newRateLimiter(s.MaxAcceptRate, s.MaxAcceptBurst)
+	}
+
 	connsDone := &sync.WaitGroup{}
 	defer connsDone.Wait()
 	for {
+		if limiter != nil {
+			limiter.wait()
+		}
 		conn, err := s.listenSocket.AcceptTCP()
 		if err != nil {
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
-				log.Printf("Accept error: %v; retrying in %v", err, time.Second)
+				s.logf(LogLevelError, "Accept error: %v; retrying in %v", err, time.Second)
 				time.Sleep(time.Second)
 				continue
 			}
 			s.err = err
 			break
 		}
+		ip := connIP(conn)
+		if !isAllowedIP(s, ip) {
+			conn.Close()
+			continue
+		}
+		// The connection slot is reserved before checking Server.MaxConns,
+		// since connections are counted by the accept loop. Otherwise
+		// bursts of accepted connections could exceed the limit.
+		connsCount := atomic.AddInt64(&s.currConnsCount, 1)
+		if s.MaxConns > 0 && connsCount > int64(s.MaxConns) {
+			atomic.AddInt64(&s.currConnsCount, -1)
+			rejectConn(s, conn, "MaxConns", s.MaxConns)
+			continue
+		}
+		if s.MaxConnsPerIP > 0 && !acquireIPConn(s, ip) {
+			atomic.AddInt64(&s.currConnsCount, -1)
+			rejectConn(s, conn, "MaxConnsPerIP", s.MaxConnsPerIP)
+			continue
+		}
 		if err = conn.SetReadBuffer(s.OSReadBufferSize); err != nil {
-			log.Fatalf("Cannot set TCP read buffer size to %d: [%s]", s.OSReadBufferSize, err)
+			s.logf(LogLevelWarning, "Cannot set TCP read buffer size to %d: [%s]", s.OSReadBufferSize, err)
 		}
 		if err = conn.SetWriteBuffer(s.OSWriteBufferSize); err != nil {
-			log.Fatalf("Cannot set TCP write buffer size to %d: [%s]", s.OSWriteBufferSize, err)
+			s.logf(LogLevelWarning, "Cannot set TCP write buffer size to %d: [%s]", s.OSWriteBufferSize, err)
+		}
+		if s.DisableTCPNoDelay {
+			if err = conn.SetNoDelay(false); err != nil {
+				s.logf(LogLevelWarning, "Cannot disable TCP_NODELAY: [%s]", err)
+			}
 		}
 		connsDone.Add(1)
-		go handleConn(conn, s.Cache, s.ReadBufferSize, s.WriteBufferSize, connsDone)
+		if s.tlsConfig != nil {
+			go handleConn(tls.Server(conn, s.tlsConfig), s, connsDone)
+		} else {
+			go handleConn(conn, s, connsDone)
+		}
 	}
 }
 
+// Closes the connection exceeding the limit with the given name,
+// i.e. Server.MaxConns or Server.MaxConnsPerIP.
+func rejectConn(s *Server, conn *net.TCPConn, limitName string, limit int) {
+	atomic.AddUint64(&s.rejectedConnsCount, 1)
+	if atomic.LoadInt32(&s.verbosity) >= verbosityConns {
+		s.logf(LogLevelInfo, "Rejecting connection from %s, since Server.%s=%d is reached", conn.RemoteAddr(), limitName, limit)
+	}
+	if s.tlsConfig == nil {
+		countErrorResponse(s, strTooManyConnsCrLf)
+		conn.Write(strTooManyConnsCrLf)
+	}
+	conn.Close()
+}
+
 // Starts the given server.
 //
+// Returns an error if the server cannot listen for Server.ListenAddr,
+// if server options are invalid or if Server.RunSelfTest is set
+// and the self-test fails. The server isn't started in these cases.
+//
 // No longer needed servers must be stopped via Server.Stop() call.
-func (s *Server) Start() {
+func (s *Server) Start() error {
 	if s.listenSocket != nil {
 		panic("Did you forgot calling Server.Stop() before calling Server.Start()?")
 	}
-	s.init()
+	if err := s.init(); err != nil {
+		return err
+	}
+	s.servingLock.Lock()
+	s.serving = true
+	s.servingLock.Unlock()
 	go s.run()
+	return nil
+}
+
+// Serves requests on the given connection until it is closed.
+//
+// The server must be started via Server.Start() beforehand. The call
+// allows serving connections accepted outside Server.ListenAddr such as
+// in-memory connections returned by net.Pipe(). Limits on accepted
+// connections such as Server.MaxConns and Server.AllowedNetworks aren't
+// applied to the connection.
+//
+// The connection is closed immediately if the server isn't running.
+// The connection is closed when the server is stopped. It may outlive
+// the call if it is parked. See Server.ParkIdleConns.
+func (s *Server) ServeConn(conn net.Conn) {
+	s.servingLock.Lock()
+	if !s.serving {
+		s.servingLock.Unlock()
+		conn.Close()
+		return
+	}
+	// s.done must be incremented under the lock, so Server.Stop()
+	// cannot start waiting on it concurrently.
+	s.done.Add(1)
+	s.servingLock.Unlock()
+
+	atomic.AddInt64(&s.currConnsCount, 1)
+	serveNewConn(&serverConn{
+		conn: conn,
+		done: &s.done,
+		fd:   -1,
+	}, s)
+}
+
+// Changes verbosity level of the running server.
+// See Server.Verbosity for available levels.
+func (s *Server) SetVerbosity(level int) {
+	if level > math.MaxInt32 {
+		level = math.MaxInt32
+	}
+	atomic.StoreInt32(&s.verbosity, int32(level))
 }
 
 // Waits until the server is stopped.
@@ -785,17 +3833,60 @@ func (s *Server) Wait() error {
 
 // Start the server and waits until it is stopped via Server.Stop() call.
 func (s *Server) Serve() error {
-	s.Start()
+	if err := s.Start(); err != nil {
+		return err
+	}
 	return s.Wait()
 }
 
 // Stops the server, which has been started via either Server.Start()
 // or Server.Serve() calls.
 //
+// Idle client connections are closed immediately, while connections
+// with in-flight requests are closed after the requests are processed.
+// See also Server.StopGracefully().
+//
 // Don't forget closing the Server.Cache, since the server doesn't close it
 // automatically.
 func (s *Server) Stop() {
+	s.StopGracefully(0)
+}
+
+// Stops the server like Server.Stop(), but waits for in-flight requests
+// for up to the given timeout. Connections with requests still
+// in progress after the timeout are closed forcibly.
+//
+// The timeout isn't limited if it isn't positive.
+func (s *Server) StopGracefully(timeout time.Duration) {
+	s.servingLock.Lock()
+	s.serving = false
+	s.servingLock.Unlock()
+
+	atomic.StoreInt32(&s.stopping, 1)
 	s.listenSocket.Close()
+	if s.udpSocket != nil {
+		s.udpSocket.Close()
+	}
+	closeIdleConns(s)
+
+	if timeout > 0 {
+		doneCh := make(chan struct{})
+		go func() {
+			s.Wait()
+			close(doneCh)
+		}()
+		select {
+		case <-doneCh:
+		case <-time.After(timeout):
+			s.logf(LogLevelWarning, "Closing connections with in-flight requests after the timeout=%s", timeout)
+			closeAllConns(s)
+		}
+	}
 	s.Wait()
+	stopFlushAll(s)
 	s.listenSocket = nil
+	s.udpSocket = nil
+	s.adminSocket = nil
+	s.poller = nil
+	atomic.StoreInt32(&s.stopping, 0)
 }
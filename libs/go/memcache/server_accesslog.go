@@ -0,0 +1,251 @@
+package memcache
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+// Access log support.
+//
+// See Server.AccessLog.
+
+// The maximum number of response bytes captured for AccessLogEntry.Result.
+const maxCapturedResponseSize = 128
+
+// Access log entry for a request passed to Server.AccessLog.
+type AccessLogEntry struct {
+	// The time when the request processing started.
+	Time time.Time
+
+	// The address of the client.
+	RemoteAddr net.Addr
+
+	// The command name such as 'get' or 'set'. Binary protocol commands
+	// are named after the corresponding text protocol commands.
+	Command string
+
+	// The first key in the request. Empty for commands without keys.
+	Key string
+
+	// The value size for storage commands.
+	Size int
+
+	// The time spent on processing the request and writing the response.
+	Duration time.Duration
+
+	// The first line of the text protocol response such as 'STORED'
+	// or 'END', or the status of the binary protocol response.
+	// Empty if the server didn't respond, e.g. for noreply
+	// and quiet requests.
+	Result string
+
+	// Whether the first requested item is found by retrieval commands
+	// such as 'get' or 'gat'.
+	Hit bool
+}
+
+// Tracer for processed commands.
+//
+// OpenTelemetry spans may be created by the adapter calling
+// tracer.Start(ctx, entry.Command, trace.WithTimestamp(entry.Time))
+// and span.End(trace.WithTimestamp(entry.Time.Add(entry.Duration)))
+// with attributes set from the entry.
+type Tracer interface {
+	// Traces the processed command. ctx is the context returned
+	// by Server.OnConnect for the connection. The entry mustn't
+	// be modified.
+	//
+	// The method may be called concurrently from multiple goroutines.
+	TraceCommand(ctx context.Context, entry *AccessLogEntry)
+}
+
+// Formats the entry as a single access log line.
+func (e *AccessLogEntry) String() string {
+	return fmt.Sprintf("%s %s %s key=%q size=%d duration=%s result=%q",
+		e.Time.Format(time.RFC3339Nano), e.RemoteAddr, e.Command, e.Key, e.Size, e.Duration, e.Result)
+}
+
+// Positions of the key token in text protocol command lines.
+var textCmdKeyTokens = map[string]int{
+	"get":     1,
+	"gets":    1,
+	"getde":   1,
+	"cget":    1,
+	"cgetde":  1,
+	"set":     1,
+	"add":     1,
+	"replace": 1,
+	"append":  1,
+	"prepend": 1,
+	"cas":     1,
+	"delete":  1,
+	"incr":    1,
+	"decr":    1,
+	"touch":   1,
+	"gat":     2,
+	"gats":    2,
+}
+
+// Commands, which set AccessLogEntry.Hit.
+var retrievalCmds = map[string]bool{
+	"get":    true,
+	"gets":   true,
+	"getk":   true,
+	"getde":  true,
+	"cget":   true,
+	"cgetde": true,
+	"gat":    true,
+	"gats":   true,
+}
+
+// Names of binary protocol commands.
+var binaryCmdNames = map[byte]string{
+	opGet:           "get",
+	opGetK:          "getk",
+	opSet:           "set",
+	opAdd:           "add",
+	opReplace:       "replace",
+	opDelete:        "delete",
+	opIncrement:     "incr",
+	opDecrement:     "decr",
+	opQuit:          "quit",
+	opFlush:         "flush_all",
+	opNoop:          "noop",
+	opVersion:       "version",
+	opAppend:        "append",
+	opPrepend:       "prepend",
+	opStat:          "stats",
+	opVerbosity:     "verbosity",
+	opTouch:         "touch",
+	opGat:           "gat",
+	opSaslListMechs: "sasl_list_mechs",
+	opSaslAuth:      "sasl_auth",
+	opSaslStep:      "sasl_step",
+}
+
+// Returns the name of the given binary protocol command.
+func binaryCmdName(cmd byte) string {
+	if name, ok := binaryCmdNames[cmd]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", cmd)
+}
+
+// Returns true if the next request must be passed to Server.AccessLog
+// and Server.Tracer according to Server.AccessLogSampleRate.
+func shouldLogAccess(s *Server) bool {
+	return s.AccessLogSampleRate >= 1 || rand.Float64() < s.AccessLogSampleRate
+}
+
+// Starts the access log entry for the next request on the given connection.
+//
+// The response is captured for requests sampled for Server.AccessLog
+// and Server.Tracer. Pending responses are flushed in this case, so only
+// the response to the request is captured.
+func startAccessLogEntry(c *serverConn, cw *countingWriter, sampled bool) {
+	if sampled {
+		c.Flush()
+		cw.captured = make([]byte, 0, maxCapturedResponseSize)
+	}
+	c.accessLogEntry = &AccessLogEntry{
+		Time:       time.Now(),
+		RemoteAddr: c.conn.RemoteAddr(),
+	}
+}
+
+// Completes the access log entry started via startAccessLogEntry()
+// and passes it to Server.AccessLog, Server.Tracer
+// and Server.OnSlowRequest.
+func finishAccessLogEntry(c *serverConn, s *Server, cw *countingWriter) {
+	sampled := cw.captured != nil
+	if sampled {
+		c.Flush()
+	}
+	e := c.accessLogEntry
+	e.Duration = time.Since(e.Time)
+	c.accessLogEntry = nil
+	if sampled {
+		e.Result = responseResult(cw.captured)
+		if retrievalCmds[e.Command] {
+			e.Hit = strings.HasPrefix(e.Result, "VALUE ") || e.Result == "OK"
+		}
+		cw.captured = nil
+	}
+	if s.SlowRequestThreshold > 0 && e.Duration >= s.SlowRequestThreshold {
+		reportSlowRequest(s, e)
+	}
+	if !sampled {
+		return
+	}
+	if s.AccessLog != nil {
+		s.AccessLog(e)
+	}
+	if s.Tracer != nil {
+		s.Tracer.TraceCommand(c.ctx, e)
+	}
+}
+
+func reportSlowRequest(s *Server, e *AccessLogEntry) {
+	if s.OnSlowRequest != nil {
+		s.OnSlowRequest(e)
+		return
+	}
+	s.logf(LogLevelWarning, "Slow request from %s: command=[%s], key=[%s], size=%d, duration=%s",
+		e.RemoteAddr, e.Command, formatLoggedLine([]byte(e.Key), s.MaxLoggedLineLength), e.Size, e.Duration)
+}
+
+// Fills the access log entry from the text protocol command line.
+func fillTextAccessLogEntry(e *AccessLogEntry, s *Server, line []byte) {
+	cmd, key := textCmdAndKey(line)
+	e.Command = string(cmd)
+	e.Key = string(key)
+	for _, prefix := range storageCmdPrefixes {
+		if bytes.HasPrefix(line, prefix) {
+			_, _, _, size, _, _, _, _ := parseSetCmd(line[len(prefix):], bytes.Equal(prefix, strCas), s.Clock())
+			if size > 0 {
+				e.Size = size
+			}
+			break
+		}
+	}
+}
+
+// Fills the access log entry from the binary protocol request.
+func fillBinaryAccessLogEntry(e *AccessLogEntry, req *binaryRequest) {
+	e.Command = binaryCmdName(req.cmd)
+	e.Key = string(req.key)
+	switch req.cmd {
+	case opSet, opAdd, opReplace, opAppend, opPrepend:
+		e.Size = req.valueSize()
+	}
+}
+
+// Extracts AccessLogEntry.Result from the beginning of the response.
+func responseResult(response []byte) string {
+	if len(response) == 0 {
+		return ""
+	}
+	if response[0] == binaryResponseMagic {
+		if len(response) < binaryHeaderSize {
+			return ""
+		}
+		status := binary.BigEndian.Uint16(response[6:])
+		if status == statusNoError {
+			return "OK"
+		}
+		if msg, ok := binaryStatusMessages[status]; ok {
+			return string(msg)
+		}
+		return fmt.Sprintf("0x%02x", status)
+	}
+	if n := bytes.Index(response, strCrLf); n != -1 {
+		response = response[:n]
+	}
+	return string(response)
+}
@@ -0,0 +1,87 @@
+package memcache
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// Access control for client connections.
+//
+// See Server.AllowedNetworks, Server.DeniedNetworks
+// and Server.MaxConnsPerIP.
+
+// Parses CIDR networks from the Server option with the given name.
+func parseNetworks(cidrs []string, optionName string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("memcache.Server: cannot parse network=[%s] in %s: %w", cidr, optionName, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func networksContain(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if clients with the given ip may connect to the server.
+//
+// Counts denied clients.
+func isAllowedIP(s *Server, ip net.IP) bool {
+	if networksContain(s.deniedNetworks, ip) ||
+		(len(s.allowedNetworks) > 0 && !networksContain(s.allowedNetworks, ip)) {
+		atomic.AddUint64(&s.deniedConnsCount, 1)
+		if atomic.LoadInt32(&s.verbosity) >= verbosityConns {
+			s.logf(LogLevelInfo, "Denying access for %s", ip)
+		}
+		return false
+	}
+	return true
+}
+
+// Returns the client ip for the given connection.
+func connIP(conn net.Conn) net.IP {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+// Registers a connection from the given ip.
+//
+// Returns false if the ip already has Server.MaxConnsPerIP connections.
+func acquireIPConn(s *Server, ip net.IP) bool {
+	key := string(ip.To16())
+	s.ipConnsLock.Lock()
+	defer s.ipConnsLock.Unlock()
+
+	if s.ipConns[key] >= s.MaxConnsPerIP {
+		return false
+	}
+	if s.ipConns == nil {
+		s.ipConns = make(map[string]int)
+	}
+	s.ipConns[key]++
+	return true
+}
+
+// Unregisters the connection registered via acquireIPConn().
+func releaseIPConn(s *Server, ip net.IP) {
+	key := string(ip.To16())
+	s.ipConnsLock.Lock()
+	if s.ipConns[key] <= 1 {
+		delete(s.ipConns, key)
+	} else {
+		s.ipConns[key]--
+	}
+	s.ipConnsLock.Unlock()
+}
@@ -0,0 +1,83 @@
+package memcache
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"sync/atomic"
+)
+
+// Admin HTTP endpoint.
+//
+// See Server.AdminAddr.
+
+// Serves admin HTTP requests on s.adminSocket until s.stopCh is closed.
+func (s *Server) serveAdmin() {
+	defer s.done.Done()
+
+	hs := &http.Server{Handler: newAdminHandler(s)}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- hs.Serve(s.adminSocket)
+	}()
+	select {
+	case <-s.stopCh:
+		hs.Close()
+		<-errCh
+	case err := <-errCh:
+		s.logf(LogLevelError, "Cannot serve admin HTTP requests on AdminAddr=[%s]: [%s]", s.AdminAddr, err)
+	}
+}
+
+func newAdminHandler(s *Server) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(s.Stats()); err != nil {
+			s.logf(LogLevelWarning, "Cannot write admin /stats response to %s: [%s]", r.RemoteAddr, err)
+		}
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&s.stopping) != 0 {
+			http.Error(w, "stopping", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "OK")
+	})
+	mux.HandleFunc("/verbosity", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			level, err := strconv.Atoi(r.FormValue("level"))
+			if err != nil || level < 0 {
+				http.Error(w, "level must be a non-negative integer", http.StatusBadRequest)
+				return
+			}
+			s.SetVerbosity(level)
+			s.logf(LogLevelInfo, "Verbosity level is set to %d via admin HTTP endpoint by %s", level, r.RemoteAddr)
+		}
+		fmt.Fprintln(w, atomic.LoadInt32(&s.verbosity))
+	})
+	mux.HandleFunc("/readonly", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			readOnly, err := strconv.ParseBool(r.FormValue("enabled"))
+			if err != nil {
+				http.Error(w, "enabled must be a boolean", http.StatusBadRequest)
+				return
+			}
+			s.SetReadOnly(readOnly)
+			s.logf(LogLevelInfo, "Read-only mode is set to %t via admin HTTP endpoint by %s", readOnly, r.RemoteAddr)
+		}
+		if s.IsReadOnly() {
+			fmt.Fprintln(w, 1)
+		} else {
+			fmt.Fprintln(w, 0)
+		}
+	})
+	return mux
+}
@@ -0,0 +1,734 @@
+package memcache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github.com/kireevroi/ybc/bindings/go/ybc"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Memcached binary protocol support.
+//
+// Connections starting with binaryRequestMagic byte are served using
+// the binary protocol, while other connections are served using
+// the text protocol.
+//
+// See https://github.com/memcached/memcached/wiki/BinaryProtocolRevamped .
+
+const (
+	binaryRequestMagic  = 0x80
+	binaryResponseMagic = 0x81
+	binaryHeaderSize    = 24
+)
+
+// Binary protocol opcodes.
+const (
+	opGet        = 0x00
+	opSet        = 0x01
+	opAdd        = 0x02
+	opReplace    = 0x03
+	opDelete     = 0x04
+	opIncrement  = 0x05
+	opDecrement  = 0x06
+	opQuit       = 0x07
+	opFlush      = 0x08
+	opGetQ       = 0x09
+	opNoop       = 0x0a
+	opVersion    = 0x0b
+	opGetK       = 0x0c
+	opGetKQ      = 0x0d
+	opAppend     = 0x0e
+	opPrepend    = 0x0f
+	opStat       = 0x10
+	opSetQ       = 0x11
+	opAddQ       = 0x12
+	opReplaceQ   = 0x13
+	opDeleteQ    = 0x14
+	opIncrementQ = 0x15
+	opDecrementQ = 0x16
+	opQuitQ      = 0x17
+	opFlushQ     = 0x18
+	opAppendQ    = 0x19
+	opPrependQ   = 0x1a
+	opVerbosity  = 0x1b
+	opTouch      = 0x1c
+	opGat        = 0x1d
+	opGatQ       = 0x1e
+
+	opSaslListMechs = 0x20
+	opSaslAuth      = 0x21
+	opSaslStep      = 0x22
+)
+
+// Maps quiet opcodes to the corresponding opcodes.
+//
+// Quiet commands respond only on errors, while quiet get commands
+// respond only on cache hits.
+var binaryQuietOpcodes = map[byte]byte{
+	opGetQ:       opGet,
+	opGetKQ:      opGetK,
+	opSetQ:       opSet,
+	opAddQ:       opAdd,
+	opReplaceQ:   opReplace,
+	opDeleteQ:    opDelete,
+	opIncrementQ: opIncrement,
+	opDecrementQ: opDecrement,
+	opQuitQ:      opQuit,
+	opFlushQ:     opFlush,
+	opAppendQ:    opAppend,
+	opPrependQ:   opPrepend,
+	opGatQ:       opGat,
+}
+
+// Binary protocol response statuses.
+const (
+	statusNoError          = 0x00
+	statusKeyNotFound      = 0x01
+	statusKeyExists        = 0x02
+	statusValueTooLarge    = 0x03
+	statusInvalidArgs      = 0x04
+	statusItemNotStored    = 0x05
+	statusNonNumeric       = 0x06
+	statusAuthError        = 0x20
+	statusUnknownCommand   = 0x81
+	statusOutOfMemory      = 0x82
+	statusNotSupported     = 0x83
+	statusBusy             = 0x85
+	statusTemporaryFailure = 0x86
+)
+
+// Messages sent in the body of error responses.
+var binaryStatusMessages = map[uint16][]byte{
+	statusKeyNotFound:      []byte("Not found"),
+	statusKeyExists:        []byte("Data exists for key"),
+	statusValueTooLarge:    []byte("Too large"),
+	statusInvalidArgs:      []byte("Invalid arguments"),
+	statusItemNotStored:    []byte("Not stored"),
+	statusNonNumeric:       []byte("Non-numeric server-side value for incr or decr"),
+	statusAuthError:        []byte("Auth failure"),
+	statusUnknownCommand:   []byte("Unknown command"),
+	statusOutOfMemory:      []byte("Out of memory"),
+	statusNotSupported:     []byte("Not supported"),
+	statusBusy:             []byte("Busy"),
+	statusTemporaryFailure: []byte("Temporary failure"),
+}
+
+// The expiration in incr and decr requests meaning the item mustn't be
+// created if it is missing.
+const binaryNoInitialValue = 0xffffffff
+
+// Binary protocol request.
+type binaryRequest struct {
+	opcode    byte
+	keyLen    int
+	extrasLen int
+	bodyLen   int
+	opaque    uint32
+	cas       uint64
+
+	// The opcode with quiet variants mapped to the corresponding
+	// non-quiet opcodes.
+	cmd   byte
+	quiet bool
+
+	extras []byte
+	key    []byte
+}
+
+// The size of the request value following extras and key.
+func (req *binaryRequest) valueSize() int {
+	return req.bodyLen - req.extrasLen - req.keyLen
+}
+
+// Returns true if the first byte of the connection belongs to a binary
+// protocol request.
+func isBinaryConn(r *bufio.Reader) bool {
+	buf, err := r.Peek(1)
+	return err == nil && buf[0] == binaryRequestMagic
+}
+
+// Reads request header, extras and key from the client connection.
+//
+// The value isn't read, since it may be streamed directly to the cache.
+func readBinaryRequest(c *serverConn, s *Server, req *binaryRequest) bool {
+	// The header is read into c.lineBuf, since local arrays passed
+	// to io.ReadFull escape to heap.
+	h := append(c.lineBuf[:0], make([]byte, binaryHeaderSize)...)
+	c.lineBuf = h
+	if _, err := io.ReadFull(c.Reader, h); err != nil {
+		if err != io.EOF {
+			s.logf(LogLevelWarning, "Cannot read binary request header: [%s]", err)
+		}
+		return false
+	}
+	if h[0] != binaryRequestMagic {
+		s.logf(LogLevelWarning, "Unexpected magic byte=[%d] in binary request. Expected [%d]", h[0], binaryRequestMagic)
+		return false
+	}
+	req.opcode = h[1]
+	req.keyLen = int(binary.BigEndian.Uint16(h[2:]))
+	req.extrasLen = int(h[4])
+	req.bodyLen = int(binary.BigEndian.Uint32(h[8:]))
+	req.opaque = binary.BigEndian.Uint32(h[12:])
+	req.cas = binary.BigEndian.Uint64(h[16:])
+
+	req.cmd = req.opcode
+	req.quiet = false
+	if cmd, ok := binaryQuietOpcodes[req.opcode]; ok {
+		req.cmd = cmd
+		req.quiet = true
+	}
+
+	req.extras = nil
+	req.key = nil
+	if req.bodyLen < req.extrasLen+req.keyLen {
+		// The body is skipped by the caller.
+		s.logf(LogLevelWarning, "Too short body=%d in binary request. Expected at least %d bytes", req.bodyLen, req.extrasLen+req.keyLen)
+		return true
+	}
+	buf := append(h, make([]byte, req.extrasLen+req.keyLen)...)
+	c.lineBuf = buf
+	buf = buf[binaryHeaderSize:]
+	if _, err := io.ReadFull(c.Reader, buf); err != nil {
+		s.logf(LogLevelWarning, "Cannot read extras and key of binary request: [%s]", err)
+		return false
+	}
+	req.extras = buf[:req.extrasLen]
+	req.key = buf[req.extrasLen:]
+	return true
+}
+
+func writeBinaryResponse(w *bufio.Writer, req *binaryRequest, status uint16, cas uint64, extras, key, value []byte) bool {
+	// The header is built in the free space of the write buffer, since
+	// local arrays passed to bufio.Writer.Write escape to heap.
+	// The header is allocated only if the buffer is almost full.
+	h := appendBinaryResponseHeader(w.AvailableBuffer(), req, status, cas, len(extras), len(key), len(value))
+	return writeStr(w, h) && writeStr(w, extras) && writeStr(w, key) && writeStr(w, value)
+}
+
+func appendBinaryResponseHeader(dst []byte, req *binaryRequest, status uint16, cas uint64, extrasLen, keyLen, valueLen int) []byte {
+	dst = append(dst, binaryResponseMagic, req.opcode)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(keyLen))
+	dst = append(dst, byte(extrasLen), 0)
+	dst = binary.BigEndian.AppendUint16(dst, status)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(extrasLen+keyLen+valueLen))
+	dst = binary.BigEndian.AppendUint32(dst, req.opaque)
+	return binary.BigEndian.AppendUint64(dst, cas)
+}
+
+func writeBinaryError(w *bufio.Writer, req *binaryRequest, status uint16) bool {
+	return writeBinaryResponse(w, req, status, 0, nil, nil, binaryStatusMessages[status])
+}
+
+// Writes successful response unless the request is quiet.
+func writeBinarySuccess(w *bufio.Writer, req *binaryRequest, cas uint64) bool {
+	if req.quiet {
+		return true
+	}
+	return writeBinaryResponse(w, req, statusNoError, cas, nil, nil, nil)
+}
+
+// Skips the value of the request and writes error response.
+func discardBinaryValueAndWriteError(c *serverConn, s *Server, req *binaryRequest, status uint16) bool {
+	size := req.bodyLen
+	if req.extras != nil {
+		size = req.valueSize()
+	}
+	if _, err := io.CopyN(ioutil.Discard, c.Reader, int64(size)); err != nil {
+		s.logf(LogLevelWarning, "Error when skipping binary request body with size=[%d]: [%s]", size, err)
+		return false
+	}
+	return writeBinaryError(c.Writer, req, status)
+}
+
+// Returns true if the request has the given extras size, has key
+// only if hasKey is set and has value only if hasValue is set.
+func checkBinaryRequest(s *Server, req *binaryRequest, extrasLen int, hasKey, hasValue bool) bool {
+	if req.extras == nil {
+		return false
+	}
+	if req.extrasLen != extrasLen {
+		s.logf(LogLevelWarning, "Unexpected extras size=%d for binary opcode=[%d]. Expected %d", req.extrasLen, req.opcode, extrasLen)
+		return false
+	}
+	if hasKey != (req.keyLen > 0) || (!hasValue && req.valueSize() > 0) {
+		s.logf(LogLevelWarning, "Unexpected key size=%d and value size=%d for binary opcode=[%d]", req.keyLen, req.valueSize(), req.opcode)
+		return false
+	}
+	return !hasKey || isValidServerKey(s, req.key)
+}
+
+// Reads the item's casid. The item position isn't changed.
+func peekItemCasid(item *ybc.Item) uint64 {
+	return binary.LittleEndian.Uint64(item.Peek())
+}
+
+// Writes get response for the given item.
+//
+// The key is written only if shouldWriteKey is set.
+func writeBinaryGetResponse(c *serverConn, s *Server, req *binaryRequest, item *ybc.Item, shouldWriteKey bool, scratchBuf *[]byte) bool {
+	flags, payload, ok := itemFlagsAndPayload(s, item)
+	if !ok {
+		return writeBinaryError(c.Writer, req, statusTemporaryFailure)
+	}
+	*scratchBuf = binary.BigEndian.AppendUint32((*scratchBuf)[:0], flags)
+	var key []byte
+	if shouldWriteKey {
+		key = req.key
+	}
+	if shouldWriteDirect(c, s, len(payload)) {
+		h := appendBinaryResponseHeader(c.vecHeaders[:0], req, statusNoError, peekItemCasid(item), len(*scratchBuf), len(key), len(payload))
+		h = append(h, *scratchBuf...)
+		c.vecHeaders = append(h, key...)
+		return writeBuffersDirect(c, s, append(c.vecBufs[:0], c.vecHeaders, payload))
+	}
+	return writeBinaryResponse(c.Writer, req, statusNoError, peekItemCasid(item), *scratchBuf, key, payload)
+}
+
+func processBinaryGet(c *serverConn, s *Server, req *binaryRequest, scratchBuf *[]byte) bool {
+	if !checkBinaryRequest(s, req, 0, true, false) {
+		return discardBinaryValueAndWriteError(c, s, req, statusInvalidArgs)
+	}
+	countCmd(c, s, cmdGet)
+	item, ok := getCachedItem(s, req.key)
+	if !ok {
+		return writeBinaryError(c.Writer, req, statusTemporaryFailure)
+	}
+	s.countGetResult(item != nil)
+	if item == nil {
+		if req.quiet {
+			return true
+		}
+		if req.cmd == opGetK {
+			return writeBinaryResponse(c.Writer, req, statusKeyNotFound, 0, nil, req.key, nil)
+		}
+		return writeBinaryError(c.Writer, req, statusKeyNotFound)
+	}
+	ok = writeBinaryGetResponse(c, s, req, item, req.cmd == opGetK, scratchBuf)
+	item.Close()
+	return ok
+}
+
+// Processes set, add and replace requests.
+//
+// Set and replace requests with non-zero cas are processed as cas commands.
+func processBinarySet(c *serverConn, s *Server, req *binaryRequest) bool {
+	if !checkBinaryRequest(s, req, flagsSize+4, true, true) {
+		return discardBinaryValueAndWriteError(c, s, req, statusInvalidArgs)
+	}
+	flags := binary.BigEndian.Uint32(req.extras)
+	expiration := secondsToExpiration(int(binary.BigEndian.Uint32(req.extras[flagsSize:])), s.Clock())
+	key := req.key
+	size := req.valueSize()
+	isCas := req.cas != 0 && req.cmd != opAdd
+	switch {
+	case isCas:
+		countCmd(c, s, cmdCas)
+	case req.cmd == opAdd:
+		countCmd(c, s, cmdAdd)
+	case req.cmd == opReplace:
+		countCmd(c, s, cmdReplace)
+	default:
+		countCmd(c, s, cmdSet)
+	}
+
+	if isTooLargeValue(s, size) {
+		return discardBinaryValueAndWriteError(c, s, req, statusValueTooLarge)
+	}
+	if (expiration <= 0 && s.RejectExpiredSets) ||
+		(s.TombstoneRejectsSets && s.DeleteTombstoneWindow > 0 && tombstoneExists(s, key)) {
+		return discardBinaryValueAndWriteError(c, s, req, statusItemNotStored)
+	}
+
+	trackHotKey(s, key)
+
+	// Check for the existing item before starting the transaction,
+	// since the transaction may overwrite the item.
+	isPlainSet := !isCas && req.cmd == opSet
+	itemExists := isPlainSet && s.TrackSetCreates && cachedItemExists(s, key)
+
+	casid := getCasid()
+	txn := startSetTxnWithCasid(s, key, flags, expiration, size, casid)
+	if txn == nil {
+		return discardBinaryValueAndWriteError(c, s, req, statusOutOfMemory)
+	}
+	if !startPayloadRead(c, s) || !readRawValueToTxn(c.Reader, s, txn, size, s.VerifyChecksums) || !finishPayloadRead(c, s) {
+		rollbackSetTxn(s, txn)
+		return false
+	}
+
+	if !isCas && (req.cmd == opAdd || req.cmd == opReplace) {
+		mustExist := req.cmd == opReplace
+		stored, ok := commitConditionalSetTxn(s, key, txn, mustExist)
+		if !ok {
+			return writeBinaryError(c.Writer, req, statusTemporaryFailure)
+		}
+		if !stored {
+			if mustExist {
+				return writeBinaryError(c.Writer, req, statusKeyNotFound)
+			}
+			return writeBinaryError(c.Writer, req, statusKeyExists)
+		}
+		onItemStored(s, key, size, expiration)
+		return writeBinarySuccess(c.Writer, req, casid)
+	}
+
+	if isCas {
+		stored, cacheMiss, ok := commitCasTxn(s, key, txn, req.cas)
+		if !ok {
+			return writeBinaryError(c.Writer, req, statusTemporaryFailure)
+		}
+		if cacheMiss {
+			return writeBinaryError(c.Writer, req, statusKeyNotFound)
+		}
+		if !stored {
+			return writeBinaryError(c.Writer, req, statusKeyExists)
+		}
+	} else if !commitSetTxn(s, txn) {
+		return writeBinaryError(c.Writer, req, statusTemporaryFailure)
+	}
+	if isPlainSet {
+		trackSetCreate(s, itemExists)
+	}
+	onItemStored(s, key, size, expiration)
+	return writeBinarySuccess(c.Writer, req, casid)
+}
+
+func processBinaryDelete(c *serverConn, s *Server, req *binaryRequest) bool {
+	if !checkBinaryRequest(s, req, 0, true, false) {
+		return discardBinaryValueAndWriteError(c, s, req, statusInvalidArgs)
+	}
+	countCmd(c, s, cmdDelete)
+	deleted, ok := deleteItem(s, req.key)
+	if !ok {
+		return writeBinaryError(c.Writer, req, statusOutOfMemory)
+	}
+	if !deleted {
+		return writeBinaryError(c.Writer, req, statusKeyNotFound)
+	}
+	return writeBinarySuccess(c.Writer, req, 0)
+}
+
+// Processes increment and decrement requests.
+//
+// Missing items are created with the initial value passed in the request
+// unless the request expiration is binaryNoInitialValue.
+func processBinaryIncrDecr(c *serverConn, s *Server, req *binaryRequest, scratchBuf *[]byte) bool {
+	if !checkBinaryRequest(s, req, 20, true, false) {
+		return discardBinaryValueAndWriteError(c, s, req, statusInvalidArgs)
+	}
+	isIncr := req.cmd == opIncrement
+	if isIncr {
+		countCmd(c, s, cmdIncr)
+	} else {
+		countCmd(c, s, cmdDecr)
+	}
+	delta := binary.BigEndian.Uint64(req.extras)
+	initial := binary.BigEndian.Uint64(req.extras[8:])
+	expirationSeconds := binary.BigEndian.Uint32(req.extras[16:])
+	key := req.key
+
+	casid := getCasid()
+	var number uint64
+	for {
+		item, ok := lookupCachedItem(s, key)
+		if !ok {
+			return writeBinaryError(c.Writer, req, statusTemporaryFailure)
+		}
+
+		var flags uint32
+		var ttl time.Duration
+		if item == nil {
+			if expirationSeconds == binaryNoInitialValue {
+				return writeBinaryError(c.Writer, req, statusKeyNotFound)
+			}
+			number = initial
+			ttl = secondsToExpiration(int(expirationSeconds), s.Clock())
+		} else {
+			var isNumber bool
+			flags, number, isNumber = parseItemNumber(s, item)
+			ttl = item.Ttl()
+			if !isNumber {
+				item.Close()
+				return writeBinaryError(c.Writer, req, statusNonNumeric)
+			}
+			number = applyDelta(number, delta, isIncr)
+		}
+		*scratchBuf = strconv.AppendUint((*scratchBuf)[:0], number, 10)
+		var stored bool
+		if item == nil {
+			stored, ok = storeItemValueIfMissing(s, key, flags, ttl, *scratchBuf, casid)
+		} else {
+			stored, ok = storeItemValueIfUnchanged(s, key, item, flags, ttl, *scratchBuf, casid)
+			item.Close()
+		}
+		if !ok {
+			return writeBinaryError(c.Writer, req, statusOutOfMemory)
+		}
+		if stored {
+			break
+		}
+		// The item has been modified or created after it has been read,
+		// so retry with the new value.
+	}
+	if req.quiet {
+		return true
+	}
+	*scratchBuf = binary.BigEndian.AppendUint64((*scratchBuf)[:0], number)
+	return writeBinaryResponse(c.Writer, req, statusNoError, casid, nil, nil, *scratchBuf)
+}
+
+// Processes append and prepend requests.
+//
+// The item retains its flags and ttl. The request is retried if the item
+// has been concurrently modified.
+func processBinaryAppendPrepend(c *serverConn, s *Server, req *binaryRequest, scratchBuf *[]byte) bool {
+	if !checkBinaryRequest(s, req, 0, true, true) {
+		return discardBinaryValueAndWriteError(c, s, req, statusInvalidArgs)
+	}
+	isPrepend := req.cmd == opPrepend
+	if isPrepend {
+		countCmd(c, s, cmdPrepend)
+	} else {
+		countCmd(c, s, cmdAppend)
+	}
+	size := req.valueSize()
+	if isTooLargeValue(s, size) {
+		return discardBinaryValueAndWriteError(c, s, req, statusValueTooLarge)
+	}
+
+	buf := append((*scratchBuf)[:0], make([]byte, size)...)
+	*scratchBuf = buf
+	if !startPayloadRead(c, s) {
+		return false
+	}
+	if _, err := io.ReadFull(c.Reader, buf); err != nil {
+		s.logf(LogLevelWarning, "Error when reading payload with size=[%d]: [%s]", size, err)
+		return false
+	}
+	if !finishPayloadRead(c, s) {
+		return false
+	}
+	key := req.key
+
+	casid := getCasid()
+	for {
+		item, ok := lookupCachedItem(s, key)
+		if !ok {
+			return writeBinaryError(c.Writer, req, statusTemporaryFailure)
+		}
+		if item == nil {
+			return writeBinaryError(c.Writer, req, statusItemNotStored)
+		}
+		if req.cas != 0 && peekItemCasid(item) != req.cas {
+			item.Close()
+			return writeBinaryError(c.Writer, req, statusKeyExists)
+		}
+		flags, payload, ok := itemFlagsAndPayload(s, item)
+		if !ok {
+			item.Close()
+			return writeBinaryError(c.Writer, req, statusTemporaryFailure)
+		}
+		if isTooLargeValue(s, size+len(payload)) {
+			item.Close()
+			return writeBinaryError(c.Writer, req, statusValueTooLarge)
+		}
+		var value []byte
+		buf, value = joinItemPayload(buf, size, payload, isPrepend)
+		*scratchBuf = buf
+
+		stored, ok := storeItemValueIfUnchanged(s, key, item, flags, item.Ttl(), value, casid)
+		item.Close()
+		if !ok {
+			return writeBinaryError(c.Writer, req, statusOutOfMemory)
+		}
+		if stored {
+			break
+		}
+		// The item has been modified after it has been read, so retry
+		// with the new value.
+	}
+	return writeBinarySuccess(c.Writer, req, casid)
+}
+
+// Processes touch, gat and gatq requests.
+func processBinaryTouch(c *serverConn, s *Server, req *binaryRequest, scratchBuf *[]byte) bool {
+	if !checkBinaryRequest(s, req, 4, true, false) {
+		return discardBinaryValueAndWriteError(c, s, req, statusInvalidArgs)
+	}
+	isGat := req.cmd == opGat
+	if isGat {
+		countCmd(c, s, cmdGat)
+	} else {
+		countCmd(c, s, cmdTouch)
+	}
+	expiration := secondsToExpiration(int(binary.BigEndian.Uint32(req.extras)), s.Clock())
+	key := req.key
+
+	item, ok := fetchCachedItem(s, key, isGat)
+	if !ok {
+		return writeBinaryError(c.Writer, req, statusTemporaryFailure)
+	}
+	if isGat {
+		s.countGetResult(item != nil)
+	}
+	if item == nil {
+		if isGat && req.quiet {
+			return true
+		}
+		return writeBinaryError(c.Writer, req, statusKeyNotFound)
+	}
+	ok = touchItem(s, key, item, expiration)
+	if !ok {
+		item.Close()
+		return writeBinaryError(c.Writer, req, statusOutOfMemory)
+	}
+	if isGat {
+		ok = writeBinaryGetResponse(c, s, req, item, false, scratchBuf)
+	} else {
+		ok = writeBinaryResponse(c.Writer, req, statusNoError, peekItemCasid(item), nil, nil, nil)
+	}
+	item.Close()
+	return ok
+}
+
+func processBinaryFlush(c *serverConn, s *Server, req *binaryRequest) bool {
+	extrasLen := 0
+	if req.extrasLen > 0 {
+		extrasLen = 4
+	}
+	if !checkBinaryRequest(s, req, extrasLen, false, false) {
+		return discardBinaryValueAndWriteError(c, s, req, statusInvalidArgs)
+	}
+	countCmd(c, s, cmdFlushAll)
+	var expiration time.Duration
+	if extrasLen > 0 {
+		if t := int(binary.BigEndian.Uint32(req.extras)); t != 0 {
+			expiration = secondsToExpiration(t, s.Clock())
+		}
+	}
+	flushAll(s, expiration)
+	return writeBinarySuccess(c.Writer, req, 0)
+}
+
+func processBinaryVerbosity(c *serverConn, s *Server, req *binaryRequest) bool {
+	if !checkBinaryRequest(s, req, 4, false, false) {
+		return discardBinaryValueAndWriteError(c, s, req, statusInvalidArgs)
+	}
+	s.SetVerbosity(int(binary.BigEndian.Uint32(req.extras)))
+	return writeBinarySuccess(c.Writer, req, 0)
+}
+
+// Writes a response per each stat followed by a response with empty key.
+//
+// Only the default stats group is supported.
+func processBinaryStat(c *serverConn, s *Server, req *binaryRequest, scratchBuf *[]byte) bool {
+	hasKey := req.keyLen > 0
+	if !checkBinaryRequest(s, req, 0, hasKey, false) || (hasKey && !bytes.Equal(req.key, strHotKeys)) {
+		return discardBinaryValueAndWriteError(c, s, req, statusInvalidArgs)
+	}
+	writeStatsFunc := writeStats
+	if hasKey {
+		writeStatsFunc = writeHotKeysStats
+	}
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if !writeStatsFunc(w, s, scratchBuf) || !flushWriter(w, s) {
+		return writeBinaryError(c.Writer, req, statusTemporaryFailure)
+	}
+	for _, line := range bytes.Split(buf.Bytes(), strCrLf) {
+		line = bytes.TrimPrefix(line, strStatWs)
+		n := bytes.IndexByte(line, ' ')
+		if n == -1 {
+			continue
+		}
+		if !writeBinaryResponse(c.Writer, req, statusNoError, 0, nil, line[:n], line[n+1:]) {
+			return false
+		}
+	}
+	return writeBinaryResponse(c.Writer, req, statusNoError, 0, nil, nil, nil)
+}
+
+func flushWriter(w *bufio.Writer, s *Server) bool {
+	if err := w.Flush(); err != nil {
+		s.logf(LogLevelWarning, "Cannot flush the writer: [%s]", err)
+		return false
+	}
+	return true
+}
+
+func processBinaryRequest(c *serverConn, s *Server, scratchBuf *[]byte) bool {
+	var req binaryRequest
+	if !readBinaryRequest(c, s, &req) {
+		return false
+	}
+	if atomic.LoadInt32(&s.verbosity) >= verbosityCommands {
+		s.logf(LogLevelDebug, "Binary command from %s: opcode=[%d], key=[%s]", c.conn.RemoteAddr(), req.opcode, formatLoggedLine(req.key, s.MaxLoggedLineLength))
+	}
+	if c.accessLogEntry != nil {
+		fillBinaryAccessLogEntry(c.accessLogEntry, &req)
+	}
+	if c.rateLimited {
+		return discardBinaryValueAndWriteError(c, s, &req, statusBusy)
+	}
+	if s.Authenticator != nil && !c.authenticated && !isBinarySaslCmd(req.cmd) {
+		return discardBinaryValueAndWriteError(c, s, &req, statusAuthError)
+	}
+	if s.OnCommand != nil && !commandHook(c, s, binaryCmdName(req.cmd), string(req.key)) {
+		return discardBinaryValueAndWriteError(c, s, &req, statusAuthError)
+	}
+	if s.IsReadOnly() && isMutatingBinaryCmd(req.cmd) {
+		return discardBinaryValueAndWriteError(c, s, &req, statusNotSupported)
+	}
+	switch req.cmd {
+	case opGet, opGetK:
+		return processBinaryGet(c, s, &req, scratchBuf)
+	case opSet, opAdd, opReplace:
+		return processBinarySet(c, s, &req)
+	case opDelete:
+		return processBinaryDelete(c, s, &req)
+	case opIncrement, opDecrement:
+		return processBinaryIncrDecr(c, s, &req, scratchBuf)
+	case opAppend, opPrepend:
+		return processBinaryAppendPrepend(c, s, &req, scratchBuf)
+	case opTouch, opGat:
+		return processBinaryTouch(c, s, &req, scratchBuf)
+	case opFlush:
+		return processBinaryFlush(c, s, &req)
+	case opVerbosity:
+		return processBinaryVerbosity(c, s, &req)
+	case opStat:
+		return processBinaryStat(c, s, &req, scratchBuf)
+	case opSaslListMechs, opSaslAuth, opSaslStep:
+		// SASL commands are unknown if authentication is disabled
+		// like in the original memcached.
+		if s.Authenticator == nil {
+			break
+		}
+		if req.cmd == opSaslListMechs {
+			return processBinarySaslListMechs(c, s, &req)
+		}
+		return processBinarySaslAuth(c, s, &req, scratchBuf)
+	case opNoop, opVersion, opQuit:
+		if !checkBinaryRequest(s, &req, 0, false, false) {
+			return discardBinaryValueAndWriteError(c, s, &req, statusInvalidArgs)
+		}
+		switch req.cmd {
+		case opNoop:
+			return writeBinaryResponse(c.Writer, &req, statusNoError, 0, nil, nil, nil)
+		case opVersion:
+			return writeBinaryResponse(c.Writer, &req, statusNoError, 0, nil, nil, s.versionBytes)
+		}
+		if !writeBinarySuccess(c.Writer, &req, 0) {
+			return false
+		}
+		return processQuitCmd(c, s)
+	}
+	s.logf(LogLevelWarning, "Unrecognized binary opcode=[%d]", req.opcode)
+	return discardBinaryValueAndWriteError(c, s, &req, statusUnknownCommand)
+}
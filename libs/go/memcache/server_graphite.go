@@ -0,0 +1,74 @@
+package memcache
+
+import (
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+func appendGraphiteMetric(dst []byte, prefix, name string, value int64, timestamp int64) []byte {
+	dst = append(dst, prefix...)
+	dst = append(dst, name...)
+	dst = append(dst, ' ')
+	dst = strconv.AppendInt(dst, value, 10)
+	dst = append(dst, ' ')
+	dst = strconv.AppendInt(dst, timestamp, 10)
+	return append(dst, '\n')
+}
+
+// Periodically pushes counters and gauges to Server.GraphiteAddr
+// via Graphite plaintext protocol until s.stopCh is closed.
+//
+// Unlike StatsD, Graphite receives cumulative counter values.
+func (s *Server) pushGraphite() {
+	defer s.done.Done()
+
+	interval := s.GraphiteInterval
+	if interval <= 0 {
+		interval = defaultGraphiteInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	names, counters := s.metricsCounters()
+	var buf []byte
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case t := <-ticker.C:
+			timestamp := t.Unix()
+			buf = buf[:0]
+			for i, p := range counters {
+				buf = appendGraphiteMetric(buf, s.GraphitePrefix, names[i], int64(atomic.LoadUint64(p)), timestamp)
+			}
+			gaugeNames, gauges := s.metricsGauges()
+			for i, value := range gauges {
+				buf = appendGraphiteMetric(buf, s.GraphitePrefix, gaugeNames[i], value, timestamp)
+			}
+
+			// Reconnect on the next push if Graphite is unavailable.
+			if conn == nil {
+				var err error
+				if conn, err = net.DialTimeout("tcp", s.GraphiteAddr, interval); err != nil {
+					s.logf(LogLevelError, "Cannot connect to Graphite at [%s]: [%s]", s.GraphiteAddr, err)
+					conn = nil
+					continue
+				}
+			}
+			conn.SetWriteDeadline(t.Add(interval))
+			if _, err := conn.Write(buf); err != nil {
+				s.logf(LogLevelError, "Cannot send metrics to Graphite at [%s]: [%s]", s.GraphiteAddr, err)
+				conn.Close()
+				conn = nil
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package memcache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+)
+
+// Connection lifecycle hooks.
+//
+// See Server.OnConnect, Server.OnDisconnect and Server.OnCommand.
+
+// The error passed to Server.OnDisconnect if the connection is closed
+// because of a malformed request or an I/O error when processing it.
+var ErrConnAborted = errors.New("memcache.Server: the connection is aborted")
+
+// Calls Server.OnConnect for the given connection.
+//
+// Returns the context for Server.OnCommand calls on the connection.
+// Returns false if the connection is rejected.
+func connectHook(s *Server, conn net.Conn) (context.Context, bool) {
+	ctx := context.Background()
+	if s.OnConnect == nil {
+		return ctx, true
+	}
+	ctx, err := s.OnConnect(ctx, conn)
+	if err != nil {
+		if atomic.LoadInt32(&s.verbosity) >= verbosityConns {
+			s.logf(LogLevelInfo, "Connection from %s is rejected by Server.OnConnect: [%s]", conn.RemoteAddr(), err)
+		}
+		return nil, false
+	}
+	return ctx, true
+}
+
+// Returns the command name and the first key from the text protocol
+// command line.
+//
+// The key is nil for commands without keys.
+func textCmdAndKey(line []byte) (cmd, key []byte) {
+	tokens := bytes.Fields(line)
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	cmd = tokens[0]
+	if n, ok := textCmdKeyTokens[string(cmd)]; ok && n < len(tokens) {
+		key = tokens[n]
+	}
+	return cmd, key
+}
+
+// Calls Server.OnCommand for the given command.
+//
+// Returns false if the command is rejected.
+func commandHook(c *serverConn, s *Server, cmd, key string) bool {
+	err := s.OnCommand(c.ctx, cmd, key)
+	if err == nil {
+		return true
+	}
+	if atomic.LoadInt32(&s.verbosity) >= verbosityConns {
+		s.logf(LogLevelInfo, "Command=[%s] from %s is rejected by Server.OnCommand: [%s]", cmd, c.conn.RemoteAddr(), err)
+	}
+	return false
+}
+
+// Calls Server.OnCommand for the given text protocol command line
+// and responds to the rejected command.
+//
+// ok is set to false if the connection must be closed.
+func acceptTextCmd(c *serverConn, s *Server, line []byte) (accepted, ok bool) {
+	cmd, key := textCmdAndKey(line)
+	if commandHook(c, s, string(cmd), string(key)) {
+		return true, true
+	}
+	return false, rejectCmd(c, s, line, strCmdRejectedCrLf)
+}
@@ -0,0 +1,157 @@
+package memcache
+
+import (
+	"bufio"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Hot keys tracking.
+//
+// See Server.HotKeysCount.
+
+const (
+	// Count-min sketch dimensions. Counts for rare keys are overestimated
+	// by up to 2/hotKeysSketchWidth of sampled requests with the probability
+	// at least 1-1/2^hotKeysSketchDepth.
+	hotKeysSketchDepth = 4
+	hotKeysSketchWidth = 1024
+)
+
+// Request rate for a key reported by Server.HotKeys().
+type HotKey struct {
+	Key string
+
+	// Estimated requests per second.
+	Rate float64
+}
+
+// Tracks the most requested keys over tumbling time windows.
+//
+// Sampled keys are counted in a count-min sketch, so memory usage
+// doesn't depend on the number of distinct keys. Up to Server.HotKeysCount
+// keys with the highest estimated counts are remembered as candidates.
+type hotKeysTracker struct {
+	mu         sync.Mutex
+	sketch     [hotKeysSketchDepth][hotKeysSketchWidth]uint32
+	candidates map[string]uint32
+	hotKeys    []HotKey
+}
+
+// Counts a get or set request for the given key if the request is sampled.
+func trackHotKey(s *Server, key []byte) {
+	if s.HotKeysCount <= 0 || rand.Float64() >= s.HotKeysSampleRate {
+		return
+	}
+	s.hotKeys.add(s, key)
+}
+
+func (t *hotKeysTracker) add(s *Server, key []byte) {
+	h := fnv.New64a()
+	h.Write(key)
+	sum := h.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Derive row hashes from two halves of a single hash
+	// as described by Kirsch and Mitzenmacher.
+	count := ^uint32(0)
+	for i := range t.sketch {
+		n := &t.sketch[i][(h1+uint32(i)*h2)%hotKeysSketchWidth]
+		*n++
+		if *n < count {
+			count = *n
+		}
+	}
+
+	if t.candidates == nil {
+		t.candidates = make(map[string]uint32, s.HotKeysCount)
+	}
+	if _, ok := t.candidates[string(key)]; ok {
+		t.candidates[string(key)] = count
+		return
+	}
+	if len(t.candidates) < s.HotKeysCount {
+		t.candidates[string(key)] = count
+		return
+	}
+	minKey, minCount := "", ^uint32(0)
+	for k, n := range t.candidates {
+		if n < minCount {
+			minKey, minCount = k, n
+		}
+	}
+	if count > minCount {
+		delete(t.candidates, minKey)
+		t.candidates[string(key)] = count
+	}
+}
+
+// Publishes hot keys for the completed window and starts a new window.
+func (t *hotKeysTracker) rotate(s *Server, window time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	hotKeys := make([]HotKey, 0, len(t.candidates))
+	for k, n := range t.candidates {
+		hotKeys = append(hotKeys, HotKey{
+			Key:  k,
+			Rate: float64(n) / s.HotKeysSampleRate / window.Seconds(),
+		})
+	}
+	sort.Slice(hotKeys, func(i, j int) bool {
+		if hotKeys[i].Rate != hotKeys[j].Rate {
+			return hotKeys[i].Rate > hotKeys[j].Rate
+		}
+		return hotKeys[i].Key < hotKeys[j].Key
+	})
+	t.hotKeys = hotKeys
+	t.sketch = [hotKeysSketchDepth][hotKeysSketchWidth]uint32{}
+	t.candidates = nil
+}
+
+// Rotates hot keys windows until s.stopCh is closed.
+func (s *Server) rotateHotKeys() {
+	defer s.done.Done()
+
+	ticker := time.NewTicker(s.HotKeysWindow)
+	defer ticker.Stop()
+
+	prevTime := time.Now()
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case t := <-ticker.C:
+			if window := t.Sub(prevTime); window > 0 {
+				s.hotKeys.rotate(s, window)
+			}
+			prevTime = t
+		}
+	}
+}
+
+// Returns up to Server.HotKeysCount keys with the highest request rates
+// over the last completed Server.HotKeysWindow.
+//
+// Keys are sorted by rates in descending order.
+func (s *Server) HotKeys() []HotKey {
+	s.hotKeys.mu.Lock()
+	defer s.hotKeys.mu.Unlock()
+	return append([]HotKey(nil), s.hotKeys.hotKeys...)
+}
+
+// Writes 'STAT hotkey:<key> <rate>' lines for hot keys.
+func writeHotKeysStats(w *bufio.Writer, s *Server, scratchBuf *[]byte) bool {
+	for _, hk := range s.HotKeys() {
+		if !writeFloatStat(w, "hotkey:"+hk.Key, hk.Rate, scratchBuf) {
+			return false
+		}
+	}
+	return true
+}
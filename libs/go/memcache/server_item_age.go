@@ -0,0 +1,109 @@
+package memcache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Only each itemAgeSamplingRate-th stored item is sampled.
+	itemAgeSamplingRate = 100
+
+	// The maximum number of sampled items.
+	maxItemAgeSamples = 1024
+)
+
+type itemAgeSample struct {
+	key       []byte
+	casid     uint64
+	createdAt time.Time
+}
+
+// Estimates the age of the oldest live item in the cache.
+//
+// Ybc bindings cannot report item creation times, so the sampler remembers
+// creation times for a subset of stored items and reports the age
+// of the oldest sampled item, which is still in the cache. This is a lower
+// bound for the age of the oldest item in the cache.
+type itemAgeSampler struct {
+	storedItemsCount uint64
+
+	// The number of samples. Allows skipping the lookup and the lock
+	// in addItem() when the sampler is full.
+	samplesCount int64
+
+	// Serializes oldestItemAge() calls, so samples may be looked up
+	// in the cache without holding mu.
+	pruneMu sync.Mutex
+
+	mu      sync.Mutex
+	samples []itemAgeSample // sorted by createdAt
+}
+
+func (sampler *itemAgeSampler) addItem(s *Server, key []byte) {
+	if atomic.AddUint64(&sampler.storedItemsCount, 1)%itemAgeSamplingRate != 1 {
+		return
+	}
+	// Drop new samples instead of old ones when the sampler is full,
+	// since old samples are more valuable for the estimation.
+	// Samples for deleted items are removed by oldestItemAge().
+	if atomic.LoadInt64(&sampler.samplesCount) >= maxItemAgeSamples {
+		return
+	}
+	casid, cacheMiss, ok := getCasidForCachedItem(s, key)
+	if !ok || cacheMiss {
+		return
+	}
+	createdAt := s.Clock()
+
+	sampler.mu.Lock()
+	if len(sampler.samples) < maxItemAgeSamples {
+		sampler.samples = append(sampler.samples, itemAgeSample{
+			key:       append([]byte(nil), key...),
+			casid:     casid,
+			createdAt: createdAt,
+		})
+		atomic.StoreInt64(&sampler.samplesCount, int64(len(sampler.samples)))
+	}
+	sampler.mu.Unlock()
+}
+
+// Returns the age of the oldest sampled item, which is still in the cache.
+func (sampler *itemAgeSampler) oldestItemAge(s *Server) time.Duration {
+	sampler.pruneMu.Lock()
+	defer sampler.pruneMu.Unlock()
+
+	sampler.mu.Lock()
+	samples := append([]itemAgeSample(nil), sampler.samples...)
+	sampler.mu.Unlock()
+
+	// Remove samples for evicted, expired, deleted and overwritten items.
+	// Cache lookups run without holding mu, so stats requests don't block
+	// set commands. Samples are only appended while the lock is released.
+	n := len(samples)
+	liveSamples := samples[:0]
+	for _, sample := range samples {
+		casid, cacheMiss, ok := getCasidForCachedItem(s, sample.key)
+		if ok && !cacheMiss && casid == sample.casid {
+			liveSamples = append(liveSamples, sample)
+		}
+	}
+
+	sampler.mu.Lock()
+	liveSamples = append(liveSamples, sampler.samples[n:]...)
+	sampler.samples = liveSamples
+	atomic.StoreInt64(&sampler.samplesCount, int64(len(liveSamples)))
+	sampler.mu.Unlock()
+
+	if len(liveSamples) == 0 {
+		return 0
+	}
+	return s.Clock().Sub(liveSamples[0].createdAt)
+}
+
+func (s *Server) sampleItemAge(key []byte) {
+	if s.TrackOldestItemAge {
+		s.itemAgeSampler.addItem(s, key)
+	}
+}
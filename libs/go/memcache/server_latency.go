@@ -0,0 +1,106 @@
+package memcache
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// Per-command latency histograms.
+//
+// See Server.TrackLatencies.
+
+// Histograms have log-linear buckets like HDR histograms: each power
+// of two microseconds is split into latencySubBuckets linear buckets,
+// so the relative error doesn't exceed 1/latencySubBuckets.
+const (
+	latencySubBucketBits = 3
+	latencySubBuckets    = 1 << latencySubBucketBits
+
+	// Covers latencies up to 2^35 microseconds, i.e. more than 9 hours.
+	latencyBucketsCount = 34 * latencySubBuckets
+)
+
+// Latency histogram updated concurrently via atomic operations.
+type latencyHistogram [latencyBucketsCount]uint64
+
+// Returns the histogram bucket index for the given duration.
+func latencyBucket(d time.Duration) int {
+	v := uint64(d / time.Microsecond)
+	if v < latencySubBuckets {
+		return int(v)
+	}
+	shift := bits.Len64(v) - latencySubBucketBits - 1
+	n := (shift+1)*latencySubBuckets + int(v>>uint(shift)) - latencySubBuckets
+	if n >= latencyBucketsCount {
+		n = latencyBucketsCount - 1
+	}
+	return n
+}
+
+// Returns the upper bound for durations in the histogram bucket
+// with the given index.
+func latencyBucketUpperBound(n int) time.Duration {
+	if n < latencySubBuckets {
+		return time.Duration(n+1) * time.Microsecond
+	}
+	shift := uint(n/latencySubBuckets - 1)
+	m := uint64(n%latencySubBuckets + latencySubBuckets)
+	return time.Duration((m+1)<<shift) * time.Microsecond
+}
+
+func (h *latencyHistogram) record(d time.Duration) {
+	atomic.AddUint64(&h[latencyBucket(d)], 1)
+}
+
+// Latency percentiles for a command type reported by Server.Stats().
+//
+// Percentiles are approximated with the relative error up to 12.5%.
+type CmdLatencies struct {
+	// The number of commands in the histogram.
+	Count uint64
+
+	P50 time.Duration
+	P95 time.Duration
+	P99 time.Duration
+}
+
+func (h *latencyHistogram) latencies() CmdLatencies {
+	var counts [latencyBucketsCount]uint64
+	var l CmdLatencies
+	for i := range counts {
+		counts[i] = atomic.LoadUint64(&h[i])
+		l.Count += counts[i]
+	}
+	if l.Count == 0 {
+		return l
+	}
+	l.P50 = percentile(&counts, l.Count, 0.5)
+	l.P95 = percentile(&counts, l.Count, 0.95)
+	l.P99 = percentile(&counts, l.Count, 0.99)
+	return l
+}
+
+func percentile(counts *[latencyBucketsCount]uint64, total uint64, q float64) time.Duration {
+	rank := uint64(q*float64(total) + 0.5)
+	if rank == 0 {
+		rank = 1
+	}
+	var n uint64
+	for i, count := range counts {
+		n += count
+		if n >= rank {
+			return latencyBucketUpperBound(i)
+		}
+	}
+	return latencyBucketUpperBound(latencyBucketsCount - 1)
+}
+
+// Records the processing duration for the last command counted
+// via countCmd() on the given connection.
+func recordLatency(c *serverConn, s *Server, d time.Duration) {
+	if c.cmd < 0 {
+		return
+	}
+	s.latencies[c.cmd].record(d)
+}
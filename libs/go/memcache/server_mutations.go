@@ -0,0 +1,118 @@
+package memcache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Change data capture for cache mutations.
+//
+// See Server.SubscribeMutations.
+
+// Type of cache mutation.
+type MutationType int
+
+const (
+	// The item is stored by set, add, replace, cas, append, prepend,
+	// incr, decr, touch or gat command.
+	MutationSet = MutationType(iota)
+
+	// The item is deleted by delete command.
+	MutationDelete
+
+	// All the items are deleted by flush_all command.
+	MutationFlush
+)
+
+var mutationTypeNames = [...]string{
+	MutationSet:    "set",
+	MutationDelete: "delete",
+	MutationFlush:  "flush",
+}
+
+func (t MutationType) String() string {
+	if t < 0 || int(t) >= len(mutationTypeNames) {
+		return "unknown"
+	}
+	return mutationTypeNames[t]
+}
+
+// Cache mutation passed to channels registered
+// via Server.SubscribeMutations().
+type Mutation struct {
+	Type MutationType
+
+	// The key of the mutated item. Empty for MutationFlush.
+	Key string
+
+	// The value size for MutationSet.
+	Size int
+
+	// The item TTL for MutationSet or the delay before clearing
+	// the cache for MutationFlush.
+	Expiration time.Duration
+
+	// The time of the mutation.
+	Time time.Time
+}
+
+type mutationSubscribers struct {
+	// The number of subscribers for the fast path without subscribers.
+	count int32
+
+	mu  sync.RWMutex
+	chs map[chan<- Mutation]struct{}
+}
+
+// Registers the given channel for receiving cache mutations.
+//
+// Mutations are sent to the channel without blocking, so mutations
+// are dropped if the channel is full. Dropped mutations are counted
+// in 'dropped_mutations' stat. Use buffered channels and read them
+// promptly in order to avoid drops.
+//
+// Mutations for the channel stop after the returned unsubscribe function
+// is called. The channel may be closed after that.
+func (s *Server) SubscribeMutations(ch chan<- Mutation) (unsubscribe func()) {
+	subs := &s.mutationSubs
+	subs.mu.Lock()
+	if subs.chs == nil {
+		subs.chs = make(map[chan<- Mutation]struct{})
+	}
+	subs.chs[ch] = struct{}{}
+	atomic.StoreInt32(&subs.count, int32(len(subs.chs)))
+	subs.mu.Unlock()
+
+	return func() {
+		subs.mu.Lock()
+		delete(subs.chs, ch)
+		atomic.StoreInt32(&subs.count, int32(len(subs.chs)))
+		subs.mu.Unlock()
+	}
+}
+
+// Sends the mutation to all the channels registered
+// via Server.SubscribeMutations().
+func publishMutation(s *Server, t MutationType, key []byte, size int, expiration time.Duration) {
+	subs := &s.mutationSubs
+	if atomic.LoadInt32(&subs.count) == 0 {
+		return
+	}
+	m := Mutation{
+		Type:       t,
+		Key:        string(key),
+		Size:       size,
+		Expiration: expiration,
+		Time:       time.Now(),
+	}
+	subs.mu.RLock()
+	for ch := range subs.chs {
+		select {
+		case ch <- m:
+		default:
+			atomic.AddUint64(&s.droppedMutationsCount, 1)
+		}
+	}
+	subs.mu.RUnlock()
+}
@@ -0,0 +1,86 @@
+package memcache
+
+import (
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Parking of idle connections.
+//
+// See Server.ParkIdleConns.
+
+func (s *Server) parkedConnsCount() int {
+	if s.poller == nil {
+		return 0
+	}
+	return s.poller.len()
+}
+
+// Parks the connection, which stayed idle for Server.ParkIdleDelay
+// after all the pending responses are flushed.
+//
+// The parked connection holds neither a goroutine nor read and write
+// buffers. The connection poller resumes it via resumeConn() when data
+// arrives.
+//
+// Returns false if the connection cannot be parked, so the caller must
+// continue serving it.
+func parkConn(c *serverConn, s *Server) bool {
+	if atomic.LoadInt32(&s.stopping) != 0 {
+		return false
+	}
+	releaseConnBuffers(c, s)
+	if err := s.poller.add(c); err != nil {
+		s.logf(LogLevelWarning, "Cannot park connection from %s: [%s]", c.conn.RemoteAddr(), err)
+		acquireConnBuffers(c, s, c.cr, c.cw)
+		return false
+	}
+
+	// The connection mustn't be accessed after it is added
+	// to the poller, since it may be resumed or closed concurrently.
+	// closeIdleConns() may miss the connection if the server started
+	// stopping before it is parked, so close it here.
+	if atomic.LoadInt32(&s.stopping) != 0 {
+		closeParkedConn(c, s, nil)
+	}
+	return true
+}
+
+// Resumes serving requests on the parked connection with incoming data.
+//
+// The connection must be switched from connParked to connBusy state
+// and removed from the poller by the caller.
+func resumeConn(c *serverConn, s *Server) {
+	acquireConnBuffers(c, s, c.cr, c.cw)
+	serveConn(c, s)
+}
+
+// Closes the parked connection with the given reason passed
+// to Server.OnDisconnect.
+//
+// Returns false if the connection has been already resumed or closed.
+func closeParkedConn(c *serverConn, s *Server, closeErr error) bool {
+	if !atomic.CompareAndSwapInt32(&c.state, connParked, connClosing) {
+		return false
+	}
+	s.poller.remove(c)
+	c.closeErr = closeErr
+	closeConn(c, s)
+	return true
+}
+
+// Closes connections parked for longer than Server.IdleTimeout.
+func closeIdleParkedConns(s *Server) {
+	for _, c := range s.poller.parkedBefore(time.Now().Add(-s.IdleTimeout)) {
+		go func(c *serverConn) {
+			if !closeParkedConn(c, s, os.ErrDeadlineExceeded) {
+				return
+			}
+			atomic.AddUint64(&s.idleKicksCount, 1)
+			if atomic.LoadInt32(&s.verbosity) >= verbosityConns {
+				s.logf(LogLevelInfo, "Closing idle connection from %s after Server.IdleTimeout=%s", c.conn.RemoteAddr(), s.IdleTimeout)
+			}
+		}(c)
+	}
+}
@@ -0,0 +1,167 @@
+//go:build linux
+
+package memcache
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// The maximum duration of a single epoll_wait() call.
+// Bounds the delay of noticing server stop and idle parked connections.
+const pollInterval = 100 * time.Millisecond
+
+// Poller for parked connections based on epoll.
+type connPoller struct {
+	epfd   int
+	lock   sync.Mutex
+	conns  map[int]*serverConn
+	closed bool
+}
+
+func newConnPoller() (*connPoller, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return &connPoller{
+		epfd:  epfd,
+		conns: make(map[int]*serverConn),
+	}, nil
+}
+
+var errPollerClosed = errors.New("memcache.Server: the connection poller is closed")
+
+// Starts watching the connection for incoming data and switches it
+// to connParked state.
+//
+// The state is switched under the poller lock, so closeIdleConns()
+// and the poller never observe a parked connection, which isn't
+// registered in the poller.
+func (p *connPoller) add(c *serverConn) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return errPollerClosed
+	}
+	// EPOLLONESHOT prevents from resuming the connection multiple times.
+	event := syscall.EpollEvent{
+		Events: syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT,
+		Fd:     int32(c.fd),
+	}
+	if err := syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, c.fd, &event); err != nil {
+		return err
+	}
+	p.conns[c.fd] = c
+	atomic.StoreInt32(&c.state, connParked)
+	return nil
+}
+
+// Stops watching the connection. The call is no-op if the connection
+// isn't watched.
+func (p *connPoller) remove(c *serverConn) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.conns[c.fd] != c {
+		return
+	}
+	delete(p.conns, c.fd)
+	if !p.closed {
+		syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_DEL, c.fd, nil)
+	}
+}
+
+func (p *connPoller) get(fd int) *serverConn {
+	p.lock.Lock()
+	c := p.conns[fd]
+	p.lock.Unlock()
+	return c
+}
+
+// Returns the number of parked connections.
+func (p *connPoller) len() int {
+	p.lock.Lock()
+	n := len(p.conns)
+	p.lock.Unlock()
+	return n
+}
+
+// Returns connections parked before the given time.
+func (p *connPoller) parkedBefore(t time.Time) []*serverConn {
+	var conns []*serverConn
+	p.lock.Lock()
+	for _, c := range p.conns {
+		if c.parkTime.Before(t) {
+			conns = append(conns, c)
+		}
+	}
+	p.lock.Unlock()
+	return conns
+}
+
+func (p *connPoller) close() {
+	p.lock.Lock()
+	p.closed = true
+	syscall.Close(p.epfd)
+	p.lock.Unlock()
+}
+
+// Resumes parked connections with incoming data until the server is stopped.
+func (s *Server) pollParkedConns() {
+	defer s.done.Done()
+	p := s.poller
+	defer p.close()
+
+	events := make([]syscall.EpollEvent, 256)
+	lastIdleCheck := time.Now()
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		default:
+		}
+		n, err := syscall.EpollWait(p.epfd, events, int(pollInterval/time.Millisecond))
+		if err != nil && err != syscall.EINTR {
+			s.logf(LogLevelError, "Cannot wait for events on parked connections: [%s]", err)
+			return
+		}
+		for i := 0; i < n; i++ {
+			c := p.get(int(events[i].Fd))
+			// The connection may be closed concurrently.
+			if c == nil || !atomic.CompareAndSwapInt32(&c.state, connParked, connBusy) {
+				continue
+			}
+			p.remove(c)
+			go resumeConn(c, s)
+		}
+		if s.IdleTimeout > 0 && time.Since(lastIdleCheck) >= pollInterval {
+			closeIdleParkedConns(s)
+			lastIdleCheck = time.Now()
+		}
+	}
+}
+
+// Returns the file descriptor of the connection for parking
+// or -1 if the connection cannot be parked.
+//
+// TLS connections aren't parked, since they may buffer decrypted data
+// unseen by the poller.
+func connFd(conn net.Conn) int {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return -1
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return -1
+	}
+	fd := -1
+	rawConn.Control(func(sysFd uintptr) {
+		fd = int(sysFd)
+	})
+	return fd
+}
@@ -0,0 +1,39 @@
+//go:build !linux
+
+package memcache
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// Stub poller for platforms without parking support.
+// See Server.ParkIdleConns.
+type connPoller struct{}
+
+func newConnPoller() (*connPoller, error) {
+	return nil, errors.New("memcache.Server: ParkIdleConns is supported only on Linux")
+}
+
+func (p *connPoller) add(c *serverConn) error {
+	return errors.New("memcache.Server: ParkIdleConns is supported only on Linux")
+}
+
+func (p *connPoller) remove(c *serverConn) {}
+
+func (p *connPoller) len() int {
+	return 0
+}
+
+func (p *connPoller) parkedBefore(t time.Time) []*serverConn {
+	return nil
+}
+
+func (s *Server) pollParkedConns() {
+	s.done.Done()
+}
+
+func connFd(conn net.Conn) int {
+	return -1
+}
@@ -0,0 +1,102 @@
+package memcache
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// Buffer pools reducing allocations under high connection turnover.
+
+const (
+	// The initial capacity of per-connection line and scratch buffers.
+	defaultConnBufSize = 1024
+
+	// Larger buffers aren't returned to pools in order to avoid
+	// holding memory after occasional large requests.
+	maxPooledBufSize = 64 * 1024
+)
+
+var byteBufPool sync.Pool
+
+// Returns an empty byte buffer with at least defaultConnBufSize capacity.
+//
+// The buffer must be returned via releaseByteBuf() when no longer needed.
+func acquireByteBuf() *[]byte {
+	if v := byteBufPool.Get(); v != nil {
+		return v.(*[]byte)
+	}
+	buf := make([]byte, 0, defaultConnBufSize)
+	return &buf
+}
+
+func releaseByteBuf(buf *[]byte) {
+	if cap(*buf) > maxPooledBufSize {
+		return
+	}
+	*buf = (*buf)[:0]
+	byteBufPool.Put(buf)
+}
+
+// Returns a reader with Server.ReadBufferSize buffer reading from rd.
+//
+// The reader must be returned via releaseReader() when no longer needed.
+func acquireReader(s *Server, rd io.Reader) *bufio.Reader {
+	if v := s.readerPool.Get(); v != nil {
+		r := v.(*bufio.Reader)
+		// The buffer size may change between server restarts.
+		if r.Size() == s.ReadBufferSize {
+			r.Reset(rd)
+			return r
+		}
+	}
+	return bufio.NewReaderSize(rd, s.ReadBufferSize)
+}
+
+func releaseReader(s *Server, r *bufio.Reader) {
+	r.Reset(nil)
+	s.readerPool.Put(r)
+}
+
+// Returns a writer with Server.WriteBufferSize buffer writing to wr.
+//
+// The writer must be returned via releaseWriter() when no longer needed.
+func acquireWriter(s *Server, wr io.Writer) *bufio.Writer {
+	if v := s.writerPool.Get(); v != nil {
+		w := v.(*bufio.Writer)
+		if w.Size() == s.WriteBufferSize {
+			w.Reset(wr)
+			return w
+		}
+	}
+	return bufio.NewWriterSize(wr, s.WriteBufferSize)
+}
+
+func releaseWriter(s *Server, w *bufio.Writer) {
+	w.Reset(nil)
+	s.writerPool.Put(w)
+}
+
+// Acquires buffers for serving requests read from r with responses
+// written to w on the connection.
+//
+// Buffers must be returned via releaseConnBuffers() when no longer needed.
+func acquireConnBuffers(c *serverConn, s *Server, r io.Reader, w io.Writer) {
+	c.ReadWriter = bufio.NewReadWriter(acquireReader(s, r), acquireWriter(s, w))
+	c.lineBufPtr = acquireByteBuf()
+	c.lineBuf = *c.lineBufPtr
+	c.scratchBuf = acquireByteBuf()
+}
+
+func releaseConnBuffers(c *serverConn, s *Server) {
+	releaseReader(s, c.Reader)
+	releaseWriter(s, c.Writer)
+	c.ReadWriter = nil
+	// c.lineBuf may be reallocated when reading long lines.
+	*c.lineBufPtr = c.lineBuf
+	releaseByteBuf(c.lineBufPtr)
+	c.lineBuf = nil
+	c.lineBufPtr = nil
+	releaseByteBuf(c.scratchBuf)
+	c.scratchBuf = nil
+}
@@ -0,0 +1,44 @@
+package memcache
+
+import (
+	"time"
+)
+
+func (s *Server) sampleFullness() {
+	defer s.done.Done()
+
+	ticker := time.NewTicker(s.FullnessSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+			s.updatePressure(s.CacheFullness())
+		}
+	}
+}
+
+// Updates the number of crossed HighPressureThresholds for the given fullness
+// and calls OnHighPressure if a new threshold has been crossed.
+//
+// The callback is called once per sample even if the fullness jumped
+// over multiple thresholds at once.
+//
+// Must be called from a single goroutine.
+func (s *Server) updatePressure(fullness float64) {
+	thresholds := s.HighPressureThresholds
+	level := s.pressureLevel
+	for level > 0 && fullness < thresholds[level-1]-s.HighPressureHysteresis {
+		level--
+	}
+	crossed := false
+	for level < len(thresholds) && fullness >= thresholds[level] {
+		level++
+		crossed = true
+	}
+	s.pressureLevel = level
+	if crossed {
+		s.OnHighPressure(fullness)
+	}
+}
@@ -0,0 +1,106 @@
+package memcache
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Request rate limiting.
+//
+// See Server.MaxRequestRate and Server.MaxRequestRatePerIP.
+
+// Rate limiter shared by connections from the same ip.
+type ipRateLimiter struct {
+	lock    sync.Mutex
+	limiter *rateLimiter
+
+	// The number of connections using the limiter.
+	refs int
+}
+
+// Returns the rate limiter for the given ip. The limiter must be released
+// via releaseIPRateLimiter() when no longer needed.
+func acquireIPRateLimiter(s *Server, ip net.IP) *ipRateLimiter {
+	key := string(ip.To16())
+	s.ipRateLimitersLock.Lock()
+	defer s.ipRateLimitersLock.Unlock()
+
+	if s.ipRateLimiters == nil {
+		s.ipRateLimiters = make(map[string]*ipRateLimiter)
+	}
+	l := s.ipRateLimiters[key]
+	if l == nil {
+		l = &ipRateLimiter{
+			limiter: newRateLimiter(s.MaxRequestRatePerIP, s.MaxRequestBurstPerIP),
+		}
+		s.ipRateLimiters[key] = l
+	}
+	l.refs++
+	return l
+}
+
+func releaseIPRateLimiter(s *Server, ip net.IP) {
+	key := string(ip.To16())
+	s.ipRateLimitersLock.Lock()
+	l := s.ipRateLimiters[key]
+	l.refs--
+	if l.refs == 0 {
+		delete(s.ipRateLimiters, key)
+	}
+	s.ipRateLimitersLock.Unlock()
+}
+
+// Applies Server.MaxRequestRate and Server.MaxRequestRatePerIP
+// to the next request on the given connection.
+//
+// Delays the request until it fits the rate limits unless
+// Server.RejectRateLimitedRequests is set. Otherwise returns false
+// if the request exceeds the rate limits.
+func limitRequestRate(c *serverConn, s *Server) bool {
+	if s.RejectRateLimitedRequests {
+		if (c.rateLimiter != nil && !c.rateLimiter.tryTake()) || (c.ipRateLimiter != nil && !c.ipRateLimiter.tryTake()) {
+			atomic.AddUint64(&s.rateLimitedCount, 1)
+			return false
+		}
+		return true
+	}
+
+	var delay time.Duration
+	if c.rateLimiter != nil {
+		delay = c.rateLimiter.reserve()
+	}
+	if c.ipRateLimiter != nil {
+		if d := c.ipRateLimiter.reserve(); d > delay {
+			delay = d
+		}
+	}
+	if delay > 0 {
+		atomic.AddUint64(&s.rateLimitedCount, 1)
+		time.Sleep(delay)
+	}
+	return true
+}
+
+func (l *ipRateLimiter) reserve() time.Duration {
+	l.lock.Lock()
+	delay := l.limiter.reserve()
+	l.lock.Unlock()
+	return delay
+}
+
+func (l *ipRateLimiter) tryTake() bool {
+	l.lock.Lock()
+	ok := l.limiter.tryTake()
+	l.lock.Unlock()
+	return ok
+}
+
+// Responds to the text protocol command exceeding the rate limits.
+func rejectRateLimitedCmd(c *serverConn, s *Server, line []byte) bool {
+	if atomic.LoadInt32(&s.verbosity) >= verbosityConns {
+		s.logf(LogLevelInfo, "Rejecting command=[%s] from %s exceeding the request rate limit", formatLoggedLine(line, s.MaxLoggedLineLength), c.conn.RemoteAddr())
+	}
+	return rejectCmd(c, s, line, strRateLimitedCrLf)
+}
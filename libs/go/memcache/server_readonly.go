@@ -0,0 +1,56 @@
+package memcache
+
+import (
+	"bytes"
+	"sync/atomic"
+)
+
+// Read-only mode.
+//
+// See Server.ReadOnly.
+
+// Prefixes of text protocol commands rejected in read-only mode.
+var mutatingCmdPrefixes = [][]byte{
+	strSet, strAdd, strReplace, strAppend, strPrepend, strCas,
+	strDelete, strIncr, strDecr, strTouch, strGat, strGats, strFlushAll,
+}
+
+// Switches the running server to or from read-only mode.
+// See Server.ReadOnly.
+func (s *Server) SetReadOnly(readOnly bool) {
+	var v int32
+	if readOnly {
+		v = 1
+	}
+	atomic.StoreInt32(&s.readOnly, v)
+}
+
+// Returns true if the server is in read-only mode.
+func (s *Server) IsReadOnly() bool {
+	return atomic.LoadInt32(&s.readOnly) != 0
+}
+
+func isMutatingCmd(line []byte) bool {
+	for _, prefix := range mutatingCmdPrefixes {
+		if bytes.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func isMutatingBinaryCmd(cmd byte) bool {
+	switch cmd {
+	case opSet, opAdd, opReplace, opDelete, opIncrement, opDecrement, opAppend, opPrepend, opTouch, opGat, opFlush:
+		return true
+	}
+	return false
+}
+
+// Responds to the text protocol command rejected in read-only mode.
+func rejectReadOnlyCmd(c *serverConn, s *Server, line []byte) bool {
+	if atomic.LoadInt32(&s.verbosity) >= verbosityCommands {
+		s.logf(LogLevelDebug, "Rejecting command=[%s] from %s in read-only mode", formatLoggedLine(line, s.MaxLoggedLineLength), c.conn.RemoteAddr())
+	}
+	return rejectCmd(c, s, line, strReadOnlyCrLf)
+}
@@ -0,0 +1,118 @@
+package memcache
+
+import (
+	"container/heap"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tracks keys, which are recomputed by clients after cache misses
+// returned from getde and cgetde commands.
+//
+// A recomputation is considered finished when the item for the key is stored
+// or when the grace duration passed to getde expires.
+//
+// Expired recomputations are removed lazily in deadline order, so neither
+// getde nor stats commands scan all the tracked keys.
+type recomputesTracker struct {
+	// The number of keys in deadlines. Allows avoiding the lock
+	// in finish() when there are no recomputations in flight.
+	count int64
+
+	mu        sync.Mutex
+	deadlines map[string]time.Time
+
+	// Deadlines ordered by time. May contain stale entries for finished
+	// or restarted recomputations, which are skipped on removal.
+	queue recomputeDeadlines
+}
+
+type recomputeDeadline struct {
+	key      string
+	deadline time.Time
+}
+
+// heap.Interface implementation ordering deadlines by time.
+type recomputeDeadlines []recomputeDeadline
+
+func (q recomputeDeadlines) Len() int           { return len(q) }
+func (q recomputeDeadlines) Less(i, j int) bool { return q[i].deadline.Before(q[j].deadline) }
+func (q recomputeDeadlines) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+
+func (q *recomputeDeadlines) Push(x interface{}) {
+	*q = append(*q, x.(recomputeDeadline))
+}
+
+func (q *recomputeDeadlines) Pop() interface{} {
+	old := *q
+	n := len(old) - 1
+	d := old[n]
+	old[n] = recomputeDeadline{}
+	*q = old[:n]
+	return d
+}
+
+// Registers recomputation for the given key.
+//
+// Returns false if maxCount recomputations are already in flight.
+// maxCount <= 0 means no limit.
+func (t *recomputesTracker) tryStart(key []byte, graceDuration time.Duration, maxCount int) bool {
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.removeExpired(now)
+	if _, ok := t.deadlines[string(key)]; !ok && maxCount > 0 && len(t.deadlines) >= maxCount {
+		return false
+	}
+	if t.deadlines == nil {
+		t.deadlines = make(map[string]time.Time)
+	}
+	d := recomputeDeadline{
+		key:      string(key),
+		deadline: now.Add(graceDuration),
+	}
+	t.deadlines[d.key] = d.deadline
+	heap.Push(&t.queue, d)
+	atomic.StoreInt64(&t.count, int64(len(t.deadlines)))
+	return true
+}
+
+func (t *recomputesTracker) finish(key []byte) {
+	if atomic.LoadInt64(&t.count) == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	delete(t.deadlines, string(key))
+	if len(t.deadlines) == 0 {
+		// All the queued deadlines are stale now.
+		t.queue = t.queue[:0]
+	}
+	atomic.StoreInt64(&t.count, int64(len(t.deadlines)))
+	t.mu.Unlock()
+}
+
+// Returns the number of recomputations in flight.
+func (t *recomputesTracker) inFlightCount() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.removeExpired(time.Now())
+	return len(t.deadlines)
+}
+
+// Removes recomputations with deadlines before now.
+//
+// Must be called under t.mu.
+func (t *recomputesTracker) removeExpired(now time.Time) {
+	for len(t.queue) > 0 && now.After(t.queue[0].deadline) {
+		d := heap.Pop(&t.queue).(recomputeDeadline)
+		if deadline, ok := t.deadlines[d.key]; ok && deadline.Equal(d.deadline) {
+			delete(t.deadlines, d.key)
+		}
+	}
+	atomic.StoreInt64(&t.count, int64(len(t.deadlines)))
+}
@@ -0,0 +1,125 @@
+package memcache
+
+import (
+	"bytes"
+	"io"
+)
+
+// SASL authentication support.
+//
+// Only PLAIN mechanism is supported. Binary protocol clients authenticate
+// via SASL auth requests. Text protocol clients authenticate like
+// in the original memcached by sending 'set' command with
+// '<username> <password>' payload, while the key, flags and expiration
+// are ignored.
+//
+// See Server.Authenticator.
+
+// The maximum payload size of authentication requests.
+const maxAuthPayloadSize = 1024
+
+// Returns true if the given binary command may be processed
+// before the client is authenticated.
+func isBinarySaslCmd(cmd byte) bool {
+	return cmd == opSaslListMechs || cmd == opSaslAuth || cmd == opSaslStep
+}
+
+// Parses SASL PLAIN message in the form [authzid] \0 authcid \0 passwd.
+func parseSaslPlain(msg []byte) (username, password []byte, ok bool) {
+	n := bytes.IndexByte(msg, 0)
+	if n == -1 {
+		return
+	}
+	msg = msg[n+1:]
+	n = bytes.IndexByte(msg, 0)
+	if n == -1 {
+		return
+	}
+	username = msg[:n]
+	password = msg[n+1:]
+	ok = true
+	return
+}
+
+// Checks the given credentials via Server.Authenticator and marks
+// the connection as authenticated on success.
+func authenticate(c *serverConn, s *Server, username, password []byte) bool {
+	c.authenticated = s.Authenticator(string(username), string(password))
+	if !c.authenticated {
+		s.logf(LogLevelWarning, "Authentication failure for username=[%s] from %s", formatLoggedLine(username, s.MaxLoggedLineLength), c.conn.RemoteAddr())
+	}
+	return c.authenticated
+}
+
+func processBinarySaslListMechs(c *serverConn, s *Server, req *binaryRequest) bool {
+	if !checkBinaryRequest(s, req, 0, false, false) {
+		return discardBinaryValueAndWriteError(c, s, req, statusInvalidArgs)
+	}
+	return writeBinaryResponse(c.Writer, req, statusNoError, 0, nil, nil, strSaslPlain)
+}
+
+// Processes SASL auth and step requests.
+//
+// PLAIN mechanism completes in a single step, so step requests are
+// processed like auth requests.
+func processBinarySaslAuth(c *serverConn, s *Server, req *binaryRequest, scratchBuf *[]byte) bool {
+	if req.extras == nil || req.extrasLen != 0 || req.valueSize() > maxAuthPayloadSize {
+		return discardBinaryValueAndWriteError(c, s, req, statusInvalidArgs)
+	}
+	if !bytes.Equal(req.key, strSaslPlain) {
+		s.logf(LogLevelWarning, "Unsupported SASL mechanism=[%s]", formatLoggedLine(req.key, s.MaxLoggedLineLength))
+		return discardBinaryValueAndWriteError(c, s, req, statusAuthError)
+	}
+
+	msg := append((*scratchBuf)[:0], make([]byte, req.valueSize())...)
+	*scratchBuf = msg
+	if !startPayloadRead(c, s) {
+		return false
+	}
+	if _, err := io.ReadFull(c.Reader, msg); err != nil {
+		s.logf(LogLevelWarning, "Error when reading SASL message with size=[%d]: [%s]", len(msg), err)
+		return false
+	}
+	if !finishPayloadRead(c, s) {
+		return false
+	}
+
+	username, password, ok := parseSaslPlain(msg)
+	if !ok {
+		s.logf(LogLevelWarning, "Cannot find username and password in SASL PLAIN message from %s", c.conn.RemoteAddr())
+	}
+	if !ok || !authenticate(c, s, username, password) {
+		return writeBinaryError(c.Writer, req, statusAuthError)
+	}
+	return writeBinaryResponse(c.Writer, req, statusNoError, 0, nil, nil, strAuthenticated)
+}
+
+// Processes the command line received before the client is authenticated.
+//
+// Only 'set' command with '<username> <password>' payload and 'quit'
+// command are accepted.
+func processUnauthenticatedCmd(c *serverConn, s *Server, line []byte, scratchBuf *[]byte) bool {
+	if bytes.Equal(line, strQuit) {
+		return processQuitCmd(c, s)
+	}
+	if !bytes.HasPrefix(line, strSet) {
+		return writeErrorStr(c.Writer, s, strUnauthenticatedCrLf)
+	}
+	_, _, _, size, _, _, _, ok := parseSetCmd(line[len(strSet):], false, s.Clock())
+	if !ok || size > maxAuthPayloadSize {
+		return discardValueAndWriteClientError(c.ReadWriter, s, line, size)
+	}
+	payload, validChunk, ok := readPayload(c, s, (*scratchBuf)[:0], size)
+	if !ok {
+		return false
+	}
+	*scratchBuf = payload
+	if !validChunk {
+		return writeErrorStr(c.Writer, s, strBadDataChunkCrLf)
+	}
+	n := bytes.IndexByte(payload, ' ')
+	if n == -1 || !authenticate(c, s, payload[:n], payload[n+1:]) {
+		return writeErrorStr(c.Writer, s, strAuthFailureCrLf)
+	}
+	return writeStr(c.Writer, strStoredCrLf)
+}
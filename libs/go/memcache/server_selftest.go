@@ -0,0 +1,121 @@
+package memcache
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrSelfTestFailed = errors.New("memcache.Server: self-test failed")
+
+// The key used by Server.SelfTest().
+//
+// Clients cannot access this key, since keys cannot contain whitespace
+// in memcache protocol.
+var selfTestKey = []byte("ybc memcache server self-test")
+
+const (
+	selfTestFlags      = 0xdeadbeef
+	selfTestExpiration = time.Hour
+)
+
+var selfTestValue = []byte("self-test value\r\nwith CRLF inside")
+
+// Stores, reads and deletes an item in Server.Cache using the same code
+// paths as set, get and delete commands and verifies the results.
+//
+// The item is stored under a key, which cannot be accessed by clients.
+// The item is deleted after the test.
+//
+// flush_all isn't tested. It calls Cacher.Clear(), which removes all
+// the items from Server.Cache including items stored before the server
+// start, and Cacher has no way to clear only the self-test's key.
+// Running flush_all against a scratch cache wouldn't check Server.Cache
+// and would publish a flush to Server.SubscribeMutations() subscribers.
+//
+// Requests issued by the self-test aren't counted in hot keys.
+// See Server.HotKeysCount.
+//
+// Server.Start() runs the self-test if Server.RunSelfTest is set.
+// Call it after Server.Start() otherwise, so defaults for unset
+// options are applied.
+func (s *Server) SelfTest() error {
+	if !selfTestSet(s) {
+		return ErrSelfTestFailed
+	}
+	ok := selfTestGet(s)
+	if !s.Cache.Delete(selfTestKey) {
+		s.logf(LogLevelError, "Self-test: cannot delete the item stored by set")
+		return ErrSelfTestFailed
+	}
+	if !ok {
+		return ErrSelfTestFailed
+	}
+	item, ok := fetchCachedItem(s, selfTestKey, false)
+	if !ok {
+		return ErrSelfTestFailed
+	}
+	if item != nil {
+		item.Close()
+		s.logf(LogLevelError, "Self-test: the item is still in the cache after delete")
+		return ErrSelfTestFailed
+	}
+	return nil
+}
+
+func selfTestSet(s *Server) bool {
+	txn := startSetTxnWithCasid(s, selfTestKey, selfTestFlags, selfTestExpiration, len(selfTestValue), getCasid())
+	if txn == nil {
+		s.logf(LogLevelError, "Self-test: cannot start set transaction")
+		return false
+	}
+	payload := make([]byte, 0, len(selfTestValue)+len(strCrLf))
+	payload = append(append(payload, selfTestValue...), strCrLf...)
+	r := bufio.NewReader(bytes.NewReader(payload))
+	if validChunk, ok := readValueToTxn(r, s, txn, len(selfTestValue), s.VerifyChecksums); !ok || !validChunk {
+		rollbackSetTxn(s, txn)
+		s.logf(LogLevelError, "Self-test: cannot write value to set transaction")
+		return false
+	}
+	if !commitSetTxn(s, txn) {
+		s.logf(LogLevelError, "Self-test: cannot commit set transaction")
+		return false
+	}
+	return true
+}
+
+func selfTestGet(s *Server) bool {
+	item, ok := fetchCachedItem(s, selfTestKey, false)
+	if !ok {
+		return false
+	}
+	if item == nil {
+		s.logf(LogLevelError, "Self-test: cannot find the item stored by set")
+		return false
+	}
+
+	ttl := item.Ttl()
+	if ttl <= 0 || ttl > selfTestExpiration {
+		item.Close()
+		s.logf(LogLevelError, "Self-test: unexpected ttl=[%s]. Expected up to [%s]", ttl, selfTestExpiration)
+		return false
+	}
+
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	scratchBuf := make([]byte, 0, 64)
+	ok = writeGetResponse(w, s, selfTestKey, item, false, s.VerifyChecksums, &scratchBuf)
+	item.Close()
+	if !ok || w.Flush() != nil {
+		s.logf(LogLevelError, "Self-test: cannot write get response")
+		return false
+	}
+	expectedResponse := fmt.Sprintf("VALUE %s %d %d\r\n%s\r\n", selfTestKey, uint32(selfTestFlags), len(selfTestValue), selfTestValue)
+	if buf.String() != expectedResponse {
+		s.logf(LogLevelError, "Self-test: unexpected get response=[%q]. Expected [%q]", buf.String(), expectedResponse)
+		return false
+	}
+	return true
+}
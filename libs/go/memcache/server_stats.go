@@ -0,0 +1,452 @@
+package memcache
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/kireevroi/ybc/bindings/go/ybc"
+)
+
+// Command types tracked by the server.
+const (
+	cmdGet = iota
+	cmdGets
+	cmdGetDe
+	cmdCget
+	cmdCgetDe
+	cmdSet
+	cmdAdd
+	cmdReplace
+	cmdCas
+	cmdAppend
+	cmdPrepend
+	cmdDelete
+	cmdIncr
+	cmdDecr
+	cmdTouch
+	cmdGat
+	cmdGats
+	cmdFlushAll
+	cmdsCount
+)
+
+var cmdNames = [cmdsCount]string{
+	cmdGet:      "get",
+	cmdGets:     "gets",
+	cmdGetDe:    "getde",
+	cmdCget:     "cget",
+	cmdCgetDe:   "cgetde",
+	cmdSet:      "set",
+	cmdAdd:      "add",
+	cmdReplace:  "replace",
+	cmdCas:      "cas",
+	cmdAppend:   "append",
+	cmdPrepend:  "prepend",
+	cmdDelete:   "delete",
+	cmdIncr:     "incr",
+	cmdDecr:     "decr",
+	cmdTouch:    "touch",
+	cmdGat:      "gat",
+	cmdGats:     "gats",
+	cmdFlushAll: "flush_all",
+}
+
+// The number of command rate samples taken during Server.CommandRateWindow.
+const commandRateSamplesPerWindow = 10
+
+func countCmd(c *serverConn, s *Server, cmd int) {
+	atomic.AddUint64(&s.cmdCounters[cmd], 1)
+	c.cmd = cmd
+}
+
+func (s *Server) commandRate(cmd int) float64 {
+	return math.Float64frombits(atomic.LoadUint64(&s.cmdRates[cmd]))
+}
+
+// Periodically samples command counters and updates exponentially weighted
+// moving averages of command rates until s.stopCh is closed.
+func (s *Server) updateCommandRates() {
+	defer s.done.Done()
+
+	ticker := time.NewTicker(s.CommandRateWindow / commandRateSamplesPerWindow)
+	defer ticker.Stop()
+
+	sampler := newCommandRateSampler(s)
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+			sampler.sample(s)
+		}
+	}
+}
+
+// Updates command rates from command counters sampled at Server.Clock times.
+type commandRateSampler struct {
+	alpha        float64
+	prevCounters [cmdsCount]uint64
+	prevTime     time.Time
+}
+
+func newCommandRateSampler(s *Server) *commandRateSampler {
+	interval := s.CommandRateWindow / commandRateSamplesPerWindow
+	r := &commandRateSampler{
+		alpha:    1 - math.Exp(-float64(interval)/float64(s.CommandRateWindow)),
+		prevTime: s.Clock(),
+	}
+	for i := range r.prevCounters {
+		r.prevCounters[i] = atomic.LoadUint64(&s.cmdCounters[i])
+	}
+	return r
+}
+
+func (r *commandRateSampler) sample(s *Server) {
+	now := s.Clock()
+	elapsed := now.Sub(r.prevTime).Seconds()
+	r.prevTime = now
+	if elapsed <= 0 {
+		return
+	}
+	for i := range r.prevCounters {
+		n := atomic.LoadUint64(&s.cmdCounters[i])
+		instantRate := float64(n-r.prevCounters[i]) / elapsed
+		r.prevCounters[i] = n
+		rate := s.commandRate(i)
+		rate += r.alpha * (instantRate - rate)
+		atomic.StoreUint64(&s.cmdRates[i], math.Float64bits(rate))
+	}
+}
+
+func writeStat(w *bufio.Writer, name string, value []byte) bool {
+	return writeStr(w, strStatWs) && writeString(w, name) && writeWs(w) &&
+		writeStr(w, value) && writeCrLf(w)
+}
+
+func (s *Server) countGetResult(found bool) {
+	if found {
+		atomic.AddUint64(&s.getHitsCount, 1)
+	} else {
+		atomic.AddUint64(&s.getMissesCount, 1)
+	}
+}
+
+// Counts bytes read from the underlying reader.
+type countingReader struct {
+	r io.Reader
+	n *uint64
+
+	// The number of bytes read from the underlying reader.
+	// See ConnStats.BytesRead.
+	bytesCount uint64
+
+	// The last error returned from the underlying reader except io.EOF.
+	err error
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	atomic.AddUint64(cr.n, uint64(n))
+	cr.bytesCount += uint64(n)
+	if err != nil && err != io.EOF {
+		cr.err = err
+	}
+	return n, err
+}
+
+// Counts bytes written to the underlying writer.
+type countingWriter struct {
+	w io.Writer
+	n *uint64
+
+	// The number of bytes written to the underlying writer.
+	// See ConnStats.BytesWritten.
+	bytesCount uint64
+
+	// Captures the beginning of written data for the access log if non-nil.
+	// See Server.AccessLog.
+	captured []byte
+
+	// The last error returned from the underlying writer.
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddUint64(cw.n, uint64(n))
+	cw.bytesCount += uint64(n)
+	cw.capture(p[:n])
+	if err != nil {
+		cw.err = err
+	}
+	return n, err
+}
+
+func (cw *countingWriter) capture(p []byte) {
+	if cw.captured != nil && len(cw.captured) < cap(cw.captured) {
+		m := cap(cw.captured) - len(cw.captured)
+		if m > len(p) {
+			m = len(p)
+		}
+		cw.captured = append(cw.captured, p[:m]...)
+	}
+}
+
+// Returns the number of storage commands processed by the server.
+func (s *Server) storageCmdsCount() uint64 {
+	var n uint64
+	for _, cmd := range []int{cmdSet, cmdAdd, cmdReplace, cmdCas, cmdAppend, cmdPrepend} {
+		n += atomic.LoadUint64(&s.cmdCounters[cmd])
+	}
+	return n
+}
+
+// Writes stats with the same meaning as in memcached.
+//
+// evictions stat is written only if Server.Cache reports evictions.
+// See ybc.EvictionsCounter.
+func writeStandardStats(w *bufio.Writer, s *Server, scratchBuf *[]byte) bool {
+	getHits := atomic.LoadUint64(&s.getHitsCount)
+	getMisses := atomic.LoadUint64(&s.getMissesCount)
+	ok := writeIntStat(w, "uptime", int64(time.Since(s.startTime)/time.Second), scratchBuf) &&
+		writeIntStat(w, "curr_connections", atomic.LoadInt64(&s.currConnsCount), scratchBuf) &&
+		writeUint64Stat(w, "total_connections", atomic.LoadUint64(&s.totalConnsCount), scratchBuf) &&
+		writeUint64Stat(w, "cmd_get", getHits+getMisses, scratchBuf) &&
+		writeUint64Stat(w, "cmd_set", s.storageCmdsCount(), scratchBuf) &&
+		writeUint64Stat(w, "get_hits", getHits, scratchBuf) &&
+		writeUint64Stat(w, "get_misses", getMisses, scratchBuf) &&
+		writeUint64Stat(w, "bytes_read", atomic.LoadUint64(&s.bytesReadCount), scratchBuf) &&
+		writeUint64Stat(w, "bytes_written", atomic.LoadUint64(&s.bytesWrittenCount), scratchBuf)
+	if ok {
+		if ec, isCounter := s.Cache.(ybc.EvictionsCounter); isCounter {
+			ok = writeUint64Stat(w, "evictions", ec.Evictions(), scratchBuf)
+		}
+	}
+	return ok
+}
+
+func writeIntStat(w *bufio.Writer, name string, value int64, scratchBuf *[]byte) bool {
+	buf := strconv.AppendInt((*scratchBuf)[:0], value, 10)
+	*scratchBuf = buf
+	return writeStat(w, name, buf)
+}
+
+func writeUint64Stat(w *bufio.Writer, name string, value uint64, scratchBuf *[]byte) bool {
+	buf := strconv.AppendUint((*scratchBuf)[:0], value, 10)
+	*scratchBuf = buf
+	return writeStat(w, name, buf)
+}
+
+func writeFloatStat(w *bufio.Writer, name string, value float64, scratchBuf *[]byte) bool {
+	buf := strconv.AppendFloat((*scratchBuf)[:0], value, 'f', 2, 64)
+	*scratchBuf = buf
+	return writeStat(w, name, buf)
+}
+
+func processStatsCmd(c *bufio.ReadWriter, s *Server, line []byte, scratchBuf *[]byte) bool {
+	if len(line) > 0 && line[0] == ' ' && bytes.Equal(line[1:], strHotKeys) {
+		return writeHotKeysStats(c.Writer, s, scratchBuf) && writeEndCrLf(c.Writer)
+	}
+	if !expectEof(line, 0) {
+		return writeClientError(c.Writer, s, line)
+	}
+	return writeStats(c.Writer, s, scratchBuf) && writeEndCrLf(c.Writer)
+}
+
+// Writes 'STAT name value' lines for all the stats reported by the server.
+func writeStats(w *bufio.Writer, s *Server, scratchBuf *[]byte) bool {
+	if !writeStandardStats(w, s, scratchBuf) {
+		return false
+	}
+	if !writeIntStat(w, "open_txns", atomic.LoadInt64(&s.openTxnsCount), scratchBuf) ||
+		!writeUint64Stat(w, "client_disconnects", atomic.LoadUint64(&s.clientDisconnectsCount), scratchBuf) ||
+		!writeUint64Stat(w, "rejected_connections", atomic.LoadUint64(&s.rejectedConnsCount), scratchBuf) ||
+		!writeUint64Stat(w, "denied_connections", atomic.LoadUint64(&s.deniedConnsCount), scratchBuf) ||
+		!writeUint64Stat(w, "idle_kicks", atomic.LoadUint64(&s.idleKicksCount), scratchBuf) ||
+		!writeUint64Stat(w, "rate_limited_requests", atomic.LoadUint64(&s.rateLimitedCount), scratchBuf) ||
+		!writeUint64Stat(w, "dropped_mutations", atomic.LoadUint64(&s.droppedMutationsCount), scratchBuf) ||
+		!writeUint64Stat(w, "dropped_udp_requests", atomic.LoadUint64(&s.droppedUDPRequestsCount), scratchBuf) ||
+		!writeUint64Stat(w, "client_errors", atomic.LoadUint64(&s.clientErrorsCount), scratchBuf) ||
+		!writeUint64Stat(w, "server_errors", atomic.LoadUint64(&s.serverErrorsCount), scratchBuf) ||
+		!writeIntStat(w, "getde_in_flight", int64(s.recomputes.inFlightCount()), scratchBuf) {
+		return false
+	}
+	if s.ParkIdleConns {
+		if !writeIntStat(w, "parked_connections", int64(s.parkedConnsCount()), scratchBuf) {
+			return false
+		}
+	}
+	if s.TrackSetCreates {
+		if !writeUint64Stat(w, "new_items", atomic.LoadUint64(&s.newItemsCount), scratchBuf) ||
+			!writeUint64Stat(w, "updated_items", atomic.LoadUint64(&s.updatedItemsCount), scratchBuf) {
+			return false
+		}
+	}
+	if s.ReportCacheStats {
+		cs := s.Cache.(ybc.StatsReporter).Stats()
+		if !writeUint64Stat(w, "curr_items", cs.ItemsCount, scratchBuf) ||
+			!writeUint64Stat(w, "bytes", cs.UsedBytes, scratchBuf) ||
+			!writeUint64Stat(w, "limit_maxbytes", cs.DataFileSize, scratchBuf) ||
+			!writeUint64Stat(w, "cache_hits", cs.Hits, scratchBuf) ||
+			!writeUint64Stat(w, "cache_misses", cs.Misses, scratchBuf) ||
+			!writeUint64Stat(w, "storage_wraps", cs.StorageWraps, scratchBuf) ||
+			!writeUint64Stat(w, "fragmented_bytes", cs.FragmentedBytes, scratchBuf) {
+			return false
+		}
+	}
+	if s.TrackOldestItemAge {
+		oldestItemAge := int64(s.itemAgeSampler.oldestItemAge(s) / time.Second)
+		if !writeIntStat(w, "oldest_item_age", oldestItemAge, scratchBuf) {
+			return false
+		}
+	}
+	if s.CommandRateWindow > 0 {
+		for i := 0; i < cmdsCount; i++ {
+			if !writeFloatStat(w, cmdNames[i]+"_rate", s.commandRate(i), scratchBuf) {
+				return false
+			}
+		}
+	}
+	if s.TrackLatencies {
+		for i := 0; i < cmdsCount; i++ {
+			l := s.latencies[i].latencies()
+			if !writeIntStat(w, cmdNames[i]+"_latency_p50_us", int64(l.P50/time.Microsecond), scratchBuf) ||
+				!writeIntStat(w, cmdNames[i]+"_latency_p95_us", int64(l.P95/time.Microsecond), scratchBuf) ||
+				!writeIntStat(w, cmdNames[i]+"_latency_p99_us", int64(l.P99/time.Microsecond), scratchBuf) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Snapshot of server statistics returned by Server.Stats().
+type ServerStats struct {
+	// The duration since the server start.
+	Uptime time.Duration
+
+	// The number of open client connections.
+	CurrConns int64
+
+	// The number of client connections accepted since the server start.
+	TotalConns uint64
+
+	// The number of processed commands keyed by command name
+	// such as 'get' or 'set'.
+	Cmds map[string]uint64
+
+	// The number of keys found and not found by get commands.
+	GetHits   uint64
+	GetMisses uint64
+
+	// The number of bytes read from and written to client connections.
+	BytesRead    uint64
+	BytesWritten uint64
+
+	// The number of set transactions in progress.
+	OpenTxns int64
+
+	// The number of items stored and updated by set commands.
+	// Tracked only if Server.TrackSetCreates is set.
+	NewItems     uint64
+	UpdatedItems uint64
+
+	// The number of items deleted because of checksum mismatch.
+	// See Server.VerifyChecksums.
+	ChecksumMismatches uint64
+
+	// The number of connections closed by clients before responses
+	// were written.
+	ClientDisconnects uint64
+
+	// The number of connections rejected because of Server.MaxConns
+	// and Server.MaxConnsPerIP limits.
+	RejectedConns uint64
+
+	// The number of connections denied by Server.AllowedNetworks
+	// and Server.DeniedNetworks.
+	DeniedConns uint64
+
+	// The number of connections closed after Server.IdleTimeout.
+	IdleKicks uint64
+
+	// The number of requests exceeding request rate limits.
+	RateLimitedRequests uint64
+
+	// The number of mutations dropped because of full subscriber channels.
+	// See Server.SubscribeMutations().
+	DroppedMutations uint64
+
+	// The number of UDP request datagrams dropped because of
+	// Server.MaxUDPRequests limit.
+	DroppedUDPRequests uint64
+
+	// The number of CLIENT_ERROR responses sent to clients.
+	ClientErrors uint64
+
+	// The number of SERVER_ERROR responses sent to clients.
+	ServerErrors uint64
+
+	// The number of idle connections parked without goroutines.
+	// See Server.ParkIdleConns.
+	ParkedConns int
+
+	// Latency percentiles keyed by command name.
+	// Tracked only if Server.TrackLatencies is set.
+	Latencies map[string]CmdLatencies
+
+	// Storage-level stats reported by Cache.Stats().
+	// Set only if Server.ReportCacheStats is set.
+	Cache *ybc.CacheStats
+}
+
+// Returns a snapshot of the server statistics.
+//
+// The method may be called concurrently from multiple goroutines.
+func (s *Server) Stats() *ServerStats {
+	stats := &ServerStats{
+		CurrConns:           atomic.LoadInt64(&s.currConnsCount),
+		TotalConns:          atomic.LoadUint64(&s.totalConnsCount),
+		Cmds:                make(map[string]uint64, cmdsCount),
+		GetHits:             atomic.LoadUint64(&s.getHitsCount),
+		GetMisses:           atomic.LoadUint64(&s.getMissesCount),
+		BytesRead:           atomic.LoadUint64(&s.bytesReadCount),
+		BytesWritten:        atomic.LoadUint64(&s.bytesWrittenCount),
+		OpenTxns:            atomic.LoadInt64(&s.openTxnsCount),
+		NewItems:            atomic.LoadUint64(&s.newItemsCount),
+		UpdatedItems:        atomic.LoadUint64(&s.updatedItemsCount),
+		ChecksumMismatches:  atomic.LoadUint64(&s.checksumMismatchesCount),
+		ClientDisconnects:   atomic.LoadUint64(&s.clientDisconnectsCount),
+		RejectedConns:       atomic.LoadUint64(&s.rejectedConnsCount),
+		DeniedConns:         atomic.LoadUint64(&s.deniedConnsCount),
+		IdleKicks:           atomic.LoadUint64(&s.idleKicksCount),
+		RateLimitedRequests: atomic.LoadUint64(&s.rateLimitedCount),
+		DroppedMutations:    atomic.LoadUint64(&s.droppedMutationsCount),
+		DroppedUDPRequests:  atomic.LoadUint64(&s.droppedUDPRequestsCount),
+		ClientErrors:        atomic.LoadUint64(&s.clientErrorsCount),
+		ServerErrors:        atomic.LoadUint64(&s.serverErrorsCount),
+		ParkedConns:         s.parkedConnsCount(),
+	}
+	if !s.startTime.IsZero() {
+		stats.Uptime = time.Since(s.startTime)
+	}
+	for i := 0; i < cmdsCount; i++ {
+		stats.Cmds[cmdNames[i]] = atomic.LoadUint64(&s.cmdCounters[i])
+	}
+	if sr, ok := s.Cache.(ybc.StatsReporter); s.ReportCacheStats && ok {
+		cs := sr.Stats()
+		stats.Cache = &cs
+	}
+	if s.TrackLatencies {
+		stats.Latencies = make(map[string]CmdLatencies, cmdsCount)
+		for i := 0; i < cmdsCount; i++ {
+			stats.Latencies[cmdNames[i]] = s.latencies[i].latencies()
+		}
+	}
+	return stats
+}
@@ -0,0 +1,87 @@
+package memcache
+
+import (
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Returns counters pushed to StatsD and Graphite and their names.
+func (s *Server) metricsCounters() (names []string, counters []*uint64) {
+	for i := 0; i < cmdsCount; i++ {
+		names = append(names, "cmd_"+cmdNames[i])
+		counters = append(counters, &s.cmdCounters[i])
+	}
+	names = append(names, "checksum_mismatches", "new_items", "updated_items", "client_disconnects")
+	counters = append(counters, &s.checksumMismatchesCount, &s.newItemsCount, &s.updatedItemsCount, &s.clientDisconnectsCount)
+	return
+}
+
+// Returns gauges pushed to StatsD and Graphite and their names.
+func (s *Server) metricsGauges() (names []string, values []int64) {
+	names = []string{"open_txns", "getde_in_flight", "curr_connections"}
+	values = []int64{
+		atomic.LoadInt64(&s.openTxnsCount),
+		int64(s.recomputes.inFlightCount()),
+		atomic.LoadInt64(&s.currConnsCount),
+	}
+	return
+}
+
+func appendStatsDMetric(dst []byte, prefix, name string, value int64, metricType string) []byte {
+	dst = append(dst, prefix...)
+	dst = append(dst, name...)
+	dst = append(dst, ':')
+	dst = strconv.AppendInt(dst, value, 10)
+	dst = append(dst, '|')
+	dst = append(dst, metricType...)
+	return append(dst, '\n')
+}
+
+// Periodically pushes counter deltas and gauges to Server.StatsDAddr
+// until s.stopCh is closed.
+func (s *Server) pushStatsD() {
+	defer s.done.Done()
+
+	conn, err := net.Dial("udp", s.StatsDAddr)
+	if err != nil {
+		s.logf(LogLevelError, "Cannot connect to StatsD at [%s]: [%s]", s.StatsDAddr, err)
+		return
+	}
+	defer conn.Close()
+
+	interval := s.StatsDInterval
+	if interval <= 0 {
+		interval = defaultStatsDInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	names, counters := s.metricsCounters()
+	prevValues := make([]uint64, len(counters))
+	for i, p := range counters {
+		prevValues[i] = atomic.LoadUint64(p)
+	}
+	var buf []byte
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+			buf = buf[:0]
+			for i, p := range counters {
+				n := atomic.LoadUint64(p)
+				buf = appendStatsDMetric(buf, s.StatsDPrefix, names[i], int64(n-prevValues[i]), "c")
+				prevValues[i] = n
+			}
+			gaugeNames, gauges := s.metricsGauges()
+			for i, value := range gauges {
+				buf = appendStatsDMetric(buf, s.StatsDPrefix, gaugeNames[i], value, "g")
+			}
+			if _, err := conn.Write(buf[:len(buf)-1]); err != nil {
+				s.logf(LogLevelError, "Cannot send metrics to StatsD at [%s]: [%s]", s.StatsDAddr, err)
+			}
+		}
+	}
+}
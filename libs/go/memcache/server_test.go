@@ -0,0 +1,3898 @@
+package memcache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"github.com/kireevroi/ybc/bindings/go/ybc"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newClientServerCacheWithConfig(configFunc func(s *Server), t *testing.T) (c *Client, s *Server, cache *ybc.Cache) {
+	c = &Client{
+		ServerAddr: testAddr,
+		ClientConfig: ClientConfig{
+			ConnectionsCount: 1,
+		},
+	}
+	s, cache = newServerCache(t)
+	configFunc(s)
+	s.Start()
+	c.Start()
+	return
+}
+
+// Cacher with slow GetItem().
+type slowCacher struct {
+	ybc.Cacher
+	delay time.Duration
+}
+
+func (c *slowCacher) GetItem(key []byte) (item *ybc.Item, err error) {
+	time.Sleep(c.delay)
+	return c.Cacher.GetItem(key)
+}
+
+type temporaryError struct{}
+
+func (e *temporaryError) Error() string   { return "temporary error" }
+func (e *temporaryError) Temporary() bool { return true }
+
+// Cacher, which fails GetItem() and NewSetTxn() calls with temporary errors
+// failuresCount times in a row before succeeding.
+type flakyCacher struct {
+	ybc.Cacher
+	failuresCount int32
+	failuresLeft  int32
+}
+
+func (c *flakyCacher) shouldFail() bool {
+	if atomic.AddInt32(&c.failuresLeft, -1) >= 0 {
+		return true
+	}
+	atomic.StoreInt32(&c.failuresLeft, c.failuresCount)
+	return false
+}
+
+func (c *flakyCacher) GetItem(key []byte) (item *ybc.Item, err error) {
+	if c.shouldFail() {
+		return nil, &temporaryError{}
+	}
+	return c.Cacher.GetItem(key)
+}
+
+func (c *flakyCacher) NewSetTxn(key []byte, valueSize int, ttl time.Duration) (txn *ybc.SetTxn, err error) {
+	if c.shouldFail() {
+		return nil, &temporaryError{}
+	}
+	return c.Cacher.NewSetTxn(key, valueSize, ttl)
+}
+
+func dialServer(t *testing.T) (conn net.Conn, r *bufio.Reader) {
+	conn, err := net.Dial("tcp", testAddr)
+	if err != nil {
+		t.Fatalf("Cannot connect to test server at %s: [%s]", testAddr, err)
+	}
+	r = bufio.NewReader(conn)
+	return
+}
+
+func sendRequest(conn net.Conn, req string, t *testing.T) {
+	if _, err := conn.Write([]byte(req)); err != nil {
+		t.Fatalf("Cannot send request=[%s] to the server: [%s]", req, err)
+	}
+}
+
+// Reads response lines until the given last line and returns value keys
+// for VALUE lines.
+func readValueKeys(r *bufio.Reader, lastLine string, t *testing.T) (keys []string) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Cannot read response line: [%s]", err)
+		}
+		if line == lastLine {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] != "VALUE" {
+			t.Fatalf("Unexpected response line=[%s]", line)
+		}
+		keys = append(keys, fields[1])
+		size, _ := strconv.Atoi(fields[3])
+		if _, err = r.Discard(size + 2); err != nil {
+			t.Fatalf("Cannot read value for key=[%s]: [%s]", fields[1], err)
+		}
+	}
+}
+
+func readStats(t *testing.T) map[string]string {
+	conn, r := dialServer(t)
+	defer conn.Close()
+	sendRequest(conn, "stats\r\n", t)
+
+	stats := make(map[string]string)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Cannot read response for 'stats' command: [%s]", err)
+		}
+		if line == "END\r\n" {
+			return stats
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != "STAT" {
+			t.Fatalf("Unexpected line in 'stats' response: [%s]", line)
+		}
+		stats[fields[1]] = fields[2]
+	}
+}
+
+func TestServer_VerifyChecksums(t *testing.T) {
+	c, s, cache := newClientServerCacheWithConfig(func(s *Server) { s.VerifyChecksums = true }, t)
+	defer cache.Close()
+	defer s.Stop()
+	defer c.Stop()
+
+	key := []byte("key")
+	value := []byte("value")
+	item := Item{
+		Key:   key,
+		Value: value,
+		Flags: 12345,
+	}
+	if err := c.Set(&item); err != nil {
+		t.Fatalf("error in client.Set(): [%s]", err)
+	}
+	item.Value = nil
+	item.Flags = 0
+	if err := c.Get(&item); err != nil {
+		t.Fatalf("error in client.Get(): [%s]", err)
+	}
+	if !bytes.Equal(item.Value, value) {
+		t.Fatalf("invalid value=[%s] returned. Expected [%s]", item.Value, value)
+	}
+	if item.Flags != 12345 {
+		t.Fatalf("invalid flags=[%d] returned. Expected [%d]", item.Flags, 12345)
+	}
+
+	// Corrupt the payload directly in the cache.
+	buf, err := cache.Get(key)
+	if err != nil {
+		t.Fatalf("error in cache.Get(): [%s]", err)
+	}
+	if len(buf) != casidSize+flagsSize+checksumSize+len(value) {
+		t.Fatalf("unexpected item size=%d", len(buf))
+	}
+	buf[len(buf)-1]++
+	corruptedBuf := buf
+	if err = cache.Set(key, corruptedBuf, ybc.MaxTtl); err != nil {
+		t.Fatalf("error in cache.Set(): [%s]", err)
+	}
+
+	if err = c.Get(&item); err != ErrCacheMiss {
+		t.Fatalf("unexpected error=[%s] returned for corrupted item. Expected ErrCacheMiss", err)
+	}
+	if buf, err = cache.Get(key); err != ybc.ErrCacheMiss && (err != nil || len(buf) > 0) {
+		t.Fatalf("corrupted item must be deleted from the cache. err=[%v], value=[%q]", err, buf)
+	}
+	if n := atomic.LoadUint64(&s.checksumMismatchesCount); n != 1 {
+		t.Fatalf("unexpected checksum mismatches count=%d. Expected 1", n)
+	}
+
+	// Values stored after the corrupted item has been read mustn't be deleted.
+	if err = cache.Set(key, corruptedBuf, ybc.MaxTtl); err != nil {
+		t.Fatalf("error in cache.Set(): [%s]", err)
+	}
+	corruptedItem, err := cache.GetItem(key)
+	if err != nil {
+		t.Fatalf("error in cache.GetItem(): [%s]", err)
+	}
+	defer corruptedItem.Close()
+	item.Value = []byte("fresh")
+	if err = c.Set(&item); err != nil {
+		t.Fatalf("error in client.Set(): [%s]", err)
+	}
+	deleteCorruptedItem(s, key, corruptedItem)
+	item.Value = nil
+	if err = c.Get(&item); err != nil {
+		t.Fatalf("error in client.Get(): [%s]", err)
+	}
+	if string(item.Value) != "fresh" {
+		t.Fatalf("invalid value=[%s] returned. Expected [fresh]", item.Value)
+	}
+}
+
+func TestServer_QuitHalfClose(t *testing.T) {
+	c, s, cache := newClientServerCacheWithConfig(func(s *Server) { s.QuitMode = QuitHalfClose }, t)
+	defer cache.Close()
+	defer s.Stop()
+	defer c.Stop()
+
+	key := []byte("key")
+	value := bytes.Repeat([]byte("x"), 64*1024)
+	item := Item{
+		Key:   key,
+		Value: value,
+	}
+	if err := c.Set(&item); err != nil {
+		t.Fatalf("error in client.Set(): [%s]", err)
+	}
+
+	conn, err := net.Dial("tcp", testAddr)
+	if err != nil {
+		t.Fatalf("Cannot connect to test server at %s: [%s]", testAddr, err)
+	}
+	defer conn.Close()
+
+	getsCount := 20
+	var req bytes.Buffer
+	for i := 0; i < getsCount; i++ {
+		req.WriteString("get key\r\n")
+	}
+	// Requests after 'quit' must be ignored.
+	req.WriteString("quit\r\nget key\r\n")
+	if _, err = conn.Write(req.Bytes()); err != nil {
+		t.Fatalf("Cannot send requests to the server: [%s]", err)
+	}
+
+	r := bufio.NewReader(conn)
+	header := fmt.Sprintf("VALUE key 0 %d\r\n", len(value))
+	expectedResponse := header + string(value) + "\r\nEND\r\n"
+	buf := make([]byte, len(expectedResponse))
+	for i := 0; i < getsCount; i++ {
+		if _, err = io.ReadFull(r, buf); err != nil {
+			t.Fatalf("Cannot read response #%d: [%s]", i, err)
+		}
+		if string(buf) != expectedResponse {
+			t.Fatalf("Unexpected response #%d", i)
+		}
+	}
+	if _, err = r.ReadByte(); err != io.EOF {
+		t.Fatalf("Unexpected error after reading all the responses: [%s]. Expected io.EOF", err)
+	}
+}
+
+// Counts Close() calls on the wrapped connection.
+type closeCountingConn struct {
+	net.Conn
+	closesCount int32
+}
+
+func (c *closeCountingConn) Close() error {
+	atomic.AddInt32(&c.closesCount, 1)
+	return c.Conn.Close()
+}
+
+func TestServer_QuitCloseImmediately(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.QuitMode = QuitCloseImmediately
+	s.Start()
+	defer s.Stop()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	conn := &closeCountingConn{
+		Conn: serverConn,
+	}
+	serveDone := make(chan struct{})
+	go func() {
+		s.ServeConn(conn)
+		close(serveDone)
+	}()
+
+	// The pending response for 'version' must be dropped.
+	sendRequest(clientConn, "version\r\nquit\r\n", t)
+	data, err := io.ReadAll(clientConn)
+	if err != nil {
+		t.Fatalf("Cannot read until the connection is closed: [%s]", err)
+	}
+	if len(data) > 0 {
+		t.Fatalf("Unexpected response=[%s] after 'quit'. Expected no response", data)
+	}
+	<-serveDone
+	if n := atomic.LoadInt32(&conn.closesCount); n != 1 {
+		t.Fatalf("Unexpected number of Close() calls on the connection: %d. Expected 1", n)
+	}
+}
+
+func TestServer_CommandRates(t *testing.T) {
+	// The fake clock is advanced by the test, while the long window
+	// prevents background sampling.
+	nowNanos := time.Now().UnixNano()
+	clock := func() time.Time { return time.Unix(0, atomic.LoadInt64(&nowNanos)) }
+	c, s, cache := newClientServerCacheWithConfig(func(s *Server) {
+		s.CommandRateWindow = time.Hour
+		s.Clock = clock
+	}, t)
+	defer cache.Close()
+	defer s.Stop()
+	defer c.Stop()
+
+	item := Item{
+		Key: []byte("key"),
+	}
+	sampler := newCommandRateSampler(s)
+	for i := 0; i < 100; i++ {
+		for j := 0; j < 10; j++ {
+			if err := c.Get(&item); err != ErrCacheMiss {
+				t.Fatalf("Unexpected error returned from client.Get(): [%s]. Expected ErrCacheMiss", err)
+			}
+		}
+		atomic.AddInt64(&nowNanos, int64(100*time.Millisecond))
+		sampler.sample(s)
+	}
+	expectedRate := 100.0
+
+	stats := readStats(t)
+	rate, err := strconv.ParseFloat(stats["gets_rate"], 64)
+	if err != nil {
+		t.Fatalf("Cannot parse gets_rate=[%s]: [%s]", stats["gets_rate"], err)
+	}
+	if rate < expectedRate*0.99 || rate > expectedRate*1.01 {
+		t.Fatalf("Unexpected gets_rate=%f. Expected %f", rate, expectedRate)
+	}
+	if stats["set_rate"] != "0.00" {
+		t.Fatalf("Unexpected set_rate=[%s]. Expected [0.00]", stats["set_rate"])
+	}
+}
+
+func checkMultigetKeys(dedupe bool, expectedKeys string, t *testing.T) {
+	c, s, cache := newClientServerCacheWithConfig(func(s *Server) { s.DedupeMultigetKeys = dedupe }, t)
+	defer cache.Close()
+	defer s.Stop()
+	defer c.Stop()
+
+	for _, key := range []string{"a", "b", "c"} {
+		item := Item{
+			Key:   []byte(key),
+			Value: []byte("value"),
+		}
+		if err := c.Set(&item); err != nil {
+			t.Fatalf("error in client.Set(): [%s]", err)
+		}
+	}
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	for _, cmd := range []string{"get", "gets"} {
+		sendRequest(conn, cmd+" a b a a c b\r\n", t)
+		keys := strings.Join(readValueKeys(r, "END\r\n", t), " ")
+		if keys != expectedKeys {
+			t.Fatalf("Unexpected keys returned for %s: [%s]. Expected [%s]", cmd, keys, expectedKeys)
+		}
+	}
+}
+
+func TestServer_DedupeMultigetKeys(t *testing.T) {
+	checkMultigetKeys(false, "a b a a c b", t)
+	checkMultigetKeys(true, "a b c", t)
+}
+
+func TestServer_DedupeManyMultigetKeys(t *testing.T) {
+	s := &Server{
+		DedupeMultigetKeys: true,
+	}
+	var c serverConn
+	var line, expectedKeys []string
+	for i := 0; i < 3*maxLinearDedupeKeys; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		line = append(line, key, key, fmt.Sprintf("key_%d", i/2))
+		expectedKeys = append(expectedKeys, key)
+	}
+
+	// The connection must be reusable for subsequent requests.
+	for i := 0; i < 2; i++ {
+		parseGetKeys(&c, s, []byte(strings.Join(line, " ")))
+		var keys []string
+		for _, key := range c.keys {
+			keys = append(keys, string(key))
+		}
+		if strings.Join(keys, " ") != strings.Join(expectedKeys, " ") {
+			t.Fatalf("Unexpected keys=[%s]. Expected [%s]", keys, expectedKeys)
+		}
+	}
+
+	// Scratch storage must be reused by subsequent requests.
+	lineBuf := []byte(strings.Join(line, " "))
+	allocs := testing.AllocsPerRun(10, func() {
+		parseGetKeys(&c, s, lineBuf)
+	})
+	if allocs != 0 {
+		t.Fatalf("Unexpected allocations=%.1f for deduplicating keys. Expected 0", allocs)
+	}
+}
+
+func checkSingleGetMiss(explicitMiss bool, expectedResponse string, t *testing.T) {
+	c, s, cache := newClientServerCacheWithConfig(func(s *Server) { s.ExplicitMiss = explicitMiss }, t)
+	defer cache.Close()
+	defer s.Stop()
+	defer c.Stop()
+
+	item := Item{
+		Key:   []byte("key"),
+		Value: []byte("value"),
+	}
+	if err := c.Set(&item); err != nil {
+		t.Fatalf("error in client.Set(): [%s]", err)
+	}
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	for _, cmd := range []string{"get", "gets"} {
+		sendRequest(conn, cmd+" missing\r\n", t)
+		buf := make([]byte, len(expectedResponse))
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatalf("Cannot read response for %s: [%s]", cmd, err)
+		}
+		if string(buf) != expectedResponse {
+			t.Fatalf("Unexpected response for %s: [%s]. Expected [%s]", cmd, buf, expectedResponse)
+		}
+
+		// Multiget misses must be signalled only by the absence of values.
+		sendRequest(conn, cmd+" missing key missing2\r\n", t)
+		keys := strings.Join(readValueKeys(r, "END\r\n", t), " ")
+		if keys != "key" {
+			t.Fatalf("Unexpected keys returned for %s: [%s]. Expected [key]", cmd, keys)
+		}
+	}
+
+	item.Key = []byte("missing")
+	if err := c.Get(&item); err != ErrCacheMiss {
+		t.Fatalf("Unexpected error returned from client.Get(): [%s]. Expected ErrCacheMiss", err)
+	}
+}
+
+func TestServer_ExplicitMiss(t *testing.T) {
+	checkSingleGetMiss(false, "END\r\n", t)
+	checkSingleGetMiss(true, "NOT_FOUND\r\nEND\r\n", t)
+}
+
+func expectResponse(r *bufio.Reader, expectedResponse string, t *testing.T) {
+	buf := make([]byte, len(expectedResponse))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatalf("Cannot read response: [%s]. Expected [%s]", err, expectedResponse)
+	}
+	if string(buf) != expectedResponse {
+		t.Fatalf("Unexpected response: [%s]. Expected [%s]", buf, expectedResponse)
+	}
+}
+
+func TestServer_SetFlagsValidation(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+
+	sendRequest(conn, "set key 4294967295 0 5\r\nvalue\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+
+	for _, flags := range []string{"4294967296", "18446744073709551621", "abc"} {
+		for _, cmd := range []string{"set key %s 0 5", "add key1 %s 0 5", "cas key %s 0 5 123"} {
+			req := fmt.Sprintf(cmd, flags)
+			sendRequest(conn, req+"\r\nvalue\r\n", t)
+			expectResponse(r, "CLIENT_ERROR bad command line format\r\n", t)
+		}
+	}
+
+	// The connection must remain usable after rejected commands.
+	sendRequest(conn, "get key key1\r\n", t)
+	expectResponse(r, "VALUE key 4294967295 5\r\nvalue\r\nEND\r\n", t)
+}
+
+func TestServer_PayloadReadTimeout(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.PayloadReadTimeout = 200 * time.Millisecond
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+
+	// Slow payloads fitting the timeout must be accepted.
+	sendRequest(conn, "set key 0 0 5\r\nva", t)
+	time.Sleep(s.PayloadReadTimeout / 2)
+	sendRequest(conn, "lue\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+
+	// The timeout mustn't apply between commands.
+	time.Sleep(s.PayloadReadTimeout * 2)
+	start := time.Now()
+	sendRequest(conn, "set key 0 0 100000\r\nvalue", t)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("Unexpected error=[%s] when reading from stalled connection. Expected io.EOF", err)
+	}
+	if d := time.Since(start); d < s.PayloadReadTimeout {
+		t.Fatalf("The connection has been closed too early: after %s. Expected after %s", d, s.PayloadReadTimeout)
+	}
+}
+
+func expectOpenTxns(expectedCount string, t *testing.T) {
+	var stats map[string]string
+	for i := 0; i < 100; i++ {
+		stats = readStats(t)
+		if stats["open_txns"] == expectedCount {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Unexpected open_txns=[%s]. Expected [%s]", stats["open_txns"], expectedCount)
+}
+
+func TestServer_OpenTxns(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.MaxOpenTxns = 1
+	s.Start()
+	defer s.Stop()
+
+	expectOpenTxns("0", t)
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	sendRequest(conn, "set key 0 0 5\r\nva", t)
+	expectOpenTxns("1", t)
+
+	// Transactions exceeding MaxOpenTxns must be rejected.
+	conn1, r1 := dialServer(t)
+	defer conn1.Close()
+	sendRequest(conn1, "set key1 0 0 5\r\nvalue\r\n", t)
+	expectResponse(r1, "SERVER_ERROR out of memory storing object\r\n", t)
+	expectOpenTxns("1", t)
+
+	// Committed transaction.
+	sendRequest(conn, "lue\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+	expectOpenTxns("0", t)
+
+	// Rolled back transaction.
+	sendRequest(conn, "add key 0 0 5\r\nvalue\r\n", t)
+	expectResponse(r, "NOT_STORED\r\n", t)
+	expectOpenTxns("0", t)
+
+	// Transaction aborted by closing the connection.
+	sendRequest(conn, "set key 0 0 5\r\nva", t)
+	expectOpenTxns("1", t)
+	conn.Close()
+	expectOpenTxns("0", t)
+}
+
+func checkEmptyGet(rejectEmptyGet bool, expectedResponse string, t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.RejectEmptyGet = rejectEmptyGet
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	for _, req := range []string{"get\r\n", "get \r\n", "gets\r\n", "gets  \r\n", "gat 100\r\n", "gats 100 \r\n"} {
+		sendRequest(conn, req, t)
+		expectResponse(r, expectedResponse, t)
+	}
+}
+
+func TestServer_RejectEmptyGet(t *testing.T) {
+	checkEmptyGet(false, "END\r\n", t)
+	checkEmptyGet(true, "ERROR\r\n", t)
+}
+
+func TestServer_MultigetConcurrency(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.Cache = &slowCacher{
+		Cacher: cache,
+		delay:  10 * time.Millisecond,
+	}
+	s.MultigetConcurrency = 4
+	s.Start()
+	defer s.Stop()
+
+	var keys, expectedKeys []string
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		keys = append(keys, key)
+		if i%3 == 0 {
+			continue
+		}
+		if err := cache.Set([]byte(key), make([]byte, casidSize+flagsSize), ybc.MaxTtl); err != nil {
+			t.Fatalf("error in cache.Set(): [%s]", err)
+		}
+		expectedKeys = append(expectedKeys, key)
+	}
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	for _, cmd := range []string{"get", "gets"} {
+		sendRequest(conn, cmd+" "+strings.Join(keys, " ")+"\r\n", t)
+		returnedKeys := strings.Join(readValueKeys(r, "END\r\n", t), " ")
+		if returnedKeys != strings.Join(expectedKeys, " ") {
+			t.Fatalf("Unexpected keys returned for %s: [%s]. Expected [%s]", cmd, returnedKeys, expectedKeys)
+		}
+	}
+}
+
+// Thread-safe buffer for capturing log output.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestServer_MaxLoggedLineLength(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.MaxLoggedLineLength = 8
+	s.Start()
+	defer s.Stop()
+
+	var logBuf logBuffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	sendRequest(conn, "\x01\x80ab\\ cd"+strings.Repeat("secret", 100)+"\r\n", t)
+	expectResponse(r, "ERROR\r\n", t)
+
+	expectedLine := `Unrecognized command=[\x01\x80ab\x5c cd...]`
+	logged := logBuf.String()
+	if !strings.Contains(logged, expectedLine) {
+		t.Fatalf("Unexpected log output=[%s]. Expected [%s]", logged, expectedLine)
+	}
+	if strings.Contains(logged, "secret") {
+		t.Fatalf("Log output=[%s] mustn't contain the truncated part of the line", logged)
+	}
+}
+
+func checkCacheOpRetries(retries int, shouldSucceed bool, t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.Cache = &flakyCacher{
+		Cacher:        cache,
+		failuresCount: 2,
+		failuresLeft:  2,
+	}
+	s.CacheOpRetries = retries
+	s.CacheOpRetryDelay = time.Millisecond
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	sendRequest(conn, "set key 123 0 5\r\nvalue\r\n", t)
+	if !shouldSucceed {
+		expectResponse(r, "SERVER_ERROR out of memory storing object\r\n", t)
+		return
+	}
+	expectResponse(r, "STORED\r\n", t)
+	sendRequest(conn, "get key\r\n", t)
+	expectResponse(r, "VALUE key 123 5\r\nvalue\r\nEND\r\n", t)
+}
+
+func TestServer_CacheOpRetries(t *testing.T) {
+	checkCacheOpRetries(0, false, t)
+	checkCacheOpRetries(1, false, t)
+	checkCacheOpRetries(2, true, t)
+	checkCacheOpRetries(5, true, t)
+}
+
+func TestServer_TrackSetCreates(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.TrackSetCreates = true
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	expectedStats := [][2]string{{"1", "0"}, {"1", "1"}, {"1", "2"}}
+	for i, expected := range expectedStats {
+		sendRequest(conn, "set key 0 0 5\r\nvalue\r\n", t)
+		expectResponse(r, "STORED\r\n", t)
+		stats := readStats(t)
+		if stats["new_items"] != expected[0] || stats["updated_items"] != expected[1] {
+			t.Fatalf("Unexpected stats after set #%d: new_items=[%s], updated_items=[%s]. Expected [%s] and [%s]",
+				i, stats["new_items"], stats["updated_items"], expected[0], expected[1])
+		}
+	}
+
+	// Binary protocol sets must be tracked too.
+	binaryConn, binaryR := dialServer(t)
+	defer binaryConn.Close()
+	setExtras := []byte{0, 0, 0, 0, 0, 0, 0, 0}
+	expectedStats = [][2]string{{"2", "2"}, {"2", "3"}}
+	for i, expected := range expectedStats {
+		sendRequest(binaryConn, string(binaryRequestPacket(opSet, 0, setExtras, []byte("binary_key"), []byte("value"))), t)
+		expectBinaryResponse(binaryR, opSet, statusNoError, "", "", t)
+		stats := readStats(t)
+		if stats["new_items"] != expected[0] || stats["updated_items"] != expected[1] {
+			t.Fatalf("Unexpected stats after binary set #%d: new_items=[%s], updated_items=[%s]. Expected [%s] and [%s]",
+				i, stats["new_items"], stats["updated_items"], expected[0], expected[1])
+		}
+	}
+}
+
+func checkLineEndings(strict bool, expectedResponse string, t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.StrictLineEndings = strict
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	sendRequest(conn, "set key 0 0 5\r\nvalue\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+	sendRequest(conn, "get key\nget key\r\n", t)
+	expectResponse(r, expectedResponse, t)
+
+	// Subsequent commands must be processed as usual.
+	sendRequest(conn, "get key\r\n", t)
+	expectResponse(r, "VALUE key 0 5\r\nvalue\r\nEND\r\n", t)
+}
+
+func TestServer_StrictLineEndings(t *testing.T) {
+	checkLineEndings(false, "VALUE key 0 5\r\nvalue\r\nEND\r\nVALUE key 0 5\r\nvalue\r\nEND\r\n", t)
+	checkLineEndings(true, "ERROR\r\nVALUE key 0 5\r\nvalue\r\nEND\r\n", t)
+}
+
+func TestServer_OnConnClose(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	statsCh := make(chan *ConnStats, 1)
+	s.OnConnClose = func(stats *ConnStats) { statsCh <- stats }
+	s.Start()
+	defer s.Stop()
+
+	conn, _ := dialServer(t)
+	defer conn.Close()
+	req := "set key 0 0 5\r\nvalue\r\nget key\r\ngets key other\r\ndelete key\r\nstats\r\nquit\r\n"
+	sendRequest(conn, req, t)
+
+	// The server closes the connection after 'quit', so all the responses
+	// may be read until EOF.
+	resp, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("Cannot read responses: [%s]", err)
+	}
+	if !bytes.HasPrefix(resp, []byte("STORED\r\nVALUE key 0 5\r\nvalue\r\nEND\r\n")) || !bytes.HasSuffix(resp, []byte("END\r\n")) {
+		t.Fatalf("Unexpected responses=[%s]", resp)
+	}
+
+	select {
+	case stats := <-statsCh:
+		if stats.CommandsCount != 5 {
+			t.Fatalf("Unexpected CommandsCount=%d. Expected 5", stats.CommandsCount)
+		}
+		if stats.BytesRead != uint64(len(req)) {
+			t.Fatalf("Unexpected BytesRead=%d. Expected %d", stats.BytesRead, len(req))
+		}
+		if stats.BytesWritten != uint64(len(resp)) {
+			t.Fatalf("Unexpected BytesWritten=%d. Expected %d", stats.BytesWritten, len(resp))
+		}
+		if stats.RemoteAddr.String() != conn.LocalAddr().String() {
+			t.Fatalf("Unexpected RemoteAddr=[%s]. Expected [%s]", stats.RemoteAddr, conn.LocalAddr())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timeout when waiting for OnConnClose call")
+	}
+}
+
+type tenantKey struct{}
+
+func TestServer_ConnHooks(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	var connectsCount int32
+	s.OnConnect = func(ctx context.Context, conn net.Conn) (context.Context, error) {
+		if atomic.AddInt32(&connectsCount, 1) > 1 {
+			return nil, errors.New("too many connections")
+		}
+		return context.WithValue(ctx, tenantKey{}, "foo"), nil
+	}
+	var cmdsLock sync.Mutex
+	var cmds []string
+	s.OnCommand = func(ctx context.Context, cmd, key string) error {
+		cmdsLock.Lock()
+		cmds = append(cmds, fmt.Sprintf("%s:%s:%s", ctx.Value(tenantKey{}), cmd, key))
+		cmdsLock.Unlock()
+		if key == "secret" {
+			return errors.New("access denied")
+		}
+		return nil
+	}
+	disconnectCh := make(chan error, 1)
+	s.OnDisconnect = func(conn net.Conn, err error) { disconnectCh <- err }
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	sendRequest(conn, "set secret 0 0 5\r\nvalue\r\nset key 0 0 5\r\nvalue\r\nget secret\r\nversion\r\n", t)
+	expectResponse(r, "CLIENT_ERROR command rejected\r\nSTORED\r\nCLIENT_ERROR command rejected\r\nVERSION 1.4.0-ybc\r\n", t)
+
+	// Connections rejected by OnConnect must be closed.
+	conn1, r1 := dialServer(t)
+	defer conn1.Close()
+	sendRequest(conn1, "version\r\n", t)
+	if _, err := r1.ReadByte(); err == nil {
+		t.Fatalf("The connection rejected by OnConnect must be closed")
+	}
+
+	sendRequest(conn, "quit\r\n", t)
+	select {
+	case err := <-disconnectCh:
+		if err != nil {
+			t.Fatalf("Unexpected error=[%s] passed to OnDisconnect after quit", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timeout when waiting for OnDisconnect call")
+	}
+	expectedCmds := []string{"foo:set:secret", "foo:set:key", "foo:get:secret", "foo:version:", "foo:quit:"}
+	if fmt.Sprint(cmds) != fmt.Sprint(expectedCmds) {
+		t.Fatalf("Unexpected commands=%v passed to OnCommand. Expected %v", cmds, expectedCmds)
+	}
+
+	// Truncated requests must be reported to OnDisconnect.
+	atomic.StoreInt32(&connectsCount, 0)
+	conn2, _ := dialServer(t)
+	defer conn2.Close()
+	sendRequest(conn2, "set key 0 0 5\r\nval", t)
+	conn2.(*net.TCPConn).CloseWrite()
+	select {
+	case err := <-disconnectCh:
+		if err != ErrConnAborted {
+			t.Fatalf("Unexpected error=[%v] passed to OnDisconnect. Expected [%s]", err, ErrConnAborted)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timeout when waiting for OnDisconnect call")
+	}
+}
+
+// Tracer sending traced commands to a channel.
+type chanTracer chan string
+
+func (ch chanTracer) TraceCommand(ctx context.Context, entry *AccessLogEntry) {
+	ch <- fmt.Sprintf("%s:%s:%s:%v", ctx.Value(tenantKey{}), entry.Command, entry.Key, entry.Hit)
+}
+
+func TestServer_Tracer(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	tracer := make(chanTracer, 10)
+	s.Tracer = tracer
+	s.OnConnect = func(ctx context.Context, conn net.Conn) (context.Context, error) {
+		return context.WithValue(ctx, tenantKey{}, "foo"), nil
+	}
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	sendRequest(conn, "set key 0 0 5\r\nvalue\r\nget key\r\nget missing\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+	readValueKeys(r, "END\r\n", t)
+	expectResponse(r, "END\r\n", t)
+
+	for _, expected := range []string{"foo:set:key:false", "foo:get:key:true", "foo:get:missing:false"} {
+		select {
+		case traced := <-tracer:
+			if traced != expected {
+				t.Fatalf("Unexpected traced command=[%s]. Expected [%s]", traced, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timeout when waiting for traced command=[%s]", expected)
+		}
+	}
+}
+
+func TestServer_SlowRequests(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.Cache = &slowCacher{
+		Cacher: cache,
+		delay:  100 * time.Millisecond,
+	}
+	s.SlowRequestThreshold = 50 * time.Millisecond
+	slowCh := make(chan *AccessLogEntry, 10)
+	s.OnSlowRequest = func(entry *AccessLogEntry) { slowCh <- entry }
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	sendRequest(conn, "set key 0 0 5\r\nvalue\r\nversion\r\nget key\r\n", t)
+	expectResponse(r, "STORED\r\nVERSION 1.4.0-ybc\r\n", t)
+	readValueKeys(r, "END\r\n", t)
+
+	select {
+	case e := <-slowCh:
+		if e.Command != "get" || e.Key != "key" || e.Duration < s.SlowRequestThreshold {
+			t.Fatalf("Unexpected slow request: command=[%s], key=[%s], duration=%s. Expected get command for [key]", e.Command, e.Key, e.Duration)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timeout when waiting for OnSlowRequest call")
+	}
+	select {
+	case e := <-slowCh:
+		t.Fatalf("Unexpected slow request: command=[%s], duration=%s", e.Command, e.Duration)
+	default:
+	}
+}
+
+func TestServer_AccessLog(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	entriesCh := make(chan *AccessLogEntry, 10)
+	s.AccessLog = func(entry *AccessLogEntry) { entriesCh <- entry }
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	sendRequest(conn, "set key 0 0 5\r\nvalue\r\ngat 100 key\r\ndelete missing\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+	readValueKeys(r, "END\r\n", t)
+	expectResponse(r, "NOT_FOUND\r\n", t)
+
+	expectedEntries := []AccessLogEntry{
+		{Command: "set", Key: "key", Size: 5, Result: "STORED"},
+		{Command: "gat", Key: "key", Result: "VALUE key 0 5"},
+		{Command: "delete", Key: "missing", Result: "NOT_FOUND"},
+	}
+	for _, expected := range expectedEntries {
+		var e *AccessLogEntry
+		select {
+		case e = <-entriesCh:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timeout when waiting for AccessLog call")
+		}
+		if e.Command != expected.Command || e.Key != expected.Key || e.Size != expected.Size || e.Result != expected.Result {
+			t.Fatalf("Unexpected access log entry=[%s]. Expected command=[%s], key=[%s], size=%d, result=[%s]",
+				e, expected.Command, expected.Key, expected.Size, expected.Result)
+		}
+		if e.RemoteAddr.String() != conn.LocalAddr().String() {
+			t.Fatalf("Unexpected RemoteAddr=[%s]. Expected [%s]", e.RemoteAddr, conn.LocalAddr())
+		}
+	}
+}
+
+func checkExpiredSets(rejectExpiredSets bool, expectedResponse string, t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.RejectExpiredSets = rejectExpiredSets
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	pastTime := time.Now().Add(-time.Hour).Unix()
+	for _, expiration := range []string{"-1", strconv.FormatInt(pastTime, 10)} {
+		sendRequest(conn, "set key 0 "+expiration+" 5\r\nvalue\r\n", t)
+		expectResponse(r, expectedResponse, t)
+		// Give the cache a chance to expire the item stored in default mode.
+		time.Sleep(10 * time.Millisecond)
+		sendRequest(conn, "get key\r\n", t)
+		expectResponse(r, "END\r\n", t)
+	}
+
+	// Items with expiration in the future must be stored.
+	sendRequest(conn, "set key 0 0 5\r\nvalue\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+	sendRequest(conn, "get key\r\n", t)
+	expectResponse(r, "VALUE key 0 5\r\nvalue\r\nEND\r\n", t)
+}
+
+func TestServer_RejectExpiredSets(t *testing.T) {
+	checkExpiredSets(false, "STORED\r\n", t)
+	checkExpiredSets(true, "NOT_STORED\r\n", t)
+}
+
+func TestServer_Clock(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.RejectExpiredSets = true
+	s.Clock = func() time.Time { return time.Now().Add(-2 * time.Hour) }
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+
+	// The absolute expiration is in the past according to the local clock,
+	// but in the future according to the server clock.
+	expiration := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	sendRequest(conn, "set key 0 "+expiration+" 5\r\nvalue\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+	sendRequest(conn, "get key\r\n", t)
+	expectResponse(r, "VALUE key 0 5\r\nvalue\r\nEND\r\n", t)
+}
+
+func TestServer_SelfTest(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.RunSelfTest = true
+	if err := s.Start(); err != nil {
+		t.Fatalf("Unexpected error in Server.Start(): [%s]", err)
+	}
+	s.Stop()
+	if _, err := cache.Get(selfTestKey); err != ybc.ErrCacheMiss {
+		t.Fatalf("The self-test item must be deleted from the cache. err=[%s]", err)
+	}
+
+	s.Cache = &flakyCacher{
+		Cacher:        cache,
+		failuresCount: 1,
+		failuresLeft:  1,
+	}
+	if err := s.Start(); err != ErrSelfTestFailed {
+		t.Fatalf("Unexpected error in Server.Start(): [%s]. Expected ErrSelfTestFailed", err)
+	}
+
+	// The failed self-test mustn't leave the listen address occupied.
+	s.Cache = cache
+	if err := s.Start(); err != nil {
+		t.Fatalf("Unexpected error in Server.Start(): [%s]", err)
+	}
+	s.Stop()
+}
+
+func TestServer_CommandAliases(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.CommandAliases = map[string]string{
+		"fetch": "get",
+		"put":   "set",
+	}
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	sendRequest(conn, "put Key 0 0 5\r\nvalue\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+	sendRequest(conn, "fetch Key\r\n", t)
+	expectResponse(r, "VALUE Key 0 5\r\nvalue\r\nEND\r\n", t)
+
+	// Commands are case-sensitive by default.
+	sendRequest(conn, "GET Key\r\n", t)
+	expectResponse(r, "ERROR\r\n", t)
+}
+
+func TestServer_CaseInsensitiveCommands(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.CaseInsensitiveCommands = true
+	s.CommandAliases = map[string]string{
+		"fetch": "get",
+	}
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	sendRequest(conn, "SET Key 0 0 5\r\nvalue\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+	for _, cmd := range []string{"get", "GET", "Get", "FETCH"} {
+		sendRequest(conn, cmd+" Key\r\n", t)
+		expectResponse(r, "VALUE Key 0 5\r\nvalue\r\nEND\r\n", t)
+	}
+}
+
+func TestServer_LenientTokenizer(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+
+	// Extra whitespace is rejected by default.
+	sendRequest(conn, "set  key 0 0 5\r\nvalue\r\n", t)
+	expectResponse(r, "CLIENT_ERROR bad command line format\r\n", t)
+	conn.Close()
+	s.Stop()
+
+	s.LenientTokenizer = true
+	s.Start()
+	conn, r = dialServer(t)
+	defer conn.Close()
+	sendRequest(conn, "  set  key \t0 0   5 \r\nvalue\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+	sendRequest(conn, "get   key  key\t\r\n", t)
+	expectResponse(r, "VALUE key 0 5\r\nvalue\r\nVALUE key 0 5\r\nvalue\r\nEND\r\n", t)
+	sendRequest(conn, " \t \r\n", t)
+	expectResponse(r, "ERROR\r\n", t)
+}
+
+func TestServer_LongCommandLine(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.ReadBufferSize = 128
+	s.MaxLineSize = 4096
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	sendRequest(conn, "set key 0 0 5\r\nvalue\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+
+	// Command lines exceeding ReadBufferSize must be accepted.
+	keys := strings.Repeat("missing_key ", 300)
+	sendRequest(conn, "get "+keys+"key\r\n", t)
+	expectResponse(r, "VALUE key 0 5\r\nvalue\r\nEND\r\n", t)
+
+	// Command lines exceeding MaxLineSize must be skipped.
+	keys = strings.Repeat("missing_key ", 500)
+	sendRequest(conn, "get "+keys+"key\r\nget key\r\n", t)
+	expectResponse(r, "CLIENT_ERROR line too long\r\nVALUE key 0 5\r\nvalue\r\nEND\r\n", t)
+}
+
+func TestServer_ReportCacheStats(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.ReportCacheStats = true
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	sendRequest(conn, "set key1 0 0 5\r\nvalue\r\nset key2 0 0 5\r\nvalue\r\nget key1 missing\r\n", t)
+	expectResponse(r, "STORED\r\nSTORED\r\nVALUE key1 0 5\r\nvalue\r\nEND\r\n", t)
+
+	// Lookups, which don't serve get requests, mustn't be counted
+	// in cache_hits and cache_misses.
+	sendRequest(conn, "touch key1 100\r\ncas key2 0 0 1 12345\r\nx\r\nincr missing 1\r\n", t)
+	expectResponse(r, "TOUCHED\r\nEXISTS\r\nNOT_FOUND\r\n", t)
+
+	stats := readStats(t)
+	if stats["curr_items"] != "2" {
+		t.Fatalf("Unexpected curr_items=[%s]. Expected [2]", stats["curr_items"])
+	}
+	if stats["limit_maxbytes"] != strconv.Itoa(int(cache.Stats().DataFileSize)) {
+		t.Fatalf("Unexpected limit_maxbytes=[%s]", stats["limit_maxbytes"])
+	}
+	if stats["cache_hits"] != "1" || stats["cache_misses"] != "1" {
+		t.Fatalf("Unexpected cache_hits=[%s], cache_misses=[%s]. Expected [1] and [1]", stats["cache_hits"], stats["cache_misses"])
+	}
+	if stats["fragmented_bytes"] != "0" {
+		t.Fatalf("Unexpected fragmented_bytes=[%s]. Expected [0]", stats["fragmented_bytes"])
+	}
+	if cs := s.Stats().Cache; cs == nil || cs.ItemsCount != 2 {
+		t.Fatalf("Unexpected cache stats in Server.Stats(): %+v", cs)
+	}
+}
+
+func TestServer_TrackOldestItemAge(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	nowNanos := time.Now().UnixNano()
+	s.Clock = func() time.Time { return time.Unix(0, atomic.LoadInt64(&nowNanos)) }
+	s.TrackOldestItemAge = true
+	s.Start()
+	defer s.Stop()
+
+	if age := readStats(t)["oldest_item_age"]; age != "0" {
+		t.Fatalf("Unexpected oldest_item_age=[%s] for empty cache. Expected [0]", age)
+	}
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	sendRequest(conn, "set key 0 0 5\r\nvalue\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+
+	atomic.AddInt64(&nowNanos, int64(time.Second))
+	if age := readStats(t)["oldest_item_age"]; age != "1" {
+		t.Fatalf("Unexpected oldest_item_age=[%s]. Expected [1]", age)
+	}
+	atomic.AddInt64(&nowNanos, int64(time.Second))
+	if age := readStats(t)["oldest_item_age"]; age != "2" {
+		t.Fatalf("Unexpected oldest_item_age=[%s]. Expected [2]", age)
+	}
+
+	// The age must be reset after the sampled item is deleted.
+	sendRequest(conn, "delete key\r\n", t)
+	expectResponse(r, "DELETED\r\n", t)
+	if age := readStats(t)["oldest_item_age"]; age != "0" {
+		t.Fatalf("Unexpected oldest_item_age=[%s] after deleting the item. Expected [0]", age)
+	}
+}
+
+// Connection, which reads requests from r and fails all the writes.
+type brokenWriteConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *brokenWriteConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *brokenWriteConn) Write(p []byte) (int, error) {
+	return 0, errors.New("connection reset by peer")
+}
+
+func (c *brokenWriteConn) Close() error {
+	return nil
+}
+
+func TestServer_ClientDisconnects(t *testing.T) {
+	cache := newCache(t)
+	defer cache.Close()
+	s := &Server{
+		Cache:           cache,
+		ReadBufferSize:  defaultReadBufferSize,
+		WriteBufferSize: defaultWriteBufferSize,
+	}
+
+	conn := &brokenWriteConn{
+		r: strings.NewReader("get key\r\nget key\r\nget key\r\n"),
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	handleConn(conn, s, &wg)
+	if n := atomic.LoadUint64(&s.clientDisconnectsCount); n != 1 {
+		t.Fatalf("Unexpected client disconnects count=%d. Expected 1", n)
+	}
+
+	// Connections closed by clients after reading all the responses
+	// mustn't be counted.
+	c, s, cache := newClientServerCacheWithConfig(func(s *Server) {}, t)
+	defer cache.Close()
+	defer s.Stop()
+	defer c.Stop()
+	item := Item{
+		Key: []byte("key"),
+	}
+	if err := c.Get(&item); err != ErrCacheMiss {
+		t.Fatalf("Unexpected error returned from client.Get(): [%s]. Expected ErrCacheMiss", err)
+	}
+	if stats := readStats(t); stats["client_disconnects"] != "0" {
+		t.Fatalf("Unexpected client_disconnects=[%s]. Expected [0]", stats["client_disconnects"])
+	}
+}
+
+func TestServer_MaxConcurrentRecomputes(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.MaxConcurrentRecomputes = 3
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	grantedCount := 0
+	for i := 0; i < 10; i++ {
+		sendRequest(conn, fmt.Sprintf("getde key_%d 10000\r\n", i), t)
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Cannot read response for getde: [%s]", err)
+		}
+		switch line {
+		case "END\r\n":
+			grantedCount++
+		case "WB\r\n":
+		default:
+			t.Fatalf("Unexpected response for getde: [%s]", line)
+		}
+	}
+	if grantedCount != 3 {
+		t.Fatalf("Unexpected number of granted recomputations=%d. Expected 3", grantedCount)
+	}
+	if n := readStats(t)["getde_in_flight"]; n != "3" {
+		t.Fatalf("Unexpected getde_in_flight=[%s]. Expected [3]", n)
+	}
+
+	// Storing recomputed item must free a slot for another recomputation.
+	sendRequest(conn, "set key_0 0 0 5\r\nvalue\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+	if n := readStats(t)["getde_in_flight"]; n != "2" {
+		t.Fatalf("Unexpected getde_in_flight=[%s]. Expected [2]", n)
+	}
+	sendRequest(conn, "getde key_100 10000\r\n", t)
+	expectResponse(r, "END\r\n", t)
+	if n := readStats(t)["getde_in_flight"]; n != "3" {
+		t.Fatalf("Unexpected getde_in_flight=[%s]. Expected [3]", n)
+	}
+}
+
+func TestRecomputesTracker_Expiration(t *testing.T) {
+	var rt recomputesTracker
+	for i := 0; i < 10; i++ {
+		if !rt.tryStart([]byte(fmt.Sprintf("key_%d", i)), 50*time.Millisecond, 0) {
+			t.Fatalf("Cannot start recomputation for key_%d", i)
+		}
+	}
+	// Restarted recomputation must survive the original deadline.
+	rt.tryStart([]byte("key_0"), time.Hour, 0)
+	rt.finish([]byte("key_1"))
+	if n := rt.inFlightCount(); n != 9 {
+		t.Fatalf("Unexpected number of recomputations in flight=%d. Expected 9", n)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if n := rt.inFlightCount(); n != 1 {
+		t.Fatalf("Unexpected number of recomputations in flight=%d. Expected 1", n)
+	}
+	if len(rt.queue) != 1 {
+		t.Fatalf("Unexpected number of queued deadlines=%d. Expected 1", len(rt.queue))
+	}
+	if !rt.tryStart([]byte("key_1"), time.Hour, 2) {
+		t.Fatalf("Cannot start recomputation for key_1")
+	}
+	if rt.tryStart([]byte("key_2"), time.Hour, 2) {
+		t.Fatalf("Recomputation for key_2 mustn't exceed maxCount")
+	}
+}
+
+func TestServer_Stats(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	sendRequest(conn, "set key 0 0 5\r\nvalue\r\nget key missing\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+	readValueKeys(r, "END\r\n", t)
+
+	stats := s.Stats()
+	if stats.CurrConns != 1 || stats.TotalConns != 1 {
+		t.Fatalf("Unexpected CurrConns=%d, TotalConns=%d. Expected 1, 1", stats.CurrConns, stats.TotalConns)
+	}
+	if stats.Cmds["set"] != 1 || stats.Cmds["get"] != 1 || stats.Cmds["delete"] != 0 {
+		t.Fatalf("Unexpected Cmds=%v", stats.Cmds)
+	}
+	if stats.GetHits != 1 || stats.GetMisses != 1 {
+		t.Fatalf("Unexpected GetHits=%d, GetMisses=%d. Expected 1, 1", stats.GetHits, stats.GetMisses)
+	}
+	if stats.BytesRead == 0 || stats.BytesWritten == 0 {
+		t.Fatalf("Unexpected BytesRead=%d, BytesWritten=%d", stats.BytesRead, stats.BytesWritten)
+	}
+	if stats.Uptime <= 0 {
+		t.Fatalf("Unexpected Uptime=%s", stats.Uptime)
+	}
+}
+
+func TestServer_Latencies(t *testing.T) {
+	for _, d := range []time.Duration{0, 5 * time.Microsecond, 100 * time.Microsecond, 3 * time.Millisecond, time.Second} {
+		upper := latencyBucketUpperBound(latencyBucket(d))
+		if upper <= d || upper > d+d/latencySubBuckets+time.Microsecond {
+			t.Fatalf("Unexpected bucket upper bound=%s for duration=%s", upper, d)
+		}
+	}
+
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.Cache = &slowCacher{Cacher: cache, delay: 10 * time.Millisecond}
+	s.TrackLatencies = true
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	sendRequest(conn, "set key 0 0 5\r\nvalue\r\nget key\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+	if keys := readValueKeys(r, "END\r\n", t); len(keys) != 1 {
+		t.Fatalf("Unexpected keys=%v", keys)
+	}
+
+	l := s.Stats().Latencies["get"]
+	if l.Count != 1 {
+		t.Fatalf("Unexpected get latencies count=%d. Expected 1", l.Count)
+	}
+	if l.P50 < 10*time.Millisecond || l.P50 > l.P95 || l.P95 > l.P99 {
+		t.Fatalf("Unexpected get latencies=%+v", l)
+	}
+	if n := s.Stats().Latencies["delete"].Count; n != 0 {
+		t.Fatalf("Unexpected delete latencies count=%d. Expected 0", n)
+	}
+
+	stats := readStats(t)
+	if stats["get_latency_p99_us"] == "" || stats["get_latency_p99_us"] == "0" {
+		t.Fatalf("Unexpected get_latency_p99_us=%q", stats["get_latency_p99_us"])
+	}
+}
+
+func TestServer_HotKeys(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.HotKeysCount = 2
+	s.HotKeysSampleRate = 1
+	// Requests issued by the self-test mustn't be counted.
+	s.RunSelfTest = true
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	sendRequest(conn, "get hot\r\nget hot\r\nget hot\r\nset warm 0 0 1\r\nx\r\nget warm\r\nget cold\r\n", t)
+	expectResponse(r, "END\r\nEND\r\nEND\r\nSTORED\r\n", t)
+	readValueKeys(r, "END\r\n", t)
+	expectResponse(r, "END\r\n", t)
+
+	// Complete the window explicitly, since the default window is too long.
+	s.hotKeys.rotate(s, time.Second)
+
+	hotKeys := s.HotKeys()
+	expectedHotKeys := []HotKey{{Key: "hot", Rate: 3}, {Key: "warm", Rate: 2}}
+	if !reflect.DeepEqual(hotKeys, expectedHotKeys) {
+		t.Fatalf("Unexpected hot keys=%+v. Expected %+v", hotKeys, expectedHotKeys)
+	}
+
+	sendRequest(conn, "stats hotkeys\r\n", t)
+	expectResponse(r, "STAT hotkey:hot 3.00\r\nSTAT hotkey:warm 2.00\r\nEND\r\n", t)
+
+	// The protocol is detected per connection.
+	binaryConn, r := dialServer(t)
+	defer binaryConn.Close()
+	sendRequest(binaryConn, string(binaryRequestPacket(opStat, 0, nil, []byte("hotkeys"), nil)), t)
+	expectBinaryResponse(r, opStat, statusNoError, "hotkey:hot", "3.00", t)
+	expectBinaryResponse(r, opStat, statusNoError, "hotkey:warm", "2.00", t)
+	expectBinaryResponse(r, opStat, statusNoError, "", "", t)
+}
+
+func TestServer_ReadOnly(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.ReadOnly = true
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	sendRequest(conn, "set key 0 0 5\r\nvalue\r\ndelete key\r\nflush_all\r\nget key\r\n", t)
+	expectResponse(r, "SERVER_ERROR read only\r\nSERVER_ERROR read only\r\nSERVER_ERROR read only\r\nEND\r\n", t)
+
+	s.SetReadOnly(false)
+	sendRequest(conn, "set key 0 0 5\r\nvalue\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+
+	s.SetReadOnly(true)
+	binaryConn, r := dialServer(t)
+	defer binaryConn.Close()
+	sendRequest(binaryConn, string(binaryRequestPacket(opDelete, 0, nil, []byte("key"), nil)), t)
+	expectBinaryResponse(r, opDelete, statusNotSupported, "", "", t)
+	sendRequest(binaryConn, string(binaryRequestPacket(opGet, 0, nil, []byte("key"), nil)), t)
+	expectBinaryResponse(r, opGet, statusNoError, "", "value", t)
+}
+
+func TestServer_Admin(t *testing.T) {
+	const adminAddr = "localhost:12347"
+
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.AdminAddr = adminAddr
+	s.Start()
+	defer s.Stop()
+
+	httpRequest := func(method, path string) string {
+		req, err := http.NewRequest(method, "http://"+adminAddr+path, nil)
+		if err != nil {
+			t.Fatalf("Cannot create request for %s: [%s]", path, err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Cannot request %s: [%s]", path, err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Cannot read response body for %s: [%s]", path, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Unexpected status code=%d for %s. Expected 200. Body=[%s]", resp.StatusCode, path, body)
+		}
+		return string(body)
+	}
+
+	if body := httpRequest("GET", "/healthz"); body != "OK\n" {
+		t.Fatalf("Unexpected /healthz response=[%s]", body)
+	}
+	httpRequest("GET", "/debug/pprof/")
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	sendRequest(conn, "get key\r\n", t)
+	expectResponse(r, "END\r\n", t)
+
+	var stats ServerStats
+	if err := json.Unmarshal([]byte(httpRequest("GET", "/stats")), &stats); err != nil {
+		t.Fatalf("Cannot parse /stats response: [%s]", err)
+	}
+	if stats.CurrConns != 1 || stats.Cmds["get"] != 1 {
+		t.Fatalf("Unexpected CurrConns=%d, Cmds=%v in /stats response", stats.CurrConns, stats.Cmds)
+	}
+
+	if body := httpRequest("POST", "/verbosity?level=2"); body != "2\n" {
+		t.Fatalf("Unexpected /verbosity response=[%s]", body)
+	}
+	if body := httpRequest("POST", "/readonly?enabled=1"); body != "1\n" || !s.IsReadOnly() {
+		t.Fatalf("Unexpected /readonly response=[%s]", body)
+	}
+	sendRequest(conn, "delete key\r\n", t)
+	expectResponse(r, "SERVER_ERROR read only\r\n", t)
+}
+
+func TestServer_SubscribeMutations(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.Start()
+	defer s.Stop()
+
+	ch := make(chan Mutation, 10)
+	unsubscribe := s.SubscribeMutations(ch)
+	droppedCh := make(chan Mutation)
+	defer s.SubscribeMutations(droppedCh)()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	sendRequest(conn, "set key 0 100 5\r\nvalue\r\ndelete key\r\ndelete key\r\nflush_all\r\n", t)
+	expectResponse(r, "STORED\r\nDELETED\r\nNOT_FOUND\r\nOK\r\n", t)
+
+	expectedMutations := []Mutation{
+		{Type: MutationSet, Key: "key", Size: 5, Expiration: 100 * time.Second},
+		{Type: MutationDelete, Key: "key"},
+		{Type: MutationFlush},
+	}
+	for _, expected := range expectedMutations {
+		m := <-ch
+		if m.Time.IsZero() {
+			t.Fatalf("Unexpected zero time in mutation=%+v", m)
+		}
+		m.Time = time.Time{}
+		if m != expected {
+			t.Fatalf("Unexpected mutation=%+v. Expected %+v", m, expected)
+		}
+	}
+	if n := s.Stats().DroppedMutations; n != 3 {
+		t.Fatalf("Unexpected DroppedMutations=%d. Expected 3", n)
+	}
+
+	unsubscribe()
+	sendRequest(conn, "delete key\r\nset key 0 0 5\r\nvalue\r\n", t)
+	expectResponse(r, "NOT_FOUND\r\nSTORED\r\n", t)
+	select {
+	case m := <-ch:
+		t.Fatalf("Unexpected mutation=%+v after unsubscribing", m)
+	default:
+	}
+}
+
+func TestServer_SubscribeMutationsTouch(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	sendRequest(conn, "set key 0 0 5\r\nvalue\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+
+	ch := make(chan Mutation, 10)
+	defer s.SubscribeMutations(ch)()
+
+	sendRequest(conn, "touch key 100\r\ngat 200 key\r\ntouch missing 100\r\n", t)
+	expectResponse(r, "TOUCHED\r\nVALUE key 0 5\r\nvalue\r\nEND\r\nNOT_FOUND\r\n", t)
+
+	expectedMutations := []Mutation{
+		{Type: MutationSet, Key: "key", Size: 5, Expiration: 100 * time.Second},
+		{Type: MutationSet, Key: "key", Size: 5, Expiration: 200 * time.Second},
+	}
+	for _, expected := range expectedMutations {
+		m := <-ch
+		m.Time = time.Time{}
+		if m != expected {
+			t.Fatalf("Unexpected mutation=%+v. Expected %+v", m, expected)
+		}
+	}
+	select {
+	case m := <-ch:
+		t.Fatalf("Unexpected mutation=%+v for touching missing item", m)
+	default:
+	}
+}
+
+func TestServer_BufferPools(t *testing.T) {
+	s := &Server{ReadBufferSize: 4096, WriteBufferSize: 4096}
+	releaseReader(s, acquireReader(s, nil))
+	releaseWriter(s, acquireWriter(s, nil))
+
+	// Pooled buffers mustn't be reused after buffer sizes change.
+	s.ReadBufferSize = 8192
+	s.WriteBufferSize = 8192
+	if n := acquireReader(s, nil).Size(); n != s.ReadBufferSize {
+		t.Fatalf("Unexpected reader buffer size=%d. Expected %d", n, s.ReadBufferSize)
+	}
+	if n := acquireWriter(s, nil).Size(); n != s.WriteBufferSize {
+		t.Fatalf("Unexpected writer buffer size=%d. Expected %d", n, s.WriteBufferSize)
+	}
+
+	buf := acquireByteBuf()
+	*buf = append(*buf, "foobar"...)
+	releaseByteBuf(buf)
+	if buf = acquireByteBuf(); len(*buf) != 0 {
+		t.Fatalf("Unexpected non-empty pooled buffer=[%s]", *buf)
+	}
+}
+
+// Returns the average number of allocations for processing the given
+// requests via processFunc. The connection is backed by in-memory buffers.
+func requestAllocs(s *Server, processFunc func(c *serverConn, s *Server, scratchBuf *[]byte) bool, requests []byte, t *testing.T) float64 {
+	var src bytes.Reader
+	var dst bytes.Buffer
+	c := &serverConn{
+		ReadWriter: bufio.NewReadWriter(bufio.NewReader(&src), bufio.NewWriter(&dst)),
+		lineBuf:    make([]byte, 0, 1024),
+	}
+	scratchBuf := make([]byte, 0, 1024)
+	return testing.AllocsPerRun(100, func() {
+		src.Reset(requests)
+		c.Reader.Reset(&src)
+		for c.Reader.Buffered() > 0 || src.Len() > 0 {
+			if !processFunc(c, s, &scratchBuf) {
+				t.Fatalf("Cannot process requests=[%q]", requests)
+			}
+		}
+		c.Flush()
+		dst.Reset()
+	})
+}
+
+func TestServer_ZeroAllocRequests(t *testing.T) {
+	if raceEnabled {
+		t.Skip("The race detector allocates memory")
+	}
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.Start()
+	defer s.Stop()
+
+	// Storage commands aren't checked, since ybc.SetTxn allocates memory.
+	item := Item{Key: []byte("key"), Value: []byte("value")}
+	if err := s.Cache.Set(item.Key, append(make([]byte, casidSize+flagsSize), item.Value...), ybc.MaxTtl); err != nil {
+		t.Fatalf("Cannot store the item: [%s]", err)
+	}
+
+	textRequests := []byte("get key\r\ngets key missing\r\ndelete missing\r\nincr missing 1\r\nversion\r\nverbosity 0\r\n")
+	if n := requestAllocs(s, processRequest, textRequests, t); n != 0 {
+		t.Fatalf("Unexpected allocations=%.1f for text protocol requests. Expected 0", n)
+	}
+
+	var binaryRequests []byte
+	binaryRequests = append(binaryRequests, binaryRequestPacket(opGet, 0, nil, []byte("key"), nil)...)
+	binaryRequests = append(binaryRequests, binaryRequestPacket(opGetK, 0, nil, []byte("key"), nil)...)
+	binaryRequests = append(binaryRequests, binaryRequestPacket(opGet, 0, nil, []byte("missing"), nil)...)
+	binaryRequests = append(binaryRequests, binaryRequestPacket(opNoop, 0, nil, nil, nil)...)
+	binaryRequests = append(binaryRequests, binaryRequestPacket(opVersion, 0, nil, nil, nil)...)
+	if n := requestAllocs(s, processBinaryRequest, binaryRequests, t); n != 0 {
+		t.Fatalf("Unexpected allocations=%.1f for binary protocol requests. Expected 0", n)
+	}
+}
+
+func TestServer_Expvar(t *testing.T) {
+	for i := 0; i < 2; i++ {
+		// Restarted servers and clients must replace published variables.
+		c, s, cache := newClientServerCacheWithConfig(func(s *Server) { s.ExpvarPrefix = "memcache_test." }, t)
+		c.Stop()
+		c.ExpvarPrefix = "memcache_test."
+		c.Start()
+
+		item := Item{Key: []byte("key"), Value: []byte("value")}
+		if err := c.Set(&item); err != nil {
+			t.Fatalf("Error in Client.Set(): [%s]", err)
+		}
+
+		v := expvar.Get("memcache_test.server")
+		if v == nil {
+			t.Fatalf("Cannot find published server stats")
+		}
+		var stats ServerStats
+		if err := json.Unmarshal([]byte(v.String()), &stats); err != nil {
+			t.Fatalf("Cannot parse published server stats=[%s]: [%s]", v, err)
+		}
+		if stats.Cmds["set"] != 1 {
+			t.Fatalf("Unexpected published server stats=[%s]. Expected a single set command", v)
+		}
+
+		v = expvar.Get("memcache_test.client." + testAddr)
+		if v == nil {
+			t.Fatalf("Cannot find published client counters")
+		}
+		if !strings.Contains(v.String(), `"requests":1`) {
+			t.Fatalf("Unexpected published client counters=[%s]. Expected a single request", v)
+		}
+
+		c.Stop()
+		s.Stop()
+		cache.Close()
+	}
+}
+
+func TestServer_Graphite(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen TCP: [%s]", err)
+	}
+	defer ln.Close()
+
+	c, s, cache := newClientServerCacheWithConfig(func(s *Server) {
+		s.GraphiteAddr = ln.Addr().String()
+		s.GraphiteInterval = 50 * time.Millisecond
+		s.GraphitePrefix = "ybc."
+	}, t)
+	defer cache.Close()
+	defer s.Stop()
+	defer c.Stop()
+
+	item := Item{
+		Key: []byte("key"),
+	}
+	for i := 0; i < 3; i++ {
+		if err := c.Get(&item); err != ErrCacheMiss {
+			t.Fatalf("Unexpected error returned from client.Get(): [%s]. Expected ErrCacheMiss", err)
+		}
+	}
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Cannot accept Graphite connection: [%s]", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	getsSeen, gaugeSeen := false, false
+	for !getsSeen || !gaugeSeen {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Cannot read metrics: [%s]. gets seen=%v, gauge seen=%v", err, getsSeen, gaugeSeen)
+		}
+		var name string
+		var value, timestamp int64
+		if _, err = fmt.Sscanf(line, "%s %d %d\n", &name, &value, &timestamp); err != nil {
+			t.Fatalf("Cannot parse metric line=[%s]: [%s]", line, err)
+		}
+		if name == "ybc.cmd_gets" && value == 3 {
+			getsSeen = true
+		}
+		if name == "ybc.open_txns" && value == 0 {
+			gaugeSeen = true
+		}
+	}
+}
+
+func TestServer_StatsD(t *testing.T) {
+	statsDConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen UDP: [%s]", err)
+	}
+	defer statsDConn.Close()
+
+	c, s, cache := newClientServerCacheWithConfig(func(s *Server) {
+		s.StatsDAddr = statsDConn.LocalAddr().String()
+		s.StatsDInterval = 50 * time.Millisecond
+		s.StatsDPrefix = "ybc."
+	}, t)
+	defer cache.Close()
+	defer s.Stop()
+	defer c.Stop()
+
+	item := Item{
+		Key: []byte("key"),
+	}
+	for i := 0; i < 3; i++ {
+		if err := c.Get(&item); err != ErrCacheMiss {
+			t.Fatalf("Unexpected error returned from client.Get(): [%s]. Expected ErrCacheMiss", err)
+		}
+	}
+
+	// Counter deltas may be spread among multiple packets.
+	getsCount := 0
+	gaugeSeen := false
+	buf := make([]byte, 64*1024)
+	deadline := time.Now().Add(5 * time.Second)
+	statsDConn.SetReadDeadline(deadline)
+	for getsCount < 3 || !gaugeSeen {
+		n, _, err := statsDConn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Cannot read metrics: [%s]. gets count=%d, gauge seen=%v", err, getsCount, gaugeSeen)
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if strings.HasPrefix(line, "ybc.cmd_gets:") {
+				var delta int
+				if _, err = fmt.Sscanf(line, "ybc.cmd_gets:%d|c", &delta); err != nil {
+					t.Fatalf("Cannot parse metric line=[%s]: [%s]", line, err)
+				}
+				getsCount += delta
+			}
+			if line == "ybc.open_txns:0|g" {
+				gaugeSeen = true
+			}
+		}
+	}
+	if getsCount != 3 {
+		t.Fatalf("Unexpected cmd_gets sum=%d. Expected 3", getsCount)
+	}
+}
+
+func checkDeleteTombstones(tombstoneRejectsSets bool, expectedCasResponse, expectedSetResponse string, t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.DeleteTombstoneWindow = 500 * time.Millisecond
+	s.TombstoneRejectsSets = tombstoneRejectsSets
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	sendRequest(conn, "set key 0 0 5\r\nvalue\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+	sendRequest(conn, "delete key\r\n", t)
+	expectResponse(r, "DELETED\r\n", t)
+
+	sendRequest(conn, "get key\r\ngets key\r\ncget key 123\r\ngetde key 1000\r\n", t)
+	expectResponse(r, "END\r\nEND\r\nEND\r\nEND\r\n", t)
+	sendRequest(conn, "delete key\r\ncas key 0 0 5 123\r\nvalue\r\n", t)
+	expectResponse(r, "NOT_FOUND\r\n"+expectedCasResponse, t)
+
+	sendRequest(conn, "set key 0 0 6\r\nvalue1\r\n", t)
+	expectResponse(r, expectedSetResponse, t)
+	if expectedSetResponse == "STORED\r\n" {
+		sendRequest(conn, "get key\r\n", t)
+		expectResponse(r, "VALUE key 0 6\r\nvalue1\r\nEND\r\n", t)
+		return
+	}
+	sendRequest(conn, "add key 0 0 6\r\nvalue1\r\n", t)
+	expectResponse(r, "NOT_STORED\r\n", t)
+
+	// Sets must succeed after the tombstone expires.
+	time.Sleep(s.DeleteTombstoneWindow + 100*time.Millisecond)
+	sendRequest(conn, "set key 0 0 6\r\nvalue2\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+	sendRequest(conn, "get key\r\n", t)
+	expectResponse(r, "VALUE key 0 6\r\nvalue2\r\nEND\r\n", t)
+}
+
+func TestServer_DeleteTombstoneWindow(t *testing.T) {
+	checkDeleteTombstones(false, "NOT_FOUND\r\n", "STORED\r\n", t)
+	checkDeleteTombstones(true, "NOT_STORED\r\n", "NOT_STORED\r\n", t)
+}
+
+func TestServer_MaxAcceptRate(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.MaxAcceptRate = 20
+	s.MaxAcceptBurst = 2
+	s.Start()
+	defer s.Stop()
+
+	connsCount := 10
+	start := time.Now()
+	var conns []net.Conn
+	var readers []*bufio.Reader
+	for i := 0; i < connsCount; i++ {
+		conn, r := dialServer(t)
+		defer conn.Close()
+		sendRequest(conn, "get key\r\n", t)
+		conns = append(conns, conn)
+		readers = append(readers, r)
+	}
+	for i := range conns {
+		conns[i].SetReadDeadline(time.Now().Add(5 * time.Second))
+		expectResponse(readers[i], "END\r\n", t)
+	}
+
+	// The first MaxAcceptBurst connections are accepted immediately.
+	minDuration := time.Duration(float64(connsCount-s.MaxAcceptBurst) / s.MaxAcceptRate * float64(time.Second))
+	if d := time.Since(start); d < minDuration*9/10 {
+		t.Fatalf("Connections have been accepted too fast: in %s. Expected at least %s", d, minDuration)
+	}
+}
+
+func TestServer_OnHighPressure(t *testing.T) {
+	var fractions []float64
+	s := &Server{
+		HighPressureThresholds: []float64{0.8, 0.9},
+		HighPressureHysteresis: 0.05,
+		OnHighPressure: func(fraction float64) {
+			fractions = append(fractions, fraction)
+		},
+	}
+	samples := []float64{
+		0.5,
+		0.8,  // crosses 0.8
+		0.85, // no crossing
+		0.77, // within hysteresis for 0.8
+		0.82, // still above 0.8 after hysteresis, no crossing
+		0.7,  // drops below 0.8 - hysteresis
+		0.81, // crosses 0.8 again
+		0.95, // crosses 0.9
+		0.99, // no crossing
+		0.5,  // drops below both thresholds
+		0.92, // crosses both thresholds at once
+	}
+	for _, fullness := range samples {
+		s.updatePressure(fullness)
+	}
+	expectedFractions := []float64{0.8, 0.81, 0.95, 0.92}
+	if fmt.Sprintf("%v", fractions) != fmt.Sprintf("%v", expectedFractions) {
+		t.Fatalf("Unexpected OnHighPressure calls=%v. Expected %v", fractions, expectedFractions)
+	}
+
+	// Make sure the server samples fullness in background.
+	calls := make(chan float64, 100)
+	c, s, cache := newClientServerCacheWithConfig(func(s *Server) {
+		s.CacheFullness = func() float64 { return 0.95 }
+		s.FullnessSampleInterval = 10 * time.Millisecond
+		s.OnHighPressure = func(fraction float64) {
+			calls <- fraction
+		}
+	}, t)
+	defer cache.Close()
+	defer s.Stop()
+	defer c.Stop()
+
+	select {
+	case fraction := <-calls:
+		if fraction != 0.95 {
+			t.Fatalf("Unexpected fraction=%v passed to OnHighPressure. Expected 0.95", fraction)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("OnHighPressure wasn't called")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(calls) != 0 {
+		t.Fatalf("Unexpected %d OnHighPressure calls for constant fullness. Expected 0", len(calls))
+	}
+}
+
+func checkIncrDecr(verifyChecksums bool, t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.VerifyChecksums = verifyChecksums
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+
+	sendRequest(conn, "incr key 1\r\ndecr key 1\r\n", t)
+	expectResponse(r, "NOT_FOUND\r\nNOT_FOUND\r\n", t)
+
+	sendRequest(conn, "set key 123 0 2\r\n10\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+	sendRequest(conn, "incr key 5\r\ndecr key 3\r\ndecr key 100\r\n", t)
+	expectResponse(r, "15\r\n12\r\n0\r\n", t)
+	sendRequest(conn, "incr key 7 noreply\r\nget key\r\n", t)
+	expectResponse(r, "VALUE key 123 1\r\n7\r\nEND\r\n", t)
+
+	// incr must wrap around on overflow.
+	sendRequest(conn, "set key 0 0 20\r\n18446744073709551615\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+	sendRequest(conn, "incr key 2\r\n", t)
+	expectResponse(r, "1\r\n", t)
+
+	sendRequest(conn, "set key 0 0 3\r\nabc\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+	sendRequest(conn, "incr key 1\r\ndecr key 1\r\n", t)
+	expectResponse(r, "CLIENT_ERROR cannot increment or decrement non-numeric value\r\nCLIENT_ERROR cannot increment or decrement non-numeric value\r\n", t)
+	sendRequest(conn, "incr key abc\r\n", t)
+	expectResponse(r, "CLIENT_ERROR invalid numeric delta argument\r\n", t)
+
+	// Concurrent increments mustn't be lost.
+	sendRequest(conn, "set counter 0 0 1\r\n0\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+	const workersCount = 4
+	const incrsCount = 100
+	var wg sync.WaitGroup
+	for i := 0; i < workersCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, r := dialServer(t)
+			defer conn.Close()
+			for j := 0; j < incrsCount; j++ {
+				sendRequest(conn, "incr counter 1\r\n", t)
+				if _, err := r.ReadString('\n'); err != nil {
+					t.Errorf("Cannot read incr response: [%s]", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	sendRequest(conn, "get counter\r\n", t)
+	expectResponse(r, fmt.Sprintf("VALUE counter 0 3\r\n%d\r\nEND\r\n", workersCount*incrsCount), t)
+}
+
+func TestServer_IncrDecr(t *testing.T) {
+	checkIncrDecr(false, t)
+	checkIncrDecr(true, t)
+}
+
+func checkAppendPrepend(verifyChecksums bool, t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.VerifyChecksums = verifyChecksums
+	s.PayloadReadTimeout = time.Second
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+
+	sendRequest(conn, "append key 0 0 3\r\nabc\r\nprepend key 0 0 3\r\nabc\r\n", t)
+	expectResponse(r, "NOT_STORED\r\nNOT_STORED\r\n", t)
+
+	sendRequest(conn, "set key 123 0 5\r\nvalue\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+	sendRequest(conn, "append key 0 0 4\r\n_end\r\nprepend key 456 0 6\r\nbegin_\r\n", t)
+	expectResponse(r, "STORED\r\nSTORED\r\n", t)
+	sendRequest(conn, "append key 0 0 2 noreply\r\n!!\r\nget key\r\n", t)
+	expectResponse(r, "VALUE key 123 17\r\nbegin_value_end!!\r\nEND\r\n", t)
+
+	// Appending to an empty value.
+	sendRequest(conn, "set empty 0 0 0\r\n\r\nappend empty 0 0 3\r\nabc\r\nget empty\r\n", t)
+	expectResponse(r, "STORED\r\nSTORED\r\nVALUE empty 0 3\r\nabc\r\nEND\r\n", t)
+
+	sendRequest(conn, "append key abc 0 3\r\nabc\r\n", t)
+	expectResponse(r, "CLIENT_ERROR bad command line format\r\n", t)
+}
+
+func TestServer_AppendPrepend(t *testing.T) {
+	checkAppendPrepend(false, t)
+	checkAppendPrepend(true, t)
+}
+
+func TestServer_Replace(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+
+	sendRequest(conn, "replace key 0 0 5\r\nvalue\r\nget key\r\n", t)
+	expectResponse(r, "NOT_STORED\r\nEND\r\n", t)
+
+	sendRequest(conn, "add key 0 0 5\r\nvalue\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+	sendRequest(conn, "add key 0 0 5\r\nfoo12\r\n", t)
+	expectResponse(r, "NOT_STORED\r\n", t)
+	sendRequest(conn, "replace key 123 0 9\r\nnew value\r\nget key\r\n", t)
+	expectResponse(r, "STORED\r\nVALUE key 123 9\r\nnew value\r\nEND\r\n", t)
+	sendRequest(conn, "replace key 0 0 3 noreply\r\nabc\r\nget key\r\n", t)
+	expectResponse(r, "VALUE key 0 3\r\nabc\r\nEND\r\n", t)
+
+	sendRequest(conn, "delete key\r\nreplace key 0 0 3\r\nabc\r\n", t)
+	expectResponse(r, "DELETED\r\nNOT_STORED\r\n", t)
+}
+
+func TestServer_ConcurrentAdd(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.Start()
+	defer s.Stop()
+
+	testConcurrentAdd(t)
+}
+
+func TestServer_ConcurrentAddOverTombstones(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.DeleteTombstoneWindow = time.Hour
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	var req, resp bytes.Buffer
+	for j := 0; j < 100; j++ {
+		fmt.Fprintf(&req, "set key_%d 0 0 5\r\nvalue\r\ndelete key_%d\r\n", j, j)
+		resp.WriteString("STORED\r\nDELETED\r\n")
+	}
+	sendRequest(conn, req.String(), t)
+	expectResponse(r, resp.String(), t)
+
+	testConcurrentAdd(t)
+}
+
+// Sends add commands for the same keys via concurrent connections
+// and verifies that each key is stored exactly once.
+func testConcurrentAdd(t *testing.T) {
+	const keysCount = 100
+	const connsCount = 4
+	var storedCounts [keysCount]int32
+	var wg sync.WaitGroup
+	for i := 0; i < connsCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", testAddr)
+			if err != nil {
+				t.Errorf("Cannot connect to test server at %s: [%s]", testAddr, err)
+				return
+			}
+			defer conn.Close()
+			var req bytes.Buffer
+			for j := 0; j < keysCount; j++ {
+				fmt.Fprintf(&req, "add key_%d 0 0 5\r\nvalue\r\n", j)
+			}
+			if _, err := conn.Write(req.Bytes()); err != nil {
+				t.Errorf("Cannot send request to the server: [%s]", err)
+				return
+			}
+			r := bufio.NewReader(conn)
+			for j := 0; j < keysCount; j++ {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					t.Errorf("Cannot read response: [%s]", err)
+					return
+				}
+				switch line {
+				case "STORED\r\n":
+					atomic.AddInt32(&storedCounts[j], 1)
+				case "NOT_STORED\r\n":
+				default:
+					t.Errorf("Unexpected response=[%s] for key_%d", line, j)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for i, n := range storedCounts {
+		if n != 1 {
+			t.Fatalf("Unexpected number of stored items for key_%d: %d. Expected 1", i, n)
+		}
+	}
+}
+
+func TestServer_ConcurrentReadModifyWrite(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	sendRequest(conn, "set counter 0 0 1\r\n0\r\nset list 0 0 0\r\n\r\n", t)
+	expectResponse(r, "STORED\r\nSTORED\r\n", t)
+
+	// Concurrent incr, append and touch commands mustn't lose updates.
+	const requestsCount = 300
+	const connsCount = 3
+	var wg sync.WaitGroup
+	for i := 0; i < connsCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", testAddr)
+			if err != nil {
+				t.Errorf("Cannot connect to test server at %s: [%s]", testAddr, err)
+				return
+			}
+			defer conn.Close()
+			var req bytes.Buffer
+			for j := 0; j < requestsCount; j++ {
+				req.WriteString("incr counter 1 noreply\r\nappend list 0 0 1 noreply\r\nx\r\ntouch counter 0 noreply\r\ntouch list 0 noreply\r\n")
+			}
+			req.WriteString("quit\r\n")
+			if _, err := conn.Write(req.Bytes()); err != nil {
+				t.Errorf("Cannot send request to the server: [%s]", err)
+				return
+			}
+			io.Copy(io.Discard, conn)
+		}()
+	}
+	wg.Wait()
+
+	n := connsCount * requestsCount
+	sendRequest(conn, "get counter list\r\n", t)
+	expectResponse(r, fmt.Sprintf("VALUE counter 0 %d\r\n%d\r\nVALUE list 0 %d\r\n%s\r\nEND\r\n",
+		len(strconv.Itoa(n)), n, n, strings.Repeat("x", n)), t)
+}
+
+func TestServer_ConcurrentCas(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	sendRequest(conn, "set list 0 0 0\r\n\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+
+	// Concurrent appends mustn't be lost because of cas commands
+	// and vice versa.
+	const requestsCount = 1000
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		conn, err := net.Dial("tcp", testAddr)
+		if err != nil {
+			t.Errorf("Cannot connect to test server at %s: [%s]", testAddr, err)
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for j := 0; j < requestsCount; j++ {
+			if _, err := conn.Write([]byte("append list 0 0 1\r\nx\r\n")); err != nil {
+				t.Errorf("Cannot send request to the server: [%s]", err)
+				return
+			}
+			if line, err := r.ReadString('\n'); err != nil || line != "STORED\r\n" {
+				t.Errorf("Unexpected append response=[%s]: [%v]", line, err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		conn, err := net.Dial("tcp", testAddr)
+		if err != nil {
+			t.Errorf("Cannot connect to test server at %s: [%s]", testAddr, err)
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for j := 0; j < requestsCount; {
+			if _, err := conn.Write([]byte("gets list\r\n")); err != nil {
+				t.Errorf("Cannot send request to the server: [%s]", err)
+				return
+			}
+			var size int
+			var casid uint64
+			if _, err := fmt.Fscanf(r, "VALUE list 0 %d %d\r\n", &size, &casid); err != nil {
+				t.Errorf("Cannot parse gets response: [%s]", err)
+				return
+			}
+			value := make([]byte, size+len("\r\nEND\r\n"))
+			if _, err := io.ReadFull(r, value); err != nil {
+				t.Errorf("Cannot read gets response: [%s]", err)
+				return
+			}
+			fmt.Fprintf(conn, "cas list 0 0 %d %d\r\n%sy\r\n", size+1, casid, value[:size])
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Errorf("Cannot read cas response: [%s]", err)
+				return
+			}
+			switch line {
+			case "STORED\r\n":
+				j++
+			case "EXISTS\r\n":
+			default:
+				t.Errorf("Unexpected cas response=[%s]", line)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	sendRequest(conn, "get list\r\n", t)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Cannot read get response: [%s]", err)
+	}
+	if line != fmt.Sprintf("VALUE list 0 %d\r\n", 2*requestsCount) {
+		t.Fatalf("Unexpected get response=[%s]", line)
+	}
+	value, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Cannot read get response: [%s]", err)
+	}
+	if n := strings.Count(value, "x"); n != requestsCount {
+		t.Fatalf("Unexpected number of appended chunks: %d. Expected %d", n, requestsCount)
+	}
+	expectResponse(r, "END\r\n", t)
+}
+
+func TestServer_Touch(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+
+	sendRequest(conn, "touch key 100\r\n", t)
+	expectResponse(r, "NOT_FOUND\r\n", t)
+
+	sendRequest(conn, "set key 123 1 5\r\nvalue\r\ngets key\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Cannot read gets response: [%s]", err)
+	}
+	expectResponse(r, "value\r\nEND\r\n", t)
+
+	sendRequest(conn, "touch key 100\r\n", t)
+	expectResponse(r, "TOUCHED\r\n", t)
+
+	// The item must survive the original expiration with unchanged
+	// casid, flags and value.
+	time.Sleep(1100 * time.Millisecond)
+	sendRequest(conn, "gets key\r\n", t)
+	expectResponse(r, line+"value\r\nEND\r\n", t)
+
+	sendRequest(conn, "touch key -1 noreply\r\n", t)
+	time.Sleep(10 * time.Millisecond)
+	sendRequest(conn, "get key\r\n", t)
+	expectResponse(r, "END\r\n", t)
+}
+
+func TestServer_Gat(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+
+	sendRequest(conn, "gat 100 key\r\ngat 100\r\n", t)
+	expectResponse(r, "END\r\nEND\r\n", t)
+
+	sendRequest(conn, "set key 123 1 5\r\nvalue\r\nset key1 0 1 3\r\nabc\r\n", t)
+	expectResponse(r, "STORED\r\nSTORED\r\n", t)
+	sendRequest(conn, "gat 100 key missing key1\r\n", t)
+	expectResponse(r, "VALUE key 123 5\r\nvalue\r\nVALUE key1 0 3\r\nabc\r\nEND\r\n", t)
+	sendRequest(conn, "gets key\r\n", t)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Cannot read gets response: [%s]", err)
+	}
+	expectResponse(r, "value\r\nEND\r\n", t)
+
+	// Items must survive the original expiration.
+	time.Sleep(1100 * time.Millisecond)
+	sendRequest(conn, "gats 100 key\r\n", t)
+	expectResponse(r, line+"value\r\nEND\r\n", t)
+	sendRequest(conn, "get key1\r\n", t)
+	expectResponse(r, "VALUE key1 0 3\r\nabc\r\nEND\r\n", t)
+}
+
+func TestServer_PlainCacher(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+
+	// Hide optional interfaces implemented by ybc.Cache.
+	s.Cache = struct{ ybc.Cacher }{cache}
+	s.ReportCacheStats = true
+	if err := s.Start(); err == nil {
+		s.Stop()
+		t.Fatalf("ReportCacheStats must require ybc.StatsReporter")
+	}
+	s.ReportCacheStats = false
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+
+	sendRequest(conn, "set key 123 1 5\r\nvalue\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+	sendRequest(conn, "touch key 100\r\ntouch missing 100\r\n", t)
+	expectResponse(r, "TOUCHED\r\nNOT_FOUND\r\n", t)
+	sendRequest(conn, "gat 100 key\r\n", t)
+	expectResponse(r, "VALUE key 123 5\r\nvalue\r\nEND\r\n", t)
+
+	// The item must survive the original expiration.
+	time.Sleep(1100 * time.Millisecond)
+	sendRequest(conn, "get key\r\n", t)
+	expectResponse(r, "VALUE key 123 5\r\nvalue\r\nEND\r\n", t)
+}
+
+func openTestEncryptedCache(t *testing.T, config *ybc.Config) *ybc.EncryptedCache {
+	ec, err := config.OpenEncryptedCache([]byte("0123456789abcdef"), true)
+	if err != nil {
+		t.Fatalf("Cannot open encrypted cache: [%s]", err)
+	}
+	return ec
+}
+
+func TestServer_EncryptedCache(t *testing.T) {
+	config := &ybc.Config{
+		MaxItemsCount: 1000 * 1000,
+		DataFileSize:  10 * 1000 * 1000,
+		DataFile:      "test-cache.encrypted",
+	}
+	defer os.Remove(config.DataFile)
+
+	ec := openTestEncryptedCache(t, config)
+	s := &Server{
+		Cache:      ec,
+		ListenAddr: testAddr,
+	}
+	s.Start()
+
+	conn, r := dialServer(t)
+	sendRequest(conn, "set secretkey 123 0 11\r\nsecretvalue\r\nadd secretkey 0 0 3\r\nabc\r\n", t)
+	expectResponse(r, "STORED\r\nNOT_STORED\r\n", t)
+	sendRequest(conn, "append secretkey 0 0 3\r\nabc\r\ntouch secretkey 100\r\n", t)
+	expectResponse(r, "STORED\r\nTOUCHED\r\n", t)
+	conn.Close()
+	s.Stop()
+	if err := ec.Close(); err != nil {
+		t.Fatalf("Cannot close encrypted cache: [%s]", err)
+	}
+
+	data, err := os.ReadFile(config.DataFile)
+	if err != nil {
+		t.Fatalf("Cannot read encrypted cache file: [%s]", err)
+	}
+	if bytes.Contains(data, []byte("secret")) {
+		t.Fatalf("Plaintext is found in the encrypted cache file")
+	}
+
+	ec = openTestEncryptedCache(t, config)
+	defer ec.Close()
+	s.Cache = ec
+	s.Start()
+	defer s.Stop()
+
+	conn, r = dialServer(t)
+	defer conn.Close()
+	sendRequest(conn, "gat 100 secretkey\r\n", t)
+	expectResponse(r, "VALUE secretkey 123 14\r\nsecretvalueabc\r\nEND\r\n", t)
+}
+
+func TestServer_StandardStats(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+
+	req := "set key 0 0 5\r\nvalue\r\nadd key 0 0 5\r\nvalue\r\nget key missing\r\ngets key\r\n"
+	sendRequest(conn, req, t)
+	resp := "STORED\r\nNOT_STORED\r\nVALUE key 0 5\r\nvalue\r\nEND\r\n"
+	expectResponse(r, resp, t)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Cannot read gets response: [%s]", err)
+	}
+	expectResponse(r, "value\r\nEND\r\n", t)
+	resp += line + "value\r\nEND\r\n"
+
+	stats := readStats(t)
+	expectedStats := map[string]string{
+		"curr_connections": "2",
+		"cmd_get":          "3",
+		"cmd_set":          "2",
+		"get_hits":         "2",
+		"get_misses":       "1",
+		"bytes_read":       strconv.Itoa(len(req) + len("stats\r\n")),
+		"bytes_written":    strconv.Itoa(len(resp)),
+		"evictions":        "0",
+	}
+	for name, expectedValue := range expectedStats {
+		if stats[name] != expectedValue {
+			t.Fatalf("Unexpected stat %s=[%s]. Expected [%s]", name, stats[name], expectedValue)
+		}
+	}
+	if _, err := strconv.Atoi(stats["uptime"]); err != nil {
+		t.Fatalf("Cannot parse uptime=[%s]: [%s]", stats["uptime"], err)
+	}
+}
+
+func TestServer_Version(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+
+	sendRequest(conn, "version\r\nversion\r\n", t)
+	expectResponse(r, "VERSION 1.4.0-ybc\r\nVERSION 1.4.0-ybc\r\n", t)
+	conn.Close()
+	s.Stop()
+
+	s.Version = "1.2.3"
+	s.Start()
+	conn, r = dialServer(t)
+	defer conn.Close()
+	sendRequest(conn, "version\r\n", t)
+	expectResponse(r, "VERSION 1.2.3\r\n", t)
+}
+
+func TestServer_Verbosity(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.Start()
+	defer s.Stop()
+
+	var logBuf logBuffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+
+	sendRequest(conn, "get foo\r\nverbosity 2\r\nget bar\r\nverbosity 0 noreply\r\nget baz\r\nversion\r\n", t)
+	expectResponse(r, "END\r\nOK\r\nEND\r\nEND\r\nVERSION 1.4.0-ybc\r\n", t)
+
+	logged := logBuf.String()
+	if !strings.Contains(logged, "[get bar]") {
+		t.Fatalf("Unexpected log output=[%s]. Expected [get bar] command to be logged", logged)
+	}
+	if strings.Contains(logged, "[get foo]") || strings.Contains(logged, "[get baz]") {
+		t.Fatalf("Unexpected log output=[%s]. Commands mustn't be logged at verbosity 0", logged)
+	}
+
+	sendRequest(conn, "verbosity foo\r\n", t)
+	expectResponse(r, "CLIENT_ERROR bad command line format\r\n", t)
+}
+
+// Logger recording messages with their levels.
+type levelLogger struct {
+	mu       sync.Mutex
+	messages map[LogLevel][]string
+}
+
+func (l *levelLogger) Logf(level LogLevel, format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.messages == nil {
+		l.messages = make(map[LogLevel][]string)
+	}
+	l.messages[level] = append(l.messages[level], fmt.Sprintf(format, args...))
+}
+
+func (l *levelLogger) contains(level LogLevel, substr string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, msg := range l.messages[level] {
+		if strings.Contains(msg, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestServer_Logger(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	var logger levelLogger
+	s.Logger = &logger
+	s.Verbosity = 2
+	s.Start()
+	defer s.Stop()
+
+	var logBuf logBuffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	conn, r := dialServer(t)
+	sendRequest(conn, "get foo\r\nfoobar\r\n", t)
+	expectResponse(r, "END\r\nERROR\r\n", t)
+	sendRequest(conn, "delete foo bar baz\r\nset foo bar 0 3\r\nabc\r\n", t)
+	expectResponse(r, "CLIENT_ERROR bad command line format\r\nCLIENT_ERROR bad command line format\r\n", t)
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	for _, expected := range []struct {
+		level  LogLevel
+		substr string
+	}{
+		{LogLevelInfo, "Accepted connection"},
+		{LogLevelDebug, "[get foo]"},
+		{LogLevelWarning, "Unrecognized command=[foobar]"},
+		{LogLevelWarning, "Invalid command arguments=[foo bar baz]"},
+		{LogLevelWarning, "Invalid command arguments=[foo bar 0 3]"},
+		{LogLevelInfo, "Closed connection"},
+	} {
+		if !logger.contains(expected.level, expected.substr) {
+			t.Fatalf("Cannot find [%s] in messages logged with level %s: %v", expected.substr, expected.level, logger.messages)
+		}
+	}
+	if logged := logBuf.String(); logged != "" {
+		t.Fatalf("Unexpected output=[%s] to the standard logger", logged)
+	}
+}
+
+func TestServer_ErrorResponses(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+
+	// Unrecognized commands and empty lines.
+	sendRequest(conn, "foobar\r\n\r\n", t)
+	expectResponse(r, "ERROR\r\nERROR\r\n", t)
+
+	// Invalid command lines.
+	for _, req := range []string{
+		"delete key foo\r\n",
+		"incr key\r\n",
+		"touch key foo\r\n",
+		"cget key foo\r\n",
+		"getde key\r\n",
+		"flush_all foo\r\n",
+		"stats foo\r\n",
+	} {
+		sendRequest(conn, req, t)
+		expectResponse(r, "CLIENT_ERROR bad command line format\r\n", t)
+	}
+
+	// The payload must be skipped if its size is known.
+	sendRequest(conn, "set key 0 0 5 foo\r\nvalue\r\n", t)
+	expectResponse(r, "CLIENT_ERROR bad command line format\r\n", t)
+	sendRequest(conn, "cas key 0 0 5\r\nvalue\r\n", t)
+	expectResponse(r, "CLIENT_ERROR bad command line format\r\n", t)
+
+	// The payload is processed as a command line if its size is unknown.
+	sendRequest(conn, "set key 0 0 -5\r\nvalue\r\n", t)
+	expectResponse(r, "CLIENT_ERROR bad command line format\r\nERROR\r\n", t)
+
+	// Payloads not followed by \r\n.
+	sendRequest(conn, "set key 0 0 5\r\nvalue!!\r\n", t)
+	expectResponse(r, "CLIENT_ERROR bad data chunk\r\n", t)
+	sendRequest(conn, "append key 0 0 5\r\nvalue!!\r\n", t)
+	expectResponse(r, "CLIENT_ERROR bad data chunk\r\n", t)
+
+	// The connection must remain usable after errors.
+	sendRequest(conn, "set key 0 0 5\r\nvalue\r\nget key\r\n", t)
+	expectResponse(r, "STORED\r\nVALUE key 0 5\r\nvalue\r\nEND\r\n", t)
+
+	// ERROR responses aren't counted as client errors.
+	stats := s.Stats()
+	if stats.ClientErrors != 12 {
+		t.Fatalf("Unexpected ClientErrors=%d. Expected 12", stats.ClientErrors)
+	}
+	if stats.ServerErrors != 0 {
+		t.Fatalf("Unexpected ServerErrors=%d. Expected 0", stats.ServerErrors)
+	}
+}
+
+func TestServer_KeyValidation(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+
+	longKey := strings.Repeat("k", 250)
+	sendRequest(conn, "set "+longKey+" 0 0 5\r\nvalue\r\nget "+longKey+"\r\n", t)
+	expectResponse(r, "STORED\r\nVALUE "+longKey+" 0 5\r\nvalue\r\nEND\r\n", t)
+
+	for _, key := range []string{longKey + "k", "foo\x01bar", "foo\tbar", "foo\x7fbar"} {
+		sendRequest(conn, "set "+key+" 0 0 5\r\nvalue\r\n", t)
+		expectResponse(r, "CLIENT_ERROR bad command line format\r\n", t)
+		sendRequest(conn, "get foo "+key+"\r\n", t)
+		expectResponse(r, "CLIENT_ERROR bad command line format\r\n", t)
+		sendRequest(conn, "delete "+key+"\r\n", t)
+		expectResponse(r, "CLIENT_ERROR bad command line format\r\n", t)
+		sendRequest(conn, "incr "+key+" 1\r\n", t)
+		expectResponse(r, "CLIENT_ERROR bad command line format\r\n", t)
+	}
+	conn.Close()
+	s.Stop()
+
+	s.MaxKeySize = 300
+	s.Start()
+	conn, r = dialServer(t)
+	defer conn.Close()
+	sendRequest(conn, "set "+longKey+"k 0 0 5\r\nvalue\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+}
+
+func TestServer_MaxValueSize(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.MaxValueSize = 5
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+
+	sendRequest(conn, "set key 0 0 5\r\nvalue\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+
+	for _, cmd := range []string{"set", "add", "replace", "append", "prepend"} {
+		sendRequest(conn, cmd+" key 0 0 6\r\nvalue1\r\n", t)
+		expectResponse(r, "SERVER_ERROR object too large for cache\r\n", t)
+	}
+	sendRequest(conn, "cas key 0 0 6 123\r\nvalue1\r\n", t)
+	expectResponse(r, "SERVER_ERROR object too large for cache\r\n", t)
+
+	// The resulting value for append and prepend mustn't exceed the limit.
+	sendRequest(conn, "append key 0 0 1\r\n1\r\n", t)
+	expectResponse(r, "SERVER_ERROR object too large for cache\r\n", t)
+
+	sendRequest(conn, "get key\r\n", t)
+	expectResponse(r, "VALUE key 0 5\r\nvalue\r\nEND\r\n", t)
+
+	stats := s.Stats()
+	if stats.ServerErrors != 7 {
+		t.Fatalf("Unexpected ServerErrors=%d. Expected 7", stats.ServerErrors)
+	}
+	if stats.ClientErrors != 0 {
+		t.Fatalf("Unexpected ClientErrors=%d. Expected 0", stats.ClientErrors)
+	}
+}
+
+func binaryRequestPacket(opcode byte, cas uint64, extras, key, value []byte) []byte {
+	var h [binaryHeaderSize]byte
+	h[0] = binaryRequestMagic
+	h[1] = opcode
+	binary.BigEndian.PutUint16(h[2:], uint16(len(key)))
+	h[4] = byte(len(extras))
+	binary.BigEndian.PutUint32(h[8:], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(h[12:], uint32(opcode)+1000)
+	binary.BigEndian.PutUint64(h[16:], cas)
+	packet := append(h[:], extras...)
+	packet = append(packet, key...)
+	return append(packet, value...)
+}
+
+type binaryResponse struct {
+	opcode byte
+	status uint16
+	cas    uint64
+	extras []byte
+	key    []byte
+	value  []byte
+}
+
+func readBinaryResponse(r *bufio.Reader, t *testing.T) *binaryResponse {
+	var h [binaryHeaderSize]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		t.Fatalf("Cannot read binary response header: [%s]", err)
+	}
+	if h[0] != binaryResponseMagic {
+		t.Fatalf("Unexpected magic=[%d] in binary response. Expected [%d]", h[0], binaryResponseMagic)
+	}
+	if opaque := binary.BigEndian.Uint32(h[12:]); opaque != uint32(h[1])+1000 {
+		t.Fatalf("Unexpected opaque=%d in binary response for opcode=[%d]", opaque, h[1])
+	}
+	keyLen := int(binary.BigEndian.Uint16(h[2:]))
+	extrasLen := int(h[4])
+	body := make([]byte, binary.BigEndian.Uint32(h[8:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		t.Fatalf("Cannot read binary response body: [%s]", err)
+	}
+	return &binaryResponse{
+		opcode: h[1],
+		status: binary.BigEndian.Uint16(h[6:]),
+		cas:    binary.BigEndian.Uint64(h[16:]),
+		extras: body[:extrasLen],
+		key:    body[extrasLen : extrasLen+keyLen],
+		value:  body[extrasLen+keyLen:],
+	}
+}
+
+func expectBinaryResponse(r *bufio.Reader, opcode byte, status uint16, key, value string, t *testing.T) *binaryResponse {
+	resp := readBinaryResponse(r, t)
+	if resp.opcode != opcode || resp.status != status {
+		t.Fatalf("Unexpected binary response opcode=[%d], status=[%d]. Expected opcode=[%d], status=[%d]", resp.opcode, resp.status, opcode, status)
+	}
+	if string(resp.key) != key {
+		t.Fatalf("Unexpected key=[%s] in binary response. Expected [%s]", resp.key, key)
+	}
+	if status == statusNoError && string(resp.value) != value {
+		t.Fatalf("Unexpected value=[%s] in binary response. Expected [%s]", resp.value, value)
+	}
+	return resp
+}
+
+func TestServer_BinaryProtocol(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+
+	setExtras := []byte{0, 0, 0, 123, 0, 0, 0, 0}
+	sendRequest(conn, string(binaryRequestPacket(opSet, 0, setExtras, []byte("key"), []byte("value"))), t)
+	setResp := expectBinaryResponse(r, opSet, statusNoError, "", "", t)
+
+	sendRequest(conn, string(binaryRequestPacket(opGetK, 0, nil, []byte("key"), nil)), t)
+	resp := expectBinaryResponse(r, opGetK, statusNoError, "key", "value", t)
+	if !bytes.Equal(resp.extras, setExtras[:4]) {
+		t.Fatalf("Unexpected flags=[%v] in get response. Expected [%v]", resp.extras, setExtras[:4])
+	}
+	if resp.cas != setResp.cas {
+		t.Fatalf("Unexpected cas=%d in get response. Expected %d", resp.cas, setResp.cas)
+	}
+
+	// cas
+	sendRequest(conn, string(binaryRequestPacket(opSet, setResp.cas+1, setExtras, []byte("key"), []byte("foo"))), t)
+	expectBinaryResponse(r, opSet, statusKeyExists, "", "", t)
+	sendRequest(conn, string(binaryRequestPacket(opSet, setResp.cas, setExtras, []byte("key"), []byte("foo"))), t)
+	expectBinaryResponse(r, opSet, statusNoError, "", "", t)
+
+	// add and replace
+	sendRequest(conn, string(binaryRequestPacket(opAdd, 0, setExtras, []byte("key"), []byte("bar"))), t)
+	expectBinaryResponse(r, opAdd, statusKeyExists, "", "", t)
+	sendRequest(conn, string(binaryRequestPacket(opReplace, 0, setExtras, []byte("missing"), []byte("bar"))), t)
+	expectBinaryResponse(r, opReplace, statusKeyNotFound, "", "", t)
+
+	// append and prepend
+	sendRequest(conn, string(binaryRequestPacket(opAppend, 0, nil, []byte("key"), []byte("bar"))), t)
+	expectBinaryResponse(r, opAppend, statusNoError, "", "", t)
+	sendRequest(conn, string(binaryRequestPacket(opPrepend, 0, nil, []byte("key"), []byte("<"))), t)
+	expectBinaryResponse(r, opPrepend, statusNoError, "", "", t)
+	sendRequest(conn, string(binaryRequestPacket(opGet, 0, nil, []byte("key"), nil)), t)
+	expectBinaryResponse(r, opGet, statusNoError, "", "<foobar", t)
+
+	// incr and decr
+	incrExtras := []byte{0, 0, 0, 0, 0, 0, 0, 5, 0, 0, 0, 0, 0, 0, 0, 10, 0, 0, 0, 0}
+	sendRequest(conn, string(binaryRequestPacket(opIncrement, 0, incrExtras, []byte("num"), nil)), t)
+	expectBinaryResponse(r, opIncrement, statusNoError, "", "\x00\x00\x00\x00\x00\x00\x00\x0a", t)
+	sendRequest(conn, string(binaryRequestPacket(opIncrement, 0, incrExtras, []byte("num"), nil)), t)
+	expectBinaryResponse(r, opIncrement, statusNoError, "", "\x00\x00\x00\x00\x00\x00\x00\x0f", t)
+	sendRequest(conn, string(binaryRequestPacket(opDecrement, 0, incrExtras, []byte("key"), nil)), t)
+	expectBinaryResponse(r, opDecrement, statusNonNumeric, "", "", t)
+	noInitialExtras := append(append([]byte{}, incrExtras[:16]...), 0xff, 0xff, 0xff, 0xff)
+	sendRequest(conn, string(binaryRequestPacket(opIncrement, 0, noInitialExtras, []byte("missing"), nil)), t)
+	expectBinaryResponse(r, opIncrement, statusKeyNotFound, "", "", t)
+
+	// Quiet commands respond only on errors and cache hits, noop flushes
+	// responses.
+	req := binaryRequestPacket(opSetQ, 0, setExtras, []byte("key1"), []byte("value1"))
+	req = append(req, binaryRequestPacket(opGetQ, 0, nil, []byte("missing"), nil)...)
+	req = append(req, binaryRequestPacket(opGetKQ, 0, nil, []byte("key1"), nil)...)
+	req = append(req, binaryRequestPacket(opDeleteQ, 0, nil, []byte("missing"), nil)...)
+	req = append(req, binaryRequestPacket(opNoop, 0, nil, nil, nil)...)
+	sendRequest(conn, string(req), t)
+	expectBinaryResponse(r, opGetKQ, statusNoError, "key1", "value1", t)
+	expectBinaryResponse(r, opDeleteQ, statusKeyNotFound, "", "", t)
+	expectBinaryResponse(r, opNoop, statusNoError, "", "", t)
+
+	// delete and touch
+	sendRequest(conn, string(binaryRequestPacket(opDelete, 0, nil, []byte("key1"), nil)), t)
+	expectBinaryResponse(r, opDelete, statusNoError, "", "", t)
+	sendRequest(conn, string(binaryRequestPacket(opGet, 0, nil, []byte("key1"), nil)), t)
+	expectBinaryResponse(r, opGet, statusKeyNotFound, "", "", t)
+	sendRequest(conn, string(binaryRequestPacket(opTouch, 0, []byte{0, 0, 0, 100}, []byte("key"), nil)), t)
+	expectBinaryResponse(r, opTouch, statusNoError, "", "", t)
+	sendRequest(conn, string(binaryRequestPacket(opGat, 0, []byte{0, 0, 0, 100}, []byte("key"), nil)), t)
+	expectBinaryResponse(r, opGat, statusNoError, "", "<foobar", t)
+
+	// Invalid and unknown requests.
+	sendRequest(conn, string(binaryRequestPacket(opGet, 0, nil, nil, nil)), t)
+	expectBinaryResponse(r, opGet, statusInvalidArgs, "", "", t)
+	sendRequest(conn, string(binaryRequestPacket(opSet, 0, nil, []byte("key"), []byte("value"))), t)
+	expectBinaryResponse(r, opSet, statusInvalidArgs, "", "", t)
+	sendRequest(conn, string(binaryRequestPacket(0x21, 0, nil, []byte("PLAIN"), []byte("secret"))), t)
+	expectBinaryResponse(r, 0x21, statusUnknownCommand, "", "", t)
+
+	sendRequest(conn, string(binaryRequestPacket(opVersion, 0, nil, nil, nil)), t)
+	expectBinaryResponse(r, opVersion, statusNoError, "", "1.4.0-ybc", t)
+
+	sendRequest(conn, string(binaryRequestPacket(opStat, 0, nil, nil, nil)), t)
+	stats := make(map[string]string)
+	for {
+		resp := readBinaryResponse(r, t)
+		if len(resp.key) == 0 {
+			break
+		}
+		stats[string(resp.key)] = string(resp.value)
+	}
+	if stats["curr_connections"] != "1" {
+		t.Fatalf("Unexpected curr_connections=[%s] in binary stats. Expected [1]", stats["curr_connections"])
+	}
+
+	sendRequest(conn, string(binaryRequestPacket(opFlush, 0, nil, nil, nil)), t)
+	expectBinaryResponse(r, opFlush, statusNoError, "", "", t)
+	sendRequest(conn, string(binaryRequestPacket(opGet, 0, nil, []byte("key"), nil)), t)
+	expectBinaryResponse(r, opGet, statusKeyNotFound, "", "", t)
+
+	sendRequest(conn, string(binaryRequestPacket(opQuit, 0, nil, nil, nil)), t)
+	expectBinaryResponse(r, opQuit, statusNoError, "", "", t)
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("Unexpected error=[%s] after quit. Expected io.EOF", err)
+	}
+}
+
+func udpRequest(conn net.Conn, requestID uint16, req string, t *testing.T) string {
+	var h [udpHeaderSize]byte
+	binary.BigEndian.PutUint16(h[:], requestID)
+	binary.BigEndian.PutUint16(h[4:], 1)
+	if _, err := conn.Write(append(h[:], req...)); err != nil {
+		t.Fatalf("Cannot send UDP request=[%s]: [%s]", req, err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var chunks []string
+	buf := make([]byte, udpMaxDatagramSize)
+	for received := 0; received == 0 || received < len(chunks); received++ {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("Cannot read UDP response for request=[%s]: [%s]", req, err)
+		}
+		if n < udpHeaderSize {
+			t.Fatalf("Too short UDP response datagram: %d bytes", n)
+		}
+		if id := binary.BigEndian.Uint16(buf); id != requestID {
+			t.Fatalf("Unexpected request id=%d in UDP response. Expected %d", id, requestID)
+		}
+		seq := int(binary.BigEndian.Uint16(buf[2:]))
+		total := int(binary.BigEndian.Uint16(buf[4:]))
+		if chunks == nil {
+			chunks = make([]string, total)
+		}
+		if total != len(chunks) || seq >= total {
+			t.Fatalf("Unexpected seq=%d, total=%d in UDP response. Expected total=%d", seq, total, len(chunks))
+		}
+		chunks[seq] = string(buf[udpHeaderSize:n])
+	}
+	return strings.Join(chunks, "")
+}
+
+func TestServer_UDP(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.UDPListenAddr = testAddr
+	s.Start()
+	defer s.Stop()
+
+	conn, err := net.Dial("udp", testAddr)
+	if err != nil {
+		t.Fatalf("Cannot connect to UDP test server at %s: [%s]", testAddr, err)
+	}
+	defer conn.Close()
+
+	if resp := udpRequest(conn, 1, "set key 0 0 5\r\nvalue\r\nget key\r\n", t); resp != "STORED\r\nVALUE key 0 5\r\nvalue\r\nEND\r\n" {
+		t.Fatalf("Unexpected UDP response=[%s]", resp)
+	}
+
+	// Large responses must be split into multiple datagrams.
+	value := strings.Repeat("0123456789", 500)
+	if resp := udpRequest(conn, 2, fmt.Sprintf("set big 0 0 %d\r\n%s\r\n", len(value), value), t); resp != "STORED\r\n" {
+		t.Fatalf("Unexpected UDP response=[%s]", resp)
+	}
+	expectedResp := fmt.Sprintf("VALUE big 0 %d\r\n%s\r\nEND\r\n", len(value), value)
+	if resp := udpRequest(conn, 3, "get big\r\n", t); resp != expectedResp {
+		t.Fatalf("Unexpected UDP response=[%s]. Expected [%s]", resp, expectedResp)
+	}
+}
+
+// Cacher, which blocks GetItem() calls until unblockCh is closed.
+type blockingCacher struct {
+	ybc.Cacher
+	blockedCh chan struct{}
+	unblockCh chan struct{}
+}
+
+func (c *blockingCacher) GetItem(key []byte) (item *ybc.Item, err error) {
+	c.blockedCh <- struct{}{}
+	<-c.unblockCh
+	return c.Cacher.GetItem(key)
+}
+
+func TestServer_MaxUDPRequests(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	bc := &blockingCacher{
+		Cacher:    cache,
+		blockedCh: make(chan struct{}, 1),
+		unblockCh: make(chan struct{}),
+	}
+	s.Cache = bc
+	s.UDPListenAddr = testAddr
+	s.MaxUDPRequests = 1
+	s.Start()
+	defer s.Stop()
+
+	conn, err := net.Dial("udp", testAddr)
+	if err != nil {
+		t.Fatalf("Cannot connect to UDP test server at %s: [%s]", testAddr, err)
+	}
+	defer conn.Close()
+
+	respCh := make(chan string, 1)
+	go func() {
+		respCh <- udpRequest(conn, 1, "get key\r\n", t)
+	}()
+	<-bc.blockedCh
+
+	// The request exceeding MaxUDPRequests must be dropped.
+	var h [udpHeaderSize]byte
+	binary.BigEndian.PutUint16(h[:], 2)
+	binary.BigEndian.PutUint16(h[4:], 1)
+	if _, err = conn.Write(append(h[:], "get key\r\n"...)); err != nil {
+		t.Fatalf("Cannot send UDP request: [%s]", err)
+	}
+	for i := 0; s.Stats().DroppedUDPRequests == 0; i++ {
+		if i > 100 {
+			t.Fatalf("The UDP request exceeding MaxUDPRequests isn't dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(bc.unblockCh)
+	if resp := <-respCh; resp != "END\r\n" {
+		t.Fatalf("Unexpected UDP response=[%s]", resp)
+	}
+	if n := s.Stats().DroppedUDPRequests; n != 1 {
+		t.Fatalf("Unexpected DroppedUDPRequests=%d. Expected 1", n)
+	}
+}
+
+func TestServer_FlushAllDelayedAfterDisconnect(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	sendRequest(conn, "set key 0 0 5\r\nvalue\r\nflush_all 1\r\n", t)
+	expectResponse(r, "STORED\r\nOK\r\n", t)
+
+	// The delayed flush_all must survive the connection which issued it.
+	conn.Close()
+
+	conn, r = dialServer(t)
+	defer conn.Close()
+	sendRequest(conn, "get key\r\n", t)
+	expectResponse(r, "VALUE key 0 5\r\nvalue\r\nEND\r\n", t)
+
+	time.Sleep(2 * time.Second)
+	sendRequest(conn, "get key\r\n", t)
+	expectResponse(r, "END\r\n", t)
+}
+
+// Returns self-signed certificate for localhost with the given common name.
+func newTestCertificate(commonName string, t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Cannot generate key: [%s]", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Cannot create certificate: [%s]", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Cannot parse certificate: [%s]", err)
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        cert,
+	}
+}
+
+func TestServer_TLS(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	cert := newTestCertificate("localhost", t)
+	s.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	s.Start()
+	defer s.Stop()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(cert.Leaf)
+	conn, err := tls.Dial("tcp", testAddr, &tls.Config{
+		RootCAs:    rootCAs,
+		ServerName: "localhost",
+	})
+	if err != nil {
+		t.Fatalf("Cannot establish TLS connection to the test server: [%s]", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	sendRequest(conn, "set key 0 0 5\r\nvalue\r\nget key\r\n", t)
+	expectResponse(r, "STORED\r\nVALUE key 0 5\r\nvalue\r\nEND\r\n", t)
+
+	// Unencrypted requests must be rejected.
+	plainConn, plainR := dialServer(t)
+	defer plainConn.Close()
+	sendRequest(plainConn, "get key\r\n", t)
+	plainConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := io.ReadAll(plainR)
+	if err != nil {
+		t.Fatalf("Unencrypted connection must be closed by the server: [%s]", err)
+	}
+	if bytes.Contains(resp, []byte("END")) {
+		t.Fatalf("Unexpected response=[%q] for unencrypted request", resp)
+	}
+}
+
+func expectClosedTLSConn(clientCert *tls.Certificate, rootCAs *x509.CertPool, t *testing.T) {
+	config := &tls.Config{
+		RootCAs:    rootCAs,
+		ServerName: "localhost",
+	}
+	if clientCert != nil {
+		config.Certificates = []tls.Certificate{*clientCert}
+	}
+	conn, err := tls.Dial("tcp", testAddr, config)
+	if err != nil {
+		// The handshake may fail on the client side.
+		return
+	}
+	defer conn.Close()
+	sendRequest(conn, "get key\r\n", t)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if resp, _ := io.ReadAll(conn); bytes.Contains(resp, []byte("END")) {
+		t.Fatalf("Unexpected response=[%q] for unauthorized client", resp)
+	}
+}
+
+func TestServer_ClientCerts(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	serverCert := newTestCertificate("localhost", t)
+	goodCert := newTestCertificate("good client", t)
+	badCert := newTestCertificate("bad client", t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(goodCert.Leaf)
+	clientCAs.AddCert(badCert.Leaf)
+	s.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    clientCAs,
+	}
+	s.RequireClientCerts = true
+	s.AuthorizeClientCert = func(remoteAddr net.Addr, cert *x509.Certificate) bool {
+		return cert != nil && cert.Subject.CommonName == "good client"
+	}
+	s.Start()
+	defer s.Stop()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(serverCert.Leaf)
+	conn, err := tls.Dial("tcp", testAddr, &tls.Config{
+		RootCAs:      rootCAs,
+		ServerName:   "localhost",
+		Certificates: []tls.Certificate{goodCert},
+	})
+	if err != nil {
+		t.Fatalf("Cannot establish TLS connection to the test server: [%s]", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	sendRequest(conn, "set key 0 0 5\r\nvalue\r\nget key\r\n", t)
+	expectResponse(r, "STORED\r\nVALUE key 0 5\r\nvalue\r\nEND\r\n", t)
+
+	expectClosedTLSConn(nil, rootCAs, t)
+	expectClosedTLSConn(&badCert, rootCAs, t)
+	untrustedCert := newTestCertificate("good client", t)
+	expectClosedTLSConn(&untrustedCert, rootCAs, t)
+
+	if s.TLSConfig.ClientAuth != tls.NoClientCert {
+		t.Fatalf("Server.TLSConfig must remain unmodified")
+	}
+}
+
+func TestServer_Authentication(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.Authenticator = func(username, password string) bool {
+		return username == "user" && password == "secret"
+	}
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	sendRequest(conn, "get key\r\n", t)
+	expectResponse(r, "CLIENT_ERROR unauthenticated\r\n", t)
+	sendRequest(conn, "set auth 0 0 10\r\nuser wrong\r\n", t)
+	expectResponse(r, "CLIENT_ERROR authentication failure\r\n", t)
+	sendRequest(conn, "set auth 0 0 11\r\nuser secret\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+	sendRequest(conn, "set key 0 0 5\r\nvalue\r\nget key\r\n", t)
+	expectResponse(r, "STORED\r\nVALUE key 0 5\r\nvalue\r\nEND\r\n", t)
+
+	// Binary protocol clients authenticate via SASL.
+	binConn, binR := dialServer(t)
+	defer binConn.Close()
+	sendRequest(binConn, string(binaryRequestPacket(opGet, 0, nil, []byte("key"), nil)), t)
+	expectBinaryResponse(binR, opGet, statusAuthError, "", "", t)
+	sendRequest(binConn, string(binaryRequestPacket(opSaslListMechs, 0, nil, nil, nil)), t)
+	expectBinaryResponse(binR, opSaslListMechs, statusNoError, "", "PLAIN", t)
+	sendRequest(binConn, string(binaryRequestPacket(opSaslAuth, 0, nil, []byte("PLAIN"), []byte("\x00user\x00wrong"))), t)
+	expectBinaryResponse(binR, opSaslAuth, statusAuthError, "", "", t)
+	sendRequest(binConn, string(binaryRequestPacket(opSaslAuth, 0, nil, []byte("PLAIN"), []byte("\x00user\x00secret"))), t)
+	expectBinaryResponse(binR, opSaslAuth, statusNoError, "", "Authenticated", t)
+	sendRequest(binConn, string(binaryRequestPacket(opGet, 0, nil, []byte("key"), nil)), t)
+	expectBinaryResponse(binR, opGet, statusNoError, "", "value", t)
+}
+
+func TestServer_StopGracefully(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.Start()
+
+	// Idle connections mustn't block Stop().
+	idleConn, idleR := dialServer(t)
+	defer idleConn.Close()
+	sendRequest(idleConn, "set key 0 0 5\r\nvalue\r\n", t)
+	expectResponse(idleR, "STORED\r\n", t)
+
+	// The in-flight request must be finished before closing the connection.
+	busyConn, busyR := dialServer(t)
+	defer busyConn.Close()
+	sendRequest(busyConn, "set key 0 0 5\r\nval", t)
+	time.Sleep(100 * time.Millisecond)
+
+	stopDone := make(chan struct{})
+	go func() {
+		s.StopGracefully(time.Second)
+		close(stopDone)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	sendRequest(busyConn, "ue\r\n", t)
+	expectResponse(busyR, "STORED\r\n", t)
+	if _, err := busyR.ReadByte(); err == nil {
+		t.Fatalf("The connection must be closed after the in-flight request")
+	}
+	if _, err := idleR.ReadByte(); err == nil {
+		t.Fatalf("The idle connection must be closed")
+	}
+	select {
+	case <-stopDone:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timeout when waiting for StopGracefully()")
+	}
+
+	// Connections with in-flight requests must be closed after the timeout.
+	s.Start()
+	busyConn, busyR = dialServer(t)
+	defer busyConn.Close()
+	sendRequest(busyConn, "set key 0 0 5\r\nval", t)
+	time.Sleep(100 * time.Millisecond)
+	s.StopGracefully(100 * time.Millisecond)
+	if _, err := busyR.ReadByte(); err == nil {
+		t.Fatalf("The connection must be closed after the timeout")
+	}
+}
+
+func TestServer_MaxConns(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.MaxConns = 2
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	sendRequest(conn, "version\r\n", t)
+	expectResponse(r, "VERSION 1.4.0-ybc\r\n", t)
+
+	// The second connection is used by readStats().
+	if stats := readStats(t); stats["rejected_connections"] != "0" {
+		t.Fatalf("Unexpected rejected_connections=[%s]. Expected [0]", stats["rejected_connections"])
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	conn2, r2 := dialServer(t)
+	defer conn2.Close()
+	sendRequest(conn2, "version\r\n", t)
+	expectResponse(r2, "VERSION 1.4.0-ybc\r\n", t)
+
+	rejectedConn, rejectedR := dialServer(t)
+	defer rejectedConn.Close()
+	expectResponse(rejectedR, "SERVER_ERROR too many connections\r\n", t)
+	if _, err := rejectedR.ReadByte(); err == nil {
+		t.Fatalf("The rejected connection must be closed")
+	}
+
+	conn2.Close()
+	// Wait until the server notices the closed connection.
+	time.Sleep(100 * time.Millisecond)
+	if stats := readStats(t); stats["rejected_connections"] != "1" {
+		t.Fatalf("Unexpected rejected_connections=[%s]. Expected [1]", stats["rejected_connections"])
+	}
+}
+
+func TestServer_MaxConnsBurst(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.MaxConns = 2
+	s.Start()
+	defer s.Stop()
+
+	// Connections accepted in a burst mustn't exceed Server.MaxConns.
+	conns := make([]net.Conn, 20)
+	readers := make([]*bufio.Reader, len(conns))
+	for i := range conns {
+		conns[i], readers[i] = dialServer(t)
+		defer conns[i].Close()
+	}
+	acceptedCount := 0
+	for i, conn := range conns {
+		conn.Write([]byte("version\r\n"))
+		line, err := readers[i].ReadString('\n')
+		if err != nil {
+			t.Fatalf("Cannot read response: [%s]", err)
+		}
+		switch line {
+		case "VERSION 1.4.0-ybc\r\n":
+			acceptedCount++
+		case "SERVER_ERROR too many connections\r\n":
+		default:
+			t.Fatalf("Unexpected response=[%s]", line)
+		}
+	}
+	if acceptedCount != s.MaxConns {
+		t.Fatalf("Unexpected number of accepted connections=%d. Expected %d", acceptedCount, s.MaxConns)
+	}
+}
+
+func TestServer_MaxConnsPerIP(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.MaxConnsPerIP = 1
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	sendRequest(conn, "version\r\n", t)
+	expectResponse(r, "VERSION 1.4.0-ybc\r\n", t)
+
+	rejectedConn, rejectedR := dialServer(t)
+	defer rejectedConn.Close()
+	expectResponse(rejectedR, "SERVER_ERROR too many connections\r\n", t)
+
+	// The connection slot must be released after closing the connection.
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	if stats := readStats(t); stats["rejected_connections"] != "1" {
+		t.Fatalf("Unexpected rejected_connections=[%s]. Expected [1]", stats["rejected_connections"])
+	}
+}
+
+func TestServer_DeniedNetworks(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.AllowedNetworks = []string{"127.0.0.0/8", "::1/128"}
+	s.DeniedNetworks = []string{"127.0.0.1/32"}
+	s.Start()
+	defer s.Stop()
+
+	conn, err := net.Dial("tcp", "127.0.0.1"+testAddr[strings.IndexByte(testAddr, ':'):])
+	if err != nil {
+		t.Fatalf("Cannot connect to test server: [%s]", err)
+	}
+	defer conn.Close()
+	sendRequest(conn, "version\r\n", t)
+	if _, err := bufio.NewReader(conn).ReadByte(); err == nil {
+		t.Fatalf("The connection from the denied network must be closed")
+	}
+	if n := atomic.LoadUint64(&s.deniedConnsCount); n != 1 {
+		t.Fatalf("Unexpected denied connections count=%d. Expected 1", n)
+	}
+}
+
+func TestServer_StartErrors(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.Start()
+	defer s.Stop()
+
+	for _, s1 := range []*Server{
+		{Cache: cache, ListenAddr: testAddr},
+		{Cache: cache, ListenAddr: "foo:bar"},
+		{Cache: cache, ListenAddr: "localhost:12346", DeniedNetworks: []string{"foobar"}},
+		{Cache: cache, ListenAddr: "localhost:12346", RequireClientCerts: true},
+	} {
+		if err := s1.Start(); err == nil {
+			s1.Stop()
+			t.Fatalf("Server with ListenAddr=[%s] must fail to start", s1.ListenAddr)
+		}
+	}
+
+	// The address must be released after the failed start.
+	s1 := &Server{Cache: cache, ListenAddr: "localhost:12346", UDPListenAddr: "foo:bar"}
+	if err := s1.Start(); err == nil {
+		t.Fatalf("Server with invalid UDPListenAddr must fail to start")
+	}
+	s1.UDPListenAddr = ""
+	if err := s1.Start(); err != nil {
+		t.Fatalf("Cannot start server: [%s]", err)
+	}
+	s1.Stop()
+}
+
+func TestServer_IdleTimeout(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.IdleTimeout = 200 * time.Millisecond
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+
+	// Active connections must remain open.
+	for i := 0; i < 5; i++ {
+		sendRequest(conn, "version\r\n", t)
+		expectResponse(r, "VERSION 1.4.0-ybc\r\n", t)
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if _, err := r.ReadByte(); err == nil {
+		t.Fatalf("The idle connection must be closed")
+	}
+	if stats := readStats(t); stats["idle_kicks"] != "1" {
+		t.Fatalf("Unexpected idle_kicks=[%s]. Expected [1]", stats["idle_kicks"])
+	}
+}
+
+func TestServer_ReadTimeout(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.ReadTimeout = 200 * time.Millisecond
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+
+	// Idle connections mustn't be closed.
+	time.Sleep(300 * time.Millisecond)
+	sendRequest(conn, "set key 0 0 5\r\nvalue\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+
+	// Stalled requests must be interrupted.
+	sendRequest(conn, "set key 0 0 5\r\nva", t)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("The connection with stalled request must be closed. err=[%v]", err)
+	}
+}
+
+func TestServer_WriteTimeout(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.WriteTimeout = 200 * time.Millisecond
+	s.OSWriteBufferSize = 4096
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	value := strings.Repeat("x", 256*1024)
+	sendRequest(conn, fmt.Sprintf("set key 0 0 %d\r\n%s\r\n", len(value), value), t)
+	expectResponse(r, "STORED\r\n", t)
+
+	// The client doesn't read responses, so the server must close
+	// the connection after the timeout.
+	sendRequest(conn, strings.Repeat("get key\r\n", 100), t)
+	time.Sleep(time.Second)
+	if stats := readStats(t); stats["curr_connections"] != "1" {
+		t.Fatalf("Unexpected curr_connections=[%s]. Expected [1]", stats["curr_connections"])
+	}
+}
+
+func TestServer_MaxRequestRate(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.MaxRequestRate = 20
+	s.MaxRequestBurst = 2
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	requestsCount := 10
+	start := time.Now()
+	sendRequest(conn, strings.Repeat("get key\r\n", requestsCount), t)
+	expectResponse(r, strings.Repeat("END\r\n", requestsCount), t)
+
+	// The first MaxRequestBurst requests are processed immediately.
+	minDuration := time.Duration(float64(requestsCount-s.MaxRequestBurst) / s.MaxRequestRate * float64(time.Second))
+	if d := time.Since(start); d < minDuration*9/10 {
+		t.Fatalf("Requests have been processed too fast: in %s. Expected at least %s", d, minDuration)
+	}
+}
+
+func TestServer_RejectRateLimitedRequests(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.MaxRequestRatePerIP = 0.1
+	s.MaxRequestBurstPerIP = 2
+	s.RejectRateLimitedRequests = true
+	s.Start()
+	defer s.Stop()
+
+	// The limit is shared by connections from the same ip.
+	conn, r := dialServer(t)
+	defer conn.Close()
+	sendRequest(conn, "set key 0 0 5\r\nvalue\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+	conn2, r2 := dialServer(t)
+	defer conn2.Close()
+	sendRequest(conn2, "get key\r\nset key 0 0 5\r\nvalue\r\nget key\r\n", t)
+	expectResponse(r2, "VALUE key 0 5\r\nvalue\r\nEND\r\n", t)
+	expectResponse(r2, "SERVER_ERROR rate limit exceeded\r\nSERVER_ERROR rate limit exceeded\r\n", t)
+	if n := atomic.LoadUint64(&s.rateLimitedCount); n != 2 {
+		t.Fatalf("Unexpected rate limited requests count=%d. Expected 2", n)
+	}
+}
+
+// Waits until the server reports the given number of parked connections.
+func waitForParkedConns(s *Server, n int, t *testing.T) {
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Stats().ParkedConns != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Unexpected parked connections=%d. Expected %d", s.Stats().ParkedConns, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServer_ParkIdleConns(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("ParkIdleConns is supported only on Linux")
+	}
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.ParkIdleConns = true
+	s.ParkIdleDelay = 300 * time.Millisecond
+	s.IdleTimeout = 1500 * time.Millisecond
+	s.Start()
+
+	const connsCount = 20
+	conns := make([]net.Conn, connsCount)
+	readers := make([]*bufio.Reader, connsCount)
+	for i := range conns {
+		conns[i], readers[i] = dialServer(t)
+		defer conns[i].Close()
+		sendRequest(conns[i], fmt.Sprintf("set key%d 0 0 1\r\n%d\r\n", i, i%10), t)
+		expectResponse(readers[i], "STORED\r\n", t)
+	}
+	// Connections mustn't be parked until they stay idle for ParkIdleDelay.
+	if n := s.Stats().ParkedConns; n != 0 {
+		t.Fatalf("Unexpected parked connections=%d before ParkIdleDelay. Expected 0", n)
+	}
+	waitForParkedConns(s, connsCount, t)
+
+	// Parked connections must be resumed on incoming requests.
+	for i := range conns {
+		sendRequest(conns[i], fmt.Sprintf("get key%d\r\n", i), t)
+		expectResponse(readers[i], fmt.Sprintf("VALUE key%d 0 1\r\n%d\r\nEND\r\n", i, i%10), t)
+	}
+	waitForParkedConns(s, connsCount, t)
+	if stats := readStats(t); stats["parked_connections"] == "" {
+		t.Fatalf("Missing parked_connections stat")
+	}
+
+	// Parked connections must be closed after IdleTimeout.
+	time.Sleep(1700 * time.Millisecond)
+	for i := range conns {
+		conns[i].SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := readers[i].ReadByte(); err != io.EOF {
+			t.Fatalf("The idle parked connection must be closed. err=[%v]", err)
+		}
+	}
+	waitForParkedConns(s, 0, t)
+	if idleKicks := s.Stats().IdleKicks; idleKicks != connsCount {
+		t.Fatalf("Unexpected idle kicks=%d. Expected %d", idleKicks, connsCount)
+	}
+
+	// Parked connections mustn't prevent the server from stopping.
+	conn, r := dialServer(t)
+	defer conn.Close()
+	sendRequest(conn, "version\r\n", t)
+	expectResponse(r, "VERSION 1.4.0-ybc\r\n", t)
+	waitForParkedConns(s, 1, t)
+	s.Stop()
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("The parked connection must be closed on server stop. err=[%v]", err)
+	}
+}
+
+func TestServer_VectoredMultiget(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.WriteBufferSize = 4096
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	values := []string{strings.Repeat("a", 10000), "small", strings.Repeat("c", 5000)}
+	for i, value := range values {
+		sendRequest(conn, fmt.Sprintf("set key%d %d 0 %d\r\n%s\r\n", i, i, len(value), value), t)
+		expectResponse(r, "STORED\r\n", t)
+	}
+
+	// The pending response must be written before the vectored response.
+	sendRequest(conn, "version\r\nget key0 missing key1 key2\r\n", t)
+	expectResponse(r, "VERSION 1.4.0-ybc\r\n", t)
+	var expected strings.Builder
+	for i, value := range values {
+		fmt.Fprintf(&expected, "VALUE key%d %d %d\r\n%s\r\n", i, i, len(value), value)
+	}
+	expected.WriteString("END\r\n")
+	expectResponse(r, expected.String(), t)
+
+	sendRequest(conn, "gets key2 key0\r\n", t)
+	for _, i := range []int{2, 0} {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Cannot read response line: [%s]", err)
+		}
+		prefix := fmt.Sprintf("VALUE key%d %d %d ", i, i, len(values[i]))
+		if !strings.HasPrefix(line, prefix) || !strings.HasSuffix(line, "\r\n") {
+			t.Fatalf("Unexpected response line=[%s]. Expected prefix [%s]", line, prefix)
+		}
+		expectResponse(r, values[i]+"\r\n", t)
+	}
+	expectResponse(r, "END\r\n", t)
+
+	// Multi-get responses for missing keys must remain valid.
+	sendRequest(conn, "get missing1 missing2\r\n", t)
+	expectResponse(r, "END\r\n", t)
+}
+
+func TestServer_MaxUnflushedResponses(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.MaxUnflushedResponses = 2
+	s.DisableTCPNoDelay = true
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+
+	// Responses must be flushed while the server waits for the payload
+	// of the incomplete request.
+	sendRequest(conn, "version\r\nversion\r\nset key 0 0 5\r\nva", t)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	expectResponse(r, "VERSION 1.4.0-ybc\r\nVERSION 1.4.0-ybc\r\n", t)
+	conn.SetReadDeadline(time.Time{})
+	sendRequest(conn, "lue\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+}
+
+func TestServer_FlushDelay(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.FlushDelay = 200 * time.Millisecond
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+
+	// The response must be delayed until the next request arrives
+	// or the delay expires.
+	startTime := time.Now()
+	sendRequest(conn, "version\r\n", t)
+	time.Sleep(50 * time.Millisecond)
+	sendRequest(conn, "set key 0 0 5\r\nvalue\r\n", t)
+	expectResponse(r, "VERSION 1.4.0-ybc\r\nSTORED\r\n", t)
+	if d := time.Since(startTime); d < 150*time.Millisecond {
+		t.Fatalf("Responses must be delayed for up to FlushDelay. Delay=%s", d)
+	}
+
+	sendRequest(conn, "get key\r\n", t)
+	expectResponse(r, "VALUE key 0 5\r\nvalue\r\nEND\r\n", t)
+}
+
+func TestServer_LargeValues(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.WriteBufferSize = 4096
+	s.VerifyChecksums = true
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+	value := strings.Repeat("0123456789", 100*1000)
+	sendRequest(conn, fmt.Sprintf("set key 123 0 %d\r\n%s\r\n", len(value), value), t)
+	expectResponse(r, "STORED\r\n", t)
+
+	// The pending response must be written before the large value.
+	sendRequest(conn, "version\r\nget key\r\n", t)
+	expectResponse(r, fmt.Sprintf("VERSION 1.4.0-ybc\r\nVALUE key 123 %d\r\n%s\r\nEND\r\n", len(value), value), t)
+	sendRequest(conn, "gets key\r\n", t)
+	if keys := readValueKeys(r, "END\r\n", t); !reflect.DeepEqual(keys, []string{"key"}) {
+		t.Fatalf("Unexpected keys=%q in gets response", keys)
+	}
+
+	binaryConn, binaryR := dialServer(t)
+	defer binaryConn.Close()
+	sendRequest(binaryConn, string(binaryRequestPacket(opGetK, 0, nil, []byte("key"), nil)), t)
+	resp := expectBinaryResponse(binaryR, opGetK, statusNoError, "key", value, t)
+	if flags := binary.BigEndian.Uint32(resp.extras); flags != 123 {
+		t.Fatalf("Unexpected flags=%d in binary response. Expected 123", flags)
+	}
+	sendRequest(binaryConn, string(binaryRequestPacket(opGet, 0, nil, []byte("key"), nil)), t)
+	expectBinaryResponse(binaryR, opGet, statusNoError, "", value, t)
+}
+
+func TestServer_ShardedCache(t *testing.T) {
+	config := ybc.Config{
+		MaxItemsCount: 100 * 1000,
+		DataFileSize:  10 * 1000 * 1000,
+	}
+	if _, err := OpenShardedCache(&config, 1000*1000, true); err == nil {
+		t.Fatalf("Expecting error for too many shards")
+	}
+	cache, err := OpenShardedCache(&config, 4, true)
+	if err != nil {
+		t.Fatalf("Cannot open sharded cache: [%s]", err)
+	}
+	defer cache.Close()
+	s := &Server{
+		Cache:      cache,
+		ListenAddr: testAddr,
+	}
+	s.Start()
+	defer s.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, r := dialServer(t)
+			defer conn.Close()
+			for j := 0; j < 100; j++ {
+				key := fmt.Sprintf("key_%d_%d", i, j)
+				sendRequest(conn, fmt.Sprintf("set %s 0 0 %d\r\n%s\r\n", key, len(key), key), t)
+				expectResponse(r, "STORED\r\n", t)
+				sendRequest(conn, fmt.Sprintf("get %s\r\n", key), t)
+				expectResponse(r, fmt.Sprintf("VALUE %s 0 %d\r\n%s\r\nEND\r\n", key, len(key), key), t)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestServer_ServeConn(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.Start()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	serveDone := make(chan struct{})
+	go func() {
+		s.ServeConn(serverConn)
+		close(serveDone)
+	}()
+	r := bufio.NewReader(clientConn)
+	sendRequest(clientConn, "set key 0 0 5\r\nvalue\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+	sendRequest(clientConn, "get key\r\n", t)
+	expectResponse(r, "VALUE key 0 5\r\nvalue\r\nEND\r\n", t)
+
+	// The connection must be closed on server stop.
+	s.Stop()
+	select {
+	case <-serveDone:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("ServeConn must return after the server is stopped")
+	}
+	if _, err := r.ReadByte(); err == nil {
+		t.Fatalf("The connection must be closed after the server is stopped")
+	}
+
+	// Connections passed after the server is stopped must be closed.
+	clientConn, serverConn = net.Pipe()
+	defer clientConn.Close()
+	s.ServeConn(serverConn)
+	if _, err := clientConn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("The connection must be closed if the server is stopped")
+	}
+}
+
+func TestServer_ServeConnDuringStop(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+
+	for i := 0; i < 10; i++ {
+		s.Start()
+		var wg sync.WaitGroup
+		for j := 0; j < 10; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				clientConn, serverConn := net.Pipe()
+				defer clientConn.Close()
+				s.ServeConn(serverConn)
+			}()
+		}
+		s.Stop()
+		wg.Wait()
+	}
+}
+
+func TestServer_MaxUnflushedBytes(t *testing.T) {
+	s, cache := newServerCache(t)
+	defer cache.Close()
+	s.MaxUnflushedBytes = 30
+	s.Start()
+	defer s.Stop()
+
+	conn, r := dialServer(t)
+	defer conn.Close()
+
+	// Responses exceeding the limit must be flushed while the server waits
+	// for the payload of the incomplete request.
+	sendRequest(conn, "version\r\nversion\r\nset key 0 0 5\r\nva", t)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	expectResponse(r, "VERSION 1.4.0-ybc\r\nVERSION 1.4.0-ybc\r\n", t)
+	conn.SetReadDeadline(time.Time{})
+	sendRequest(conn, "lue\r\n", t)
+	expectResponse(r, "STORED\r\n", t)
+}
@@ -0,0 +1,150 @@
+package memcache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Memcached UDP protocol support.
+//
+// Each request datagram starts with a frame header followed by text
+// or binary protocol requests. The response is split into datagrams
+// starting with frame headers, which contain the request id, the sequence
+// number of the datagram and the total number of datagrams in the response.
+
+const (
+	udpHeaderSize = 8
+
+	// The maximum size of response datagrams including the frame header
+	// like in the original memcached.
+	udpMaxDatagramSize = 1400
+
+	udpMaxRequestSize = 64 * 1024
+)
+
+// Connection for a single request datagram.
+//
+// Reads return requests from the datagram, while writes are buffered
+// for sending in response datagrams.
+type udpRequestConn struct {
+	r          bytes.Reader
+	w          bytes.Buffer
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+func (c *udpRequestConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c *udpRequestConn) Write(p []byte) (int, error)        { return c.w.Write(p) }
+func (c *udpRequestConn) Close() error                       { return nil }
+func (c *udpRequestConn) LocalAddr() net.Addr                { return c.localAddr }
+func (c *udpRequestConn) RemoteAddr() net.Addr               { return c.remoteAddr }
+func (c *udpRequestConn) SetDeadline(t time.Time) error      { return nil }
+func (c *udpRequestConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *udpRequestConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// Serves request datagrams received on s.udpSocket until it is closed.
+//
+// Up to Server.MaxUDPRequests requests are processed concurrently.
+// Datagrams exceeding the limit are dropped.
+func (s *Server) serveUDP() {
+	defer s.done.Done()
+
+	requestsDone := &sync.WaitGroup{}
+	defer requestsDone.Wait()
+	sem := make(chan struct{}, s.MaxUDPRequests)
+	buf := make([]byte, udpMaxRequestSize)
+	for {
+		n, addr, err := s.udpSocket.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				s.logf(LogLevelError, "UDP read error: %v; retrying in %v", err, time.Second)
+				time.Sleep(time.Second)
+				continue
+			}
+			return
+		}
+		atomic.AddUint64(&s.bytesReadCount, uint64(n))
+		if !isAllowedIP(s, addr.IP) {
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		default:
+			atomic.AddUint64(&s.droppedUDPRequestsCount, 1)
+			continue
+		}
+		datagram := append([]byte(nil), buf[:n]...)
+		requestsDone.Add(1)
+		go handleUDPRequest(s, datagram, addr, sem, requestsDone)
+	}
+}
+
+func handleUDPRequest(s *Server, datagram []byte, addr *net.UDPAddr, sem chan struct{}, done *sync.WaitGroup) {
+	defer done.Done()
+	defer func() { <-sem }()
+	if len(datagram) < udpHeaderSize {
+		s.logf(LogLevelWarning, "Too short UDP datagram from %s: %d bytes. Expected at least %d bytes", addr, len(datagram), udpHeaderSize)
+		return
+	}
+	requestID := binary.BigEndian.Uint16(datagram)
+	conn := &udpRequestConn{
+		localAddr:  s.udpSocket.LocalAddr(),
+		remoteAddr: addr,
+	}
+	if total := binary.BigEndian.Uint16(datagram[4:]); total != 1 {
+		countErrorResponse(s, strMultiPacketCrLf)
+		conn.w.Write(strMultiPacketCrLf)
+		sendUDPResponse(s, requestID, conn.w.Bytes(), addr)
+		return
+	}
+	conn.r.Reset(datagram[udpHeaderSize:])
+
+	c := &serverConn{
+		conn: conn,
+	}
+	acquireConnBuffers(c, s, conn, conn)
+	defer releaseConnBuffers(c, s)
+
+	processFunc := processRequest
+	if isBinaryConn(c.Reader) {
+		processFunc = processBinaryRequest
+	}
+	for processFunc(c, s, c.scratchBuf) {
+	}
+	c.Flush()
+	sendUDPResponse(s, requestID, conn.w.Bytes(), addr)
+}
+
+// Sends the response to addr in datagrams prefixed by frame headers.
+func sendUDPResponse(s *Server, requestID uint16, response []byte, addr *net.UDPAddr) {
+	if len(response) == 0 {
+		return
+	}
+	const maxPayloadSize = udpMaxDatagramSize - udpHeaderSize
+	total := (len(response) + maxPayloadSize - 1) / maxPayloadSize
+	if total > math.MaxUint16 {
+		s.logf(LogLevelWarning, "Too large UDP response for %s: %d bytes", addr, len(response))
+		return
+	}
+	var buf [udpMaxDatagramSize]byte
+	for seq := 0; seq < total; seq++ {
+		payload := response[seq*maxPayloadSize:]
+		if len(payload) > maxPayloadSize {
+			payload = payload[:maxPayloadSize]
+		}
+		binary.BigEndian.PutUint16(buf[:], requestID)
+		binary.BigEndian.PutUint16(buf[2:], uint16(seq))
+		binary.BigEndian.PutUint16(buf[4:], uint16(total))
+		n := udpHeaderSize + copy(buf[udpHeaderSize:], payload)
+		if _, err := s.udpSocket.WriteToUDP(buf[:n], addr); err != nil {
+			s.logf(LogLevelWarning, "Cannot send UDP response to %s: [%s]", addr, err)
+			return
+		}
+		atomic.AddUint64(&s.bytesWrittenCount, uint64(n))
+	}
+}
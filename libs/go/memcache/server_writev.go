@@ -0,0 +1,143 @@
+package memcache
+
+import (
+	"net"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/kireevroi/ybc/bindings/go/ybc"
+)
+
+// Vectored writes for large responses.
+//
+// Responses with payloads exceeding Server.WriteBufferSize are written
+// directly to the connection via a single writev syscall instead of
+// being copied through the write buffer in chunks. Payloads are written
+// straight from the cache memory, so they aren't copied in user space.
+
+// Returns true if the response with the given payload size must be
+// written directly to the connection via writeBuffersDirect().
+func shouldWriteDirect(c *serverConn, s *Server, size int) bool {
+	return c.cw != nil && size > s.WriteBufferSize
+}
+
+// Returns true if the response for the given items must be written
+// via writeItemsVectored().
+func shouldWriteVectored(c *serverConn, s *Server, items []*ybc.Item) bool {
+	size := 0
+	for _, item := range items {
+		if item != nil {
+			size += item.Available()
+		}
+	}
+	return shouldWriteDirect(c, s, size)
+}
+
+// Writes bufs directly to the connection after flushing pending responses
+// in the write buffer.
+//
+// bufs must be backed by c.vecBufs.
+func writeBuffersDirect(c *serverConn, s *Server, bufs net.Buffers) bool {
+	if err := c.Flush(); err != nil {
+		return false
+	}
+	// net.Buffers.WriteTo() consumes the buffers, so they are written
+	// via a copy. The copy is stored in serverConn in order to avoid
+	// its allocation on the heap.
+	c.vecBufs = bufs
+	c.vecPending = bufs
+	_, err := c.cw.writeBuffers(&c.vecPending)
+	// Drop references to item payloads, since items are closed by callers.
+	clear(c.vecBufs)
+	if err != nil {
+		s.logf(LogLevelWarning, "Error when writing response to %s: [%s]", c.conn.RemoteAddr(), err)
+		return false
+	}
+	return true
+}
+
+// Writes the 'VALUE' response for the item directly to the connection.
+//
+// The caller is responsible for writing 'END'.
+func writeGetResponseDirect(c *serverConn, s *Server, key []byte, item *ybc.Item, shouldWriteCasid bool) bool {
+	casid, flags, ok := readGetItemMetadata(s, item, s.VerifyChecksums)
+	if !ok {
+		return false
+	}
+	size := item.Available()
+	c.vecHeaders = appendGetResponseHeader(c.vecHeaders[:0], key, flags, size, casid, shouldWriteCasid)
+	value := item.Peek()
+	return writeBuffersDirect(c, s, append(c.vecBufs[:0], c.vecHeaders, value[len(value)-size:], strCrLf))
+}
+
+func appendGetResponseHeader(dst, key []byte, flags uint32, size int, casid uint64, shouldWriteCasid bool) []byte {
+	dst = append(dst, strValue...)
+	dst = append(dst, key...)
+	dst = append(dst, ' ')
+	dst = strconv.AppendUint(dst, uint64(flags), 10)
+	dst = append(dst, ' ')
+	dst = strconv.AppendInt(dst, int64(size), 10)
+	if shouldWriteCasid {
+		dst = append(dst, ' ')
+		dst = strconv.AppendUint(dst, casid, 10)
+	}
+	return append(dst, strCrLf...)
+}
+
+// Writes 'VALUE' responses for the given items followed by 'END'
+// directly to the connection, so payloads aren't copied.
+//
+// Pending responses in the write buffer are flushed beforehand.
+func writeItemsVectored(c *serverConn, s *Server, keys [][]byte, items []*ybc.Item, shouldWriteCasid bool) bool {
+	// Headers are appended to a single buffer, which may be reallocated,
+	// so header boundaries are collected before building segments.
+	headers := c.vecHeaders[:0]
+	headerEnds := c.vecHeaderEnds[:0]
+	for i, item := range items {
+		if item == nil {
+			continue
+		}
+		casid, flags, ok := readGetItemMetadata(s, item, s.VerifyChecksums)
+		if !ok {
+			return writeServerError(c.Writer, s)
+		}
+		if len(headerEnds) > 0 {
+			// Terminates the previous payload.
+			headers = append(headers, strCrLf...)
+		}
+		headers = appendGetResponseHeader(headers, keys[i], flags, item.Available(), casid, shouldWriteCasid)
+		headerEnds = append(headerEnds, len(headers))
+	}
+	if len(headerEnds) > 0 {
+		headers = append(headers, strCrLf...)
+	}
+	headers = append(headers, strEndCrLf...)
+	c.vecHeaders = headers
+	c.vecHeaderEnds = headerEnds
+
+	bufs := c.vecBufs[:0]
+	start := 0
+	n := 0
+	for _, item := range items {
+		if item == nil {
+			continue
+		}
+		value := item.Peek()
+		bufs = append(bufs, headers[start:headerEnds[n]], value[len(value)-item.Available():])
+		start = headerEnds[n]
+		n++
+	}
+	bufs = append(bufs, headers[start:])
+	return writeBuffersDirect(c, s, bufs)
+}
+
+// Writes bufs to the underlying writer via writev if it supports it.
+func (cw *countingWriter) writeBuffers(bufs *net.Buffers) (int64, error) {
+	for _, b := range *bufs {
+		cw.capture(b)
+	}
+	n, err := bufs.WriteTo(cw.w)
+	atomic.AddUint64(cw.n, uint64(n))
+	cw.bytesCount += uint64(n)
+	return n, err
+}
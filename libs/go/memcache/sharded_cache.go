@@ -0,0 +1,51 @@
+package memcache
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+
+	"github.com/kireevroi/ybc/bindings/go/ybc"
+)
+
+// Opens the cache sharded across shardsCount ybc caches, so concurrent
+// requests for distinct keys don't contend on a single cache lock.
+//
+// config describes the whole cache. Its sizes are split evenly among
+// shards. Shard files are named after config.IndexFile and config.DataFile
+// with '.<shard>' suffixes if the files are set.
+//
+// The number of shards defaults to runtime.GOMAXPROCS(0) if shardsCount
+// isn't positive. force has the same meaning as in ybc.Config.OpenCache().
+//
+// The returned cache may be passed to Server.Cache. It must be closed
+// after use.
+func OpenShardedCache(config *ybc.Config, shardsCount int, force bool) (*ybc.Cluster, error) {
+	if shardsCount <= 0 {
+		shardsCount = runtime.GOMAXPROCS(0)
+	}
+	n := ybc.SizeT(shardsCount)
+	if config.MaxItemsCount < n || config.DataFileSize < n {
+		return nil, errors.New("memcache: MaxItemsCount and DataFileSize must be at least shardsCount")
+	}
+	configs := make(ybc.ClusterConfig, shardsCount)
+	for i := range configs {
+		cfg := *config
+		cfg.MaxItemsCount /= n
+		cfg.DataFileSize /= n
+		cfg.HotItemsCount /= n
+		cfg.HotDataSize /= n
+		if cfg.IndexFile != "" {
+			cfg.IndexFile = fmt.Sprintf("%s.%d", cfg.IndexFile, i)
+		}
+		if cfg.DataFile != "" {
+			cfg.DataFile = fmt.Sprintf("%s.%d", cfg.DataFile, i)
+		}
+		configs[i] = &cfg
+	}
+	cluster, err := configs.OpenCluster(force)
+	if err != nil {
+		return nil, fmt.Errorf("memcache: cannot open sharded cache with %d shards: %w", shardsCount, err)
+	}
+	return cluster, nil
+}
@@ -0,0 +1,147 @@
+package memcache
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Serializes values stored via TypedClient.
+type Codec[T any] interface {
+	// Appends serialized value to dst and returns the result.
+	Marshal(dst []byte, value *T) ([]byte, error)
+
+	// Deserializes data into the value.
+	Unmarshal(data []byte, value *T) error
+}
+
+// Codec, which serializes values to JSON.
+//
+// This is the default codec for TypedClient.
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Marshal(dst []byte, value *T) ([]byte, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, data...), nil
+}
+
+func (JSONCodec[T]) Unmarshal(data []byte, value *T) error {
+	return json.Unmarshal(data, value)
+}
+
+// Memcache client wrapper for values of the given type.
+//
+// Values are serialized via Codec and stored under keys prefixed
+// by KeyPrefix.
+//
+// Usage:
+//
+//	client.Start()
+//	defer client.Stop()
+//
+//	c := memcache.TypedClient[User]{
+//	    Client:     client,
+//	    KeyPrefix:  "user:",
+//	    Expiration: time.Hour,
+//	}
+//
+//	if err := c.Set([]byte("123"), &user); err != nil {
+//	    log.Fatalf("Error in c.Set(): %s", err)
+//	}
+//	u, err := c.Get([]byte("123"))
+//	if err != nil {
+//	    log.Fatalf("Error in c.Get(): %s", err)
+//	}
+type TypedClient[T any] struct {
+	// The underlying memcache client.
+	//
+	// The client must be initialized before passing it here.
+	//
+	// Currently Client, DistributedClient and CachingClient may be passed
+	// here.
+	Client Memcacher
+
+	// Prefix for keys passed to TypedClient methods.
+	// Optional parameter.
+	//
+	// Distinct prefixes allow storing values of distinct types
+	// in the same memcache server.
+	KeyPrefix string
+
+	// Expiration time for items stored via TypedClient.Set().
+	// Optional parameter.
+	//
+	// By default items have no expiration time.
+	Expiration time.Duration
+
+	// Codec for values.
+	// Optional parameter.
+	//
+	// By default JSONCodec is used.
+	Codec Codec[T]
+}
+
+func (c *TypedClient[T]) codec() Codec[T] {
+	if c.Codec == nil {
+		return JSONCodec[T]{}
+	}
+	return c.Codec
+}
+
+func (c *TypedClient[T]) key(key []byte) []byte {
+	if c.KeyPrefix == "" {
+		return key
+	}
+	k := make([]byte, 0, len(c.KeyPrefix)+len(key))
+	k = append(k, c.KeyPrefix...)
+	return append(k, key...)
+}
+
+// Obtains the value for the given key.
+//
+// Returns ErrCacheMiss on cache miss.
+// Returns codec's error if the stored value cannot be deserialized.
+func (c *TypedClient[T]) Get(key []byte) (value T, err error) {
+	item := Item{
+		Key: c.key(key),
+	}
+	if err = c.Client.Get(&item); err != nil {
+		return
+	}
+	err = c.codec().Unmarshal(item.Value, &value)
+	return
+}
+
+// Stores the given value under the given key with TypedClient.Expiration.
+func (c *TypedClient[T]) Set(key []byte, value *T) error {
+	return c.SetWithExpiration(key, value, c.Expiration)
+}
+
+// Stores the given value under the given key with the given expiration.
+//
+// Zero expiration means the item has no expiration time.
+func (c *TypedClient[T]) SetWithExpiration(key []byte, value *T, expiration time.Duration) error {
+	data, err := c.codec().Marshal(nil, value)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		// Empty values are valid, while nil values are rejected by clients.
+		data = []byte{}
+	}
+	item := Item{
+		Key:        c.key(key),
+		Value:      data,
+		Expiration: expiration,
+	}
+	return c.Client.Set(&item)
+}
+
+// Deletes the value for the given key.
+//
+// Returns ErrCacheMiss if there were no value for the given key.
+func (c *TypedClient[T]) Delete(key []byte) error {
+	return c.Client.Delete(c.key(key))
+}
@@ -0,0 +1,125 @@
+package memcache
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type typedClientTestValue struct {
+	Name  string
+	Count int
+}
+
+type typedClientTestCodec struct{}
+
+func (typedClientTestCodec) Marshal(dst []byte, value *int) ([]byte, error) {
+	return strconv.AppendInt(dst, int64(*value), 10), nil
+}
+
+func (typedClientTestCodec) Unmarshal(data []byte, value *int) error {
+	n, err := strconv.Atoi(string(data))
+	*value = n
+	return err
+}
+
+func TestTypedClient_SetGetDelete(t *testing.T) {
+	c, s, cache := newClientServerCache(t)
+	defer cache.Close()
+	defer s.Stop()
+	c.Start()
+	defer c.Stop()
+
+	tc := TypedClient[typedClientTestValue]{
+		Client:     c,
+		KeyPrefix:  "typed:",
+		Expiration: time.Hour,
+	}
+	key := []byte("key")
+
+	if _, err := tc.Get(key); err != ErrCacheMiss {
+		t.Fatalf("Unexpected error returned from TypedClient.Get(): [%v]. Expected ErrCacheMiss", err)
+	}
+
+	value := typedClientTestValue{
+		Name:  "foo",
+		Count: 42,
+	}
+	if err := tc.Set(key, &value); err != nil {
+		t.Fatalf("Error in TypedClient.Set(): [%s]", err)
+	}
+	v, err := tc.Get(key)
+	if err != nil {
+		t.Fatalf("Error in TypedClient.Get(): [%s]", err)
+	}
+	if v != value {
+		t.Fatalf("Unexpected value=%+v returned from TypedClient.Get(). Expected %+v", v, value)
+	}
+
+	// The value must be stored under the prefixed key.
+	item := Item{
+		Key: key,
+	}
+	if err := c.Get(&item); err != ErrCacheMiss {
+		t.Fatalf("Unexpected error returned from Client.Get() for unprefixed key: [%v]. Expected ErrCacheMiss", err)
+	}
+	item.Key = []byte("typed:key")
+	if err := c.Get(&item); err != nil {
+		t.Fatalf("Error in Client.Get() for prefixed key: [%s]", err)
+	}
+	expectedValue := []byte(`{"Name":"foo","Count":42}`)
+	if !bytes.Equal(item.Value, expectedValue) {
+		t.Fatalf("Unexpected serialized value=[%s]. Expected [%s]", item.Value, expectedValue)
+	}
+
+	// Values, which cannot be deserialized, result in codec's error.
+	item.Value = []byte("invalid json")
+	if err := c.Set(&item); err != nil {
+		t.Fatalf("Error in Client.Set(): [%s]", err)
+	}
+	if _, err := tc.Get(key); err == nil || err == ErrCacheMiss {
+		t.Fatalf("Unexpected error returned from TypedClient.Get() for invalid value: [%v]", err)
+	}
+
+	if err := tc.Delete(key); err != nil {
+		t.Fatalf("Error in TypedClient.Delete(): [%s]", err)
+	}
+	if err := tc.Delete(key); err != ErrCacheMiss {
+		t.Fatalf("Unexpected error returned from TypedClient.Delete(): [%v]. Expected ErrCacheMiss", err)
+	}
+}
+
+func TestTypedClient_Codec(t *testing.T) {
+	c, s, cache := newClientServerCache(t)
+	defer cache.Close()
+	defer s.Stop()
+	c.Start()
+	defer c.Stop()
+
+	tc := TypedClient[int]{
+		Client: c,
+		Codec:  typedClientTestCodec{},
+	}
+	key := []byte("counter")
+	value := 12345
+	if err := tc.SetWithExpiration(key, &value, time.Minute); err != nil {
+		t.Fatalf("Error in TypedClient.SetWithExpiration(): [%s]", err)
+	}
+	item := Item{
+		Key: key,
+	}
+	if err := c.Get(&item); err != nil {
+		t.Fatalf("Error in Client.Get(): [%s]", err)
+	}
+	if string(item.Value) != "12345" {
+		t.Fatalf("Unexpected serialized value=[%s]. Expected [12345]", item.Value)
+	}
+	v, err := tc.Get(key)
+	if err != nil {
+		t.Fatalf("Error in TypedClient.Get(): [%s]", err)
+	}
+	if v != value {
+		t.Fatalf("Unexpected value=%d returned from TypedClient.Get(). Expected %d", v, value)
+	}
+}
@@ -175,8 +175,11 @@ static void p_file_create(struct p_file *file, const char *filename);
 
 /*
  * Opens a file with the given filename.
+ *
+ * The file is opened only for reading if is_read_only is set.
  */
-static void p_file_open(struct p_file *file, const char *filename);
+static void p_file_open(struct p_file *file, const char *filename,
+    int is_read_only);
 
 /*
  * Closes the given file.
@@ -227,8 +230,28 @@ static size_t p_memory_page_mask(void);
 /*
  * Maps size bytes of the given file into memory and stores memory pointer
  * to *ptr.
+ *
+ * The mapped memory may be only read if is_read_only is set.
+ */
+static void p_memory_map(void **ptr, const struct p_file *file, size_t size,
+    int is_read_only);
+
+/*
+ * Hints the OS about backing size bytes pointed by ptr with huge pages.
+ *
+ * This is just a hint, so it may be silently ignored by the OS.
+ */
+static void p_memory_advise_huge_pages(void *ptr, size_t size);
+
+/*
+ * Locks size bytes pointed by ptr in RAM, so they cannot be paged out.
+ *
+ * The memory is unlocked when it is unmapped.
+ *
+ * Returns non-zero on success, 0 if the memory cannot be locked,
+ * for instance, due to RLIMIT_MEMLOCK limit.
  */
-static void p_memory_map(void **ptr, const struct p_file *file, size_t size);
+static int p_memory_lock(void *ptr, size_t size);
 
 /*
  * Unmaps size bytes pointed by ptr from memory.
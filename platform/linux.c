@@ -25,8 +25,8 @@
 #include <stdint.h>     /* uint*_t */
 #include <stdio.h>      /* tmpfile, fileno, fclose */
 #include <stdlib.h>     /* malloc, free, EXIT_FAILURE */
-#include <string.h>     /* strdup */
-#include <sys/mman.h>   /* mmap, munmap, msync */
+#include <string.h>     /* strdup, memset */
+#include <sys/mman.h>   /* mmap, munmap, msync, madvise, mlock */
 #include <sys/stat.h>   /* open, fstat */
 #include <sys/types.h>  /* pthread_*_t, open, stat, lseek */
 #include <time.h>       /* clock_gettime, timespec, nanosleep */
@@ -382,12 +382,19 @@ static void p_file_create(struct p_file *const file, const char *const filename)
   }
 }
 
-static void p_file_open(struct p_file *const file, const char *const filename)
+static void p_file_open(struct p_file *const file, const char *const filename,
+    const int is_read_only)
 {
-  int flags = O_RDWR;
+  int flags = is_read_only ? O_RDONLY : O_RDWR;
 
   flags |= O_CLOEXEC;  /* Close file on exec for security reasons. */
-  flags |= O_NOATIME;  /* Don't update access time for performance reasons. */
+  if (!is_read_only) {
+    /*
+     * Don't update access time for performance reasons.
+     * O_NOATIME requires file ownership, which readers may lack.
+     */
+    flags |= O_NOATIME;
+  }
 
   for (;;) {
     file->fd = open(filename, flags);
@@ -461,13 +468,15 @@ static void p_file_resize_and_preallocate(const struct p_file *const file,
    * Do not use posix_fallocate(), since it cheats and doesn't really
    * allocate pyhsical space on the storage.
    *
-   * Just fill the file with garbage.
+   * Fill the file with zeros, so new index files don't contain garbage
+   * slots, which would be counted as evicted items by m_evictions_sweep().
    */
 
   m_file_seek_zero(file);
 
   const size_t buf_size = 1024 * 1024;
   char *const buf = p_malloc(buf_size);
+  memset(buf, 0, buf_size);
 
   size_t remain = size;
   while (remain) {
@@ -556,12 +565,14 @@ static void p_memory_init(void)
 }
 
 static void p_memory_map(void **const ptr, const struct p_file *const file,
-    const size_t size)
+    const size_t size, const int is_read_only)
 {
+  const int prot = is_read_only ? PROT_READ : (PROT_READ | PROT_WRITE);
+
   /*
    * Accodring to manpages, mmap() cannot return EINTR, so don't handle it.
    */
-  *ptr = mmap(NULL, size, PROT_READ | PROT_WRITE, MAP_SHARED, file->fd, 0);
+  *ptr = mmap(NULL, size, prot, MAP_SHARED, file->fd, 0);
   if (*ptr == MAP_FAILED) {
     error(EXIT_FAILURE, errno, "mmap(fd=%d, size=%zu)", file->fd, size);
   }
@@ -569,6 +580,29 @@ static void p_memory_map(void **const ptr, const struct p_file *const file,
   assert((uintptr_t)size <= UINTPTR_MAX - (uintptr_t)*ptr);
 }
 
+static void p_memory_advise_huge_pages(void *const ptr, const size_t size)
+{
+#ifdef MADV_HUGEPAGE
+  /*
+   * Ignore errors, since this is just a hint. For instance, madvise() fails
+   * if the kernel is built without transparent huge pages support.
+   */
+  (void)madvise(ptr, size, MADV_HUGEPAGE);
+#else
+  (void)ptr;
+  (void)size;
+#endif
+}
+
+static int p_memory_lock(void *const ptr, const size_t size)
+{
+  /*
+   * mlock() faults in all the pages in the given range, so it may take
+   * a lot of time for big ranges.
+   */
+  return mlock(ptr, size) == 0;
+}
+
 static void p_memory_unmap(void *const ptr, const size_t size)
 {
   /*
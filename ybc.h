@@ -254,6 +254,67 @@ YBC_API void ybc_config_set_sync_interval(struct ybc_config *config,
  */
 YBC_API void ybc_config_disable_overwrite_protection(struct ybc_config *config);
 
+/*
+ * Enables items' checksums.
+ *
+ * By default checksums are disabled.
+ *
+ * If checksums are enabled, then a checksum is stored together with each item
+ * and is verified on each item access. Items with invalid checksums
+ * are treated as missing. This protects from serving garbage stored
+ * in corrupted data file, but slows down access to large items, since
+ * the whole item's value is read on each access.
+ *
+ * Items stored with checksums are invisible to the cache opened without
+ * checksums and vice versa.
+ */
+YBC_API void ybc_config_enable_checksums(struct ybc_config *config);
+
+/*
+ * Enables read-only mode.
+ *
+ * By default read-only mode is disabled.
+ *
+ * In read-only mode existing index and data files are opened only for reading,
+ * so multiple processes may share them. Files are neither created nor resized
+ * regardless of the force flag passed to ybc_open(), so the config must match
+ * the config used for the cache creation.
+ *
+ * Items cannot be added, modified or removed in read-only mode,
+ * i.e. ybc_set_txn_begin(), ybc_item_set*(), ybc_item_remove(),
+ * ybc_item_touch() and ybc_compact() always fail, while ybc_clear() is no-op.
+ * Hot data defragmentation and data syncing are disabled too.
+ *
+ * Files mustn't be modified by other caches while they are opened
+ * in read-only mode.
+ */
+YBC_API void ybc_config_enable_read_only(struct ybc_config *config);
+
+/*
+ * Enables backing index and data files' memory with huge pages.
+ *
+ * By default huge pages are disabled.
+ *
+ * Huge pages reduce TLB pressure for big caches. This is just a hint
+ * to the OS, which may be silently ignored. For instance, Linux backs
+ * only anonymous caches and files located on tmpfs with transparent
+ * huge pages.
+ */
+YBC_API void ybc_config_enable_huge_pages(struct ybc_config *config);
+
+/*
+ * Enables locking index and data files' memory in RAM.
+ *
+ * By default the memory isn't locked in RAM.
+ *
+ * Locked memory cannot be paged out by the OS under memory pressure,
+ * so the cache doesn't suffer from random I/O. ybc_open() reads the whole
+ * index and data files into RAM, so it may take a lot of time for big caches.
+ * ybc_open() fails if the memory cannot be locked, for instance, due to
+ * RLIMIT_MEMLOCK limit.
+ */
+YBC_API void ybc_config_enable_lock_in_ram(struct ybc_config *config);
+
 
 /*******************************************************************************
  * Cache management API.
@@ -506,6 +567,42 @@ YBC_API void ybc_set_txn_commit(struct ybc_set_txn *txn);
 YBC_API void ybc_set_txn_commit_item(struct ybc_set_txn *txn,
     struct ybc_item *item);
 
+/*
+ * Commits the given 'set' transaction only if the cache doesn't contain
+ * an item with the same key. Otherwise rolls back the transaction.
+ *
+ * The check and the commit are atomic with respect to other updates
+ * for the key, i.e. commits, ybc_item_remove() and ybc_item_touch() calls,
+ * so only one of concurrent transactions for the same missing key
+ * is commited. This may be used for implementing 'add' operation
+ * and lock-like primitives.
+ *
+ * Returns non-zero if the transaction has been commited.
+ * Returns zero if the transaction has been rolled back.
+ */
+YBC_API int ybc_set_txn_commit_if_missing(struct ybc_set_txn *txn);
+
+/*
+ * Commits the given 'set' transaction only if the cache still contains
+ * the given item under the transaction's key. Otherwise rolls back
+ * the transaction.
+ *
+ * The item must be acquired from the same cache under the same key before
+ * the call. Items with updated ttl are considered unchanged, while items
+ * overwritten, removed or moved by the cache are considered changed.
+ *
+ * The check and the commit are atomic with respect to other updates
+ * for the key, i.e. commits, ybc_item_remove() and ybc_item_touch() calls,
+ * so this may be used for implementing atomic read-modify-write operations
+ * such as counters. Concurrent updates are never lost, since the transaction
+ * is rolled back if the item has been changed after it has been acquired.
+ *
+ * Returns non-zero if the transaction has been commited.
+ * Returns zero if the transaction has been rolled back.
+ */
+YBC_API int ybc_set_txn_commit_if_unchanged(struct ybc_set_txn *txn,
+    const struct ybc_item *item);
+
 /*
  * Rolls back the given 'set' transaction.
  */
@@ -666,6 +763,17 @@ YBC_API int ybc_item_set_item(struct ybc *cache, struct ybc_item *item,
  */
 YBC_API int ybc_item_remove(struct ybc *cache, const struct ybc_key *key);
 
+/*
+ * Sets new ttl for an item with the given key.
+ *
+ * The ttl is counted from the current time. The item's value isn't copied,
+ * so the operation is cheap even for large items.
+ *
+ * Returns zero if the item wasn't in the cache, otherwise returns non-zero.
+ */
+YBC_API int ybc_item_touch(struct ybc *cache, const struct ybc_key *key,
+    uint64_t ttl);
+
 /*
  * Acquires an item with the given key.
  *
@@ -775,6 +883,128 @@ YBC_API void ybc_item_release(struct ybc_item *item);
 YBC_API void ybc_item_get_value(const struct ybc_item *item,
     struct ybc_value *value);
 
+/*
+ * Returns item's key.
+ *
+ * The item must be acquired while calling this function!
+ *
+ * The returned key can be used only until the item is released
+ * via ybc_item_release().
+ */
+YBC_API void ybc_item_get_key(const struct ybc_item *item,
+    struct ybc_key *key);
+
+/*
+ * Acquires the next live item in the cache starting from the given
+ * slot index. The slot index is advanced past the acquired item.
+ *
+ * Set *slot_index to 0 before the first call in order to iterate over
+ * all the items in the cache:
+ *
+ * size_t slot_index = 0;
+ * while (ybc_item_next(cache, item, &slot_index)) {
+ *   ybc_item_get_key(item, &key);
+ *   ybc_item_get_value(item, &value);
+ *   ...
+ *   ybc_item_release(item);
+ * }
+ *
+ * Items added or removed during the iteration may be skipped.
+ * The iteration doesn't access items' values, so it is cheap
+ * for large items.
+ *
+ * Returns non-zero if the item has been acquired. Acquired items MUST
+ * be released via ybc_item_release() call.
+ * Returns zero if there are no more items in the cache.
+ */
+YBC_API int ybc_item_next(struct ybc *cache, struct ybc_item *item,
+    size_t *slot_index);
+
+/*
+ * Cache statistics returned by ybc_get_stats().
+ */
+struct ybc_stats
+{
+  /*
+   * The number of live items in the cache.
+   */
+  size_t items_count;
+
+  /*
+   * The maximum number of items the cache can store.
+   */
+  size_t slots_count;
+
+  /*
+   * The total size of live items in bytes including keys.
+   */
+  size_t used_data_size;
+
+  /*
+   * The size of the storage in bytes.
+   */
+  size_t data_size;
+
+  /*
+   * The number of times the storage has been wrapped around.
+   *
+   * Items are evicted from the storage in FIFO order, so each wrap means
+   * the whole storage contents has been evicted or re-written.
+   */
+  size_t storage_wraps_count;
+
+  /*
+   * The size of deleted, expired and overwritten items interleaved
+   * with live items in the storage.
+   *
+   * New items evict live items together with this space. It may be reclaimed
+   * via ybc_compact().
+   */
+  size_t fragmented_data_size;
+
+  /*
+   * The number of live items evicted from the storage by new items
+   * since the cache has been opened.
+   *
+   * Evicted items are counted with a delay of up to a half of the storage
+   * wrap. Items expiring during the delay aren't counted.
+   */
+  size_t evictions_count;
+};
+
+/*
+ * Collects statistics for the given cache.
+ *
+ * The function scans the whole cache index, so its' speed depends
+ * on the number of slots in the cache. Avoid calling it frequently
+ * for big caches.
+ */
+YBC_API void ybc_get_stats(struct ybc *cache, struct ybc_stats *stats);
+
+/*
+ * Returns the number of live items evicted from the storage by new items
+ * since the cache has been opened.
+ *
+ * This is the same as ybc_stats.evictions_count, but the function
+ * doesn't scan the cache index, so it is cheap.
+ */
+YBC_API size_t ybc_get_evictions_count(struct ybc *cache);
+
+/*
+ * Compacts the storage by packing live items into a contiguous area
+ * in the front of the storage's free space.
+ *
+ * Items are moved starting from the oldest one until the total size of moved
+ * items reaches max_moved_size, so the compaction may be spread
+ * over multiple calls. Pass SIZE_MAX for compacting the whole storage.
+ *
+ * Items cannot be added to the cache during the call, so large max_moved_size
+ * values may block the cache for a long time.
+ *
+ * Returns the size of the storage space reclaimed by the call.
+ */
+YBC_API size_t ybc_compact(struct ybc *cache, size_t max_moved_size);
+
 
 /*******************************************************************************
  * Cache cluster API.